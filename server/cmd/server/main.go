@@ -1,22 +1,114 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/shalteor/cryptd-poc/server/internal/api"
 	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
 )
 
 func main() {
 	// Parse command-line flags
 	var (
-		port      = flag.String("port", "8080", "Server port")
-		dbPath    = flag.String("db", "cryptd.db", "SQLite database path")
-		jwtSecret = flag.String("jwt-secret", "", "JWT secret (required)")
+		port       = flag.String("port", "8080", "Server port")
+		dbPath     = flag.String("db", "cryptd.db", "SQLite database path")
+		jwtSecret  = flag.String("jwt-secret", "", "JWT secret (required)")
+		adminToken = flag.String("admin-token", "", "Bearer token for /v1/admin routes (optional, disables admin routes if empty)")
+
+		usernameChangeCooldown = flag.Duration("username-change-cooldown", 24*time.Hour, "Minimum time between username changes (0 disables)")
+		dbCacheSizeKiB         = flag.Int("db-cache-size-kib", 16*1024, "SQLite page cache per connection in KiB (0 keeps the SQLite default of ~2 MiB)")
+		dbMmapSize             = flag.Int64("db-mmap-size", 256<<20, "SQLite memory-mapped I/O size in bytes (0 keeps the SQLite default)")
+		dbTempStoreMemory      = flag.Bool("db-temp-store-memory", true, "Keep SQLite temporary tables and indices in memory")
+		dbConnMaxLifetime      = flag.Duration("db-conn-max-lifetime", time.Hour, "Close pooled database connections older than this (0 keeps them)")
+		dbConnMaxIdleTime      = flag.Duration("db-conn-max-idle-time", 5*time.Minute, "Close pooled database connections idle longer than this (0 keeps them)")
+		blobCacheBytes         = flag.Int64("blob-cache-bytes", 0, "Keep up to this many bytes of recently read blobs in an in-process LRU cache, invalidated on write (0 disables)")
+		writeBatchMax          = flag.Int("write-batch-max", 0, "Coalesce concurrent blob writes into shared transactions of up to this many writes; a lone write is applied at once (0 or 1 disables)")
+		writeBatchWindow       = flag.Duration("write-batch-window", 2*time.Millisecond, "With -write-batch-max, how long a batch waits to fill while writes are queueing")
+		busyTimeout            = flag.Duration("db-busy-timeout", 5*time.Second, "How long a database connection waits for another one's lock before SQLite reports the database busy (0 fails at once)")
+		busyRetries            = flag.Int("db-busy-retries", 3, "Retry blob upserts and deletes this many times when SQLite still reports the database busy or locked after -db-busy-timeout (0 disables)")
+		busyRetryBackoff       = flag.Duration("db-busy-retry-backoff", 10*time.Millisecond, "Wait before the first -db-busy-retries retry, doubled for each one after")
+		maxSessions            = flag.Int("max-sessions", 0, "Maximum recorded sessions across all users; beyond it the oldest are evicted (0 disables)")
+		rejectNonceReuse       = flag.Bool("reject-nonce-reuse", false, "Record container nonces per user and reject writes that reuse one with different content (400 nonce_reuse)")
+		maxCollections         = flag.Int("max-collections", 0, "Maximum distinct collections per user; writes adding another get 400 too_many_tags (0 = unlimited)")
+		usernameCase           = flag.String("username-case", "sensitive", "Username comparison: sensitive (alice and Alice are different accounts) or insensitive (one account; clients must lowercase the username for key derivation)")
+		usernameReleaseHold    = flag.Duration("username-release-hold", 0, "Keep usernames given up by a rename or account deletion from other accounts for this long (0 disables)")
+		dedupContent           = flag.Bool("dedup-content", false, "Store each distinct blob ciphertext once, referenced by hash (only byte-identical re-uploads share storage)")
+		blobStoreDir           = flag.String("blob-store-dir", "", "Directory to store blob ciphertext in as files, keeping only metadata in SQLite (empty stores ciphertext in SQLite)")
+		slowQueryThreshold     = flag.Duration("slow-query-threshold", 100*time.Millisecond, "Log database operations slower than this (0 disables)")
+		verifierHash           = flag.String("verifier-hash", "pbkdf2_sha256", "Hash for stored login verifiers on registration and password change (pbkdf2_sha256 or pbkdf2_sha512)")
+		expirySweepInterval    = flag.Duration("expiry-sweep-interval", time.Minute, "Interval between deletions of expired blobs (0 disables the sweeper)")
+		disableRegistration    = flag.Bool("disable-registration", false, "Reject POST /v1/auth/register with 403 registration_disabled; accounts are created via POST /v1/admin/users (requires -admin-token)")
+		requireInvite          = flag.Bool("require-invite", false, "Only allow registration with a single-use invite code minted via /v1/admin/invites (requires -admin-token)")
+		encryptedNames         = flag.Bool("encrypted-names", false, "Require every blob write to be named by an HMAC name token and carry the encrypted name, so plaintext blob names are never stored")
+		keyEscrow              = flag.Bool("key-escrow", false, "Enable PUT /v1/users/me/escrow and GET /v1/admin/users/{id}/escrow for organization key recovery (requires -admin-token)")
+		requireCurrentVerifier = flag.Bool("require-current-verifier", false, "Require currentLoginVerifier on PATCH /v1/users/me when it changes the username or password")
+		trustedProxies         = flag.String("trusted-proxies", "", "Comma-separated CIDRs or IPs of reverse proxies whose X-Forwarded-For is trusted for the client IP (empty ignores the header)")
+		requireHTTPS           = flag.Bool("require-https", false, "Reject plaintext requests with 426 Upgrade Required; behind a TLS-terminating proxy this needs X-Forwarded-Proto: https from -trusted-proxies")
+		httpsRedirect          = flag.Bool("https-redirect", false, "With -require-https, redirect plaintext GET and HEAD requests to https:// with 308 instead")
+		readOnly               = flag.Bool("read-only", false, "Start in maintenance mode: reject registration and all writes with 503 (toggle at runtime via /v1/admin/read-only)")
+		allowedAlgs            = flag.String("allowed-algs", "A256GCM,XC20P", "Comma-separated container algorithms clients may use")
+		defaultCollection      = flag.String("default-collection", "", "Collection assigned to blobs written without one (empty keeps them in the unnamed collection)")
+		userQuotaBytes         = flag.Int64("user-quota-bytes", 0, "Maximum stored ciphertext bytes per user (0 disables the quota)")
+		maxImportEntries       = flag.Int("max-import-entries", 1000, "Maximum entries in one archive import")
+		maxImportBytes         = flag.Int64("max-import-bytes", 64<<20, "Maximum size of one archive import in bytes")
+		maxBatchPut            = flag.Int("max-batch-put", 100, "Maximum blobs in one POST /v1/blobs:batchPut")
+		maxBatchUpdateMeta     = flag.Int("max-batch-update-meta", 1000, "Maximum updates in one POST /v1/blobs:batchUpdateMeta")
+		maxBatchSize           = flag.Int("max-batch-size", 0, "Deprecated: use -max-batch-put and -max-batch-update-meta. Sets each of them that is not given explicitly")
+		maxVersionCheck        = flag.Int("max-version-check", 1000, "Maximum entries in one POST /v1/blobs:versionCheck")
+		maxJSONBytes           = flag.Int64("max-json-bytes", 64<<20, "Maximum size of a JSON request body in bytes (0 = unlimited)")
+		maxJSONDepth           = flag.Int("max-json-depth", 32, "Maximum nesting depth of JSON request bodies (0 = unlimited)")
+		maxJSONTokens          = flag.Int("max-json-tokens", 1_000_000, "Maximum tokens in a JSON request body (0 = unlimited)")
+		gzipResponses          = flag.Bool("gzip", false, "Gzip JSON responses under /v1 for clients sending Accept-Encoding: gzip")
+		gzipMinBytes           = flag.Int("gzip-min-bytes", 1024, "Smallest response body to gzip; smaller ones are sent uncompressed")
+		logSampleRate          = flag.Int("log-sample-rate", 1, "Log 1 in N successful requests; 4xx/5xx responses and /v1/auth/ requests are always logged (1 logs every request)")
+		problemDetails         = flag.Bool("problem-details", false, "Answer every /v1 error as an RFC 9457 application/problem+json document; without it only clients sending Accept: application/problem+json get one")
+		debugErrors            = flag.Bool("debug-errors", false, "Include the underlying error in 500 responses; for development only, as it can expose database details")
+		auditLog               = flag.Bool("audit-log", true, "Record auth and blob events in the audit_events table, exported via /v1/admin/audit/export")
+		auditRetention         = flag.Duration("audit-retention", 90*24*time.Hour, "Delete audit events older than this, checked hourly (0 keeps them forever)")
+		hstsMaxAge             = flag.Duration("hsts-max-age", 365*24*time.Hour, "Strict-Transport-Security max-age on responses to TLS requests (0 omits the header)")
+		hstsIncludeSubDomains  = flag.Bool("hsts-include-subdomains", false, "Add includeSubDomains to Strict-Transport-Security; only if every subdomain of the host serves HTTPS")
+		contentSecurityPolicy  = flag.String("content-security-policy", "default-src 'none'; frame-ancestors 'none'", "Content-Security-Policy on every response (empty omits the header)")
+		kdfTiming              = flag.Bool("kdf-timing", false, "Record server-side verifier hash durations in /metrics, labelled by hash params")
+		kdfTimingLogThreshold  = flag.Duration("kdf-timing-log-threshold", 250*time.Millisecond, "With -kdf-timing, log verifier hashes slower than this (0 disables)")
+		maxConcurrentUploads   = flag.Int("max-concurrent-uploads", 0, "Maximum blob PUTs and archive imports running at once; more get 503 with Retry-After (0 disables)")
+		maxConcurrentKDF       = flag.Int("max-concurrent-kdf", 0, "Maximum register, verify, check and password-change requests hashing at once; more get 503 with Retry-After (0 disables)")
+		usernameCheckRate      = flag.Int("username-check-rate", 10, "Maximum GET /v1/auth/username-available requests per client IP per minute; more get 429 with Retry-After (0 disables)")
+		blobWriteRate          = flag.Int("blob-write-rate", 0, "Maximum blob write requests per user per minute; more get 429 with Retry-After (0 disables)")
+		blobWriteBurst         = flag.Int("blob-write-burst", 0, "Blob writes a user may make at once before -blob-write-rate applies (0 uses the rate)")
+		backupDir              = flag.String("backup-dir", "", "Directory for timestamped database backups (empty disables backups)")
+		backupInterval         = flag.Duration("backup-interval", 0, "Interval between automatic backups into -backup-dir (0 disables; on-demand backups via /v1/admin/backup still work)")
+		backupRetention        = flag.Int("backup-retention", 7, "Number of backups to keep in -backup-dir (0 keeps all)")
+		storageMetricsInterval = flag.Duration("storage-metrics-interval", 5*time.Minute, "Interval between refreshes of the top users by storage in /metrics (0 disables)")
+		storageMetricsTop      = flag.Int("storage-metrics-top", 10, "Number of users in the storage_top_users_bytes metric")
+
+		tlsCert         = flag.String("tls-cert", "", "TLS certificate file; with -tls-key the server terminates TLS itself (empty serves plain HTTP)")
+		tlsKey          = flag.String("tls-key", "", "TLS private key file for -tls-cert")
+		tlsMinVersion   = flag.String("tls-min-version", api.DefaultTLSPolicy().MinVersion, "Minimum TLS version, 1.2 or 1.3")
+		tlsCipherSuites = flag.String("tls-cipher-suites", strings.Join(api.DefaultTLSPolicy().CipherSuites, ","), "Comma-separated TLS 1.2 cipher suites by IANA name (TLS 1.3 suites are not configurable)")
+
+		readHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "Maximum time to read request headers (0 disables)")
+		readTimeout       = flag.Duration("read-timeout", 5*time.Minute, "Maximum time to read a whole request including the body (0 disables); keep it long enough for the largest upload")
+		writeTimeout      = flag.Duration("write-timeout", 5*time.Minute, "Maximum time from the end of the request headers to the end of the response (0 disables)")
+		maxConns          = flag.Int("max-conns", 0, "Maximum open client connections; beyond it new connections wait in the listen backlog (0 disables)")
+		idleTimeout       = flag.Duration("idle-timeout", 2*time.Minute, "Maximum time a keep-alive connection waits for the next request (0 uses read-timeout)")
+
+		maxKDFDuration        = flag.Duration("max-kdf-duration", 0, "Reject registrations whose KDF params are projected to take longer than this to derive on this machine (0 disables)")
+		allowedKDFTypes       = flag.String("allowed-kdf-types", "pbkdf2_sha256,argon2id", "Comma-separated KDF types accounts may register with or switch to; must include -default-kdf-type")
+		defaultKDFType        = flag.String("default-kdf-type", "argon2id", "KDF type assigned to clients that register without KDF params (argon2id or pbkdf2_sha256)")
+		defaultKDFIterations  = flag.Int("default-kdf-iterations", 3, "Default KDF iterations")
+		defaultKDFMemoryKiB   = flag.Int("default-kdf-memory-kib", 65536, "Default Argon2id memory in KiB")
+		defaultKDFParallelism = flag.Int("default-kdf-parallelism", 4, "Default Argon2id parallelism")
 	)
 	flag.Parse()
 
@@ -29,8 +121,138 @@ func main() {
 		*jwtSecret = jwtSecretEnv
 	}
 
+	if *adminToken == "" {
+		*adminToken = os.Getenv("ADMIN_TOKEN")
+	}
+
+	// Build server configuration
+	config := api.DefaultConfig()
+	config.AdminToken = *adminToken
+	config.UsernameChangeCooldown = *usernameChangeCooldown
+	config.VerifierHashAlg = models.VerifierHashAlg(*verifierHash)
+	config.AllowedAlgs = strings.Split(*allowedAlgs, ",")
+	config.RequireInvite = *requireInvite
+	config.DisableRegistration = *disableRegistration
+	config.RequireCurrentVerifier = *requireCurrentVerifier
+	config.KeyEscrow = *keyEscrow
+	config.EncryptedNames = *encryptedNames
+	config.ReadOnly = *readOnly
+	config.DefaultCollection = *defaultCollection
+	config.UserQuotaBytes = *userQuotaBytes
+	config.MaxImportEntries = *maxImportEntries
+	config.MaxImportBytes = *maxImportBytes
+	// -max-batch-size predates the per-endpoint caps and still sets those
+	// not given explicitly, so existing deployments keep their limit
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if explicit["max-batch-size"] {
+		log.Printf("-max-batch-size is deprecated; use -max-batch-put and -max-batch-update-meta")
+		if !explicit["max-batch-put"] {
+			*maxBatchPut = *maxBatchSize
+		}
+		if !explicit["max-batch-update-meta"] {
+			*maxBatchUpdateMeta = *maxBatchSize
+		}
+	}
+	config.MaxBatchPut = *maxBatchPut
+	config.MaxBatchUpdateMeta = *maxBatchUpdateMeta
+	config.MaxVersionCheck = *maxVersionCheck
+	config.MaxJSONBytes = *maxJSONBytes
+	config.MaxJSONDepth = *maxJSONDepth
+	config.MaxJSONTokens = *maxJSONTokens
+	config.GzipResponses = *gzipResponses
+	config.GzipMinBytes = *gzipMinBytes
+	config.AuditLog = *auditLog
+	config.LogSampleRate = *logSampleRate
+	config.DebugErrors = *debugErrors
+	config.ProblemDetails = *problemDetails
+	config.SecurityHeaders.HSTSMaxAge = *hstsMaxAge
+	config.SecurityHeaders.HSTSIncludeSubDomains = *hstsIncludeSubDomains
+	config.SecurityHeaders.ContentSecurityPolicy = *contentSecurityPolicy
+	config.KDFTiming = *kdfTiming
+	config.KDFTimingLogThreshold = *kdfTimingLogThreshold
+	config.MaxConcurrentUploads = *maxConcurrentUploads
+	config.MaxConcurrentKDF = *maxConcurrentKDF
+	config.UsernameCheckRate = *usernameCheckRate
+	config.BlobWriteRate = *blobWriteRate
+	config.BlobWriteBurst = *blobWriteBurst
+	config.BackupDir = *backupDir
+	config.BackupRetention = *backupRetention
+	trusted, err := middleware.ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	config.TrustedProxies = trusted
+	config.RequireHTTPS = *requireHTTPS
+	config.HTTPSRedirect = *httpsRedirect
+	config.MaxKDFDuration = *maxKDFDuration
+	config.AllowedKDFTypes = nil
+	for _, kdfType := range strings.Split(*allowedKDFTypes, ",") {
+		config.AllowedKDFTypes = append(config.AllowedKDFTypes, models.KDFType(strings.TrimSpace(kdfType)))
+	}
+	config.DefaultKDF = models.KDFParams{
+		Type:       models.KDFType(*defaultKDFType),
+		Iterations: *defaultKDFIterations,
+	}
+	if config.DefaultKDF.Type == models.KDFTypeArgon2id {
+		config.DefaultKDF.MemoryKiB = defaultKDFMemoryKiB
+		config.DefaultKDF.Parallelism = defaultKDFParallelism
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// The TLS policy is checked even for plain HTTP, so a bad flag fails before -tls-cert is added
+	tlsPolicy := api.TLSPolicy{MinVersion: *tlsMinVersion}
+	if *tlsCipherSuites != "" {
+		tlsPolicy.CipherSuites = strings.Split(*tlsCipherSuites, ",")
+	}
+	tlsConfig, err := tlsPolicy.TLSConfig()
+	if err != nil {
+		log.Fatalf("Invalid TLS policy: %v", err)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("Invalid configuration: -tls-cert and -tls-key must be set together")
+	}
+
 	// Initialize database
-	database, err := db.New(*dbPath)
+	dbOptions := db.DefaultOptions()
+	dbOptions.SlowQueryThreshold = *slowQueryThreshold
+	dbOptions.CacheSizeKiB = *dbCacheSizeKiB
+	dbOptions.MmapSizeBytes = *dbMmapSize
+	dbOptions.TempStoreMemory = *dbTempStoreMemory
+	dbOptions.ConnMaxLifetime = *dbConnMaxLifetime
+	dbOptions.ConnMaxIdleTime = *dbConnMaxIdleTime
+	dbOptions.BlobCacheBytes = *blobCacheBytes
+	dbOptions.WriteBatchMax = *writeBatchMax
+	dbOptions.WriteBatchWindow = *writeBatchWindow
+	dbOptions.BusyTimeout = *busyTimeout
+	dbOptions.BusyRetries = *busyRetries
+	dbOptions.BusyRetryBackoff = *busyRetryBackoff
+	dbOptions.MaxSessions = *maxSessions
+	dbOptions.DedupContent = *dedupContent
+	if *blobStoreDir != "" {
+		if *dedupContent {
+			log.Fatalf("Invalid configuration: -blob-store-dir cannot be combined with -dedup-content")
+		}
+		store, err := db.NewFilesystemBlobStore(*blobStoreDir)
+		if err != nil {
+			log.Fatalf("Failed to open blob store: %v", err)
+		}
+		dbOptions.BlobStore = store
+	}
+	dbOptions.RejectNonceReuse = *rejectNonceReuse
+	dbOptions.MaxCollections = *maxCollections
+	dbOptions.UsernameReleaseHold = *usernameReleaseHold
+	switch *usernameCase {
+	case "sensitive":
+	case "insensitive":
+		dbOptions.CaseInsensitiveUsernames = true
+	default:
+		log.Fatalf("Invalid configuration: -username-case must be sensitive or insensitive, got %q", *usernameCase)
+	}
+
+	database, err := db.NewWithOptions(*dbPath, dbOptions)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
@@ -42,24 +264,139 @@ func main() {
 
 	log.Printf("Database initialized: %s", *dbPath)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Expired blobs are hidden immediately; the sweeper reclaims their rows
+	if *expirySweepInterval > 0 {
+		go database.RunExpirySweeper(ctx, *expirySweepInterval)
+	}
+
+	// Every failed login adds an audit event, so old ones have to go
+	if *auditRetention < 0 {
+		log.Fatalf("Invalid configuration: -audit-retention must not be negative")
+	}
+	if *auditRetention > 0 {
+		go database.RunAuditRetention(ctx, time.Hour, *auditRetention)
+	}
+
+	// Backups use SQLite's online backup API, so writers are not blocked
+	if *backupDir != "" && *backupInterval > 0 {
+		go database.RunBackups(ctx, *backupDir, *backupInterval, *backupRetention)
+	} else if *backupInterval > 0 {
+		log.Printf("Ignoring -backup-interval without -backup-dir")
+	}
+
+	// Per-user metrics carry pseudonymous labels keyed by the JWT secret
+	metrics.SetUserLabelKey([]byte(*jwtSecret))
+	if *storageMetricsInterval > 0 {
+		if *storageMetricsTop <= 0 {
+			log.Fatalf("Invalid configuration: -storage-metrics-top must be positive")
+		}
+		go database.RunStorageMetrics(ctx, *storageMetricsInterval, *storageMetricsTop)
+	}
+
 	// Create API server
-	server := api.NewServer(database, *jwtSecret)
+	server := api.NewServerWithConfig(database, *jwtSecret, config)
 	router := server.NewRouter()
 
 	// Start HTTP server
 	addr := fmt.Sprintf(":%s", *port)
-	log.Printf("Starting server on %s", addr)
+	log.Printf("Starting cryptd %s on %s", api.Version, addr)
 	log.Printf("API endpoints:")
+	log.Printf("  GET    /health")
+	log.Printf("  GET    /v1/capabilities")
+	log.Printf("  GET    /v1/version")
+	log.Printf("  GET    /v1/shared/{token}")
 	log.Printf("  GET    /v1/auth/kdf")
+	log.Printf("  GET    /v1/auth/kdf/bounds")
+	log.Printf("  GET    /v1/auth/username-available")
 	log.Printf("  POST   /v1/auth/register")
 	log.Printf("  POST   /v1/auth/verify")
+	log.Printf("  POST   /v1/auth/check")
+	log.Printf("  POST   /v1/auth/introspect")
+	log.Printf("  GET    /v1/auth/verify (authenticated)")
+	log.Printf("  POST   /v1/auth/token (authenticated)")
+	log.Printf("  GET    /v1/auth/events (authenticated)")
 	log.Printf("  PATCH  /v1/users/me (authenticated)")
+	log.Printf("  GET    /v1/users/me/account-key (authenticated)")
+	log.Printf("  POST   /v1/users/me/rotate-key (authenticated)")
+	if config.KeyEscrow {
+		log.Printf("  PUT    /v1/users/me/escrow (authenticated)")
+	}
+	log.Printf("  GET    /v1/sessions (authenticated)")
+	log.Printf("  GET    /v1/sessions/summary (authenticated)")
+	log.Printf("  PATCH  /v1/sessions/{sessionID} (authenticated)")
 	log.Printf("  GET    /v1/blobs (authenticated)")
+	log.Printf("  GET    /v1/blobs:facets (authenticated)")
+	log.Printf("  GET    /v1/blobs:summary (authenticated)")
+	log.Printf("  GET    /v1/blobs:delta (authenticated)")
+	log.Printf("  POST   /v1/blobs:versionCheck (authenticated)")
 	log.Printf("  GET    /v1/blobs/{blobName} (authenticated)")
+	log.Printf("  GET    /v1/blobs/{blobName}/content (authenticated)")
+	log.Printf("  GET    /v1/export.zip (authenticated)")
 	log.Printf("  PUT    /v1/blobs/{blobName} (authenticated)")
+	log.Printf("  PATCH  /v1/blobs/{blobName} (authenticated)")
+	log.Printf("  POST   /v1/blobs:importArchive (authenticated)")
+	log.Printf("  POST   /v1/blobs:batchPut (authenticated)")
+	log.Printf("  POST   /v1/blobs:batchUpdateMeta (authenticated)")
+	log.Printf("  POST   /v1/blobs/{blobName}/rename (authenticated)")
+	log.Printf("  POST   /v1/blobs/{blobName}/rewrap (authenticated)")
+	log.Printf("  POST   /v1/blobs/{blobName}/touch (authenticated)")
+	log.Printf("  POST   /v1/blobs/{blobName}/lock (authenticated)")
+	log.Printf("  DELETE /v1/blobs/{blobName}/lock (authenticated)")
+	log.Printf("  GET    /v1/blobs/{blobName}/verify (authenticated)")
+	log.Printf("  POST   /v1/blobs/{blobName}/signed-url (authenticated)")
 	log.Printf("  DELETE /v1/blobs/{blobName} (authenticated)")
+	if config.AdminToken != "" {
+		log.Printf("  POST   /v1/admin/scrub (admin)")
+		log.Printf("  POST   /v1/admin/blobs/transfer (admin)")
+		log.Printf("  GET    /v1/admin/read-only (admin)")
+		log.Printf("  PUT    /v1/admin/read-only (admin)")
+		log.Printf("  POST   /v1/admin/invites (admin)")
+		log.Printf("  DELETE /v1/admin/invites/{code} (admin)")
+		log.Printf("  GET    /v1/admin/audit/export (admin)")
+		log.Printf("  GET    /v1/admin/stats/algs (admin)")
+		log.Printf("  POST   /v1/admin/users (admin)")
+		log.Printf("  POST   /v1/admin/users/kdf (admin)")
+		log.Printf("  POST   /v1/admin/users/{userID}/revoke-sessions (admin)")
+		if config.KeyEscrow {
+			log.Printf("  GET    /v1/admin/users/{userID}/escrow (admin)")
+		}
+		if config.BackupDir != "" {
+			log.Printf("  POST   /v1/admin/backup (admin)")
+		}
+		log.Printf("  GET    /metrics (admin)")
+	}
+
+	// Timeouts bound how long a slow client can hold a connection
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           router,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		TLSConfig:         tlsConfig,
+	}
 
-	if err := http.ListenAndServe(addr, router); err != nil {
+	// The connection limit sits below TLS, so waiting clients cost no handshake
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+	if *maxConns > 0 {
+		log.Printf("Limiting open connections to %d", *maxConns)
+	}
+	listener = middleware.LimitListener(listener, *maxConns)
+
+	if *tlsCert != "" {
+		log.Printf("Serving TLS %s+ with %d TLS 1.2 cipher suite(s)", tlsPolicy.MinVersion, len(tlsConfig.CipherSuites))
+		err = httpServer.ServeTLS(listener, *tlsCert, *tlsKey)
+	} else {
+		err = httpServer.Serve(listener)
+	}
+	if err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
@@ -0,0 +1,297 @@
+package api
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/shalteor/cryptd-poc/server/internal/crypto"
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// ScrubBlobs handles POST /v1/admin/scrub
+func (s *Server) ScrubBlobs(w http.ResponseWriter, r *http.Request) {
+	report, err := s.db.ScrubBlobs()
+	if err != nil {
+		s.respondInternalError(w, r, "failed to scrub blobs", err)
+		return
+	}
+
+	if len(report.Corrupted) > 0 {
+		log.Printf("Scrub found %d corrupted blob(s) out of %d", len(report.Corrupted), report.Scanned)
+	}
+
+	respondJSON(w, http.StatusOK, report)
+}
+
+// ReadOnlyState represents the maintenance mode toggle
+type ReadOnlyState struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// GetReadOnly handles GET /v1/admin/read-only
+func (s *Server) GetReadOnly(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, ReadOnlyState{ReadOnly: s.readOnly.Load()})
+}
+
+// SetReadOnly handles PUT /v1/admin/read-only
+func (s *Server) SetReadOnly(w http.ResponseWriter, r *http.Request) {
+	var req ReadOnlyState
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	if s.readOnly.Swap(req.ReadOnly) != req.ReadOnly {
+		log.Printf("Read-only mode set to %v", req.ReadOnly)
+	}
+
+	respondJSON(w, http.StatusOK, req)
+}
+
+// TransferBlobRequest identifies a blob to move between users
+type TransferBlobRequest struct {
+	FromUserID int64  `json:"fromUserId"`
+	ToUserID   int64  `json:"toUserId"`
+	BlobName   string `json:"blobName"`
+}
+
+// TransferBlob handles POST /v1/admin/blobs/transfer. The blob keeps its
+// ciphertext, which only the source user's account key can decrypt; support
+// must get that key to the destination user out-of-band.
+func (s *Server) TransferBlob(w http.ResponseWriter, r *http.Request) {
+	var req TransferBlobRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if req.FromUserID == 0 || req.ToUserID == 0 || req.BlobName == "" {
+		respondError(w, http.StatusBadRequest, "fromUserId, toUserId and blobName are required")
+		return
+	}
+	if req.FromUserID == req.ToUserID {
+		respondError(w, http.StatusBadRequest, "source and destination users must differ")
+		return
+	}
+
+	blob, err := s.db.TransferBlob(req.FromUserID, req.ToUserID, req.BlobName, s.config.UserQuotaBytes)
+	if err == db.ErrUserNotFound {
+		respondError(w, http.StatusNotFound, "destination user not found")
+		return
+	}
+	if err == db.ErrBlobNotFound {
+		respondBlobNotFound(w)
+		return
+	}
+	if err == db.ErrBlobExists {
+		respondError(w, http.StatusConflict, "destination user already has a blob with this name")
+		return
+	}
+	if err == db.ErrQuotaExceeded {
+		respondQuotaExceeded(w, req.ToUserID)
+		return
+	}
+	if err == db.ErrTooManyCollections {
+		respondErrorCode(w, http.StatusBadRequest, "too_many_tags", "destination user's collection limit reached")
+		return
+	}
+	if err != nil {
+		s.respondInternalError(w, r, "failed to transfer blob", err)
+		return
+	}
+
+	log.Printf("Admin transferred blob %q from user %d to user %d", req.BlobName, req.FromUserID, req.ToUserID)
+	s.audit(r, auditBlobTransferred, req.FromUserID, fmt.Sprintf("%s -> user %d", req.BlobName, req.ToUserID))
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"blobName":   blob.BlobName,
+		"fromUserId": req.FromUserID,
+		"toUserId":   blob.UserID,
+		"version":    blob.Version,
+		"updatedAt":  blob.UpdatedAt,
+	})
+}
+
+// CreateBackup handles POST /v1/admin/backup - writes an on-demand database
+// backup into the configured backup directory
+func (s *Server) CreateBackup(w http.ResponseWriter, r *http.Request) {
+	backup, err := s.db.BackupToDir(r.Context(), s.config.BackupDir, s.config.BackupRetention, time.Now())
+	if err != nil {
+		s.respondInternalError(w, r, "failed to back up database", err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, backup)
+}
+
+// CreateInvite handles POST /v1/admin/invites - mints a single-use registration code
+func (s *Server) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	code, err := crypto.GenerateRandomBytes(16)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to generate invite", err)
+		return
+	}
+
+	invite, err := s.db.CreateInvite(hex.EncodeToString(code))
+	if err != nil {
+		s.respondInternalError(w, r, "failed to create invite", err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, invite)
+}
+
+// CreateUser handles POST /v1/admin/users - provisions an account. The body is
+// a RegisterRequest, prepared client-side like a self-registration (typically
+// with a temporary password the user changes later). It is validated and
+// hashed exactly as on register, but ignores -disable-registration and
+// -require-invite; inviteCode is not consumed.
+func (s *Server) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req RegisterRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	user, params, ok := s.createAccount(w, r, req, false, "AdminCreateUser")
+	if !ok {
+		return
+	}
+
+	s.audit(r, auditUserCreated, user.ID, "")
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"id":        user.ID,
+		"username":  user.Username,
+		"createdAt": user.CreatedAt,
+		"kdf":       params,
+	})
+}
+
+// RevokeSessionsResponse reports an admin session revocation
+type RevokeSessionsResponse struct {
+	Revoked int64 `json:"revoked"` // session records deleted
+}
+
+// RevokeUserSessions handles POST /v1/admin/users/{userID}/revoke-sessions.
+// It force-logs-out a user: every token issued so far, including ones minted
+// without a session record, is rejected from the next request on. The account
+// and its credentials are untouched, so the user can log in again.
+func (s *Server) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil || userID <= 0 {
+		respondError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	revoked, err := s.db.RevokeSessions(userID)
+	if err == db.ErrUserNotFound {
+		respondError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		s.respondInternalError(w, r, "failed to revoke sessions", err)
+		return
+	}
+
+	s.audit(r, auditSessionsRevoked, userID, fmt.Sprintf("%d session(s)", revoked))
+	respondJSON(w, http.StatusOK, RevokeSessionsResponse{Revoked: revoked})
+}
+
+// RevokeInvite handles DELETE /v1/admin/invites/{code} - revokes an unused invite
+func (s *Server) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	err := s.db.RevokeInvite(chi.URLParam(r, "code"))
+	if err == db.ErrInviteNotFound {
+		respondError(w, http.StatusNotFound, "invite not found or already used")
+		return
+	}
+	if err != nil {
+		s.respondInternalError(w, r, "failed to revoke invite", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rejectWhenReadOnly fails mutating routes with 503 while maintenance mode is on
+func (s *Server) rejectWhenReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.readOnly.Load() {
+			w.Header().Set("Retry-After", "60")
+			respondErrorCode(w, http.StatusServiceUnavailable, "maintenance", "server is in read-only maintenance mode")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AlgStatsResponse counts stored blobs per container algorithm
+type AlgStatsResponse struct {
+	// Algs maps each alg to its blob count; "" counts blobs stored without one
+	Algs  map[string]int64 `json:"algs"`
+	Total int64            `json:"total"`
+}
+
+// GetAlgStats handles GET /v1/admin/stats/algs. It shows how far clients have
+// moved blobs to a new algorithm; alg is opaque metadata, so nothing is decrypted.
+func (s *Server) GetAlgStats(w http.ResponseWriter, r *http.Request) {
+	algs, err := s.db.CountBlobsByAlg()
+	if err != nil {
+		s.respondInternalError(w, r, "failed to count blobs", err)
+		return
+	}
+
+	resp := AlgStatsResponse{Algs: algs}
+	for _, count := range algs {
+		resp.Total += count
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// BulkKDFParamsRequest names the accounts whose KDF params to look up
+type BulkKDFParamsRequest struct {
+	Usernames []string `json:"usernames"`
+}
+
+// BulkKDFParamsResponse maps each found username to its KDF params and lists
+// the rest, in request order
+type BulkKDFParamsResponse struct {
+	Users   map[string]models.KDFParams `json:"users"`
+	Missing []string                    `json:"missing"`
+}
+
+// maxBulkKDFUsernames caps one bulk KDF lookup; it is a single indexed read
+const maxBulkKDFUsernames = 1000
+
+// BulkKDFParams handles POST /v1/admin/users/kdf for migration tools. It
+// returns KDF params only: never verifier hashes or wrapped keys.
+func (s *Server) BulkKDFParams(w http.ResponseWriter, r *http.Request) {
+	var req BulkKDFParamsRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.Usernames) == 0 {
+		respondError(w, http.StatusBadRequest, "usernames must not be empty")
+		return
+	}
+	if len(req.Usernames) > maxBulkKDFUsernames {
+		respondBatchTooLarge(w, maxBulkKDFUsernames)
+		return
+	}
+
+	users, err := s.db.GetKDFParamsByUsernames(req.Usernames)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to get KDF params", err)
+		return
+	}
+
+	resp := BulkKDFParamsResponse{Users: users, Missing: []string{}}
+	seen := make(map[string]bool, len(req.Usernames))
+	for _, username := range req.Usernames {
+		if _, ok := users[username]; !ok && !seen[username] {
+			resp.Missing = append(resp.Missing, username)
+		}
+		seen[username] = true
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
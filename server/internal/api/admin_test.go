@@ -0,0 +1,658 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/crypto"
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+const testAdminToken = "test-admin-token"
+
+func setupAdminTestServer(t *testing.T) (*Server, *db.DB) {
+	t.Helper()
+
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+
+	config := DefaultConfig()
+	config.AdminToken = testAdminToken
+	return NewServerWithConfig(database, "test-jwt-secret", config), database
+}
+
+func adminRequest(method, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	return req
+}
+
+func TestAdminRoutesDisabledWithoutToken(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	w := httptest.NewRecorder()
+	server.NewRouter().ServeHTTP(w, adminRequest("POST", "/v1/admin/scrub"))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
+
+func TestAdminRoutesRejectUserToken(t *testing.T) {
+	server, database := setupAdminTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	token, _ := server.jwtConfig.GenerateToken(1)
+	req := httptest.NewRequest("POST", "/v1/admin/scrub", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	server.NewRouter().ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", w.Code)
+	}
+}
+
+func TestScrubBlobsReportsCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scrub.db")
+	database, err := db.New(path)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	config := DefaultConfig()
+	config.AdminToken = testAdminToken
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+	}
+	_ = database.CreateUser(user)
+
+	for _, name := range []string{"good", "bad"} {
+		_ = database.UpsertBlob(&models.Blob{
+			UserID:        user.ID,
+			BlobName:      name,
+			EncryptedBlob: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+		})
+	}
+
+	// Corrupt one row behind the server's back
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("failed to open raw connection: %v", err)
+	}
+	defer func() { _ = raw.Close() }()
+	if _, err := raw.Exec(`UPDATE blobs SET encrypted_blob_tag = 'tah' WHERE blob_name = 'bad'`); err != nil {
+		t.Fatalf("failed to corrupt blob: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	server.NewRouter().ServeHTTP(w, adminRequest("POST", "/v1/admin/scrub"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var report models.ScrubReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if report.Scanned != 2 {
+		t.Errorf("expected 2 scanned, got %d", report.Scanned)
+	}
+	if len(report.Corrupted) != 1 || report.Corrupted[0].BlobName != "bad" || report.Corrupted[0].UserID != user.ID {
+		t.Errorf("expected only 'bad' to be reported, got %+v", report.Corrupted)
+	}
+
+	// The per-blob endpoint reports the same corruption
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	req := httptest.NewRequest("GET", "/v1/blobs/bad/verify", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	server.NewRouter().ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", w.Code)
+	}
+	var errResp map[string]string
+	_ = json.NewDecoder(w.Body).Decode(&errResp)
+	if errResp["error"] != "corrupted" {
+		t.Errorf("expected error 'corrupted', got %q", errResp["error"])
+	}
+}
+
+func TestMetricsEndpointRequiresAdminToken(t *testing.T) {
+	server, database := setupAdminTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	router := server.NewRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without admin token, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/metrics"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(w.Body).Decode(&vars); err != nil {
+		t.Fatalf("failed to decode metrics: %v", err)
+	}
+	if _, ok := vars["db_queries_total"]; !ok {
+		t.Error("expected db_queries_total in metrics")
+	}
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	server, database := setupAdminTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "vault", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Y2lwaGVy", Tag: "t"}})
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	setReadOnly := func(on bool) {
+		t.Helper()
+		req := httptest.NewRequest("PUT", "/v1/admin/read-only", strings.NewReader(fmt.Sprintf(`{"readOnly": %v}`, on)))
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("failed to toggle read-only: %d %s", w.Code, w.Body.String())
+		}
+	}
+	put := UpsertBlobRequest{EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "bmV3", Tag: "t"}}
+
+	setReadOnly(true)
+
+	for _, tt := range []struct {
+		method, target string
+		body           interface{}
+	}{
+		{"PUT", "/v1/blobs/vault", put},
+		{"DELETE", "/v1/blobs/vault", nil},
+		{"POST", "/v1/auth/register", RegisterRequest{Username: "bob", LoginVerifier: "AA=="}},
+	} {
+		w := doRequest(router, tt.method, tt.target, token, tt.body)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s: expected status 503, got %d", tt.method, tt.target, w.Code)
+		}
+		var resp map[string]string
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		if resp["code"] != "maintenance" {
+			t.Errorf("%s %s: expected maintenance code, got %v", tt.method, tt.target, resp)
+		}
+	}
+
+	for _, target := range []string{"/v1/blobs", "/v1/blobs/vault", "/v1/users/me/account-key"} {
+		if w := doRequest(router, "GET", target, token, nil); w.Code != http.StatusOK {
+			t.Errorf("GET %s: expected reads to keep working, got %d", target, w.Code)
+		}
+	}
+
+	// Admin writes are closed too; the switch itself stays open
+	for _, tt := range []struct {
+		method, target string
+		body           interface{}
+	}{
+		{"POST", "/v1/admin/scrub", nil},
+		{"POST", "/v1/admin/blobs/transfer", TransferBlobRequest{FromUserID: user.ID, ToUserID: user.ID, BlobName: "vault"}},
+		{"POST", "/v1/admin/invites", nil},
+		{"DELETE", "/v1/admin/invites/code", nil},
+		{"POST", fmt.Sprintf("/v1/admin/users/%d/revoke-sessions", user.ID), nil},
+	} {
+		if w := doRequest(router, tt.method, tt.target, testAdminToken, tt.body); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s: expected status 503, got %d", tt.method, tt.target, w.Code)
+		}
+	}
+	if w := doRequest(router, "GET", "/v1/admin/read-only", testAdminToken, nil); w.Code != http.StatusOK {
+		t.Errorf("expected the read-only state to stay readable, got %d", w.Code)
+	}
+
+	setReadOnly(false)
+
+	if w := doRequest(router, "PUT", "/v1/blobs/vault", token, put); w.Code != http.StatusOK {
+		t.Errorf("expected writes to resume, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestInviteOnlyRegistration(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	config := DefaultConfig()
+	config.AdminToken = testAdminToken
+	config.RequireInvite = true
+	router := NewServerWithConfig(database, "test-jwt-secret", config).NewRouter()
+
+	mint := func() string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("POST", "/v1/admin/invites"))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("failed to mint invite: %d %s", w.Code, w.Body.String())
+		}
+		var invite models.Invite
+		_ = json.NewDecoder(w.Body).Decode(&invite)
+		return invite.Code
+	}
+	register := func(username, code string) *httptest.ResponseRecorder {
+		return doRequest(router, "POST", "/v1/auth/register", "", RegisterRequest{
+			Username:          username,
+			LoginVerifier:     "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+			WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+			InviteCode:        code,
+		})
+	}
+	expectCode := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		var resp map[string]string
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code != status || resp["code"] != code {
+			t.Errorf("expected %d %s, got %d %v", status, code, w.Code, resp)
+		}
+	}
+
+	expectCode(register("alice", ""), http.StatusForbidden, "invite_required")
+	expectCode(register("alice", "not-a-code"), http.StatusForbidden, "invite_invalid")
+
+	code := mint()
+	if w := register("alice", code); w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201 with a valid invite, got %d: %s", w.Code, w.Body.String())
+	}
+	expectCode(register("bob", code), http.StatusForbidden, "invite_invalid")
+
+	// A rejected invite leaves no user behind, and a taken name does not burn the code
+	if _, err := database.GetUserByUsername("bob"); err != db.ErrUserNotFound {
+		t.Errorf("expected no user for a reused invite, got %v", err)
+	}
+	second := mint()
+	if w := register("alice", second); w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 for a taken username, got %d", w.Code)
+	}
+	if w := register("bob", second); w.Code != http.StatusCreated {
+		t.Errorf("expected the invite to survive a failed registration, got %d", w.Code)
+	}
+
+	// Revoking: unused codes go away, used ones cannot be revoked
+	revoked := mint()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("DELETE", "/v1/admin/invites/"+revoked))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status 204 on revoke, got %d", w.Code)
+	}
+	expectCode(register("carol", revoked), http.StatusForbidden, "invite_invalid")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("DELETE", "/v1/admin/invites/"+code))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 revoking a used invite, got %d", w.Code)
+	}
+}
+
+func TestAdminTransferBlob(t *testing.T) {
+	server, database := setupAdminTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	alice := createTestUser(t, database, "alice")
+	bob := createTestUser(t, database, "bob")
+	for _, blob := range []*models.Blob{
+		{UserID: alice.ID, BlobName: "vault", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "YWxpY2U=", Tag: "t"}},
+		{UserID: alice.ID, BlobName: "notes", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "bm90ZXM=", Tag: "t"}},
+		{UserID: bob.ID, BlobName: "notes", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Ym9i", Tag: "t"}},
+	} {
+		if err := database.UpsertBlob(blob); err != nil {
+			t.Fatalf("failed to upsert blob: %v", err)
+		}
+	}
+
+	transfer := func(req TransferBlobRequest) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(req)
+		httpReq := httptest.NewRequest("POST", "/v1/admin/blobs/transfer", strings.NewReader(string(data)))
+		httpReq.Header.Set("Authorization", "Bearer "+testAdminToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httpReq)
+		return w
+	}
+
+	w := transfer(TransferBlobRequest{FromUserID: alice.ID, ToUserID: bob.ID, BlobName: "vault"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	moved, err := database.GetBlob(bob.ID, "vault")
+	if err != nil {
+		t.Fatalf("expected bob to own vault: %v", err)
+	}
+	if moved.EncryptedBlob.Ciphertext != "YWxpY2U=" {
+		t.Errorf("expected the container to move unchanged, got %q", moved.EncryptedBlob.Ciphertext)
+	}
+	if _, err := database.GetBlob(alice.ID, "vault"); err != db.ErrBlobNotFound {
+		t.Errorf("expected vault to be gone from alice, got %v", err)
+	}
+
+	// Collision: bob already has "notes", and nothing changes
+	w = transfer(TransferBlobRequest{FromUserID: alice.ID, ToUserID: bob.ID, BlobName: "notes"})
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 on collision, got %d", w.Code)
+	}
+	if blob, err := database.GetBlob(alice.ID, "notes"); err != nil || blob.EncryptedBlob.Ciphertext != "bm90ZXM=" {
+		t.Errorf("expected alice's notes untouched after collision, got %v %v", blob, err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		req      TransferBlobRequest
+		expected int
+	}{
+		{"missing blob", TransferBlobRequest{FromUserID: alice.ID, ToUserID: bob.ID, BlobName: "nope"}, http.StatusNotFound},
+		{"unknown destination", TransferBlobRequest{FromUserID: alice.ID, ToUserID: 999, BlobName: "notes"}, http.StatusNotFound},
+		{"same user", TransferBlobRequest{FromUserID: alice.ID, ToUserID: alice.ID, BlobName: "notes"}, http.StatusBadRequest},
+		{"missing fields", TransferBlobRequest{FromUserID: alice.ID}, http.StatusBadRequest},
+	} {
+		if w := transfer(tt.req); w.Code != tt.expected {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expected, w.Code)
+		}
+	}
+}
+
+func TestAdminAlgStats(t *testing.T) {
+	server, database := setupAdminTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	stats := func() AlgStatsResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("GET", "/v1/admin/stats/algs"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp AlgStatsResponse
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		return resp
+	}
+
+	if resp := stats(); resp.Total != 0 || len(resp.Algs) != 0 {
+		t.Errorf("expected no blobs counted, got %+v", resp)
+	}
+
+	alice := createTestUser(t, database, "alice")
+	bob := createTestUser(t, database, "bob")
+	past := models.NewTimestamp(time.Now().Add(-time.Hour))
+	for _, blob := range []*models.Blob{
+		{UserID: alice.ID, BlobName: "legacy", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}},
+		{UserID: alice.ID, BlobName: "old", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t", Alg: "A256GCM"}},
+		{UserID: alice.ID, BlobName: "new", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t", Alg: "XC20P"}},
+		{UserID: bob.ID, BlobName: "new", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t", Alg: "XC20P"}},
+		{UserID: bob.ID, BlobName: "gone", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t", Alg: "A256GCM"}, ExpiresAt: &past},
+	} {
+		if err := database.UpsertBlob(blob); err != nil {
+			t.Fatalf("failed to upsert blob: %v", err)
+		}
+	}
+
+	resp := stats()
+	expected := map[string]int64{"": 1, "A256GCM": 1, "XC20P": 2}
+	if resp.Total != 4 || len(resp.Algs) != len(expected) {
+		t.Fatalf("expected 4 unexpired blobs over 3 algs, got %+v", resp)
+	}
+	for alg, count := range expected {
+		if resp.Algs[alg] != count {
+			t.Errorf("alg %q: expected %d blobs, got %d", alg, count, resp.Algs[alg])
+		}
+	}
+
+	// Rewrapping a blob to the new algorithm moves it between counts
+	if _, err := database.RewrapBlob(alice.ID, "old", models.Container{Nonce: "n2", Ciphertext: "c2", Tag: "t2", Alg: "XC20P"}, 0, db.Writer{}); err != nil {
+		t.Fatalf("failed to rewrap: %v", err)
+	}
+	if resp := stats(); resp.Algs["A256GCM"] != 0 || resp.Algs["XC20P"] != 3 {
+		t.Errorf("expected the rewrapped blob to count as XC20P, got %+v", resp.Algs)
+	}
+}
+
+func TestAdminBulkKDFParams(t *testing.T) {
+	server, database := setupAdminTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	alice := createTestUser(t, database, "alice")
+	memKiB, parallelism := 65536, 4
+	_ = database.CreateUser(&models.User{
+		Username:          "bob",
+		KDFType:           models.KDFTypeArgon2id,
+		KDFIterations:     3,
+		KDFMemoryKiB:      &memKiB,
+		KDFParallelism:    &parallelism,
+		LoginVerifierHash: []byte("bob-hash"),
+		WrappedAccountKey: models.Container{Nonce: "bob-nonce", Ciphertext: "bob-ciphertext", Tag: "bob-tag"},
+	})
+
+	w := doRequest(router, "POST", "/v1/admin/users/kdf", testAdminToken, BulkKDFParamsRequest{Usernames: []string{"alice", "ghost", "bob", "ghost"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, secret := range []string{"hash", "nonce", "ciphertext", "bob-tag"} {
+		if strings.Contains(w.Body.String(), secret) {
+			t.Errorf("response must not carry hashes or wrapped keys, found %q in %s", secret, w.Body.String())
+		}
+	}
+	var resp BulkKDFParamsResponse
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Users) != 2 || len(resp.Missing) != 1 || resp.Missing[0] != "ghost" {
+		t.Fatalf("expected alice and bob found and ghost missing once, got %+v", resp)
+	}
+	if kdf := resp.Users["alice"]; kdf.Type != alice.KDFType || kdf.Iterations != alice.KDFIterations || kdf.MemoryKiB != nil {
+		t.Errorf("unexpected params for alice: %+v", kdf)
+	}
+	if kdf := resp.Users["bob"]; kdf.Type != models.KDFTypeArgon2id || kdf.MemoryKiB == nil || *kdf.MemoryKiB != memKiB || *kdf.Parallelism != parallelism {
+		t.Errorf("unexpected params for bob: %+v", kdf)
+	}
+
+	// Nobody found is still a 200
+	w = doRequest(router, "POST", "/v1/admin/users/kdf", testAdminToken, BulkKDFParamsRequest{Usernames: []string{"ghost"}})
+	resp = BulkKDFParamsResponse{}
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if w.Code != http.StatusOK || len(resp.Users) != 0 || len(resp.Missing) != 1 {
+		t.Errorf("expected only ghost missing, got %d %+v", w.Code, resp)
+	}
+
+	tooMany := make([]string, maxBulkKDFUsernames+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("user%d", i)
+	}
+	if w := doRequest(router, "POST", "/v1/admin/users/kdf", testAdminToken, BulkKDFParamsRequest{Usernames: tooMany}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 over the batch cap, got %d", w.Code)
+	}
+	if w := doRequest(router, "POST", "/v1/admin/users/kdf", testAdminToken, BulkKDFParamsRequest{}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for no usernames, got %d", w.Code)
+	}
+
+	token, _ := server.jwtConfig.GenerateToken(alice.ID)
+	if w := doRequest(router, "POST", "/v1/admin/users/kdf", token, BulkKDFParamsRequest{Usernames: []string{"bob"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a user token, got %d", w.Code)
+	}
+}
+
+func TestAdminBackup(t *testing.T) {
+	server, database := setupAdminTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	// Without a backup directory the route is not registered
+	w := httptest.NewRecorder()
+	server.NewRouter().ServeHTTP(w, adminRequest("POST", "/v1/admin/backup"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 without -backup-dir, got %d", w.Code)
+	}
+
+	server.config.BackupDir = t.TempDir()
+	createTestUser(t, database, "alice")
+
+	w = httptest.NewRecorder()
+	server.NewRouter().ServeHTTP(w, adminRequest("POST", "/v1/admin/backup"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var backup db.BackupInfo
+	if err := json.NewDecoder(w.Body).Decode(&backup); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if filepath.Dir(backup.Path) != server.config.BackupDir || backup.SizeBytes == 0 {
+		t.Errorf("unexpected backup info: %+v", backup)
+	}
+
+	restored, err := db.New(backup.Path)
+	if err != nil {
+		t.Fatalf("failed to open backup: %v", err)
+	}
+	defer func() { _ = restored.Close() }()
+	if _, err := restored.GetUserByUsername("alice"); err != nil {
+		t.Errorf("expected alice in the backup: %v", err)
+	}
+}
+
+func TestDisableRegistration(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+	config := DefaultConfig()
+	config.AdminToken = testAdminToken
+	config.DisableRegistration = true
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	loginVerifier := crypto.EncodeBase64(make([]byte, 32))
+	req := RegisterRequest{
+		Username:          "alice",
+		LoginVerifier:     loginVerifier,
+		WrappedAccountKey: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+	}
+
+	w := doRequest(router, "POST", "/v1/auth/register", "", req)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "registration_disabled") {
+		t.Fatalf("expected 403 registration_disabled, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = doRequest(router, "GET", "/v1/capabilities", "", nil)
+	var caps CapabilitiesResponse
+	_ = json.NewDecoder(w.Body).Decode(&caps)
+	if !caps.RegistrationDisabled {
+		t.Error("expected capabilities to report registrationDisabled")
+	}
+
+	// Admins still create accounts, with the same validation as registration
+	w = doRequest(router, "POST", "/v1/admin/users", testAdminToken, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	w = doRequest(router, "POST", "/v1/admin/users", testAdminToken, req)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 for a taken username, got %d", w.Code)
+	}
+	bad := req
+	bad.Username = "bob"
+	bad.LoginVerifier = "short"
+	if w := doRequest(router, "POST", "/v1/admin/users", testAdminToken, bad); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a malformed verifier, got %d", w.Code)
+	}
+	if w := doRequest(router, "POST", "/v1/admin/users", "", req); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without the admin token, got %d", w.Code)
+	}
+
+	// The provisioned account logs in normally
+	w = doRequest(router, "POST", "/v1/auth/verify", "", VerifyRequest{Username: "alice", LoginVerifier: loginVerifier})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the created user to log in, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRevokeUserSessions(t *testing.T) {
+	server, database := setupAdminTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	loginToken := sessionToken(t, server, user.ID, "laptop")
+	bareToken, _ := server.jwtConfig.GenerateToken(user.ID)
+	bob := createTestUser(t, database, "bob")
+	bobToken := sessionToken(t, server, bob.ID, "phone")
+
+	w := doRequest(router, "POST", fmt.Sprintf("/v1/admin/users/%d/revoke-sessions", user.ID), "", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401 without the admin token, got %d", w.Code)
+	}
+
+	w = doRequest(router, "POST", fmt.Sprintf("/v1/admin/users/%d/revoke-sessions", user.ID), testAdminToken, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp RevokeSessionsResponse
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Revoked != 1 {
+		t.Errorf("expected 1 session record revoked, got %d", resp.Revoked)
+	}
+
+	// Tokens with and without a session record are both rejected
+	for _, token := range []string{loginToken, bareToken} {
+		w = doRequest(router, "GET", "/v1/blobs", token, nil)
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "session_revoked") {
+			t.Errorf("expected 401 session_revoked, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	w = doRequest(router, "POST", "/v1/auth/introspect", "", IntrospectRequest{Token: loginToken})
+	var introspect IntrospectResponse
+	_ = json.NewDecoder(w.Body).Decode(&introspect)
+	if introspect.Active {
+		t.Error("expected a revoked token to introspect as inactive")
+	}
+
+	// Other accounts and fresh logins are unaffected
+	if w := doRequest(router, "GET", "/v1/blobs", bobToken, nil); w.Code != http.StatusOK {
+		t.Errorf("expected another user's token to keep working, got %d", w.Code)
+	}
+	if w := doRequest(router, "GET", "/v1/blobs", sessionToken(t, server, user.ID, "laptop"), nil); w.Code != http.StatusOK {
+		t.Errorf("expected a token issued after the revocation to work, got %d", w.Code)
+	}
+
+	audited := false
+	_ = database.EachAuditEvent(db.AuditFilter{}, func(event models.AuditEvent) error {
+		audited = audited || (event.Type == auditSessionsRevoked && event.UserID != nil && *event.UserID == user.ID)
+		return nil
+	})
+	if !audited {
+		t.Errorf("expected an %s audit event", auditSessionsRevoked)
+	}
+
+	if w := doRequest(router, "POST", "/v1/admin/users/999/revoke-sessions", testAdminToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown user, got %d", w.Code)
+	}
+}
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// Audit event types. They are part of the export schema, so existing values
+// must not change.
+const (
+	auditRegister        = "auth.register"
+	auditLogin           = "auth.login"
+	auditLoginFailed     = "auth.login_failed"
+	auditTokenIssued     = "auth.token_issued"
+	auditUserUpdated     = "auth.user_updated"
+	auditKeyRotated      = "auth.key_rotated"
+	auditEscrowStored    = "auth.escrow_stored"
+	auditBlobPut         = "blob.put"
+	auditBlobDeleted     = "blob.delete"
+	auditBlobRenamed     = "blob.rename"
+	auditBlobRewrapped   = "blob.rewrap"
+	auditBlobLocked      = "blob.lock"
+	auditBlobUnlocked    = "blob.unlock"
+	auditBlobBatchPut    = "blob.batch_put"
+	auditBlobMetaUpdated = "blob.batch_update_meta"
+	auditBlobImported    = "blob.import"
+	auditBlobExported    = "blob.export"
+	auditBlobTransferred = "admin.blob_transfer"
+	auditEscrowRetrieved = "admin.escrow_retrieved"
+	auditUserCreated     = "admin.user_created"
+	auditSessionsRevoked = "admin.sessions_revoked"
+)
+
+const (
+	// defaultAuditPageSize applies to exports without ?limit=
+	defaultAuditPageSize = 1000
+	// maxAuditPageSize caps ?limit= on exports
+	maxAuditPageSize = 10000
+)
+
+// audit records an event for userID (0 when no account is known) with the
+// request's client IP. A failure is logged rather than failing the request,
+// which has already taken effect.
+func (s *Server) audit(r *http.Request, eventType string, userID int64, detail string) {
+	if !s.config.AuditLog {
+		return
+	}
+
+	event := &models.AuditEvent{Type: eventType, IP: clientIP(r), Detail: detail}
+	if userID != 0 {
+		event.UserID = &userID
+	}
+	if err := s.db.RecordAuditEvent(event); err != nil {
+		log.Printf("Failed to record %s audit event: %v", eventType, err)
+	}
+}
+
+// clientIP is the address part of r.RemoteAddr, which RealIP has already
+// resolved through any trusted proxies
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditCSVHeader names the CSV columns; they match the JSON field names
+var auditCSVHeader = []string{"id", "type", "userId", "ip", "detail", "createdAt"}
+
+// ExportAuditEvents handles GET /v1/admin/audit/export. It streams events
+// oldest first as NDJSON (the default) or CSV with ?format=csv, optionally
+// from ?since= on. Pages hold ?limit= events (default 1000); a Link header
+// points at the next page when there is one. The page boundary is fixed
+// before streaming, so the body is never buffered.
+func (s *Server) ExportAuditEvents(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "csv" {
+		respondError(w, http.StatusBadRequest, "format must be ndjson or csv")
+		return
+	}
+
+	since, err := parseTimeParam(r, "since")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter := db.AuditFilter{Since: since, Limit: defaultAuditPageSize}
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		filter.Limit, err = strconv.Atoi(raw)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxAuditPageSize {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxAuditPageSize))
+			return
+		}
+	}
+	if raw := r.URL.Query().Get("cursor"); raw != "" {
+		cursor, err := decodePageCursor(raw)
+		if err == nil && !cursor.Backward {
+			filter.AfterID, err = strconv.ParseInt(cursor.Name, 10, 64)
+		}
+		if err != nil || cursor.Backward {
+			respondError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+
+	lastID, more, err := s.db.LastAuditEventID(filter)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to export audit events", err)
+		return
+	}
+	if more {
+		setPageLinks(w, r, &pageCursor{Name: strconv.FormatInt(lastID, 10)}, nil)
+	}
+
+	var write func(models.AuditEvent) error
+	var flush func() error
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		_ = cw.Write(auditCSVHeader)
+		write = func(event models.AuditEvent) error {
+			userID := ""
+			if event.UserID != nil {
+				userID = strconv.FormatInt(*event.UserID, 10)
+			}
+			return cw.Write([]string{strconv.FormatInt(event.ID, 10), event.Type, userID, event.IP, event.Detail, event.CreatedAt.String()})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		write = func(event models.AuditEvent) error { return enc.Encode(event) }
+		flush = func() error { return nil }
+	}
+	w.WriteHeader(http.StatusOK)
+
+	err = s.db.EachAuditEvent(filter, write)
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		// The status is already sent; a truncated body is all the client can see
+		log.Printf("Audit export stopped early: %v", err)
+	}
+}
+
+// ListAuthEvents handles GET /v1/auth/events: the caller's own auth events,
+// newest first, in pages of ?limit= (default 100) with a Link header to the
+// next page. The cursor holds the last event's (createdAt, id).
+func (s *Server) ListAuthEvents(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	limit, page, err := parsePage(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	var cursor *db.AuditCursor
+	if page != nil {
+		cursor, err = decodeAuditCursor(*page)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+	}
+
+	// One extra row tells whether there is another page
+	events, err := s.db.ListAuthEvents(userID, cursor, limit+1)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to list events", err)
+		return
+	}
+	if len(events) > limit {
+		events = events[:limit]
+		last := events[len(events)-1]
+		setPageLinks(w, r, &pageCursor{Name: fmt.Sprintf("%d,%d", last.CreatedAt.UnixNano(), last.ID)}, nil)
+	}
+
+	respondJSON(w, http.StatusOK, events)
+}
+
+// decodeAuditCursor reads the "unixNanos,id" position ListAuthEvents puts in
+// its cursors; they only page forward
+func decodeAuditCursor(page pageCursor) (*db.AuditCursor, error) {
+	nanos, id, ok := strings.Cut(page.Name, ",")
+	if !ok || page.Backward {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &db.AuditCursor{CreatedAt: time.Unix(0, n).UTC()}
+	if cursor.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
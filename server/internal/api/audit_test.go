@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+func TestExportAuditEvents(t *testing.T) {
+	server, database := setupAdminTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	body := UpsertBlobRequest{EncryptedBlob: models.Container{Nonce: "bm9uY2Ux", Ciphertext: "b25l", Tag: "dGFn"}}
+	if w := doRequest(router, "PUT", "/v1/blobs/vault", token, body); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if w := doRequest(router, "DELETE", "/v1/blobs/vault", token, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", w.Code)
+	}
+	if w := doRequest(router, "POST", "/v1/auth/verify", "", VerifyRequest{Username: "mallory", LoginVerifier: "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/v1/admin/audit/export"))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("expected NDJSON, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var events []models.AuditEvent
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var event models.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	expected := []string{auditBlobPut, auditBlobDeleted, auditLoginFailed}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), events)
+	}
+	for i, event := range events {
+		if event.Type != expected[i] || event.IP != "192.0.2.1" || event.CreatedAt.IsZero() {
+			t.Errorf("event %d: expected %s from 192.0.2.1, got %+v", i, expected[i], event)
+		}
+	}
+	if events[0].UserID == nil || *events[0].UserID != user.ID || events[0].Detail != "vault" {
+		t.Errorf("expected the put to name alice and the blob, got %+v", events[0])
+	}
+	if events[2].UserID != nil || events[2].Detail != "mallory" {
+		t.Errorf("expected an unknown-user failure without a user id, got %+v", events[2])
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/v1/admin/audit/export?format=csv"))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %v", err)
+	}
+	if len(records) != 4 || strings.Join(records[0], ",") != "id,type,userId,ip,detail,createdAt" || records[3][1] != auditLoginFailed || records[3][2] != "" {
+		t.Errorf("unexpected CSV export: %v", records)
+	}
+}
+
+func TestExportAuditEventsPagination(t *testing.T) {
+	server, database := setupAdminTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	for _, detail := range []string{"a", "b", "c"} {
+		_ = database.RecordAuditEvent(&models.AuditEvent{Type: auditLoginFailed, Detail: detail})
+	}
+
+	linkPattern := regexp.MustCompile(`<https?://[^/]+([^>]*)>; rel="next"`)
+	target := "/v1/admin/audit/export?limit=2"
+	var details []string
+	for pages := 0; target != ""; pages++ {
+		if pages == 3 {
+			t.Fatal("expected pagination to end")
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("GET", target))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		dec := json.NewDecoder(w.Body)
+		for dec.More() {
+			var event models.AuditEvent
+			_ = dec.Decode(&event)
+			details = append(details, event.Detail)
+		}
+		target = ""
+		if match := linkPattern.FindStringSubmatch(w.Header().Get("Link")); match != nil {
+			target = match[1]
+		}
+	}
+	if strings.Join(details, ",") != "a,b,c" {
+		t.Errorf("expected a,b,c across pages, got %v", details)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/v1/admin/audit/export?format=xml"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown format, got %d", w.Code)
+	}
+}
+
+func TestListAuthEventsPagination(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	alice := createTestUser(t, database, "alice")
+	bob := createTestUser(t, database, "bob")
+	token, _ := server.jwtConfig.GenerateToken(alice.ID)
+
+	// Events 2 and 3 share a timestamp, so only the id orders them
+	base := time.Now().Add(-time.Hour)
+	for i, at := range []time.Duration{0, time.Second, time.Second, 2 * time.Second, 3 * time.Second} {
+		_ = database.RecordAuditEvent(&models.AuditEvent{Type: auditLogin, UserID: &alice.ID, Detail: strconv.Itoa(i), CreatedAt: models.NewTimestamp(base.Add(at))})
+	}
+	_ = database.RecordAuditEvent(&models.AuditEvent{Type: auditLogin, UserID: &bob.ID, Detail: "bob", CreatedAt: models.NewTimestamp(base)})
+	_ = database.RecordAuditEvent(&models.AuditEvent{Type: auditBlobPut, UserID: &alice.ID, Detail: "vault", CreatedAt: models.NewTimestamp(base)})
+
+	linkPattern := regexp.MustCompile(`<https?://[^/]+([^>]*)>; rel="next"`)
+	target := "/v1/auth/events?limit=2"
+	var details []string
+	for pages := 0; target != ""; pages++ {
+		if pages == 4 {
+			t.Fatal("expected pagination to end")
+		}
+		w := doRequest(router, "GET", target, token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var events []models.AuditEvent
+		_ = json.NewDecoder(w.Body).Decode(&events)
+		for _, event := range events {
+			details = append(details, event.Detail)
+		}
+		target = ""
+		if match := linkPattern.FindStringSubmatch(w.Header().Get("Link")); match != nil {
+			target = match[1]
+		}
+
+		// A newer event recorded mid-traversal does not shift later pages
+		if pages == 0 {
+			_ = database.RecordAuditEvent(&models.AuditEvent{Type: auditLogin, UserID: &alice.ID, Detail: "new"})
+		}
+	}
+	if strings.Join(details, ",") != "4,3,2,1,0" {
+		t.Errorf("expected 4,3,2,1,0 across pages, got %v", details)
+	}
+
+	if w := doRequest(router, "GET", "/v1/auth/events?cursor=bm9wZQ", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a malformed cursor, got %d", w.Code)
+	}
+}
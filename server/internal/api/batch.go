@@ -0,0 +1,432 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// BlobMetaUpdate changes one blob's metadata; omitted fields are left as they are
+type BlobMetaUpdate struct {
+	BlobName   string            `json:"blobName"`
+	Collection *string           `json:"collection,omitempty"` // "" moves the blob to the default collection
+	ExpiresAt  *models.Timestamp `json:"expiresAt,omitempty"`  // must be in the future
+	Pinned     *bool             `json:"pinned,omitempty"`     // pinned blobs never expire
+}
+
+// BatchUpdateMetaRequest is the body of POST /v1/blobs:batchUpdateMeta
+type BatchUpdateMetaRequest struct {
+	Updates []BlobMetaUpdate `json:"updates"`
+}
+
+// BlobMetaResult reports the outcome for one update, with the blob's new state on success
+type BlobMetaResult struct {
+	BlobName   string            `json:"blobName"`
+	OK         bool              `json:"ok"`
+	Error      string            `json:"error,omitempty"`
+	Collection string            `json:"collection,omitempty"`
+	ExpiresAt  *models.Timestamp `json:"expiresAt,omitempty"`
+	Pinned     bool              `json:"pinned,omitempty"`
+	Version    int64             `json:"version,omitempty"`
+	UpdatedAt  *models.Timestamp `json:"updatedAt,omitempty"`
+}
+
+// respondBatchTooLarge rejects a batch over the endpoint's own limit
+func respondBatchTooLarge(w http.ResponseWriter, limit int) {
+	respondErrorCode(w, http.StatusBadRequest, "batch_too_large", fmt.Sprintf("batch has more than %d entries", limit))
+}
+
+// validateMetaUpdate returns why update cannot be applied, or "" if it can
+func validateMetaUpdate(update BlobMetaUpdate) string {
+	switch {
+	case update.BlobName == "":
+		return "blob name is required"
+	case update.Collection == nil && update.ExpiresAt == nil && update.Pinned == nil:
+		return "nothing to update"
+	case update.ExpiresAt != nil && !update.ExpiresAt.After(time.Now()):
+		return "expiresAt must be in the future"
+	}
+	return ""
+}
+
+// setBlob fills in the blob's new state after a successful update
+func (result *BlobMetaResult) setBlob(blob *models.Blob) {
+	updatedAt := blob.UpdatedAt
+	result.OK = true
+	result.Collection = blob.Collection
+	result.ExpiresAt = blob.ExpiresAt
+	result.Pinned = blob.Pinned
+	result.Version = blob.Version
+	result.UpdatedAt = &updatedAt
+}
+
+// BatchUpdateMetaResponse summarizes a batch metadata update
+type BatchUpdateMetaResponse struct {
+	Updated int              `json:"updated"`
+	Failed  int              `json:"failed"`
+	Results []BlobMetaResult `json:"results"`
+}
+
+// BatchUpdateMeta handles POST /v1/blobs:batchUpdateMeta. Valid updates are
+// applied in one transaction; invalid ones and names without an unexpired blob
+// are reported per entry and skipped. Containers are never touched, so this
+// needs no re-encryption and does not count against the quota. A batch that
+// would exceed the collection limit, or touches a blob locked by another
+// session, is rejected as a whole.
+func (s *Server) BatchUpdateMeta(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	var req BatchUpdateMetaRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.Updates) == 0 {
+		respondError(w, http.StatusBadRequest, "updates must not be empty")
+		return
+	}
+	if len(req.Updates) > s.config.MaxBatchUpdateMeta {
+		respondBatchTooLarge(w, s.config.MaxBatchUpdateMeta)
+		return
+	}
+	writer, ok := blobWriter(w, r)
+	if !ok {
+		return
+	}
+
+	resp := BatchUpdateMetaResponse{Results: make([]BlobMetaResult, len(req.Updates))}
+	var valid []db.BlobMetaUpdate
+	var validIndex []int
+	for i, update := range req.Updates {
+		resp.Results[i].BlobName = update.BlobName
+		if msg := validateMetaUpdate(update); msg != "" {
+			resp.Results[i].Error = msg
+			continue
+		}
+		valid = append(valid, db.BlobMetaUpdate{
+			BlobName:   update.BlobName,
+			Collection: update.Collection,
+			ExpiresAt:  update.ExpiresAt,
+			Pinned:     update.Pinned,
+		})
+		validIndex = append(validIndex, i)
+	}
+
+	if len(valid) > 0 {
+		blobs, err := s.db.UpdateBlobsMeta(userID, valid, writer)
+		if err == db.ErrTooManyCollections {
+			respondErrorCode(w, http.StatusBadRequest, "too_many_tags", tooManyCollectionsMessage)
+			return
+		}
+		if err == db.ErrBlobLocked {
+			respondErrorCode(w, http.StatusLocked, "locked", "a blob in the batch is locked by another session; retry later or pass force=true")
+			return
+		}
+		if err != nil {
+			s.respondInternalError(w, r, "failed to update blobs", err)
+			return
+		}
+		for j, blob := range blobs {
+			result := &resp.Results[validIndex[j]]
+			if blob == nil {
+				result.Error = "blob not found"
+				continue
+			}
+			result.setBlob(blob)
+		}
+	}
+
+	for _, result := range resp.Results {
+		if result.OK {
+			resp.Updated++
+		} else {
+			resp.Failed++
+		}
+	}
+	if resp.Updated > 0 {
+		s.audit(r, auditBlobMetaUpdated, userID, fmt.Sprintf("%d blob(s)", resp.Updated))
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// UpdateBlobMeta handles PATCH /v1/blobs/{blobName}, the single-blob form of
+// :batchUpdateMeta. The body is a BlobMetaUpdate without blobName.
+func (s *Server) UpdateBlobMeta(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	var update BlobMetaUpdate
+	if !s.decodeJSON(w, r, &update) {
+		return
+	}
+	update.BlobName = chi.URLParam(r, "blobName")
+	if msg := validateMetaUpdate(update); msg != "" {
+		respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	writer, ok := blobWriter(w, r)
+	if !ok {
+		return
+	}
+
+	blobs, err := s.db.UpdateBlobsMeta(userID, []db.BlobMetaUpdate{{
+		BlobName:   update.BlobName,
+		Collection: update.Collection,
+		ExpiresAt:  update.ExpiresAt,
+		Pinned:     update.Pinned,
+	}}, writer)
+	if err == db.ErrTooManyCollections {
+		respondErrorCode(w, http.StatusBadRequest, "too_many_tags", tooManyCollectionsMessage)
+		return
+	}
+	if err == db.ErrBlobLocked {
+		s.respondBlobWriteLocked(w, userID, update.BlobName)
+		return
+	}
+	if err != nil {
+		s.respondInternalError(w, r, "failed to update blob", err)
+		return
+	}
+	if blobs[0] == nil {
+		respondBlobNotFound(w)
+		return
+	}
+	s.audit(r, auditBlobMetaUpdated, userID, update.BlobName)
+
+	result := BlobMetaResult{BlobName: update.BlobName}
+	result.setBlob(blobs[0])
+	respondJSON(w, http.StatusOK, result)
+}
+
+// VersionCheckRequest is the body of POST /v1/blobs:versionCheck
+type VersionCheckRequest struct {
+	Blobs []VersionCheckEntry `json:"blobs"`
+}
+
+// VersionCheckEntry is one blob version a client holds locally
+type VersionCheckEntry struct {
+	BlobName string `json:"blobName"`
+	Version  int64  `json:"version"`
+}
+
+// Outcomes of comparing the server's version of a blob with the client's
+const (
+	versionNewer   = "newer"   // the server has a later version: download it
+	versionOlder   = "older"   // the client has a later version than the server
+	versionEqual   = "equal"   // nothing to sync
+	versionMissing = "missing" // the server has no unexpired blob by that name
+)
+
+// VersionCheckResult compares the server's version of one blob with the client's
+type VersionCheckResult struct {
+	BlobName      string `json:"blobName"`
+	Status        string `json:"status,omitempty"`
+	ServerVersion int64  `json:"serverVersion,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// VersionCheckResponse holds one result per entry, in request order
+type VersionCheckResponse struct {
+	Results []VersionCheckResult `json:"results"`
+}
+
+// VersionCheck handles POST /v1/blobs:versionCheck: which of the client's
+// local versions are behind, ahead of or equal to the server's, so it can
+// plan uploads and downloads without fetching any content. Only the caller's
+// own blobs are compared; a name held by another user is missing.
+func (s *Server) VersionCheck(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	var req VersionCheckRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.Blobs) == 0 {
+		respondError(w, http.StatusBadRequest, "blobs must not be empty")
+		return
+	}
+	if len(req.Blobs) > s.config.MaxVersionCheck {
+		respondBatchTooLarge(w, s.config.MaxVersionCheck)
+		return
+	}
+
+	var names []string
+	seen := make(map[string]bool, len(req.Blobs))
+	for _, entry := range req.Blobs {
+		if entry.BlobName != "" && !seen[entry.BlobName] {
+			seen[entry.BlobName] = true
+			names = append(names, entry.BlobName)
+		}
+	}
+	versions, err := s.db.BlobVersions(userID, names)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to check blob versions", err)
+		return
+	}
+
+	resp := VersionCheckResponse{Results: make([]VersionCheckResult, len(req.Blobs))}
+	for i, entry := range req.Blobs {
+		result := &resp.Results[i]
+		result.BlobName = entry.BlobName
+		if entry.BlobName == "" {
+			result.Error = "blob name is required"
+			continue
+		}
+		version, ok := versions[entry.BlobName]
+		switch {
+		case !ok:
+			result.Status = versionMissing
+			continue
+		case version > entry.Version:
+			result.Status = versionNewer
+		case version < entry.Version:
+			result.Status = versionOlder
+		default:
+			result.Status = versionEqual
+		}
+		result.ServerVersion = version
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// BatchPutRequest is the body of POST /v1/blobs:batchPut
+type BatchPutRequest struct {
+	Blobs []BatchPutBlob `json:"blobs"`
+}
+
+// BatchPutBlob is one blob in a batchPut: the fields of an upsert plus the name
+type BatchPutBlob struct {
+	BlobName      string            `json:"blobName"`
+	EncryptedBlob models.Container  `json:"encryptedBlob"`
+	EncryptedName *models.Container `json:"encryptedName,omitempty"`
+	Collection    string            `json:"collection,omitempty"`
+	ExpiresAt     *models.Timestamp `json:"expiresAt,omitempty"`
+}
+
+// BatchPutResult is the stored state of one blob in a batchPut
+type BatchPutResult struct {
+	BlobName  string           `json:"blobName"`
+	Version   int64            `json:"version"`
+	UpdatedAt models.Timestamp `json:"updatedAt"`
+}
+
+// BatchPutResponse lists the stored blobs in request order
+type BatchPutResponse struct {
+	Blobs []BatchPutResult `json:"blobs"`
+}
+
+// BatchPut handles POST /v1/blobs:batchPut. Unlike importArchive it is all or
+// nothing: every entry is validated first, then all are upserted in one
+// transaction with the quota checked against the result, and any failure,
+// including a blob locked by another session, rolls the whole batch back.
+func (s *Server) BatchPut(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	var req BatchPutRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if len(req.Blobs) == 0 {
+		respondError(w, http.StatusBadRequest, "blobs must not be empty")
+		return
+	}
+	if len(req.Blobs) > s.config.MaxBatchPut {
+		respondBatchTooLarge(w, s.config.MaxBatchPut)
+		return
+	}
+	writer, ok := blobWriter(w, r)
+	if !ok {
+		return
+	}
+
+	seen := make(map[string]bool, len(req.Blobs))
+	for i, entry := range req.Blobs {
+		var code, problem string
+		switch {
+		case entry.BlobName == "":
+			problem = "blob name is required"
+		case seen[entry.BlobName]:
+			problem = "duplicate blob name"
+		case entry.ExpiresAt != nil && !entry.ExpiresAt.After(time.Now()):
+			problem = "expiresAt must be in the future"
+		default:
+			if err := s.validateContainer(entry.EncryptedBlob); err != nil {
+				problem = err.Error()
+			} else {
+				code, problem = s.checkBlobName(entry.BlobName, entry.EncryptedName)
+			}
+		}
+		if problem != "" {
+			respondBlobNameProblem(w, code, fmt.Sprintf("blobs[%d]: %s", i, problem))
+			return
+		}
+		seen[entry.BlobName] = true
+	}
+
+	blobs := make([]*models.Blob, len(req.Blobs))
+	for i, entry := range req.Blobs {
+		blobs[i] = &models.Blob{
+			BlobName:      entry.BlobName,
+			EncryptedBlob: entry.EncryptedBlob,
+			EncryptedName: entry.EncryptedName,
+			Collection:    s.collectionOrDefault(entry.Collection),
+			ExpiresAt:     entry.ExpiresAt,
+		}
+	}
+
+	imp, err := s.db.BeginBlobImport(userID, writer, blobs...)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to store blobs", err)
+		return
+	}
+
+	resp := BatchPutResponse{Blobs: make([]BatchPutResult, len(req.Blobs))}
+	for i, blob := range blobs {
+		if err := imp.Upsert(blob); err != nil {
+			_ = imp.Rollback()
+			switch err {
+			case db.ErrNonceReuse:
+				respondErrorCode(w, http.StatusBadRequest, "nonce_reuse", fmt.Sprintf("blobs[%d]: %s", i, nonceReuseMessage))
+			case db.ErrTooManyCollections:
+				respondErrorCode(w, http.StatusBadRequest, "too_many_tags", fmt.Sprintf("blobs[%d]: %s", i, tooManyCollectionsMessage))
+			case db.ErrBlobLocked:
+				respondErrorCode(w, http.StatusLocked, "locked", fmt.Sprintf("blobs[%d]: %s", i, blobLockedMessage))
+			default:
+				s.respondInternalError(w, r, "failed to store blobs", err)
+			}
+			return
+		}
+		resp.Blobs[i] = BatchPutResult{BlobName: blob.BlobName, Version: blob.Version, UpdatedAt: blob.UpdatedAt}
+	}
+
+	if err := imp.Commit(s.config.UserQuotaBytes); err != nil {
+		if err == db.ErrQuotaExceeded {
+			respondQuotaExceeded(w, userID)
+			return
+		}
+		s.respondInternalError(w, r, "failed to store blobs", err)
+		return
+	}
+
+	s.audit(r, auditBlobBatchPut, userID, fmt.Sprintf("%d blob(s)", len(resp.Blobs)))
+	respondJSON(w, http.StatusOK, resp)
+}
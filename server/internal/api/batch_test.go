@@ -0,0 +1,315 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+func TestBatchUpdateMeta(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	alice := createTestUser(t, database, "alice")
+	bob := createTestUser(t, database, "bob")
+	token, _ := server.jwtConfig.GenerateToken(alice.ID)
+	for _, blob := range []models.Blob{
+		{UserID: alice.ID, BlobName: "a"},
+		{UserID: alice.ID, BlobName: "b"},
+		{UserID: bob.ID, BlobName: "bobs"},
+	} {
+		blob.EncryptedBlob = models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}
+		if err := database.UpsertBlob(&blob); err != nil {
+			t.Fatalf("failed to upsert blob: %v", err)
+		}
+	}
+
+	archive := "archive"
+	w := doRequest(router, "POST", "/v1/blobs:batchUpdateMeta", token, BatchUpdateMetaRequest{Updates: []BlobMetaUpdate{
+		{BlobName: "a", Collection: &archive},
+		{BlobName: "missing", Collection: &archive},
+		{BlobName: "bobs", Collection: &archive},
+		{BlobName: "b"},
+		{BlobName: "b", Collection: &archive},
+	}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp BatchUpdateMetaResponse
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Updated != 2 || resp.Failed != 3 {
+		t.Errorf("expected 2 updated and 3 failed, got %+v", resp)
+	}
+	for i, expected := range []string{"", "blob not found", "blob not found", "nothing to update", ""} {
+		if result := resp.Results[i]; result.Error != expected || result.OK != (expected == "") {
+			t.Errorf("result %d: expected error %q, got %+v", i, expected, result)
+		}
+	}
+	if result := resp.Results[0]; result.Collection != "archive" || result.Version != 2 {
+		t.Errorf("expected a in archive at version 2, got %+v", result)
+	}
+
+	// Another user's blob is untouched
+	if blob, _ := database.GetBlob(bob.ID, "bobs"); blob.Collection != "" || blob.Version != 1 {
+		t.Errorf("expected bob's blob to be unchanged, got %+v", blob)
+	}
+	// The container is untouched
+	if blob, _ := database.GetBlob(alice.ID, "b"); blob.Collection != "archive" || blob.EncryptedBlob.Ciphertext != "c" {
+		t.Errorf("expected only b's collection to change, got %+v", blob)
+	}
+}
+
+func TestUpdateBlobMetaPinned(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	alice := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(alice.ID)
+	expiresAt := models.NewTimestamp(time.Now().Add(time.Hour))
+	w := doRequest(router, "PUT", "/v1/blobs/vault", token, UpsertBlobRequest{
+		EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+		ExpiresAt:     &expiresAt,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	pinned := true
+	w = doRequest(router, "PATCH", "/v1/blobs/vault", token, BlobMetaUpdate{Pinned: &pinned})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var result BlobMetaResult
+	_ = json.NewDecoder(w.Body).Decode(&result)
+	if !result.OK || !result.Pinned || result.Version != 2 || result.ExpiresAt == nil {
+		t.Errorf("expected vault pinned at version 2 with its expiry, got %+v", result)
+	}
+
+	w = doRequest(router, "GET", "/v1/blobs/vault", token, nil)
+	if !strings.Contains(w.Body.String(), `"pinned":true`) {
+		t.Errorf("expected GET to report pinned, got %s", w.Body.String())
+	}
+	w = doRequest(router, "GET", "/v1/blobs", token, nil)
+	if !strings.Contains(w.Body.String(), `"pinned":true`) {
+		t.Errorf("expected list to report pinned, got %s", w.Body.String())
+	}
+
+	for _, tt := range []struct {
+		name     string
+		target   string
+		body     any
+		expected int
+	}{
+		{"nothing to update", "/v1/blobs/vault", BlobMetaUpdate{}, http.StatusBadRequest},
+		{"missing blob", "/v1/blobs/missing", BlobMetaUpdate{Pinned: &pinned}, http.StatusNotFound},
+	} {
+		if w := doRequest(router, "PATCH", tt.target, token, tt.body); w.Code != tt.expected {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expected, w.Code)
+		}
+	}
+
+	readToken, _ := server.jwtConfig.GenerateScopedToken(alice.ID, middleware.ScopeRead)
+	if w := doRequest(router, "PATCH", "/v1/blobs/vault", readToken, BlobMetaUpdate{Pinned: &pinned}); w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403 for a read-only token, got %d", w.Code)
+	}
+}
+
+func TestBatchUpdateMetaLimits(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	server.config.MaxBatchUpdateMeta = 2
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	readToken, _ := server.jwtConfig.GenerateScopedToken(user.ID, middleware.ScopeRead)
+
+	updates := []BlobMetaUpdate{{BlobName: "a"}, {BlobName: "b"}, {BlobName: "c"}}
+	w := doRequest(router, "POST", "/v1/blobs:batchUpdateMeta", token, BatchUpdateMetaRequest{Updates: updates})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "batch_too_large") {
+		t.Errorf("expected 400 batch_too_large, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := doRequest(router, "POST", "/v1/blobs:batchUpdateMeta", token, BatchUpdateMetaRequest{}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an empty batch, got %d", w.Code)
+	}
+
+	if w := doRequest(router, "POST", "/v1/blobs:batchUpdateMeta", readToken, BatchUpdateMetaRequest{Updates: updates[:1]}); w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403 for a read-scoped token, got %d", w.Code)
+	}
+}
+
+func TestBatchLimitsArePerEndpoint(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	server.config.MaxBatchPut = 2
+	server.config.MaxBatchUpdateMeta = 3
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	blobs := make([]BatchPutBlob, 3)
+	updates := make([]BlobMetaUpdate, 4)
+	archive := "archive"
+	for i := range updates {
+		name := fmt.Sprintf("blob-%d", i)
+		updates[i] = BlobMetaUpdate{BlobName: name, Collection: &archive}
+		if i < len(blobs) {
+			blobs[i] = BatchPutBlob{BlobName: name, EncryptedBlob: models.Container{Nonce: fmt.Sprintf("n%d", i), Ciphertext: "c", Tag: "t"}}
+		}
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		body     any
+		expected int
+		limit    string
+	}{
+		{"batchPut over its cap", "/v1/blobs:batchPut", BatchPutRequest{Blobs: blobs}, http.StatusBadRequest, "more than 2 entries"},
+		{"batchPut at its cap", "/v1/blobs:batchPut", BatchPutRequest{Blobs: blobs[:2]}, http.StatusOK, ""},
+		{"batchUpdateMeta over its cap", "/v1/blobs:batchUpdateMeta", BatchUpdateMetaRequest{Updates: updates}, http.StatusBadRequest, "more than 3 entries"},
+		{"batchUpdateMeta above the batchPut cap", "/v1/blobs:batchUpdateMeta", BatchUpdateMetaRequest{Updates: updates[:3]}, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		w := doRequest(router, "POST", tt.target, token, tt.body)
+		if w.Code != tt.expected {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.name, tt.expected, w.Code, w.Body.String())
+			continue
+		}
+		if tt.limit != "" && (!strings.Contains(w.Body.String(), "batch_too_large") || !strings.Contains(w.Body.String(), tt.limit)) {
+			t.Errorf("%s: expected batch_too_large naming the limit, got %s", tt.name, w.Body.String())
+		}
+	}
+}
+
+func TestBatchPut(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "index", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "old", Tag: "t"}})
+
+	container := models.Container{Nonce: "bm9uY2Ux", Ciphertext: "b25l", Tag: "dGFn"}
+	w := doRequest(router, "POST", "/v1/blobs:batchPut", token, BatchPutRequest{Blobs: []BatchPutBlob{
+		{BlobName: "index", EncryptedBlob: container},
+		{BlobName: "entry-1", EncryptedBlob: container, Collection: "entries"},
+	}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp BatchPutResponse
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Blobs) != 2 || resp.Blobs[0].BlobName != "index" || resp.Blobs[0].Version != 2 || resp.Blobs[1].Version != 1 {
+		t.Errorf("expected index at version 2 and entry-1 at version 1, got %+v", resp.Blobs)
+	}
+	if blob, err := database.GetBlob(user.ID, "entry-1"); err != nil || blob.Collection != "entries" {
+		t.Errorf("expected entry-1 in entries, got %+v, %v", blob, err)
+	}
+}
+
+func TestBatchPutAllOrNothing(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	server.config.UserQuotaBytes = 10
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	container := models.Container{Nonce: "bm9uY2Ux", Ciphertext: "b25l", Tag: "dGFn"}
+	tests := []struct {
+		name     string
+		blobs    []BatchPutBlob
+		expected int
+	}{
+		{"invalid entry", []BatchPutBlob{{BlobName: "a", EncryptedBlob: container}, {BlobName: "b", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t", Alg: "ROT13"}}}, http.StatusBadRequest},
+		{"duplicate name", []BatchPutBlob{{BlobName: "a", EncryptedBlob: container}, {BlobName: "a", EncryptedBlob: container}}, http.StatusBadRequest},
+		{"over quota together", []BatchPutBlob{{BlobName: "a", EncryptedBlob: container}, {BlobName: "b", EncryptedBlob: container}, {BlobName: "c", EncryptedBlob: container}}, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(router, "POST", "/v1/blobs:batchPut", token, BatchPutRequest{Blobs: tt.blobs})
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d, got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+			if blobs, _ := database.ListBlobs(user.ID, db.BlobFilter{}); len(blobs) != 0 {
+				t.Errorf("expected nothing to be stored, got %d blobs", len(blobs))
+			}
+		})
+	}
+}
+
+func TestVersionCheck(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	server.config.MaxVersionCheck = 6
+	router := server.NewRouter()
+
+	alice := createTestUser(t, database, "alice")
+	bob := createTestUser(t, database, "bob")
+	container := models.Container{Nonce: "bm9uY2U=", Ciphertext: "c2VjcmV0", Tag: "dGFn"}
+	for _, name := range []string{"ahead", "behind", "same", "same"} {
+		if err := database.UpsertBlob(&models.Blob{UserID: alice.ID, BlobName: name, EncryptedBlob: container}); err != nil {
+			t.Fatalf("failed to upsert blob: %v", err)
+		}
+	}
+	_ = database.UpsertBlob(&models.Blob{UserID: alice.ID, BlobName: "ahead", EncryptedBlob: container})
+	_ = database.UpsertBlob(&models.Blob{UserID: alice.ID, BlobName: "ahead", EncryptedBlob: container})
+	_ = database.UpsertBlob(&models.Blob{UserID: bob.ID, BlobName: "bobs", EncryptedBlob: container})
+
+	// Read-scoped tokens may check, as it writes nothing
+	token, _ := server.jwtConfig.GenerateScopedToken(alice.ID, middleware.ScopeRead)
+	w := doRequest(router, "POST", "/v1/blobs:versionCheck", token, VersionCheckRequest{Blobs: []VersionCheckEntry{
+		{BlobName: "ahead", Version: 1},
+		{BlobName: "behind", Version: 4},
+		{BlobName: "same", Version: 2},
+		{BlobName: "gone", Version: 1},
+		{BlobName: "bobs", Version: 1},
+		{Version: 1},
+	}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp VersionCheckResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	expected := []VersionCheckResult{
+		{BlobName: "ahead", Status: "newer", ServerVersion: 3},
+		{BlobName: "behind", Status: "older", ServerVersion: 1},
+		{BlobName: "same", Status: "equal", ServerVersion: 2},
+		{BlobName: "gone", Status: "missing"},
+		{BlobName: "bobs", Status: "missing"},
+		{Error: "blob name is required"},
+	}
+	if len(resp.Results) != len(expected) {
+		t.Fatalf("expected %d results, got %+v", len(expected), resp.Results)
+	}
+	for i, want := range expected {
+		if resp.Results[i] != want {
+			t.Errorf("entry %d: expected %+v, got %+v", i, want, resp.Results[i])
+		}
+	}
+
+	tooMany := make([]VersionCheckEntry, 7)
+	if w := doRequest(router, "POST", "/v1/blobs:versionCheck", token, VersionCheckRequest{Blobs: tooMany}); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "batch_too_large") {
+		t.Errorf("expected 400 batch_too_large, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "POST", "/v1/blobs:versionCheck", token, VersionCheckRequest{}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an empty batch, got %d", w.Code)
+	}
+}
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/crypto"
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// Config holds tunable server behavior
+type Config struct {
+	// DefaultKDF is assigned at registration when the client omits KDF params
+	DefaultKDF models.KDFParams
+	// AllowedKDFTypes are the KDF types accounts may register or switch to.
+	// Existing accounts on another type can still log in and are asked to upgrade.
+	AllowedKDFTypes []models.KDFType
+	// MaxKDFDuration rejects registrations and KDF switches whose params are
+	// projected to take longer than this to derive on the server's hardware; 0 disables it
+	MaxKDFDuration time.Duration
+
+	// AdminToken is the static bearer token for /v1/admin routes; empty disables them
+	AdminToken string
+
+	// UsernameChangeCooldown is the minimum time between username changes; 0 disables it
+	UsernameChangeCooldown time.Duration
+
+	// VerifierHashAlg hashes login verifiers for new registrations and password changes
+	VerifierHashAlg models.VerifierHashAlg
+
+	// AllowedAlgs lists the container algorithms clients may use; each must be in crypto.AEADAlgorithms
+	AllowedAlgs []string
+
+	// EncryptedNames requires every blob write to name the blob by an HMAC name
+	// token and carry the real name encrypted, so the server never stores
+	// plaintext names. Names can then only be looked up by exact token.
+	EncryptedNames bool
+
+	// DefaultCollection is assigned to blobs written without a collection;
+	// empty keeps them in the unnamed collection
+	DefaultCollection string
+
+	// UserQuotaBytes caps each user's stored ciphertext bytes; 0 disables the quota
+	UserQuotaBytes int64
+
+	// RequireInvite makes registration consume a single-use invite minted via /v1/admin/invites
+	RequireInvite bool
+	// DisableRegistration closes self-registration; accounts are then only
+	// created by admins via POST /v1/admin/users
+	DisableRegistration bool
+
+	// KeyEscrow lets users deposit their account key wrapped to an organization
+	// recovery key, which admins can fetch. Whoever holds that key can then
+	// decrypt escrowed accounts, so this is opt-in per deployment.
+	KeyEscrow bool
+
+	// RequireCurrentVerifier makes credential changes via PATCH /v1/users/me
+	// re-prove the current password, so a stolen token cannot lock the owner out
+	RequireCurrentVerifier bool
+
+	// ReadOnly starts the server in maintenance mode, rejecting mutating requests
+	ReadOnly bool
+
+	// MaxImportEntries caps the number of entries in one archive import
+	MaxImportEntries int
+	// MaxImportBytes caps the size of one archive import request body
+	MaxImportBytes int64
+	// MaxBatchPut caps the number of blobs in one :batchPut, which re-checks
+	// the quota and writes every container
+	MaxBatchPut int
+	// MaxBatchUpdateMeta caps the number of updates in one :batchUpdateMeta;
+	// metadata writes are cheap, so it can be much higher
+	MaxBatchUpdateMeta int
+	// MaxVersionCheck caps the number of entries in one :versionCheck, which
+	// only reads metadata; it is looked up in one query, so it cannot exceed
+	// db.MaxBlobVersionsNames
+	MaxVersionCheck int
+	// MaxJSONBytes caps the size of JSON request bodies, which are read whole
+	// before decoding; 0 disables it. Blob containers travel in these bodies,
+	// so it also bounds the largest blob and batch that can be written.
+	MaxJSONBytes int64
+	// MaxJSONDepth caps the nesting depth of JSON request bodies; 0 disables it
+	MaxJSONDepth int
+	// MaxJSONTokens caps the number of tokens in a JSON request body; 0 disables it
+	MaxJSONTokens int
+
+	// GzipResponses compresses JSON responses under /v1 for clients that accept gzip
+	GzipResponses bool
+	// GzipMinBytes is the smallest response body that is compressed
+	GzipMinBytes int
+
+	// ProblemDetails answers every error under /v1 as an RFC 9457
+	// application/problem+json document. Without it, only clients that list
+	// that type in Accept get one, and the rest get {"error"}.
+	ProblemDetails bool
+
+	// KDFTiming records the duration of server-side verifier hashes in metrics
+	KDFTiming bool
+	// KDFTimingLogThreshold logs timed hashes slower than this; 0 disables logging
+	KDFTimingLogThreshold time.Duration
+
+	// MaxConcurrentUploads caps blob PUTs and archive imports running at once; 0 disables the cap
+	MaxConcurrentUploads int
+	// MaxConcurrentKDF caps requests that run the server-side verifier hash at once; 0 disables the cap
+	MaxConcurrentKDF int
+	// UsernameCheckRate caps GET /v1/auth/username-available per client IP per minute; 0 disables the cap
+	UsernameCheckRate int
+	// BlobWriteRate caps blob write requests per user per minute; 0 disables the cap
+	BlobWriteRate int
+	// BlobWriteBurst is how many blob writes a user may make at once before
+	// BlobWriteRate applies; 0 uses BlobWriteRate
+	BlobWriteBurst int
+
+	// BackupDir receives database backups; empty disables POST /v1/admin/backup
+	BackupDir string
+	// BackupRetention is how many backups to keep in BackupDir; 0 keeps all
+	BackupRetention int
+
+	// TrustedProxies are the peers whose X-Forwarded-For is believed when
+	// determining the client IP; empty ignores forwarding headers entirely
+	TrustedProxies []netip.Prefix
+	// RequireHTTPS rejects plaintext requests with 426; behind a TLS-terminating
+	// proxy it relies on X-Forwarded-Proto from TrustedProxies
+	RequireHTTPS bool
+	// HTTPSRedirect answers plaintext GET and HEAD with a 308 to https:// under RequireHTTPS
+	HTTPSRedirect bool
+
+	// AuditLog records auth and blob events in the audit_events table
+	AuditLog bool
+	// LogSampleRate logs 1 in this many successful requests; errors and
+	// /v1/auth/ requests are always logged. 1 logs every request.
+	LogSampleRate int
+	// DebugErrors includes the underlying error in 500 responses. Off in
+	// production, where clients only get a message and the request ID.
+	DebugErrors bool
+
+	// SecurityHeaders are the hardening headers set on every response
+	SecurityHeaders middleware.SecurityHeaderOptions
+}
+
+// DefaultConfig returns the configuration used by NewServer
+func DefaultConfig() Config {
+	memKiB := 65536
+	parallelism := 4
+	return Config{
+		DefaultKDF: models.KDFParams{
+			Type:        models.KDFTypeArgon2id,
+			Iterations:  3,
+			MemoryKiB:   &memKiB,
+			Parallelism: &parallelism,
+		},
+		AllowedKDFTypes:        []models.KDFType{models.KDFTypePBKDF2SHA256, models.KDFTypeArgon2id},
+		UsernameChangeCooldown: 24 * time.Hour,
+		VerifierHashAlg:        crypto.DefaultVerifierHashAlg,
+		AllowedAlgs:            []string{"A256GCM", "XC20P"},
+		MaxImportEntries:       1000,
+		MaxImportBytes:         64 << 20,
+		MaxBatchPut:            100,
+		MaxBatchUpdateMeta:     1000,
+		MaxVersionCheck:        1000,
+		MaxJSONBytes:           64 << 20,
+		MaxJSONDepth:           32,
+		MaxJSONTokens:          1_000_000,
+		KDFTimingLogThreshold:  250 * time.Millisecond,
+		GzipMinBytes:           1024,
+		AuditLog:               true,
+		LogSampleRate:          1,
+		UsernameCheckRate:      10,
+		SecurityHeaders:        middleware.DefaultSecurityHeaderOptions(),
+	}
+}
+
+// Validate checks the configuration so a misconfigured server fails fast at startup
+func (c Config) Validate() error {
+	if err := crypto.ValidateKDFParams(c.DefaultKDF); err != nil {
+		return fmt.Errorf("invalid default KDF: %w", err)
+	}
+	if len(c.AllowedKDFTypes) == 0 {
+		return fmt.Errorf("at least one KDF type must be allowed")
+	}
+	for _, kdfType := range c.AllowedKDFTypes {
+		if kdfType != models.KDFTypePBKDF2SHA256 && kdfType != models.KDFTypeArgon2id {
+			return fmt.Errorf("unknown KDF type %q", kdfType)
+		}
+	}
+	if !slices.Contains(c.AllowedKDFTypes, c.DefaultKDF.Type) {
+		return fmt.Errorf("default KDF type %q is not an allowed KDF type", c.DefaultKDF.Type)
+	}
+	if err := crypto.ValidateVerifierHashAlg(c.VerifierHashAlg); err != nil {
+		return err
+	}
+	for _, alg := range c.AllowedAlgs {
+		if _, ok := crypto.AEADAlgorithms[alg]; !ok {
+			return fmt.Errorf("unknown container algorithm %q", alg)
+		}
+	}
+	if c.RequireInvite && c.AdminToken == "" {
+		return fmt.Errorf("invite-only registration needs an admin token to mint invites")
+	}
+	if c.DisableRegistration && c.AdminToken == "" {
+		return fmt.Errorf("disabling registration needs an admin token to create accounts")
+	}
+	if c.KeyEscrow && c.AdminToken == "" {
+		return fmt.Errorf("key escrow needs an admin token to retrieve escrows")
+	}
+	if c.HTTPSRedirect && !c.RequireHTTPS {
+		return fmt.Errorf("HTTPS redirect needs HTTPS to be required")
+	}
+	if c.UserQuotaBytes < 0 {
+		return fmt.Errorf("user quota must not be negative")
+	}
+	if c.MaxImportEntries <= 0 || c.MaxImportBytes <= 0 {
+		return fmt.Errorf("import limits must be positive")
+	}
+	if c.MaxBatchPut <= 0 || c.MaxBatchUpdateMeta <= 0 || c.MaxVersionCheck <= 0 {
+		return fmt.Errorf("batch size limits must be positive")
+	}
+	if c.MaxVersionCheck > db.MaxBlobVersionsNames {
+		return fmt.Errorf("version check limit must be at most %d", db.MaxBlobVersionsNames)
+	}
+	if c.MaxJSONBytes < 0 || c.MaxJSONDepth < 0 || c.MaxJSONTokens < 0 {
+		return fmt.Errorf("JSON complexity limits must not be negative")
+	}
+	if c.LogSampleRate < 1 {
+		return fmt.Errorf("log sample rate must be at least 1")
+	}
+	if c.GzipMinBytes < 0 {
+		return fmt.Errorf("gzip minimum size must not be negative")
+	}
+	if c.MaxKDFDuration < 0 {
+		return fmt.Errorf("KDF duration budget must not be negative")
+	}
+	if c.KDFTimingLogThreshold < 0 {
+		return fmt.Errorf("KDF timing log threshold must not be negative")
+	}
+	if c.MaxConcurrentUploads < 0 || c.MaxConcurrentKDF < 0 {
+		return fmt.Errorf("concurrency limits must not be negative")
+	}
+	if c.UsernameCheckRate < 0 || c.BlobWriteRate < 0 || c.BlobWriteBurst < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	if c.SecurityHeaders.HSTSMaxAge < 0 {
+		return fmt.Errorf("HSTS max age must not be negative")
+	}
+	if c.BackupRetention < 0 {
+		return fmt.Errorf("backup retention must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("default config should be valid: %v", err)
+	}
+}
+
+func TestConfigValidateRejectsWeakDefaultKDF(t *testing.T) {
+	config := DefaultConfig()
+	config.DefaultKDF = models.KDFParams{
+		Type:       models.KDFTypePBKDF2SHA256,
+		Iterations: 1000,
+	}
+
+	if err := config.Validate(); err == nil {
+		t.Error("expected error for default KDF below minimum")
+	}
+}
+
+func TestConfigValidateRejectsUnknownVerifierHash(t *testing.T) {
+	config := DefaultConfig()
+	config.VerifierHashAlg = "md5"
+
+	if err := config.Validate(); err == nil {
+		t.Error("expected error for unknown verifier hash algorithm")
+	}
+}
+
+func TestConfigValidateRejectsUnknownAlg(t *testing.T) {
+	config := DefaultConfig()
+	config.AllowedAlgs = []string{"A256GCM", "ROT13"}
+
+	if err := config.Validate(); err == nil {
+		t.Error("expected error for algorithm missing from the registry")
+	}
+}
+
+func TestConfigValidateRequireInviteNeedsAdminToken(t *testing.T) {
+	config := DefaultConfig()
+	config.RequireInvite = true
+
+	if err := config.Validate(); err == nil {
+		t.Error("expected error for invite-only registration without an admin token")
+	}
+
+	config.AdminToken = "secret"
+	if err := config.Validate(); err != nil {
+		t.Errorf("expected invite-only config with admin token to be valid: %v", err)
+	}
+}
+
+func TestConfigValidateHTTPSRedirectNeedsRequireHTTPS(t *testing.T) {
+	config := DefaultConfig()
+	config.HTTPSRedirect = true
+
+	if err := config.Validate(); err == nil {
+		t.Error("expected error for an HTTPS redirect without requiring HTTPS")
+	}
+
+	config.RequireHTTPS = true
+	if err := config.Validate(); err != nil {
+		t.Errorf("expected HTTPS redirect with required HTTPS to be valid: %v", err)
+	}
+}
+
+func TestConfigValidateKeyEscrowNeedsAdminToken(t *testing.T) {
+	config := DefaultConfig()
+	config.KeyEscrow = true
+
+	if err := config.Validate(); err == nil {
+		t.Error("expected error for key escrow without an admin token")
+	}
+
+	config.AdminToken = "secret"
+	if err := config.Validate(); err != nil {
+		t.Errorf("expected key escrow config with admin token to be valid: %v", err)
+	}
+}
+
+func TestConfigValidateAllowedKDFTypes(t *testing.T) {
+	config := DefaultConfig()
+	config.AllowedKDFTypes = []models.KDFType{models.KDFTypeArgon2id}
+	if err := config.Validate(); err != nil {
+		t.Errorf("expected an argon2id-only config to be valid: %v", err)
+	}
+
+	config.AllowedKDFTypes = []models.KDFType{models.KDFTypePBKDF2SHA256}
+	if err := config.Validate(); err == nil {
+		t.Error("expected error when the default KDF type is not allowed")
+	}
+
+	config.AllowedKDFTypes = []models.KDFType{models.KDFTypeArgon2id, "scrypt"}
+	if err := config.Validate(); err == nil {
+		t.Error("expected error for an unknown KDF type")
+	}
+}
+
+func TestConfigValidateLogSampleRate(t *testing.T) {
+	config := DefaultConfig()
+	config.LogSampleRate = 0
+
+	if err := config.Validate(); err == nil {
+		t.Error("expected error for a log sample rate below 1")
+	}
+}
+
+func TestConfigValidateMaxVersionCheck(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxVersionCheck = db.MaxBlobVersionsNames + 1
+
+	if err := config.Validate(); err == nil {
+		t.Error("expected error for a version check limit above what one query can bind")
+	}
+
+	config.MaxVersionCheck = db.MaxBlobVersionsNames
+	if err := config.Validate(); err != nil {
+		t.Errorf("expected the largest bindable version check limit to be valid: %v", err)
+	}
+}
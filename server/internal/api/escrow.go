@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// PutKeyEscrowRequest carries the account key wrapped to the organization
+// recovery key. The wrapping scheme is the client's; the server only stores it.
+type PutKeyEscrowRequest struct {
+	EscrowedAccountKey models.Container `json:"escrowedAccountKey"`
+}
+
+// PutKeyEscrow handles PUT /v1/users/me/escrow, available with
+// Config.KeyEscrow. It stores or replaces the caller's escrow; the
+// password-wrapped account key is left untouched.
+func (s *Server) PutKeyEscrow(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	var req PutKeyEscrowRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	if req.EscrowedAccountKey.Ciphertext == "" {
+		respondError(w, http.StatusBadRequest, "escrowedAccountKey is required")
+		return
+	}
+	if err := s.validateContainer(req.EscrowedAccountKey); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	escrow, err := s.db.PutKeyEscrow(userID, req.EscrowedAccountKey)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to store key escrow", err)
+		return
+	}
+	s.audit(r, auditEscrowStored, userID, "")
+
+	respondJSON(w, http.StatusOK, escrow)
+}
+
+// GetUserKeyEscrow handles GET /v1/admin/users/{userID}/escrow, available
+// with Config.KeyEscrow. The escrow is returned as stored: only the holder of
+// the organization recovery key can unwrap it.
+func (s *Server) GetUserKeyEscrow(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil || userID <= 0 {
+		respondError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	escrow, err := s.db.GetKeyEscrow(userID)
+	if err != nil {
+		switch err {
+		case db.ErrUserNotFound:
+			respondError(w, http.StatusNotFound, "user not found")
+		case db.ErrEscrowNotFound:
+			respondError(w, http.StatusNotFound, "user has no key escrow")
+		default:
+			s.respondInternalError(w, r, "failed to get key escrow", err)
+		}
+		return
+	}
+	s.audit(r, auditEscrowRetrieved, userID, "")
+
+	respondJSON(w, http.StatusOK, escrow)
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+func TestKeyEscrow(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+	config := DefaultConfig()
+	config.AdminToken = testAdminToken
+	config.KeyEscrow = true
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	escrowTarget := "/v1/admin/users/" + strconv.FormatInt(user.ID, 10) + "/escrow"
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", escrowTarget))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 before any escrow, got %d", w.Code)
+	}
+
+	if w := doRequest(router, "PUT", "/v1/users/me/escrow", token, PutKeyEscrowRequest{}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an empty container, got %d", w.Code)
+	}
+
+	escrowed := models.Container{Nonce: "ZXNjcm93", Ciphertext: "d3JhcHBlZA==", Tag: "dGFn"}
+	if w := doRequest(router, "PUT", "/v1/users/me/escrow", token, PutKeyEscrowRequest{EscrowedAccountKey: escrowed}); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Admins get the escrow back exactly as uploaded, and the normal key is unchanged
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", escrowTarget))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var escrow models.KeyEscrow
+	_ = json.NewDecoder(w.Body).Decode(&escrow)
+	if escrow.UserID != user.ID || escrow.EscrowedAccountKey != escrowed || escrow.UpdatedAt.IsZero() {
+		t.Errorf("unexpected escrow %+v", escrow)
+	}
+	if stored, _ := database.GetUserByID(user.ID); stored.WrappedAccountKey == escrowed {
+		t.Error("expected the escrow to be stored apart from the wrapped account key")
+	}
+
+	// User tokens cannot read escrows
+	w = doRequest(router, "GET", escrowTarget, token, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a user token, got %d", w.Code)
+	}
+
+	for target, expected := range map[string]int{
+		"/v1/admin/users/999/escrow": http.StatusNotFound,
+		"/v1/admin/users/abc/escrow": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, adminRequest("GET", target))
+		if w.Code != expected {
+			t.Errorf("%s: expected status %d, got %d", target, expected, w.Code)
+		}
+	}
+
+	// Rotating the account key drops the escrow of the old one
+	rotate := RotateKeyRequest{WrappedAccountKey: models.Container{Nonce: "bmV3", Ciphertext: "a2V5", Tag: "dGFn"}}
+	if w := doRequest(router, "POST", "/v1/users/me/rotate-key", token, rotate); w.Code != http.StatusOK {
+		t.Fatalf("expected rotation to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", escrowTarget))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 after rotation, got %d", w.Code)
+	}
+}
+
+func TestKeyEscrowDisabledByDefault(t *testing.T) {
+	server, database := setupAdminTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	body := PutKeyEscrowRequest{EscrowedAccountKey: models.Container{Nonce: "bg==", Ciphertext: "Yw==", Tag: "dA=="}}
+	if w := doRequest(router, "PUT", "/v1/users/me/escrow", token, body); w.Code != http.StatusNotFound && w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected the escrow route to be absent, got %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, adminRequest("GET", "/v1/admin/users/1/escrow"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected the admin escrow route to be absent, got %d", w.Code)
+	}
+}
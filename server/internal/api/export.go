@@ -0,0 +1,127 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// exportManifestName is the archive entry that describes an export.
+// ImportArchive skips it, so an export can be imported as is.
+const exportManifestName = "manifest.json"
+
+// ExportEntry is the JSON document stored per blob in an export archive.
+// It is an ImportEntry plus the server-side state that imports do not restore.
+type ExportEntry struct {
+	ImportEntry
+	Version   int64            `json:"version"`
+	UpdatedAt models.Timestamp `json:"updatedAt"`
+}
+
+// ExportManifestBlob lists one exported blob
+type ExportManifestBlob struct {
+	Entry    string `json:"entry"`
+	BlobName string `json:"blobName"`
+	Version  int64  `json:"version"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// ExportManifest is the last entry of an export archive. It carries the
+// wrapped account key, without which none of the blobs can be decrypted.
+type ExportManifest struct {
+	Username          string               `json:"username"`
+	WrappedAccountKey models.Container     `json:"wrappedAccountKey"`
+	Rev               int64                `json:"rev"`
+	ExportedAt        models.Timestamp     `json:"exportedAt"`
+	Blobs             []ExportManifestBlob `json:"blobs"`
+}
+
+// ExportArchive handles GET /v1/export.zip.
+// Each unexpired blob becomes a {id}.json ExportEntry, followed by the
+// manifest. Entries are written and flushed one at a time as they are read
+// from the database, so only the manifest's small per-blob listing is held in
+// memory. The manifest is written last so it lists exactly what the archive holds.
+func (s *Server) ExportArchive(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r.Context())
+	if user == nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="cryptd-export.zip"`)
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	zw := zip.NewWriter(w)
+	writeEntry := func(name string, modified time.Time, v interface{}) error {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		if err := json.NewEncoder(f).Encode(v); err != nil {
+			return err
+		}
+		if err := zw.Flush(); err != nil {
+			return err
+		}
+		// Flushing is best effort; a writer that cannot flush still gets the whole body
+		_ = rc.Flush()
+		return nil
+	}
+
+	manifest := ExportManifest{
+		Username:          user.Username,
+		WrappedAccountKey: user.WrappedAccountKey,
+		Rev:               user.Rev,
+		ExportedAt:        models.NewTimestamp(time.Now()),
+		Blobs:             []ExportManifestBlob{},
+	}
+	err := s.db.EachBlob(user.ID, func(blob *models.Blob) error {
+		name := strconv.FormatInt(blob.ID, 10) + ".json"
+		createdAt := blob.CreatedAt
+		entry := ExportEntry{
+			ImportEntry: ImportEntry{
+				BlobName:      blob.BlobName,
+				EncryptedBlob: blob.EncryptedBlob,
+				EncryptedName: blob.EncryptedName,
+				Collection:    blob.Collection,
+				ExpiresAt:     blob.ExpiresAt,
+				CreatedAt:     &createdAt,
+				Pinned:        blob.Pinned,
+			},
+			Version:   blob.Version,
+			UpdatedAt: blob.UpdatedAt,
+		}
+		if err := writeEntry(name, blob.UpdatedAt.Time, entry); err != nil {
+			return err
+		}
+		manifest.Blobs = append(manifest.Blobs, ExportManifestBlob{
+			Entry:    name,
+			BlobName: blob.BlobName,
+			Version:  blob.Version,
+			Checksum: blob.Checksum,
+		})
+		return nil
+	})
+	if err == nil {
+		err = writeEntry(exportManifestName, manifest.ExportedAt.Time, manifest)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// The status is already sent; a zip without its central directory is
+		// rejected by readers, so the client cannot mistake it for a full export
+		log.Printf("Export stopped early: %v", err)
+		return
+	}
+
+	s.audit(r, auditBlobExported, user.ID, fmt.Sprintf("%d blob(s)", len(manifest.Blobs)))
+}
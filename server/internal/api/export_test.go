@@ -0,0 +1,111 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+func TestExportArchive(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	names := map[string]string{"vault": "Y2lwaGVy", "notes": "bm90ZXM=", "photos": "cGhvdG9z"}
+	for name, ciphertext := range names {
+		if err := database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: name, EncryptedBlob: models.Container{Nonce: "n-" + name, Ciphertext: ciphertext, Tag: "t"}}); err != nil {
+			t.Fatalf("failed to store blob: %v", err)
+		}
+	}
+	past := models.NewTimestamp(time.Now().Add(-time.Hour))
+	_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "gone", EncryptedBlob: models.Container{Nonce: "n-gone", Ciphertext: "Z29uZQ==", Tag: "t"}, ExpiresAt: &past})
+
+	// A pinned blob is exported, past expiry and all
+	names["kept"] = "a2VwdA=="
+	_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "kept", EncryptedBlob: models.Container{Nonce: "n-kept", Ciphertext: names["kept"], Tag: "t"}})
+	pinned := true
+	if _, err := database.UpdateBlobsMeta(user.ID, []db.BlobMetaUpdate{{BlobName: "kept", ExpiresAt: &past, Pinned: &pinned}}, db.Writer{}); err != nil {
+		t.Fatalf("failed to pin blob: %v", err)
+	}
+
+	w := doRequest(server.NewRouter(), "GET", "/v1/export.zip", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Errorf("expected application/zip, got %q", ct)
+	}
+	archive := w.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+
+	entries := map[string]ExportEntry{}
+	var manifest *ExportManifest
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", f.Name, err)
+		}
+		if f.Name == exportManifestName {
+			manifest = &ExportManifest{}
+			err = json.NewDecoder(rc).Decode(manifest)
+		} else {
+			var entry ExportEntry
+			err = json.NewDecoder(rc).Decode(&entry)
+			entries[f.Name] = entry
+		}
+		_ = rc.Close()
+		if err != nil {
+			t.Fatalf("failed to decode %s: %v", f.Name, err)
+		}
+	}
+
+	if len(entries) != len(names) {
+		t.Fatalf("expected %d blob entries, got %d", len(names), len(entries))
+	}
+	for _, entry := range entries {
+		if entry.EncryptedBlob.Ciphertext != names[entry.BlobName] || entry.CreatedAt == nil || entry.Pinned != (entry.BlobName == "kept") {
+			t.Errorf("unexpected entry %+v", entry)
+		}
+	}
+
+	if manifest == nil {
+		t.Fatal("expected a manifest entry")
+	}
+	if manifest.Username != "alice" || manifest.WrappedAccountKey != user.WrappedAccountKey {
+		t.Errorf("manifest does not carry the account key: %+v", manifest)
+	}
+	if len(manifest.Blobs) != len(names) {
+		t.Fatalf("expected %d manifest blobs, got %d", len(names), len(manifest.Blobs))
+	}
+	for _, listed := range manifest.Blobs {
+		if entries[listed.Entry].BlobName != listed.BlobName || listed.Checksum == "" {
+			t.Errorf("manifest entry %+v does not match the archive", listed)
+		}
+	}
+
+	// The archive imports as is into another account; the manifest is skipped
+	bob := createTestUser(t, database, "bob")
+	bobToken, _ := server.jwtConfig.GenerateToken(bob.ID)
+	w = importArchive(server, bobToken, archive)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected import status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp ImportArchiveResponse
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Imported != len(names) || resp.Failed != 0 {
+		t.Errorf("expected %d imported and none failed, got %+v", len(names), resp)
+	}
+	if kept, err := database.GetBlob(bob.ID, "kept"); err != nil || !kept.Pinned {
+		t.Errorf("expected the pinned blob to import pinned, got %+v, %v", kept, err)
+	}
+}
@@ -1,12 +1,29 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand/v2"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	chimw "github.com/go-chi/chi/v5/middleware"
 	"github.com/shalteor/cryptd-poc/server/internal/crypto"
 	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
 	"github.com/shalteor/cryptd-poc/server/internal/middleware"
 	"github.com/shalteor/cryptd-poc/server/internal/models"
 )
@@ -15,14 +32,97 @@ import (
 type Server struct {
 	db        *db.DB
 	jwtConfig *middleware.JWTConfig
+	config    Config
+	startedAt time.Time
+
+	// readOnly rejects mutating requests during maintenance; toggled at runtime by admins
+	readOnly atomic.Bool
+	// sessionUse spares requireAccount a write per request
+	sessionUse sessionActivity
 }
 
-// NewServer creates a new API server
+// NewServer creates a new API server with the default configuration
 func NewServer(database *db.DB, jwtSecret string) *Server {
-	return &Server{
+	return NewServerWithConfig(database, jwtSecret, DefaultConfig())
+}
+
+// NewServerWithConfig creates a new API server with the given configuration
+func NewServerWithConfig(database *db.DB, jwtSecret string, config Config) *Server {
+	s := &Server{
 		db:        database,
 		jwtConfig: middleware.NewJWTConfig(jwtSecret),
+		config:    config,
+		startedAt: time.Now(),
 	}
+	s.readOnly.Store(config.ReadOnly)
+	return s
+}
+
+// CapabilitiesResponse describes server-side settings clients may adapt to
+type CapabilitiesResponse struct {
+	KDFTypes   []models.KDFType `json:"kdfTypes"`
+	DefaultKDF models.KDFParams `json:"defaultKdf"`
+	Algs       []string         `json:"algs"`
+	// UsernameCaseInsensitive tells clients to lowercase the username before
+	// using it as KDF salt and in the account-key AAD
+	UsernameCaseInsensitive bool `json:"usernameCaseInsensitive"`
+	// RegistrationDisabled means accounts are only created by admins
+	RegistrationDisabled bool `json:"registrationDisabled"`
+	// EncryptedNames means every blob write must use a name token and carry
+	// the encrypted name
+	EncryptedNames bool `json:"encryptedNames"`
+	// DefaultCollection is the collection of blobs written without one
+	DefaultCollection string `json:"defaultCollection"`
+	Limits            Limits `json:"limits"`
+}
+
+// Limits are the enforced limits clients can pre-validate against and display.
+// A zero value means the limit is disabled.
+type Limits struct {
+	UserQuotaBytes                int64 `json:"userQuotaBytes"`
+	MaxImportEntries              int   `json:"maxImportEntries"`
+	MaxImportBytes                int64 `json:"maxImportBytes"`
+	MaxBatchPut                   int   `json:"maxBatchPut"`
+	MaxBatchUpdateMeta            int   `json:"maxBatchUpdateMeta"`
+	MaxVersionCheck               int   `json:"maxVersionCheck"`
+	MaxConcurrentUploads          int   `json:"maxConcurrentUploads"`
+	MaxConcurrentKDF              int   `json:"maxConcurrentKdf"`
+	UsernameChangeCooldownSeconds int64 `json:"usernameChangeCooldownSeconds"`
+	TokenTTLSeconds               int64 `json:"tokenTtlSeconds"`
+	MaxSignedURLSeconds           int64 `json:"maxSignedUrlSeconds"`
+	MaxSessionLabelLength         int   `json:"maxSessionLabelLength"`
+
+	// Deprecated: MaxBatchSize is the largest batch both batch endpoints
+	// accept, for clients from before MaxBatchPut and MaxBatchUpdateMeta
+	MaxBatchSize int `json:"maxBatchSize"`
+}
+
+// GetCapabilities handles GET /v1/capabilities
+func (s *Server) GetCapabilities(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, CapabilitiesResponse{
+		KDFTypes:                s.config.AllowedKDFTypes,
+		DefaultKDF:              s.config.DefaultKDF,
+		Algs:                    s.config.AllowedAlgs,
+		UsernameCaseInsensitive: s.db.CaseInsensitiveUsernames(),
+		RegistrationDisabled:    s.config.DisableRegistration,
+		EncryptedNames:          s.config.EncryptedNames,
+		DefaultCollection:       s.config.DefaultCollection,
+		Limits: Limits{
+			UserQuotaBytes:                s.config.UserQuotaBytes,
+			MaxImportEntries:              s.config.MaxImportEntries,
+			MaxImportBytes:                s.config.MaxImportBytes,
+			MaxBatchPut:                   s.config.MaxBatchPut,
+			MaxBatchUpdateMeta:            s.config.MaxBatchUpdateMeta,
+			MaxBatchSize:                  min(s.config.MaxBatchPut, s.config.MaxBatchUpdateMeta),
+			MaxVersionCheck:               s.config.MaxVersionCheck,
+			MaxConcurrentUploads:          s.config.MaxConcurrentUploads,
+			MaxConcurrentKDF:              s.config.MaxConcurrentKDF,
+			UsernameChangeCooldownSeconds: int64(s.config.UsernameChangeCooldown.Seconds()),
+			TokenTTLSeconds:               int64(s.jwtConfig.Expiration.Seconds()),
+			MaxSignedURLSeconds:           int64(maxShareTTL.Seconds()),
+			MaxSessionLabelLength:         maxSessionLabelLen,
+		},
+	})
 }
 
 // GetKDFParams handles GET /v1/auth/kdf
@@ -39,7 +139,7 @@ func (s *Server) GetKDFParams(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to get user")
+		s.respondInternalError(w, r, "failed to get user", err)
 		return
 	}
 
@@ -53,7 +153,75 @@ func (s *Server) GetKDFParams(w http.ResponseWriter, r *http.Request) {
 	respondJSON(w, http.StatusOK, params)
 }
 
-// RegisterRequest represents the registration request
+// KDFBoundsResponse answers GET /v1/auth/kdf/bounds
+type KDFBoundsResponse struct {
+	KDFType models.KDFType `json:"kdfType"`
+	crypto.KDFBounds
+}
+
+// GetKDFBounds handles GET /v1/auth/kdf/bounds. It reports the parameter
+// ranges registration and password changes accept for one allowed KDF type.
+func (s *Server) GetKDFBounds(w http.ResponseWriter, r *http.Request) {
+	kdfType := models.KDFType(r.URL.Query().Get("type"))
+	if kdfType == "" {
+		respondError(w, http.StatusBadRequest, "type is required")
+		return
+	}
+	if !s.kdfTypeAllowed(w, kdfType) {
+		return
+	}
+
+	bounds, err := crypto.BoundsForKDF(kdfType)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, KDFBoundsResponse{KDFType: kdfType, KDFBounds: bounds})
+}
+
+// Username availability answers are padded to a fixed floor plus random
+// jitter, so a taken name and a free one take the same time
+const (
+	usernameCheckFloor  = 50 * time.Millisecond
+	usernameCheckJitter = 50 * time.Millisecond
+)
+
+// UsernameAvailableResponse answers GET /v1/auth/username-available
+type UsernameAvailableResponse struct {
+	Username  string `json:"username"`
+	Available bool   `json:"available"`
+}
+
+// UsernameAvailable handles GET /v1/auth/username-available.
+// It deliberately tells anyone whether a name is taken; the per-IP rate limit
+// and uniform timing only slow enumeration down.
+func (s *Server) UsernameAvailable(w http.ResponseWriter, r *http.Request) {
+	respondAt := time.Now().Add(usernameCheckFloor + rand.N(usernameCheckJitter))
+
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		respondError(w, http.StatusBadRequest, "username is required")
+		return
+	}
+
+	available, err := s.db.UsernameAvailable(username)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to check username", err)
+		return
+	}
+
+	timer := time.NewTimer(time.Until(respondAt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	}
+	respondJSON(w, http.StatusOK, UsernameAvailableResponse{Username: username, Available: available})
+}
+
+// RegisterRequest represents the registration request.
+// All KDF fields may be omitted, in which case the server default KDF is used.
 type RegisterRequest struct {
 	Username          string           `json:"username"`
 	KDFType           models.KDFType   `json:"kdfType"`
@@ -62,130 +230,307 @@ type RegisterRequest struct {
 	KDFParallelism    *int             `json:"kdfParallelism,omitempty"`
 	LoginVerifier     string           `json:"loginVerifier"` // base64
 	WrappedAccountKey models.Container `json:"wrappedAccountKey"`
+	InviteCode        string           `json:"inviteCode,omitempty"` // required with -require-invite
 }
 
 // Register handles POST /v1/auth/register
 func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
+	if s.config.DisableRegistration {
+		respondErrorCode(w, http.StatusForbidden, "registration_disabled", "self-registration is disabled on this server")
+		return
+	}
+
 	var req RegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	user, params, ok := s.createAccount(w, r, req, s.config.RequireInvite, "Register")
+	if !ok {
 		return
 	}
 
+	s.audit(r, auditRegister, user.ID, "")
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"username":  user.Username,
+		"createdAt": user.CreatedAt,
+		"kdf":       params,
+	})
+}
+
+// acceptKDFParams checks KDF params chosen by a client, at registration or
+// on a switch: they must meet the minimums, be of an allowed type and fit
+// the -max-kdf-duration budget. On failure it writes 400 and returns false.
+func (s *Server) acceptKDFParams(w http.ResponseWriter, params models.KDFParams) bool {
+	if err := crypto.ValidateKDFParams(params); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	if !s.kdfTypeAllowed(w, params.Type) {
+		return false
+	}
+	if s.config.MaxKDFDuration > 0 {
+		if projected := crypto.EstimateKDFDuration(params); projected > s.config.MaxKDFDuration {
+			respondErrorCode(w, http.StatusBadRequest, "kdf_too_expensive", fmt.Sprintf(
+				"KDF params would take about %s to derive on this server, over the %s budget",
+				projected.Round(time.Millisecond), s.config.MaxKDFDuration))
+			return false
+		}
+	}
+	return true
+}
+
+// createAccount validates a registration, hashes its verifier and stores the
+// user; self-registration and admin provisioning both go through it. With
+// consumeInvite, req.InviteCode is used up in the same transaction as the
+// insert. On failure it writes the error response and returns false.
+func (s *Server) createAccount(w http.ResponseWriter, r *http.Request, req RegisterRequest, consumeInvite bool, op string) (*models.User, models.KDFParams, bool) {
 	// Validate username
 	if req.Username == "" {
 		respondError(w, http.StatusBadRequest, "username is required")
-		return
+		return nil, models.KDFParams{}, false
 	}
 
-	// Validate KDF params
+	if consumeInvite && req.InviteCode == "" {
+		respondErrorCode(w, http.StatusForbidden, "invite_required", "an invite code is required to register")
+		return nil, models.KDFParams{}, false
+	}
+
+	// Validate KDF params, falling back to the server default when none are given
 	params := models.KDFParams{
 		Type:        req.KDFType,
 		Iterations:  req.KDFIterations,
 		MemoryKiB:   req.KDFMemoryKiB,
 		Parallelism: req.KDFParallelism,
 	}
-	if err := crypto.ValidateKDFParams(params); err != nil {
-		respondError(w, http.StatusBadRequest, err.Error())
-		return
+	// The default was checked by Config.Validate and is exempt from the budget
+	if req.omitsKDF() {
+		params = s.config.DefaultKDF
+	} else if !s.acceptKDFParams(w, params) {
+		return nil, params, false
 	}
 
 	// Decode login verifier
-	loginVerifier, err := crypto.DecodeBase64(req.LoginVerifier)
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "invalid login verifier encoding")
-		return
+	loginVerifier, ok := decodeLoginVerifier(w, req.LoginVerifier)
+	if !ok {
+		return nil, params, false
 	}
 
-	if len(loginVerifier) != 32 {
-		respondError(w, http.StatusBadRequest, "login verifier must be 32 bytes")
-		return
+	if err := s.validateContainer(req.WrappedAccountKey); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return nil, params, false
 	}
 
 	// Hash login verifier
-	loginVerifierHash := crypto.HashLoginVerifier(loginVerifier, req.Username)
+	hashStart := time.Now()
+	loginVerifierHash, err := crypto.HashLoginVerifierWith(s.config.VerifierHashAlg, loginVerifier, req.Username)
+	s.observeKDF(op, s.config.VerifierHashAlg, hashStart)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to hash login verifier", err)
+		return nil, params, false
+	}
 
 	// Create user
 	user := &models.User{
 		Username:          req.Username,
-		KDFType:           req.KDFType,
-		KDFIterations:     req.KDFIterations,
-		KDFMemoryKiB:      req.KDFMemoryKiB,
-		KDFParallelism:    req.KDFParallelism,
+		KDFType:           params.Type,
+		KDFIterations:     params.Iterations,
+		KDFMemoryKiB:      params.MemoryKiB,
+		KDFParallelism:    params.Parallelism,
 		LoginVerifierHash: loginVerifierHash,
+		VerifierHashAlg:   s.config.VerifierHashAlg,
 		WrappedAccountKey: req.WrappedAccountKey,
 	}
 
-	if err := s.db.CreateUser(user); err != nil {
+	if consumeInvite {
+		err = s.db.CreateUserWithInvite(user, req.InviteCode)
+	} else {
+		err = s.db.CreateUser(user)
+	}
+	if err != nil {
 		if err == db.ErrUserExists {
 			respondError(w, http.StatusConflict, "username already exists")
-			return
+			return nil, params, false
 		}
-		respondError(w, http.StatusInternalServerError, "failed to create user")
-		return
+		if err == db.ErrUsernameCoolingDown {
+			respondErrorCode(w, http.StatusConflict, "username_cooling_down", "username was released recently and is not available yet")
+			return nil, params, false
+		}
+		if err == db.ErrInviteInvalid {
+			respondErrorCode(w, http.StatusForbidden, "invite_invalid", "invite code is invalid or already used")
+			return nil, params, false
+		}
+		s.respondInternalError(w, r, "failed to create user", err)
+		return nil, params, false
 	}
 
-	respondJSON(w, http.StatusCreated, map[string]interface{}{
-		"username":  user.Username,
-		"createdAt": user.CreatedAt,
-	})
+	return user, params, true
+}
+
+// kdfTypeAllowed enforces Config.AllowedKDFTypes on params a client chose.
+// On failure it writes 400 kdf_type_not_allowed and returns false.
+func (s *Server) kdfTypeAllowed(w http.ResponseWriter, kdfType models.KDFType) bool {
+	if slices.Contains(s.config.AllowedKDFTypes, kdfType) {
+		return true
+	}
+	respondErrorCode(w, http.StatusBadRequest, "kdf_type_not_allowed", fmt.Sprintf("KDF type %s is not allowed on this server", kdfType))
+	return false
+}
+
+// kdfUpgrade returns the server default KDF params when the user's KDF type
+// is no longer allowed, as a hint to switch via PATCH /v1/users/me
+func (s *Server) kdfUpgrade(user *models.User) *models.KDFParams {
+	if slices.Contains(s.config.AllowedKDFTypes, user.KDFType) {
+		return nil
+	}
+	params := s.config.DefaultKDF
+	return &params
+}
+
+// omitsKDF reports whether the request leaves KDF selection to the server
+func (req RegisterRequest) omitsKDF() bool {
+	return req.KDFType == "" && req.KDFIterations == 0 && req.KDFMemoryKiB == nil && req.KDFParallelism == nil
 }
 
 // VerifyRequest represents the login verification request
 type VerifyRequest struct {
 	Username      string `json:"username"`
-	LoginVerifier string `json:"loginVerifier"` // base64
+	LoginVerifier string `json:"loginVerifier"`   // base64
+	Label         string `json:"label,omitempty"` // session label; defaults to the User-Agent
 }
 
 // VerifyResponse represents the login verification response
 type VerifyResponse struct {
 	Token             string           `json:"token"`
 	WrappedAccountKey models.Container `json:"wrappedAccountKey"`
+	Rev               int64            `json:"rev"` // send back as If-Match on PATCH /v1/users/me
+	// KDFUpgrade, when set, means the account's KDF type is no longer allowed;
+	// the client should re-derive with these params and send them in PATCH /v1/users/me
+	KDFUpgrade *models.KDFParams `json:"kdfUpgrade,omitempty"`
 }
 
 // Verify handles POST /v1/auth/verify
 func (s *Server) Verify(w http.ResponseWriter, r *http.Request) {
-	var req VerifyRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	user, req, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	// Generate JWT token
+	token, err := s.issueToken(r, user, middleware.ScopeReadWrite, req.Label)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to generate token", err)
+		return
+	}
+
+	s.audit(r, auditLogin, user.ID, req.Label)
+	setUserETag(w, user)
+	respondJSON(w, http.StatusOK, VerifyResponse{
+		Token:             token,
+		WrappedAccountKey: user.WrappedAccountKey,
+		Rev:               user.Rev,
+		KDFUpgrade:        s.kdfUpgrade(user),
+	})
+}
+
+// CheckAuth handles POST /v1/auth/check.
+// It runs the same verifier comparison as Verify but issues no token, so
+// synthetic monitoring can exercise the login path without minting sessions.
+func (s *Server) CheckAuth(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := s.authenticate(w, r); !ok {
 		return
 	}
 
+	respondJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// authenticate decodes a VerifyRequest and checks the login verifier against
+// the stored hash, returning the request for its optional fields. On failure it
+// writes the error response and returns false.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (*models.User, VerifyRequest, bool) {
+	var req VerifyRequest
+	if !s.decodeJSON(w, r, &req) {
+		return nil, req, false
+	}
+
+	// Decode login verifier before the lookup, so a malformed one gets the
+	// same 400 whether or not the user exists
+	loginVerifier, ok := decodeLoginVerifier(w, req.LoginVerifier)
+	if !ok {
+		return nil, req, false
+	}
+
 	// Get user
 	user, err := s.db.GetUserByUsername(req.Username)
 	if err == db.ErrUserNotFound {
+		s.audit(r, auditLoginFailed, 0, req.Username)
 		respondError(w, http.StatusUnauthorized, "invalid credentials")
-		return
+		return nil, req, false
 	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to get user")
-		return
+		s.respondInternalError(w, r, "failed to get user", err)
+		return nil, req, false
 	}
 
-	// Decode login verifier
-	loginVerifier, err := crypto.DecodeBase64(req.LoginVerifier)
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "invalid login verifier encoding")
-		return
+	// Verify login verifier. The stored username salts the hash, since with
+	// case-insensitive usernames the one sent may differ in case.
+	hashStart := time.Now()
+	valid := crypto.VerifyLoginVerifierWith(user.VerifierHashAlg, loginVerifier, user.Username, user.LoginVerifierHash)
+	s.observeKDF("Verify", user.VerifierHashAlg, hashStart)
+	if !valid {
+		s.audit(r, auditLoginFailed, user.ID, req.Username)
+		respondError(w, http.StatusUnauthorized, "invalid credentials")
+		return nil, req, false
 	}
 
-	// Verify login verifier
-	if !crypto.VerifyLoginVerifier(loginVerifier, req.Username, user.LoginVerifierHash) {
-		respondError(w, http.StatusUnauthorized, "invalid credentials")
+	s.rehashVerifier(user, loginVerifier)
+	return user, req, true
+}
+
+// rehashVerifier moves a verified user's stored hash to the configured
+// -verifier-hash. Only a login has the verifier, so this is the one chance to
+// upgrade accounts hashed under an older setting without involving the client.
+// A failure is logged and the old hash kept; it stays valid for the next try.
+func (s *Server) rehashVerifier(user *models.User, loginVerifier []byte) {
+	if user.VerifierHashAlg == s.config.VerifierHashAlg {
 		return
 	}
 
-	// Generate JWT token
-	token, err := s.jwtConfig.GenerateToken(user.ID)
+	hashStart := time.Now()
+	hash, err := crypto.HashLoginVerifierWith(s.config.VerifierHashAlg, loginVerifier, user.Username)
+	s.observeKDF("Rehash", s.config.VerifierHashAlg, hashStart)
+	if err == nil {
+		err = s.db.RehashLoginVerifier(user.ID, user.Rev, hash, s.config.VerifierHashAlg)
+	}
+	if err == db.ErrUserConflict {
+		// A concurrent credential change wrote a hash under the current setting
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to generate token")
+		log.Printf("Failed to rehash login verifier for user %d: %v", user.ID, err)
 		return
 	}
+	user.LoginVerifierHash = hash
+	user.VerifierHashAlg = s.config.VerifierHashAlg
+}
 
-	respondJSON(w, http.StatusOK, VerifyResponse{
-		Token:             token,
-		WrappedAccountKey: user.WrappedAccountKey,
-	})
+// observeKDF records a server-side verifier hash when KDF timing is enabled.
+// Metrics are keyed by the hash params so runs on different hardware or
+// settings can be compared; hashes over the threshold are also logged.
+func (s *Server) observeKDF(op string, alg models.VerifierHashAlg, start time.Time) {
+	if !s.config.KDFTiming {
+		return
+	}
+
+	elapsed := time.Since(start)
+	label := crypto.VerifierHashLabel(alg)
+	metrics.KDFHashes.Add(label, 1)
+	metrics.KDFHashNanos.Add(label, elapsed.Nanoseconds())
+	metrics.KDFHashDurations.Add(label+","+metrics.DurationBucket(elapsed), 1)
+
+	if s.config.KDFTimingLogThreshold > 0 && elapsed >= s.config.KDFTimingLogThreshold {
+		log.Printf("Slow KDF: op=%s params=%s duration=%s", op, label, elapsed)
+	}
 }
 
 // UpdateUserRequest represents the credential rotation request
@@ -193,47 +538,82 @@ type UpdateUserRequest struct {
 	Username          *string          `json:"username,omitempty"`
 	LoginVerifier     string           `json:"loginVerifier"`
 	WrappedAccountKey models.Container `json:"wrappedAccountKey"`
+	// CurrentLoginVerifier re-proves the current password; required for
+	// credential changes when Config.RequireCurrentVerifier is set
+	CurrentLoginVerifier string `json:"currentLoginVerifier,omitempty"`
+	// KDF switches the account to new KDF params; the verifier and wrapped
+	// key must be derived with them. Omitted keeps the current params.
+	KDF *models.KDFParams `json:"kdf,omitempty"`
 }
 
-// UpdateUser handles PATCH /v1/users/me
+// UpdateUser handles PATCH /v1/users/me. An If-Match header carrying the user
+// ETag makes the change conditional on the credentials the client last saw.
 func (s *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
-	userID, err := middleware.GetUserIDFromContext(r.Context())
-	if err != nil {
+	user := userFromContext(r.Context())
+	if user == nil {
 		respondError(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
 
 	var req UpdateUserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
+	if !s.decodeJSON(w, r, &req) {
 		return
 	}
 
-	// Get current user
-	user, err := s.db.GetUserByID(userID)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to get user")
+	if !userRevMatches(r, user) {
+		respondErrorCode(w, http.StatusConflict, "user_modified", "credentials were changed by another client; re-fetch and retry")
+		return
+	}
+
+	if s.config.RequireCurrentVerifier && !s.reauthenticated(w, user, req) {
 		return
 	}
 
-	// Update username if provided
-	if req.Username != nil && *req.Username != "" {
+	// Update username if provided, at most once per cooldown period
+	if req.Username != nil && *req.Username != "" && *req.Username != user.Username {
+		if wait := s.usernameCooldownRemaining(user); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			respondError(w, http.StatusTooManyRequests, "username was changed too recently")
+			return
+		}
+
 		user.Username = *req.Username
+		changedAt := models.NewTimestamp(time.Now())
+		user.UsernameChangedAt = &changedAt
+	}
+
+	if req.KDF != nil {
+		if !s.acceptKDFParams(w, *req.KDF) {
+			return
+		}
+		user.KDFType = req.KDF.Type
+		user.KDFIterations = req.KDF.Iterations
+		user.KDFMemoryKiB = req.KDF.MemoryKiB
+		user.KDFParallelism = req.KDF.Parallelism
 	}
 
 	// Decode and hash new login verifier
-	loginVerifier, err := crypto.DecodeBase64(req.LoginVerifier)
-	if err != nil {
-		respondError(w, http.StatusBadRequest, "invalid login verifier encoding")
+	loginVerifier, ok := decodeLoginVerifier(w, req.LoginVerifier)
+	if !ok {
+		return
+	}
+
+	if err := s.validateContainer(req.WrappedAccountKey); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	if len(loginVerifier) != 32 {
-		respondError(w, http.StatusBadRequest, "login verifier must be 32 bytes")
+	hashStart := time.Now()
+	loginVerifierHash, err := crypto.HashLoginVerifierWith(s.config.VerifierHashAlg, loginVerifier, user.Username)
+	s.observeKDF("UpdateUser", s.config.VerifierHashAlg, hashStart)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to hash login verifier", err)
 		return
 	}
 
-	user.LoginVerifierHash = crypto.HashLoginVerifier(loginVerifier, user.Username)
+	// Re-hashing is the only point where a stored algorithm can move to the configured one
+	user.LoginVerifierHash = loginVerifierHash
+	user.VerifierHashAlg = s.config.VerifierHashAlg
 	user.WrappedAccountKey = req.WrappedAccountKey
 
 	// Update user in database
@@ -242,106 +622,228 @@ func (s *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
 			respondError(w, http.StatusConflict, "username already exists")
 			return
 		}
-		respondError(w, http.StatusInternalServerError, "failed to update user")
+		if err == db.ErrUsernameCoolingDown {
+			respondErrorCode(w, http.StatusConflict, "username_cooling_down", "username was released recently and is not available yet")
+			return
+		}
+		if err == db.ErrUserConflict {
+			respondErrorCode(w, http.StatusConflict, "user_modified", "credentials were changed by another client; re-fetch and retry")
+			return
+		}
+		if err == db.ErrNonceReuse {
+			respondErrorCode(w, http.StatusBadRequest, "nonce_reuse", nonceReuseMessage)
+			return
+		}
+		s.respondInternalError(w, r, "failed to update user", err)
 		return
 	}
 
+	s.audit(r, auditUserUpdated, user.ID, "")
+	setUserETag(w, user)
 	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"username":  user.Username,
 		"updatedAt": user.UpdatedAt,
+		"rev":       user.Rev,
 	})
 }
 
-// UpsertBlobRequest represents the blob upsert request
-type UpsertBlobRequest struct {
-	EncryptedBlob models.Container `json:"encryptedBlob"`
-}
-
-// UpsertBlob handles PUT /v1/blobs/{blobName}
-func (s *Server) UpsertBlob(w http.ResponseWriter, r *http.Request) {
-	userID, err := middleware.GetUserIDFromContext(r.Context())
+// decodeLoginVerifier decodes a base64 login verifier and checks it is
+// exactly crypto.LoginVerifierLength bytes. On failure it writes 400 and
+// returns false.
+func decodeLoginVerifier(w http.ResponseWriter, encoded string) ([]byte, bool) {
+	loginVerifier, err := crypto.DecodeBase64(encoded)
 	if err != nil {
-		respondError(w, http.StatusUnauthorized, "unauthorized")
-		return
+		respondError(w, http.StatusBadRequest, "invalid login verifier encoding")
+		return nil, false
 	}
-
-	blobName := chi.URLParam(r, "blobName")
-	if blobName == "" {
-		respondError(w, http.StatusBadRequest, "blob name is required")
-		return
+	if len(loginVerifier) != crypto.LoginVerifierLength {
+		respondError(w, http.StatusBadRequest,
+			fmt.Sprintf("login verifier must be %d bytes, got %d", crypto.LoginVerifierLength, len(loginVerifier)))
+		return nil, false
 	}
+	return loginVerifier, true
+}
 
-	var req UpsertBlobRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "invalid request body")
-		return
+// reauthenticated enforces Config.RequireCurrentVerifier on PATCH /v1/users/me.
+// An update that keeps the username and whose new verifier already matches the
+// stored hash only re-wraps the account key, so it is exempt; any other needs
+// currentLoginVerifier. On failure it writes 401 and returns false.
+func (s *Server) reauthenticated(w http.ResponseWriter, user *models.User, req UpdateUserRequest) bool {
+	verify := func(encoded string) bool {
+		verifier, err := crypto.DecodeBase64(encoded)
+		if err != nil || len(verifier) != crypto.LoginVerifierLength {
+			return false
+		}
+		hashStart := time.Now()
+		ok := crypto.VerifyLoginVerifierWith(user.VerifierHashAlg, verifier, user.Username, user.LoginVerifierHash)
+		s.observeKDF("UpdateUser", user.VerifierHashAlg, hashStart)
+		return ok
 	}
 
-	blob := &models.Blob{
-		UserID:        userID,
-		BlobName:      blobName,
-		EncryptedBlob: req.EncryptedBlob,
+	if req.CurrentLoginVerifier != "" {
+		if verify(req.CurrentLoginVerifier) {
+			return true
+		}
+		respondErrorCode(w, http.StatusUnauthorized, "reauth_failed", "current login verifier is incorrect")
+		return false
 	}
 
-	if err := s.db.UpsertBlob(blob); err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to upsert blob")
-		return
+	usernameChanged := req.Username != nil && *req.Username != "" && *req.Username != user.Username
+	if !usernameChanged && verify(req.LoginVerifier) {
+		return true
 	}
+	respondErrorCode(w, http.StatusUnauthorized, "reauth_required", "changing credentials requires currentLoginVerifier")
+	return false
+}
 
-	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"blobName":  blob.BlobName,
-		"updatedAt": blob.UpdatedAt,
-	})
+// RotateKeyBlob is one re-encrypted blob in a rotation
+type RotateKeyBlob struct {
+	BlobName      string           `json:"blobName"`
+	EncryptedBlob models.Container `json:"encryptedBlob"`
 }
 
-// GetBlob handles GET /v1/blobs/{blobName}
-func (s *Server) GetBlob(w http.ResponseWriter, r *http.Request) {
-	userID, err := middleware.GetUserIDFromContext(r.Context())
-	if err != nil {
+// RotateKeyRequest represents an account-key rotation
+type RotateKeyRequest struct {
+	WrappedAccountKey models.Container `json:"wrappedAccountKey"`
+	Blobs             []RotateKeyBlob  `json:"blobs"`
+}
+
+// RotateKey handles POST /v1/users/me/rotate-key.
+// The new wrapped account key and every blob re-encrypted under the new key are
+// applied in one transaction, so a failure never leaves a half-rotated account.
+// Like PATCH /v1/users/me it honors If-Match on the user ETag, and it only
+// applies while the rev it read is still current.
+func (s *Server) RotateKey(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r.Context())
+	if user == nil {
 		respondError(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
+	userID := user.ID
 
-	blobName := chi.URLParam(r, "blobName")
-	if blobName == "" {
-		respondError(w, http.StatusBadRequest, "blob name is required")
+	var req RotateKeyRequest
+	if !s.decodeJSON(w, r, &req) {
 		return
 	}
 
-	blob, err := s.db.GetBlob(userID, blobName)
-	if err == db.ErrBlobNotFound {
-		respondError(w, http.StatusNotFound, "blob not found")
+	if !userRevMatches(r, user) {
+		respondErrorCode(w, http.StatusConflict, "user_modified", "credentials were changed by another client; re-fetch and retry")
 		return
 	}
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to get blob")
+
+	if err := s.validateContainer(req.WrappedAccountKey); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	blobs := make([]models.Blob, len(req.Blobs))
+	for i, b := range req.Blobs {
+		if b.BlobName == "" {
+			respondError(w, http.StatusBadRequest, "blob name is required")
+			return
+		}
+		if err := s.validateContainer(b.EncryptedBlob); err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("blob %q: %v", b.BlobName, err))
+			return
+		}
+		blobs[i] = models.Blob{UserID: userID, BlobName: b.BlobName, EncryptedBlob: b.EncryptedBlob}
+	}
+
+	writer, ok := blobWriter(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.db.RotateAccountKey(userID, user.Rev, req.WrappedAccountKey, blobs, s.config.UserQuotaBytes, writer); err != nil {
+		switch err {
+		case db.ErrUserConflict:
+			respondErrorCode(w, http.StatusConflict, "user_modified", "credentials were changed by another client; re-fetch and retry")
+		case db.ErrBlobLocked:
+			respondErrorCode(w, http.StatusLocked, "locked", "a blob is locked by another session; retry later or pass force=true")
+		case db.ErrRotationIncomplete:
+			respondError(w, http.StatusConflict, "blobs must list every stored blob exactly once")
+		case db.ErrQuotaExceeded:
+			respondQuotaExceeded(w, userID)
+		case db.ErrNonceReuse:
+			respondErrorCode(w, http.StatusBadRequest, "nonce_reuse", nonceReuseMessage)
+		case db.ErrUserNotFound:
+			respondError(w, http.StatusNotFound, "user not found")
+		default:
+			s.respondInternalError(w, r, "failed to rotate account key", err)
+		}
 		return
 	}
 
+	s.audit(r, auditKeyRotated, userID, "")
+	user.Rev++
+	setUserETag(w, user)
 	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"encryptedBlob": blob.EncryptedBlob,
+		"rotated": len(blobs),
+		"rev":     user.Rev,
 	})
 }
 
-// ListBlobs handles GET /v1/blobs
-func (s *Server) ListBlobs(w http.ResponseWriter, r *http.Request) {
-	userID, err := middleware.GetUserIDFromContext(r.Context())
-	if err != nil {
+// AccountKeyResponse represents the wrapped account key re-fetch response
+type AccountKeyResponse struct {
+	WrappedAccountKey models.Container `json:"wrappedAccountKey"`
+	Rev               int64            `json:"rev"`
+}
+
+// GetAccountKey handles GET /v1/users/me/account-key
+func (s *Server) GetAccountKey(w http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r.Context())
+	if user == nil {
 		respondError(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
 
-	blobs, err := s.db.ListBlobs(userID)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "failed to list blobs")
-		return
+	setUserETag(w, user)
+	respondJSON(w, http.StatusOK, AccountKeyResponse{
+		WrappedAccountKey: user.WrappedAccountKey,
+		Rev:               user.Rev,
+	})
+}
+
+// setUserETag exposes the user's rev as an ETag for If-Match on credential updates
+func setUserETag(w http.ResponseWriter, user *models.User) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(user.Rev, 10)))
+}
+
+// userRevMatches reports whether the request's If-Match header, if any, names
+// the user's current rev. "*" and an absent header match.
+func userRevMatches(r *http.Request, user *models.User) bool {
+	raw := strings.TrimSpace(r.Header.Get("If-Match"))
+	if raw == "" || raw == "*" {
+		return true
 	}
+	current := strconv.FormatInt(user.Rev, 10)
+	for _, tag := range strings.Split(raw, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if strings.Trim(tag, `"`) == current {
+			return true
+		}
+	}
+	return false
+}
 
-	respondJSON(w, http.StatusOK, blobs)
+// usernameCooldownRemaining returns how long the user must wait before renaming again
+func (s *Server) usernameCooldownRemaining(user *models.User) time.Duration {
+	if s.config.UsernameChangeCooldown <= 0 || user.UsernameChangedAt == nil {
+		return 0
+	}
+	return time.Until(user.UsernameChangedAt.Add(s.config.UsernameChangeCooldown))
 }
 
-// DeleteBlob handles DELETE /v1/blobs/{blobName}
-func (s *Server) DeleteBlob(w http.ResponseWriter, r *http.Request) {
+// UpsertBlobRequest represents the blob upsert request
+type UpsertBlobRequest struct {
+	EncryptedBlob models.Container  `json:"encryptedBlob"`
+	EncryptedName *models.Container `json:"encryptedName,omitempty"` // optional; the name when blobName is its token
+	Collection    string            `json:"collection,omitempty"`    // optional; omitted puts the blob in -default-collection
+	ExpiresAt     *models.Timestamp `json:"expiresAt,omitempty"`     // optional, must be in the future
+}
+
+// UpsertBlob handles PUT /v1/blobs/{blobName}
+func (s *Server) UpsertBlob(w http.ResponseWriter, r *http.Request) {
 	userID, err := middleware.GetUserIDFromContext(r.Context())
 	if err != nil {
 		respondError(w, http.StatusUnauthorized, "unauthorized")
@@ -354,16 +856,1032 @@ func (s *Server) DeleteBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.db.DeleteBlob(userID, blobName); err != nil {
-		if err == db.ErrBlobNotFound {
-			respondError(w, http.StatusNotFound, "blob not found")
-			return
-		}
-		respondError(w, http.StatusInternalServerError, "failed to delete blob")
+	var req UpsertBlobRequest
+	if !s.decodeJSON(w, r, &req) {
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		respondError(w, http.StatusBadRequest, "expiresAt must be in the future")
+		return
+	}
+
+	if err := s.validateContainer(req.EncryptedBlob); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if code, message := s.checkBlobName(blobName, req.EncryptedName); message != "" {
+		respondBlobNameProblem(w, code, message)
+		return
+	}
+
+	writer, ok := blobWriter(w, r)
+	if !ok {
+		return
+	}
+
+	blob := &models.Blob{
+		UserID:        userID,
+		BlobName:      blobName,
+		EncryptedBlob: req.EncryptedBlob,
+		EncryptedName: req.EncryptedName,
+		Collection:    s.collectionOrDefault(req.Collection),
+		ExpiresAt:     req.ExpiresAt,
+	}
+
+	if err := s.db.UpsertBlobWithinQuota(blob, s.config.UserQuotaBytes, writer); err != nil {
+		if err == db.ErrBlobLocked {
+			s.respondBlobWriteLocked(w, userID, blobName)
+			return
+		}
+		if err == db.ErrQuotaExceeded {
+			respondQuotaExceeded(w, userID)
+			return
+		}
+		if err == db.ErrNonceReuse {
+			respondErrorCode(w, http.StatusBadRequest, "nonce_reuse", nonceReuseMessage)
+			return
+		}
+		if err == db.ErrTooManyCollections {
+			respondErrorCode(w, http.StatusBadRequest, "too_many_tags", tooManyCollectionsMessage)
+			return
+		}
+		s.respondInternalError(w, r, "failed to upsert blob", err)
+		return
+	}
+	s.audit(r, auditBlobPut, userID, blob.BlobName)
+
+	resp := map[string]interface{}{
+		"blobName":  blob.BlobName,
+		"updatedAt": blob.UpdatedAt,
+		"version":   blob.Version,
+		"checksum":  blob.Checksum,
+	}
+	if blob.Collection != "" {
+		resp["collection"] = blob.Collection
+	}
+	if blob.ExpiresAt != nil {
+		resp["expiresAt"] = blob.ExpiresAt
+	}
+	if blob.Pinned {
+		resp["pinned"] = true
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// GetBlob handles GET /v1/blobs/{blobName}.
+// A client holding version N can send If-Version-Match: N (or ?ifVersion=N);
+// if the stored version is still N it gets 304 without the ciphertext being read.
+func (s *Server) GetBlob(w http.ResponseWriter, r *http.Request) {
+	if unchanged, ok := s.blobVersionMatches(w, r); !ok || unchanged {
+		return
+	}
+
+	blob, ok := s.loadBlob(w, r)
+	if !ok {
+		return
+	}
+	setChecksumHeader(w, blob)
+	// The version ETag names the row for conditional deletes; it is not a
+	// content validator, since versions restart when a blob is re-created
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(blob.Version, 10)))
+
+	resp := map[string]interface{}{
+		"encryptedBlob": blob.EncryptedBlob,
+		"version":       blob.Version,
+	}
+	if blob.EncryptedName != nil {
+		resp["encryptedName"] = blob.EncryptedName
+	}
+	if blob.Collection != "" {
+		resp["collection"] = blob.Collection
+	}
+	if blob.ExpiresAt != nil {
+		resp["expiresAt"] = blob.ExpiresAt
+	}
+	if blob.Pinned {
+		resp["pinned"] = true
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// GetBlobContent handles GET /v1/blobs/{blobName}/content, with Range support
+// for resuming large downloads.
+// The body is the raw ciphertext so CLIs can pipe it to a file; the rest of the
+// container travels in X-Blob-Nonce, X-Blob-Tag and, if set, X-Blob-Alg (base64
+// as stored).
+func (s *Server) GetBlobContent(w http.ResponseWriter, r *http.Request) {
+	blob, ok := s.loadBlob(w, r)
+	if !ok {
+		return
+	}
+
+	ciphertext, err := crypto.DecodeBase64(blob.EncryptedBlob.Ciphertext)
+	if err != nil {
+		s.respondInternalError(w, r, "stored ciphertext is not valid base64", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	setChecksumHeader(w, blob)
+	w.Header().Set("X-Blob-Nonce", blob.EncryptedBlob.Nonce)
+	w.Header().Set("X-Blob-Tag", blob.EncryptedBlob.Tag)
+	if blob.EncryptedBlob.Alg != "" {
+		w.Header().Set("X-Blob-Alg", blob.EncryptedBlob.Alg)
+	}
+
+	// The checksum covers the container's bytes, so it is a strong validator
+	// for If-Range. The version is not: it restarts at 1 when a blob is
+	// deleted and re-created, and a resumed download would then splice two
+	// ciphertexts. Rows stored before checksums existed get one computed here.
+	// ServeContent answers Range with 206 and Content-Range, or 416 if unsatisfiable.
+	checksum := blob.Checksum
+	if checksum == "" {
+		checksum = crypto.ContainerChecksum(blob.EncryptedBlob)
+	}
+	w.Header().Set("ETag", strconv.Quote(checksum))
+	http.ServeContent(w, r, "", blob.UpdatedAt.Time, bytes.NewReader(ciphertext))
+}
+
+// setChecksumHeader sends the stored container checksum as X-Blob-Checksum, so
+// a client can compare it with the one returned by PUT before decrypting.
+// Legacy rows stored before checksums existed send none.
+func setChecksumHeader(w http.ResponseWriter, blob *models.Blob) {
+	if blob.Checksum != "" {
+		w.Header().Set("X-Blob-Checksum", blob.Checksum)
+	}
+}
+
+// blobVersionMatches handles the If-Version-Match header and ?ifVersion= parameter.
+// It reports whether the stored version equals the requested one, in which case
+// it has written 304. On failure it writes the error response and returns false.
+func (s *Server) blobVersionMatches(w http.ResponseWriter, r *http.Request) (unchanged bool, ok bool) {
+	raw := r.Header.Get("If-Version-Match")
+	if raw == "" {
+		raw = r.URL.Query().Get("ifVersion")
+	}
+	if raw == "" {
+		return false, true
+	}
+
+	want, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || want < 1 {
+		respondError(w, http.StatusBadRequest, "version must be a positive integer")
+		return false, false
+	}
+
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return false, false
+	}
+
+	version, err := s.db.BlobVersion(userID, chi.URLParam(r, "blobName"))
+	if err == db.ErrBlobNotFound {
+		respondBlobNotFound(w)
+		return false, false
+	}
+	if err == db.ErrBlobExpired {
+		respondError(w, http.StatusGone, "blob expired")
+		return false, false
+	}
+	if err != nil {
+		s.respondInternalError(w, r, "failed to get blob", err)
+		return false, false
+	}
+
+	if version != want {
+		return false, true
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true, true
+}
+
+// loadBlob fetches the blob named in the URL for the authenticated user.
+// On failure it writes the error response and returns false.
+func (s *Server) loadBlob(w http.ResponseWriter, r *http.Request) (*models.Blob, bool) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return nil, false
+	}
+
+	blobName := chi.URLParam(r, "blobName")
+	if blobName == "" {
+		respondError(w, http.StatusBadRequest, "blob name is required")
+		return nil, false
+	}
+
+	blob, err := s.db.GetBlob(userID, blobName)
+	if err == db.ErrBlobNotFound {
+		respondBlobNotFound(w)
+		return nil, false
+	}
+	if err == db.ErrBlobExpired {
+		respondError(w, http.StatusGone, "blob expired")
+		return nil, false
+	}
+	if err != nil {
+		s.respondInternalError(w, r, "failed to get blob", err)
+		return nil, false
+	}
+
+	return blob, true
+}
+
+// VerifyBlob handles GET /v1/blobs/{blobName}/verify
+func (s *Server) VerifyBlob(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	blobName := chi.URLParam(r, "blobName")
+	if blobName == "" {
+		respondError(w, http.StatusBadRequest, "blob name is required")
+		return
+	}
+
+	checked, err := s.db.VerifyBlob(userID, blobName)
+	if err == db.ErrBlobNotFound {
+		respondBlobNotFound(w)
+		return
+	}
+	if err == db.ErrBlobExpired {
+		respondError(w, http.StatusGone, "blob expired")
+		return
+	}
+	if err == db.ErrBlobCorrupted {
+		s.respondInternalError(w, r, "corrupted", err)
+		return
+	}
+	if err != nil {
+		s.respondInternalError(w, r, "failed to verify blob", err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"ok":      true,
+		"checked": checked,
+	})
+}
+
+// ListBlobs handles GET /v1/blobs, optionally bounded by ?from= and ?to= on updated_at
+// and scoped by ?collection= (an empty value selects the default collection).
+// With ?limit= or ?cursor= it returns one page by name, and links the
+// neighbouring pages in a Link header. ?sinceSeq= switches to change-sequence
+// sync, see listBlobChanges, and ?groupByCollection=true nests the blobs under
+// their collections, see listBlobsByCollection. ?fields= trims the plain and
+// paginated forms to the named fields, see parseBlobListFields. Every form
+// carries a weak ETag and answers a matching If-None-Match with 304, see
+// blobListNotModified.
+func (s *Server) ListBlobs(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	var filter db.BlobFilter
+	if filter.UpdatedFrom, err = parseTimeParam(r, "from"); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.UpdatedTo, err = parseTimeParam(r, "to"); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.UpdatedFrom != nil && filter.UpdatedTo != nil && filter.UpdatedFrom.After(*filter.UpdatedTo) {
+		respondError(w, http.StatusBadRequest, "from must not be after to")
+		return
+	}
+	if r.URL.Query().Has("collection") {
+		collection := r.URL.Query().Get("collection")
+		filter.Collection = &collection
+	}
+
+	limit, cursor, err := parsePage(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fields, err := parseBlobListFields(r)
+	if err != nil {
+		respondErrorCode(w, http.StatusBadRequest, "invalid_field", err.Error())
+		return
+	}
+	if fields != nil {
+		if r.URL.Query().Get("groupByCollection") == "true" || r.URL.Query().Has("sinceSeq") {
+			respondError(w, http.StatusBadRequest, "fields cannot be combined with groupByCollection or sinceSeq")
+			return
+		}
+		filter.SkipSize = !fields["encryptedSize"]
+	}
+	if s.blobListNotModified(w, r, userID) {
+		return
+	}
+	if r.URL.Query().Get("groupByCollection") == "true" {
+		if limit > 0 || r.URL.Query().Has("sinceSeq") {
+			respondError(w, http.StatusBadRequest, "groupByCollection cannot be combined with pagination or sinceSeq")
+			return
+		}
+		s.listBlobsByCollection(w, r, userID, filter)
+		return
+	}
+	if r.URL.Query().Has("sinceSeq") {
+		if cursor != nil {
+			respondError(w, http.StatusBadRequest, "sinceSeq cannot be combined with cursor")
+			return
+		}
+		s.listBlobChanges(w, r, userID, filter, limit)
+		return
+	}
+	backward := cursor != nil && cursor.Backward
+	if cursor != nil {
+		if backward {
+			filter.Before = &cursor.Name
+		} else {
+			filter.After = &cursor.Name
+		}
+	}
+	if limit > 0 {
+		// One extra row tells whether there is another page in that direction
+		filter.Limit = limit + 1
+	}
+
+	blobs, err := s.db.ListBlobs(userID, filter)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to list blobs", err)
+		return
+	}
+
+	if limit > 0 {
+		more := len(blobs) > limit
+		if more && backward {
+			blobs = blobs[1:]
+		} else if more {
+			blobs = blobs[:limit]
+		}
+
+		// Going forward there is a previous page if we came from one; going
+		// backward there is a next page, the one the cursor came from
+		hasNext, hasPrev := more, cursor != nil
+		if backward {
+			hasNext, hasPrev = true, more
+		}
+		if len(blobs) > 0 {
+			var next, prev *pageCursor
+			if hasNext {
+				next = &pageCursor{Name: blobs[len(blobs)-1].BlobName}
+			}
+			if hasPrev {
+				prev = &pageCursor{Name: blobs[0].BlobName, Backward: true}
+			}
+			setPageLinks(w, r, next, prev)
+		}
+	}
+
+	if fields != nil {
+		respondJSON(w, http.StatusOK, projectBlobList(blobs, fields))
+		return
+	}
+	respondJSON(w, http.StatusOK, blobs)
+}
+
+// blobListFields are the names ?fields= may select on GET /v1/blobs, as they
+// appear in the response
+var blobListFields = []string{"blobName", "encryptedName", "collection", "updatedAt", "encryptedSize", "version", "seq", "expiresAt", "pinned"}
+
+// blobListFieldAliases are snake_case names ?fields= also accepts, mapped to
+// the response names they select. A blob's name is its only identifier in the
+// API, so id selects blobName.
+var blobListFieldAliases = map[string]string{"id": "blobName", "updated_at": "updatedAt", "size": "encryptedSize"}
+
+// parseBlobListFields reads ?fields=, a comma-separated subset of
+// blobListFields or their aliases. It returns nil without the parameter,
+// meaning every field. blobName is always included: it identifies the blob
+// and its page cursor.
+func parseBlobListFields(r *http.Request) (map[string]bool, error) {
+	if !r.URL.Query().Has("fields") {
+		return nil, nil
+	}
+	fields := map[string]bool{"blobName": true}
+	for _, field := range strings.Split(r.URL.Query().Get("fields"), ",") {
+		field = strings.TrimSpace(field)
+		if alias, ok := blobListFieldAliases[field]; ok {
+			field = alias
+		}
+		if !slices.Contains(blobListFields, field) {
+			return nil, fmt.Errorf("unknown field %q; fields must be among %s", field, strings.Join(blobListFields, ","))
+		}
+		fields[field] = true
+	}
+	return fields, nil
+}
+
+// projectBlobList keeps the selected fields of each item. Fields that the full
+// listing omits when empty are omitted here too.
+func projectBlobList(blobs []models.BlobListItem, fields map[string]bool) []map[string]interface{} {
+	projected := make([]map[string]interface{}, len(blobs))
+	for i, blob := range blobs {
+		item := map[string]interface{}{"blobName": blob.BlobName}
+		if fields["encryptedName"] && blob.EncryptedName != nil {
+			item["encryptedName"] = blob.EncryptedName
+		}
+		if fields["collection"] && blob.Collection != "" {
+			item["collection"] = blob.Collection
+		}
+		if fields["updatedAt"] {
+			item["updatedAt"] = blob.UpdatedAt
+		}
+		if fields["encryptedSize"] {
+			item["encryptedSize"] = blob.EncryptedSize
+		}
+		if fields["version"] {
+			item["version"] = blob.Version
+		}
+		if fields["seq"] {
+			item["seq"] = blob.Seq
+		}
+		if fields["expiresAt"] && blob.ExpiresAt != nil {
+			item["expiresAt"] = blob.ExpiresAt
+		}
+		if fields["pinned"] && blob.Pinned {
+			item["pinned"] = true
+		}
+		projected[i] = item
+	}
+	return projected
+}
+
+// blobListNotModified sets a weak ETag for the user's blob list under this
+// query, derived from db.BlobListStamp, and answers 304 when If-None-Match
+// names it. The stamp is read before the list, so a write racing the request
+// can only make the ETag older than the body, costing the next poll a 200.
+func (s *Server) blobListNotModified(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	maxSeq, count, err := s.db.BlobListStamp(userID)
+	if err != nil {
+		// Serve the list without an ETag; it is only an optimization
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d,%d,%s", maxSeq, count, r.URL.RawQuery)))
+	etag := `W/"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// BlobCollectionGroup is one collection in a grouped blob listing
+type BlobCollectionGroup struct {
+	Collection string                `json:"collection"`
+	Blobs      []models.BlobListItem `json:"blobs"`
+}
+
+// listBlobsByCollection serves GET /v1/blobs?groupByCollection=true: one
+// query ordered by collection and name, split wherever the collection changes.
+// Collections are in byte order, the default ("") first; empty ones are absent.
+func (s *Server) listBlobsByCollection(w http.ResponseWriter, r *http.Request, userID int64, filter db.BlobFilter) {
+	filter.ByCollection = true
+	blobs, err := s.db.ListBlobs(userID, filter)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to list blobs", err)
+		return
+	}
+
+	groups := []BlobCollectionGroup{}
+	for _, blob := range blobs {
+		if len(groups) == 0 || groups[len(groups)-1].Collection != blob.Collection {
+			groups = append(groups, BlobCollectionGroup{Collection: blob.Collection})
+		}
+		last := &groups[len(groups)-1]
+		last.Blobs = append(last.Blobs, blob)
+	}
+	respondJSON(w, http.StatusOK, groups)
+}
+
+// listBlobChanges serves GET /v1/blobs?sinceSeq=N: blobs written after change
+// sequence N, oldest change first, with the next watermark in X-Max-Seq
+func (s *Server) listBlobChanges(w http.ResponseWriter, r *http.Request, userID int64, filter db.BlobFilter, limit int) {
+	sinceSeq, err := parseSinceSeq(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.SinceSeq = &sinceSeq
+	if limit > 0 {
+		filter.Limit = limit + 1
+	}
+
+	current, err := s.db.BlobSeq()
+	if err != nil {
+		s.respondInternalError(w, r, "failed to list blobs", err)
+		return
+	}
+	blobs, err := s.db.ListBlobs(userID, filter)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to list blobs", err)
+		return
+	}
+
+	more := limit > 0 && len(blobs) > limit
+	if more {
+		blobs = blobs[:limit]
+	}
+	var lastSeq int64
+	if len(blobs) > 0 {
+		lastSeq = blobs[len(blobs)-1].Seq
+	}
+
+	setSeqWatermark(w, current, sinceSeq, lastSeq, more)
+	respondJSON(w, http.StatusOK, blobs)
+}
+
+// BlobDelta handles GET /v1/blobs:delta?sinceSeq=N: what changed after
+// change sequence N, as upsert and delete records without content, oldest
+// first. ?limit= caps the records per response; X-Max-Seq is the next
+// watermark either way.
+func (s *Server) BlobDelta(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	if !r.URL.Query().Has("sinceSeq") {
+		respondError(w, http.StatusBadRequest, "sinceSeq is required")
+		return
+	}
+	sinceSeq, err := parseSinceSeq(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, cursor, err := parsePage(r)
+	if err == nil && cursor != nil {
+		err = fmt.Errorf("cursor is not supported; page with sinceSeq")
+	}
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	current, err := s.db.BlobSeq()
+	if err != nil {
+		s.respondInternalError(w, r, "failed to list changes", err)
+		return
+	}
+	fetch := 0
+	if limit > 0 {
+		fetch = limit + 1
+	}
+	changes, err := s.db.ListBlobChanges(userID, sinceSeq, fetch)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to list changes", err)
+		return
+	}
+
+	more := limit > 0 && len(changes) > limit
+	if more {
+		changes = changes[:limit]
+	}
+	var lastSeq int64
+	if len(changes) > 0 {
+		lastSeq = changes[len(changes)-1].Seq
+	}
+
+	setSeqWatermark(w, current, sinceSeq, lastSeq, more)
+	if changes == nil {
+		changes = []models.BlobChange{}
+	}
+	respondJSON(w, http.StatusOK, changes)
+}
+
+// parseSinceSeq reads the ?sinceSeq= change-sequence watermark
+func parseSinceSeq(r *http.Request) (int64, error) {
+	sinceSeq, err := strconv.ParseInt(r.URL.Query().Get("sinceSeq"), 10, 64)
+	if err != nil || sinceSeq < 0 {
+		return 0, fmt.Errorf("sinceSeq must be a non-negative integer")
+	}
+	return sinceSeq, nil
+}
+
+// setSeqWatermark sets X-Max-Seq, the sinceSeq for the client's next request.
+// current is the sequence read before the listing, so no later write can get
+// a value at or below it. A listing cut short by a limit ends at its last
+// entry, lastSeq, instead; one that caught writes committed after current
+// ends there too.
+func setSeqWatermark(w http.ResponseWriter, current, sinceSeq, lastSeq int64, truncated bool) {
+	watermark := max(current, lastSeq, sinceSeq)
+	if truncated {
+		watermark = lastSeq
+	}
+	w.Header().Set("X-Max-Seq", strconv.FormatInt(watermark, 10))
+}
+
+// BlobFacetsResponse holds blob counts for building navigation
+type BlobFacetsResponse struct {
+	// Collections maps each collection to its blob count; "" is the default collection
+	Collections map[string]int64 `json:"collections"`
+}
+
+// GetBlobFacets handles GET /v1/blobs:facets - per-collection counts of unexpired blobs
+func (s *Server) GetBlobFacets(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	collections, err := s.db.CountBlobsByCollection(userID)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to count blobs", err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, BlobFacetsResponse{Collections: collections})
+}
+
+// BlobSummaryResponse lets a sync client check its local set against the server
+// without fetching the index
+type BlobSummaryResponse struct {
+	Count int `json:"count"`
+	// Digest is the hex SHA-256 described at blobSetDigest
+	Digest string `json:"digest"`
+}
+
+// GetBlobSummary handles GET /v1/blobs:summary
+func (s *Server) GetBlobSummary(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	blobs, err := s.db.ListBlobVersions(userID)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to summarize blobs", err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, BlobSummaryResponse{Count: len(blobs), Digest: blobSetDigest(blobs)})
+}
+
+// blobSetDigest hashes the blob set so clients can recompute it locally: for
+// each blob in byte order of name, SHA-256 absorbs the name length as a
+// big-endian uint32, the UTF-8 name, and the version as a big-endian uint64.
+// Equal digests mean the same names at the same versions.
+func blobSetDigest(blobs []db.BlobNameVersion) string {
+	h := sha256.New()
+	var buf [8]byte
+	for _, blob := range blobs {
+		binary.BigEndian.PutUint32(buf[:4], uint32(len(blob.BlobName)))
+		h.Write(buf[:4])
+		h.Write([]byte(blob.BlobName))
+		binary.BigEndian.PutUint64(buf[:], uint64(blob.Version))
+		h.Write(buf[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// RenameBlobRequest represents a blob rename. Because the blob AAD binds the
+// name, the client must send the container re-encrypted under the new name.
+// With encrypted names, NewName is the new name's token and EncryptedName the
+// new name itself.
+type RenameBlobRequest struct {
+	NewName       string            `json:"newName"`
+	EncryptedBlob models.Container  `json:"encryptedBlob"`
+	EncryptedName *models.Container `json:"encryptedName,omitempty"`
+}
+
+// RenameBlob handles POST /v1/blobs/{blobName}/rename
+func (s *Server) RenameBlob(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	blobName := chi.URLParam(r, "blobName")
+	if blobName == "" {
+		respondError(w, http.StatusBadRequest, "blob name is required")
+		return
+	}
+
+	var req RenameBlobRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	if req.NewName == "" {
+		respondError(w, http.StatusBadRequest, "new name is required")
+		return
+	}
+	if req.NewName == blobName {
+		respondError(w, http.StatusBadRequest, "new name must differ from the current name")
+		return
+	}
+	if req.EncryptedBlob.Ciphertext == "" {
+		respondError(w, http.StatusBadRequest, "encryptedBlob re-encrypted for the new name is required")
+		return
+	}
+	if err := s.validateContainer(req.EncryptedBlob); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if code, message := s.checkBlobName(req.NewName, req.EncryptedName); message != "" {
+		respondBlobNameProblem(w, code, message)
+		return
+	}
+
+	writer, ok := blobWriter(w, r)
+	if !ok {
+		return
+	}
+
+	blob, err := s.db.RenameBlob(userID, blobName, req.NewName, req.EncryptedBlob, req.EncryptedName, s.config.UserQuotaBytes, writer)
+	if err != nil {
+		switch err {
+		case db.ErrBlobNotFound:
+			respondBlobNotFound(w)
+		case db.ErrBlobLocked:
+			s.respondBlobWriteLocked(w, userID, blobName)
+		case db.ErrBlobExists:
+			respondError(w, http.StatusConflict, "a blob with the new name already exists")
+		case db.ErrQuotaExceeded:
+			respondQuotaExceeded(w, userID)
+		case db.ErrNonceReuse:
+			respondErrorCode(w, http.StatusBadRequest, "nonce_reuse", nonceReuseMessage)
+		default:
+			s.respondInternalError(w, r, "failed to rename blob", err)
+		}
+		return
+	}
+	s.audit(r, auditBlobRenamed, userID, blobName+" -> "+blob.BlobName)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"blobName":  blob.BlobName,
+		"updatedAt": blob.UpdatedAt,
+	})
+}
+
+// RewrapBlobRequest carries a blob's content re-encrypted under a fresh nonce,
+// or under a new key the client manages
+type RewrapBlobRequest struct {
+	EncryptedBlob models.Container `json:"encryptedBlob"`
+}
+
+// RewrapBlob handles POST /v1/blobs/{blobName}/rewrap. Unlike PUT it only
+// replaces the container: the blob must exist, and its collection and expiry
+// are kept.
+func (s *Server) RewrapBlob(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	blobName := chi.URLParam(r, "blobName")
+	if blobName == "" {
+		respondError(w, http.StatusBadRequest, "blob name is required")
+		return
+	}
+
+	var req RewrapBlobRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	if req.EncryptedBlob.Ciphertext == "" {
+		respondError(w, http.StatusBadRequest, "encryptedBlob is required")
+		return
+	}
+	if err := s.validateContainer(req.EncryptedBlob); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writer, ok := blobWriter(w, r)
+	if !ok {
+		return
+	}
+
+	blob, err := s.db.RewrapBlob(userID, blobName, req.EncryptedBlob, s.config.UserQuotaBytes, writer)
+	if err != nil {
+		switch err {
+		case db.ErrBlobNotFound:
+			respondBlobNotFound(w)
+		case db.ErrBlobLocked:
+			s.respondBlobWriteLocked(w, userID, blobName)
+		case db.ErrQuotaExceeded:
+			respondQuotaExceeded(w, userID)
+		case db.ErrNonceReuse:
+			respondErrorCode(w, http.StatusBadRequest, "nonce_reuse", nonceReuseMessage)
+		default:
+			s.respondInternalError(w, r, "failed to rewrap blob", err)
+		}
+		return
+	}
+	s.audit(r, auditBlobRewrapped, userID, blob.BlobName)
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"blobName":  blob.BlobName,
+		"updatedAt": blob.UpdatedAt,
+		"version":   blob.Version,
+	})
+}
+
+// TouchBlob handles POST /v1/blobs/{blobName}/touch. It moves updatedAt to now
+// so the blob sorts as recent, leaving the content and version alone.
+func (s *Server) TouchBlob(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	writer, ok := blobWriter(w, r)
+	if !ok {
+		return
+	}
+
+	blobName := chi.URLParam(r, "blobName")
+	updatedAt, err := s.db.TouchBlob(userID, blobName, writer)
+	if err == db.ErrBlobNotFound {
+		respondBlobNotFound(w)
+		return
+	}
+	if err == db.ErrBlobLocked {
+		s.respondBlobWriteLocked(w, userID, blobName)
+		return
+	}
+	if err != nil {
+		s.respondInternalError(w, r, "failed to touch blob", err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"blobName":  blobName,
+		"updatedAt": updatedAt,
+	})
+}
+
+// DeleteBlob handles DELETE /v1/blobs/{blobName}. With If-Match carrying the
+// blob's ETag (or ?ifVersion=N) the delete only happens if the blob is still at
+// that version, so a client cannot delete a write it has not seen.
+func (s *Server) DeleteBlob(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	blobName := chi.URLParam(r, "blobName")
+	if blobName == "" {
+		respondError(w, http.StatusBadRequest, "blob name is required")
+		return
+	}
+
+	versions, conditional, err := deleteVersionPrecondition(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writer, ok := blobWriter(w, r)
+	if !ok {
+		return
+	}
+
+	if conditional {
+		err = s.db.DeleteBlobIfVersion(userID, blobName, versions, writer)
+	} else {
+		err = s.db.DeleteBlob(userID, blobName, writer)
+	}
+	if err != nil {
+		switch err {
+		case db.ErrBlobNotFound:
+			respondBlobNotFound(w)
+		case db.ErrBlobLocked:
+			s.respondBlobWriteLocked(w, userID, blobName)
+		case db.ErrVersionMismatch:
+			respondErrorCode(w, http.StatusPreconditionFailed, "version_mismatch", "blob was changed since the given version; re-fetch and retry")
+		default:
+			s.respondInternalError(w, r, "failed to delete blob", err)
+		}
+		return
+	}
+	s.audit(r, auditBlobDeleted, userID, blobName)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteVersionPrecondition reads the versions a delete is conditional on
+// from If-Match or ?ifVersion=. If-Match is a list of blob ETags compared
+// strongly, as RFC 9110 requires for it: weak tags, and tags that are not a
+// blob version, match nothing. conditional is false when the delete is
+// unconditional, including for If-Match: *.
+func deleteVersionPrecondition(r *http.Request) (versions []int64, conditional bool, err error) {
+	raw := strings.TrimSpace(r.Header.Get("If-Match"))
+	if raw == "*" {
+		return nil, false, nil
+	}
+	if raw == "" {
+		raw = r.URL.Query().Get("ifVersion")
+		if raw == "" {
+			return nil, false, nil
+		}
+		version, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || version < 1 {
+			return nil, false, fmt.Errorf("version must be a positive integer")
+		}
+		return []int64{version}, true, nil
+	}
+
+	for raw != "" {
+		weak := strings.HasPrefix(raw, "W/")
+		if weak {
+			raw = raw[len("W/"):]
+		}
+		end := -1
+		if strings.HasPrefix(raw, `"`) {
+			end = strings.IndexByte(raw[1:], '"') + 1
+		}
+		if end < 1 {
+			return nil, false, fmt.Errorf("If-Match must be * or a list of quoted ETags")
+		}
+		tag := raw[1:end]
+		raw = strings.TrimLeft(raw[end+1:], " \t")
+		if raw != "" {
+			if raw[0] != ',' {
+				return nil, false, fmt.Errorf("If-Match must be * or a list of quoted ETags")
+			}
+			raw = strings.TrimLeft(raw, " \t,")
+		}
+
+		if version, err := strconv.ParseInt(tag, 10, 64); err == nil && version >= 1 && !weak {
+			versions = append(versions, version)
+		}
+	}
+	return versions, true, nil
+}
+
+// TokenRequest represents a request to mint a scoped token
+type TokenRequest struct {
+	Scope middleware.Scope `json:"scope"`
+	Label string           `json:"label,omitempty"` // session label; defaults to the User-Agent
+}
+
+// TokenResponse represents a minted scoped token
+type TokenResponse struct {
+	Token string           `json:"token"`
+	Scope middleware.Scope `json:"scope"`
+}
+
+// IssueToken handles POST /v1/auth/token - mints a token for the current user
+// with the requested scope, e.g. a read-only token for a backup tool
+func (s *Server) IssueToken(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	var req TokenRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	if !req.Scope.Valid() {
+		respondError(w, http.StatusBadRequest, "scope must be read or readwrite")
+		return
+	}
+
+	// A token can only mint tokens with equal or narrower scope
+	if !middleware.GetScopeFromContext(r.Context()).Allows(req.Scope) {
+		respondError(w, http.StatusForbidden, "cannot mint a token broader than the current one")
+		return
+	}
+
+	token, err := s.issueToken(r, userFromContext(r.Context()), req.Scope, req.Label)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to generate token", err)
+		return
+	}
+
+	s.audit(r, auditTokenIssued, userID, string(req.Scope))
+	respondJSON(w, http.StatusCreated, TokenResponse{
+		Token: token,
+		Scope: req.Scope,
+	})
 }
 
 // VerifyAuthResponse represents the auth verification response
@@ -386,8 +1904,212 @@ func (s *Server) VerifyAuth(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// IntrospectRequest names the token to inspect; empty uses the request's own bearer token
+type IntrospectRequest struct {
+	Token string `json:"token,omitempty"`
+}
+
+// IntrospectResponse describes a token after the fashion of OAuth 2.0 token
+// introspection (RFC 7662). Only Active is set for an inactive token.
+type IntrospectResponse struct {
+	Active    bool              `json:"active"`
+	UserID    int64             `json:"userId,omitempty"`
+	Scope     middleware.Scope  `json:"scope,omitempty"`
+	JTI       string            `json:"jti,omitempty"` // session ID; empty for tokens issued without one
+	IssuedAt  *models.Timestamp `json:"issuedAt,omitempty"`
+	ExpiresAt *models.Timestamp `json:"expiresAt,omitempty"`
+}
+
+// IntrospectToken handles POST /v1/auth/introspect. A token that fails
+// validation, has expired, was revoked or belongs to a deleted account is reported as
+// {"active": false} with 200 rather than 401, so monitoring can tell a dead
+// token from a broken endpoint.
+func (s *Server) IntrospectToken(w http.ResponseWriter, r *http.Request) {
+	var req IntrospectRequest
+	if r.ContentLength != 0 && !s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	token := req.Token
+	if token == "" {
+		var err error
+		if token, err = middleware.BearerToken(r); err != nil {
+			respondError(w, http.StatusBadRequest, "token is required in the body or Authorization header")
+			return
+		}
+	}
+
+	claims, err := s.jwtConfig.ValidateToken(token)
+	if err != nil {
+		respondJSON(w, http.StatusOK, IntrospectResponse{Active: false})
+		return
+	}
+	user, err := s.db.GetUserByID(claims.UserID)
+	if err != nil && err != db.ErrUserNotFound {
+		s.respondInternalError(w, r, "failed to get user", err)
+		return
+	}
+	if err == db.ErrUserNotFound || claims.Epoch != user.SessionEpoch {
+		respondJSON(w, http.StatusOK, IntrospectResponse{Active: false})
+		return
+	}
+
+	resp := IntrospectResponse{Active: true, UserID: claims.UserID, Scope: claims.Scope, JTI: claims.ID}
+	if resp.Scope == "" {
+		resp.Scope = middleware.ScopeReadWrite
+	}
+	if claims.IssuedAt != nil {
+		issuedAt := models.NewTimestamp(claims.IssuedAt.Time)
+		resp.IssuedAt = &issuedAt
+	}
+	if claims.ExpiresAt != nil {
+		expiresAt := models.NewTimestamp(claims.ExpiresAt.Time)
+		resp.ExpiresAt = &expiresAt
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// contextKey namespaces values the api package stores in request contexts
+type contextKey string
+
+// userContextKey holds the *models.User loaded by requireAccount
+const userContextKey contextKey = "user"
+
+// requireAccount loads the token's user once per request and attaches it to the
+// context. A valid token whose account no longer exists (deleted after the token
+// was issued) gets 401 account_not_found, and one issued before the account's
+// sessions were revoked gets 401 session_revoked. It must run after AuthMiddleware.
+func (s *Server) requireAccount(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := middleware.GetUserIDFromContext(r.Context())
+		if err != nil {
+			respondError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		user, err := s.db.GetUserByID(userID)
+		if err == db.ErrUserNotFound {
+			respondErrorCode(w, http.StatusUnauthorized, "account_not_found", "account no longer exists")
+			return
+		}
+		if err != nil {
+			s.respondInternalError(w, r, "failed to get user", err)
+			return
+		}
+
+		if middleware.GetEpochFromContext(r.Context()) != user.SessionEpoch {
+			respondErrorCode(w, http.StatusUnauthorized, "session_revoked", "session was revoked; log in again")
+			return
+		}
+
+		// Activity tracking is best effort; a failure must not fail the request.
+		// It is a write, so maintenance mode pauses it.
+		if sessionID := middleware.GetSessionIDFromContext(r.Context()); sessionID != "" && !s.readOnly.Load() {
+			if now := time.Now(); s.sessionUse.due(sessionID, now) {
+				if err := s.db.RecordSessionUse(sessionID, now, sessionActivityResolution); err != nil {
+					log.Printf("Failed to record session use: %v", err)
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	})
+}
+
+// userFromContext returns the user loaded by requireAccount, or nil
+func userFromContext(ctx context.Context) *models.User {
+	user, _ := ctx.Value(userContextKey).(*models.User)
+	return user
+}
+
 // Helper functions
 
+// validateContainer checks a container against the AEAD registry and the
+// configured allow-list of algorithms
+func (s *Server) validateContainer(c models.Container) error {
+	if err := crypto.ValidateContainer(c); err != nil {
+		return err
+	}
+	if c.Alg != "" && !slices.Contains(s.config.AllowedAlgs, c.Alg) {
+		return fmt.Errorf("%w: alg %q is not allowed", crypto.ErrInvalidContainer, c.Alg)
+	}
+	return nil
+}
+
+// nameTokenSize is the byte length of a blob name token, an HMAC-SHA256 of
+// the name under a key only the client holds
+const nameTokenSize = 32
+
+// maxEncryptedNameSize caps the decoded ciphertext of a blob's encrypted name.
+// Names are short; the cap keeps encryptedName from becoming a second payload.
+const maxEncryptedNameSize = 1024
+
+// checkBlobName applies the encrypted-name rules to a blob write. A blob that
+// carries an encrypted name must be stored under its name token, unpadded
+// base64url; under Config.EncryptedNames every write must carry one. It
+// returns the error code and message to reject the write with, or "" for both.
+func (s *Server) checkBlobName(name string, encryptedName *models.Container) (code, message string) {
+	if encryptedName == nil {
+		if s.config.EncryptedNames {
+			return "encrypted_name_required", "encryptedName is required; blob names must be name tokens"
+		}
+		return "", ""
+	}
+	if token, err := base64.RawURLEncoding.DecodeString(name); err != nil || len(token) != nameTokenSize {
+		return "invalid_name_token", "a blob with an encryptedName must be named by its unpadded base64url name token"
+	}
+	if err := s.validateContainer(*encryptedName); err != nil {
+		return "", "encryptedName: " + err.Error()
+	}
+	if ciphertext, err := base64.StdEncoding.DecodeString(encryptedName.Ciphertext); err != nil || len(ciphertext) > maxEncryptedNameSize {
+		return "encrypted_name_too_large", fmt.Sprintf("encryptedName ciphertext must be at most %d bytes", maxEncryptedNameSize)
+	}
+	return "", ""
+}
+
+// respondBlobNameProblem rejects a write that failed checkBlobName
+func respondBlobNameProblem(w http.ResponseWriter, code, message string) {
+	if code == "" {
+		respondError(w, http.StatusBadRequest, message)
+		return
+	}
+	respondErrorCode(w, http.StatusBadRequest, code, message)
+}
+
+// nonceReuseMessage explains a db.ErrNonceReuse rejection to the client
+const nonceReuseMessage = "nonce was already used with different content; encrypt again with a fresh random nonce"
+
+// respondQuotaExceeded rejects a write that would exceed the user's quota and
+// counts it per pseudonymized user, so repeated attempts stand out in metrics
+func respondQuotaExceeded(w http.ResponseWriter, userID int64) {
+	metrics.QuotaRejections.Add(metrics.UserLabel(userID), 1)
+	respondError(w, http.StatusRequestEntityTooLarge, "storage quota exceeded")
+}
+
+// collectionOrDefault applies Config.DefaultCollection to a write that names no collection
+func (s *Server) collectionOrDefault(collection string) string {
+	if collection == "" {
+		return s.config.DefaultCollection
+	}
+	return collection
+}
+
+// tooManyCollectionsMessage explains a db.ErrTooManyCollections rejection
+const tooManyCollectionsMessage = "collection limit reached; use an existing collection"
+
+// parseTimeParam parses an optional RFC3339 query parameter; absent yields nil
+func parseTimeParam(r *http.Request, name string) (*time.Time, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: must be an RFC3339 timestamp", name)
+	}
+	return &t, nil
+}
+
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -397,3 +2119,31 @@ func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 func respondError(w http.ResponseWriter, status int, message string) {
 	respondJSON(w, status, map[string]string{"error": message})
 }
+
+// respondInternalError answers 500 with message and the request ID, and logs
+// err under the same ID so an operator can find it from a client report. The
+// error itself is only sent with Config.DebugErrors: it can name tables, files
+// or SQL that clients have no business seeing.
+func (s *Server) respondInternalError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	requestID := chimw.GetReqID(r.Context())
+	log.Printf("Internal error [%s] %s %s: %s: %v", requestID, r.Method, r.URL.Path, message, err)
+
+	resp := map[string]string{"error": message, "requestId": requestID}
+	if s.config.DebugErrors && err != nil {
+		resp["detail"] = err.Error()
+	}
+	respondJSON(w, http.StatusInternalServerError, resp)
+}
+
+// respondErrorCode is respondError with a machine-readable code alongside the message
+func respondErrorCode(w http.ResponseWriter, status int, code, message string) {
+	respondJSON(w, status, map[string]string{"error": message, "code": code})
+}
+
+// respondBlobNotFound writes the one 404 every blob route gives for a name the
+// caller has no blob under. Blob lookups are scoped by user, so another user's
+// blob and a blob that never existed are the same case here; handlers must not
+// answer 403, 409 or 500 based on rows outside the caller's namespace.
+func respondBlobNotFound(w http.ResponseWriter) {
+	respondError(w, http.StatusNotFound, "blob not found")
+}
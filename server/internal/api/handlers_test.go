@@ -2,13 +2,28 @@ package api
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"expvar"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/shalteor/cryptd-poc/server/internal/crypto"
 	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
 	"github.com/shalteor/cryptd-poc/server/internal/models"
 )
 
@@ -24,6 +39,59 @@ func setupTestServer(t *testing.T) (*Server, *db.DB) {
 	return server, database
 }
 
+// createTestUser inserts a PBKDF2 user with placeholder credentials
+func createTestUser(t *testing.T, database *db.DB, username string) *models.User {
+	t.Helper()
+
+	user := &models.User{
+		Username:          username,
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+	}
+	if err := database.CreateUser(user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	return user
+}
+
+// doRequest serves a request through the router, JSON-encoding body if non-nil
+func doRequest(router http.Handler, method, target, token string, body interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+
+	req := httptest.NewRequest(method, target, bytes.NewReader(data))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestSecurityHeadersWithCORS(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	req := httptest.NewRequest("OPTIONS", "/v1/blobs", nil)
+	req.Header.Set("Origin", "http://localhost:5173")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "http://localhost:5173" {
+		t.Errorf("expected the preflight to be allowed, got origin %q", got)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Content-Security-Policy") == "" {
+		t.Errorf("expected security headers on the preflight, got %v", w.Header())
+	}
+}
+
 func TestGetKDFParams(t *testing.T) {
 	server, database := setupTestServer(t)
 	defer func() { _ = database.Close() }()
@@ -74,6 +142,58 @@ func TestGetKDFParams(t *testing.T) {
 	}
 }
 
+func TestUsernameAvailable(t *testing.T) {
+	options := db.DefaultOptions()
+	options.CaseInsensitiveUsernames = true
+	database, err := db.NewWithOptions(":memory:", options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+	config := DefaultConfig()
+	config.UsernameCheckRate = 3
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	createTestUser(t, database, "alice")
+
+	check := func(username string) (*httptest.ResponseRecorder, time.Duration) {
+		start := time.Now()
+		w := doRequest(router, "GET", "/v1/auth/username-available?username="+username, "", nil)
+		return w, time.Since(start)
+	}
+	for _, tc := range []struct {
+		username  string
+		available bool
+	}{
+		{"bob", true},
+		{"alice", false},
+		{"ALICE", false}, // normalized like registration
+	} {
+		w, elapsed := check(tc.username)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", tc.username, w.Code, w.Body.String())
+		}
+		var resp UsernameAvailableResponse
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		if resp.Available != tc.available {
+			t.Errorf("%s: expected available=%v, got %v", tc.username, tc.available, resp.Available)
+		}
+		if elapsed < usernameCheckFloor {
+			t.Errorf("%s: expected the answer to be padded to %v, took %v", tc.username, usernameCheckFloor, elapsed)
+		}
+	}
+
+	// The fourth check from the same IP within a minute is refused
+	w, _ := check("carol")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 over the rate, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After on a rate-limited check")
+	}
+}
+
 func TestGetKDFParamsUserNotFound(t *testing.T) {
 	server, database := setupTestServer(t)
 	defer func() { _ = database.Close() }()
@@ -102,6 +222,69 @@ func TestGetKDFParamsMissingUsername(t *testing.T) {
 	}
 }
 
+func TestGetKDFBounds(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/auth/kdf/bounds"+query, nil)
+		w := httptest.NewRecorder()
+		server.GetKDFBounds(w, req)
+		return w
+	}
+
+	w := get("?type=argon2id")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var argon KDFBoundsResponse
+	if err := json.NewDecoder(w.Body).Decode(&argon); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if argon.KDFType != models.KDFTypeArgon2id {
+		t.Errorf("expected kdfType argon2id, got %s", argon.KDFType)
+	}
+	if argon.Iterations != (crypto.KDFParamRange{Min: crypto.MinArgon2Iterations, Max: crypto.MaxArgon2Iterations}) {
+		t.Errorf("unexpected iterations range %+v", argon.Iterations)
+	}
+	if argon.MemoryKiB == nil || *argon.MemoryKiB != (crypto.KDFParamRange{Min: crypto.MinArgon2Memory, Max: crypto.MaxArgon2Memory}) {
+		t.Errorf("unexpected memoryKiB range %+v", argon.MemoryKiB)
+	}
+	if argon.Parallelism == nil || *argon.Parallelism != (crypto.KDFParamRange{Min: crypto.MinArgon2Parallelism, Max: 255}) {
+		t.Errorf("unexpected parallelism range %+v", argon.Parallelism)
+	}
+
+	w = get("?type=pbkdf2_sha256")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if string(fields["iterations"]) != fmt.Sprintf(`{"min":%d,"max":%d}`, crypto.MinPBKDF2Iterations, crypto.MaxPBKDF2Iterations) {
+		t.Errorf("unexpected iterations range %s", fields["iterations"])
+	}
+	if _, ok := fields["memoryKiB"]; ok {
+		t.Error("expected no memoryKiB range for PBKDF2")
+	}
+	if _, ok := fields["parallelism"]; ok {
+		t.Error("expected no parallelism range for PBKDF2")
+	}
+
+	for _, query := range []string{"?type=scrypt", ""} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected status 400, got %d", query, w.Code)
+		}
+	}
+
+	// A supported type the server does not allow is refused the same way
+	server.config.AllowedKDFTypes = []models.KDFType{models.KDFTypeArgon2id}
+	if w := get("?type=pbkdf2_sha256"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a disallowed type, got %d", w.Code)
+	}
+}
+
 func TestVerifyAuth(t *testing.T) {
 	server, database := setupTestServer(t)
 	defer func() { _ = database.Close() }()
@@ -226,6 +409,225 @@ func TestRegister(t *testing.T) {
 	}
 }
 
+func TestDecodeJSONBodyErrors(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	valid := `{"encryptedBlob":{"nonce":"n","ciphertext":"c","tag":"t"}}`
+
+	for _, tt := range []struct {
+		name, body   string
+		expected     int
+		expectedCode string
+	}{
+		{"empty", "", http.StatusBadRequest, "missing_body"},
+		{"malformed", `{"encryptedBlob":`, http.StatusBadRequest, "invalid_json"},
+		{"valid", valid, http.StatusOK, ""},
+	} {
+		req := httptest.NewRequest("PUT", "/v1/blobs/vault", strings.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.expected {
+			t.Errorf("%s: expected status %d, got %d: %s", tt.name, tt.expected, w.Code, w.Body.String())
+			continue
+		}
+		var resp map[string]interface{}
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		if tt.expectedCode != "" && resp["code"] != tt.expectedCode {
+			t.Errorf("%s: expected code %q, got %v", tt.name, tt.expectedCode, resp)
+		}
+	}
+
+	// Public routes share the helper
+	w := doRequest(router, "POST", "/v1/auth/verify", "", nil)
+	if !strings.Contains(w.Body.String(), "missing_body") {
+		t.Errorf("expected missing_body on verify, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestVerifierHashAlgConfigurable(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	config := DefaultConfig()
+	config.VerifierHashAlg = models.VerifierHashPBKDF2SHA512
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	loginVerifier := crypto.EncodeBase64(make([]byte, 32))
+	w := doRequest(router, "POST", "/v1/auth/register", "", RegisterRequest{
+		Username:          "alice",
+		LoginVerifier:     loginVerifier,
+		WrappedAccountKey: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	user, err := database.GetUserByUsername("alice")
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	if user.VerifierHashAlg != models.VerifierHashPBKDF2SHA512 {
+		t.Errorf("expected %s, got %s", models.VerifierHashPBKDF2SHA512, user.VerifierHashAlg)
+	}
+
+	w = doRequest(router, "POST", "/v1/auth/verify", "", VerifyRequest{Username: "alice", LoginVerifier: loginVerifier})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 for SHA-512 user, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Users hashed before the switch still verify with their stored algorithm
+	legacy := createTestUser(t, database, "bob")
+	legacy.LoginVerifierHash = crypto.HashLoginVerifier(make([]byte, 32), "bob")
+	if err := database.UpdateUser(legacy); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+
+	w = doRequest(router, "POST", "/v1/auth/verify", "", VerifyRequest{Username: "bob", LoginVerifier: loginVerifier})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 for SHA-256 user, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestVerifierRehashedOnLogin(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	verifier := make([]byte, 32)
+	loginVerifier := crypto.EncodeBase64(verifier)
+	user := createTestUser(t, database, "alice")
+	user.LoginVerifierHash = crypto.HashLoginVerifier(verifier, "alice")
+	if err := database.UpdateUser(user); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+	before, _ := database.GetUserByUsername("alice")
+
+	// The server now hashes with SHA-512; alice's row still has SHA-256
+	config := DefaultConfig()
+	config.VerifierHashAlg = models.VerifierHashPBKDF2SHA512
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	w := doRequest(router, "POST", "/v1/auth/verify", "", VerifyRequest{Username: "alice", LoginVerifier: loginVerifier})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	after, _ := database.GetUserByUsername("alice")
+	if after.VerifierHashAlg != models.VerifierHashPBKDF2SHA512 {
+		t.Errorf("expected the hash upgraded to %s, got %s", models.VerifierHashPBKDF2SHA512, after.VerifierHashAlg)
+	}
+	if bytes.Equal(after.LoginVerifierHash, before.LoginVerifierHash) {
+		t.Error("expected a new stored hash")
+	}
+	if after.Rev != before.Rev {
+		t.Errorf("expected rev to stay %d, got %d", before.Rev, after.Rev)
+	}
+
+	// The upgraded hash verifies, and a wrong verifier still fails
+	w = doRequest(router, "POST", "/v1/auth/verify", "", VerifyRequest{Username: "alice", LoginVerifier: loginVerifier})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 after the upgrade, got %d: %s", w.Code, w.Body.String())
+	}
+	wrong := crypto.EncodeBase64(bytes.Repeat([]byte{1}, 32))
+	w = doRequest(router, "POST", "/v1/auth/verify", "", VerifyRequest{Username: "alice", LoginVerifier: wrong})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a wrong verifier, got %d", w.Code)
+	}
+}
+
+func TestAllowedKDFTypes(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	config := DefaultConfig()
+	config.AllowedKDFTypes = []models.KDFType{models.KDFTypeArgon2id}
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	w := doRequest(router, "GET", "/v1/capabilities", "", nil)
+	var caps CapabilitiesResponse
+	_ = json.NewDecoder(w.Body).Decode(&caps)
+	if !slices.Equal(caps.KDFTypes, []models.KDFType{models.KDFTypeArgon2id}) {
+		t.Errorf("expected capabilities to list only argon2id, got %v", caps.KDFTypes)
+	}
+
+	memKiB, parallelism := 65536, 4
+	register := func(username string, kdfType models.KDFType, iterations int) *httptest.ResponseRecorder {
+		req := RegisterRequest{
+			Username:          username,
+			KDFType:           kdfType,
+			KDFIterations:     iterations,
+			LoginVerifier:     crypto.EncodeBase64(make([]byte, 32)),
+			WrappedAccountKey: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+		}
+		if kdfType == models.KDFTypeArgon2id {
+			req.KDFMemoryKiB, req.KDFParallelism = &memKiB, &parallelism
+		}
+		return doRequest(router, "POST", "/v1/auth/register", "", req)
+	}
+	if w := register("bob", models.KDFTypePBKDF2SHA256, 600_000); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "kdf_type_not_allowed") {
+		t.Errorf("expected 400 kdf_type_not_allowed for PBKDF2, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := register("carol", models.KDFTypeArgon2id, 3); w.Code != http.StatusCreated {
+		t.Errorf("expected Argon2id registration to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// An account created before PBKDF2 was disallowed still logs in, with a hint
+	user := createTestUser(t, database, "alice")
+	user.LoginVerifierHash = crypto.HashLoginVerifier(make([]byte, 32), "alice")
+	_ = database.UpdateUser(user)
+	w = doRequest(router, "POST", "/v1/auth/verify", "", VerifyRequest{Username: "alice", LoginVerifier: crypto.EncodeBase64(make([]byte, 32))})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the PBKDF2 account to log in, got %d: %s", w.Code, w.Body.String())
+	}
+	var login VerifyResponse
+	_ = json.NewDecoder(w.Body).Decode(&login)
+	if login.KDFUpgrade == nil || login.KDFUpgrade.Type != models.KDFTypeArgon2id {
+		t.Fatalf("expected an Argon2id upgrade hint, got %+v", login.KDFUpgrade)
+	}
+
+	// Switching to a disallowed type is refused; following the hint is not
+	update := UpdateUserRequest{
+		LoginVerifier:     crypto.EncodeBase64(make([]byte, 32)),
+		WrappedAccountKey: models.Container{Nonce: "new-nonce", Ciphertext: "new-ciphertext", Tag: "new-tag"},
+		KDF:               &models.KDFParams{Type: models.KDFTypePBKDF2SHA256, Iterations: 700_000},
+	}
+	if w := doRequest(router, "PATCH", "/v1/users/me", login.Token, update); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "kdf_type_not_allowed") {
+		t.Errorf("expected 400 kdf_type_not_allowed, got %d: %s", w.Code, w.Body.String())
+	}
+	update.KDF = login.KDFUpgrade
+	if w := doRequest(router, "PATCH", "/v1/users/me", login.Token, update); w.Code != http.StatusOK {
+		t.Fatalf("expected the KDF upgrade to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	upgraded, _ := database.GetUserByID(user.ID)
+	if upgraded.KDFType != models.KDFTypeArgon2id || upgraded.KDFMemoryKiB == nil || *upgraded.KDFMemoryKiB != *config.DefaultKDF.MemoryKiB {
+		t.Errorf("expected the account on the default Argon2id params, got %+v", upgraded)
+	}
+
+	w = doRequest(router, "POST", "/v1/auth/verify", "", VerifyRequest{Username: "alice", LoginVerifier: crypto.EncodeBase64(make([]byte, 32))})
+	login = VerifyResponse{}
+	_ = json.NewDecoder(w.Body).Decode(&login)
+	if login.KDFUpgrade != nil {
+		t.Errorf("expected no hint after upgrading, got %+v", login.KDFUpgrade)
+	}
+}
+
 func TestRegisterDuplicateUsername(t *testing.T) {
 	server, database := setupTestServer(t)
 	defer func() { _ = database.Close() }()
@@ -268,6 +670,108 @@ func TestRegisterDuplicateUsername(t *testing.T) {
 	}
 }
 
+func TestRegisterKDFTooExpensive(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	server.config.MaxKDFDuration = time.Second
+	router := server.NewRouter()
+
+	register := func(username string, iterations, memKiB int) *httptest.ResponseRecorder {
+		parallelism := 1
+		return doRequest(router, "POST", "/v1/auth/register", "", RegisterRequest{
+			Username:          username,
+			KDFType:           models.KDFTypeArgon2id,
+			KDFIterations:     iterations,
+			KDFMemoryKiB:      &memKiB,
+			KDFParallelism:    &parallelism,
+			LoginVerifier:     crypto.EncodeBase64(make([]byte, 32)),
+			WrappedAccountKey: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+		})
+	}
+
+	// 1000 passes over 4 GiB is hours of work on any hardware
+	w := register("alice", 1000, 4<<20)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "kdf_too_expensive") {
+		t.Errorf("expected 400 kdf_too_expensive, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := database.GetUserByUsername("alice"); err != db.ErrUserNotFound {
+		t.Errorf("expected no user to be created, got %v", err)
+	}
+
+	if w := register("bob", crypto.MinArgon2Iterations, crypto.MinArgon2Memory); w.Code != http.StatusCreated {
+		t.Errorf("expected minimal params to fit the budget, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestUpdateUserKDFTooExpensive(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	server.config.MaxKDFDuration = time.Second
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	update := func(iterations, memKiB int) *httptest.ResponseRecorder {
+		parallelism := 1
+		return doRequest(router, "PATCH", "/v1/users/me", token, UpdateUserRequest{
+			LoginVerifier:     crypto.EncodeBase64(make([]byte, 32)),
+			WrappedAccountKey: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+			KDF: &models.KDFParams{
+				Type:        models.KDFTypeArgon2id,
+				Iterations:  iterations,
+				MemoryKiB:   &memKiB,
+				Parallelism: &parallelism,
+			},
+		})
+	}
+
+	w := update(1000, 4<<20)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "kdf_too_expensive") {
+		t.Errorf("expected 400 kdf_too_expensive, got %d: %s", w.Code, w.Body.String())
+	}
+	if stored, _ := database.GetUserByID(user.ID); stored.KDFType == models.KDFTypeArgon2id && stored.KDFIterations == 1000 {
+		t.Error("expected the expensive params not to be stored")
+	}
+
+	if w := update(crypto.MinArgon2Iterations, crypto.MinArgon2Memory); w.Code != http.StatusOK {
+		t.Errorf("expected minimal params to fit the budget, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRegisterConcurrentSameUsername(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	req := RegisterRequest{
+		Username:          "alice",
+		LoginVerifier:     crypto.EncodeBase64(make([]byte, 32)),
+		WrappedAccountKey: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+	}
+
+	// Register has no pre-check, so every loser reaches the UNIQUE constraint
+	const attempts = 4
+	codes := make(chan int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- doRequest(router, "POST", "/v1/auth/register", "", req).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusCreated] != 1 || counts[http.StatusConflict] != attempts-1 {
+		t.Errorf("expected one 201 and %d 409s, got %v", attempts-1, counts)
+	}
+}
+
 func TestRegisterInvalidKDFParams(t *testing.T) {
 	server, database := setupTestServer(t)
 	defer func() { _ = database.Close() }()
@@ -295,6 +799,46 @@ func TestRegisterInvalidKDFParams(t *testing.T) {
 	}
 }
 
+func TestLoginVerifierLength(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	container := models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"}
+
+	for _, size := range []int{0, crypto.LoginVerifierLength - 1, crypto.LoginVerifierLength + 1, 64} {
+		verifier := crypto.EncodeBase64(make([]byte, size))
+		expected := fmt.Sprintf("login verifier must be %d bytes, got %d", crypto.LoginVerifierLength, size)
+
+		for _, req := range []struct {
+			method, target, token string
+			body                  interface{}
+		}{
+			{"POST", "/v1/auth/register", "", RegisterRequest{Username: "bob", KDFType: models.KDFTypePBKDF2SHA256, KDFIterations: 600_000, LoginVerifier: verifier, WrappedAccountKey: container}},
+			{"POST", "/v1/auth/verify", "", VerifyRequest{Username: "alice", LoginVerifier: verifier}},
+			{"POST", "/v1/auth/verify", "", VerifyRequest{Username: "nobody", LoginVerifier: verifier}},
+			{"PATCH", "/v1/users/me", token, UpdateUserRequest{LoginVerifier: verifier, WrappedAccountKey: container}},
+		} {
+			w := doRequest(router, req.method, req.target, req.token, req.body)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s %s with %d bytes: expected status 400, got %d", req.method, req.target, size, w.Code)
+				continue
+			}
+			var errResp map[string]string
+			_ = json.NewDecoder(w.Body).Decode(&errResp)
+			if errResp["error"] != expected {
+				t.Errorf("%s %s: expected %q, got %q", req.method, req.target, expected, errResp["error"])
+			}
+		}
+	}
+
+	if _, err := database.GetUserByUsername("bob"); err == nil {
+		t.Error("expected no user to be registered with a bad verifier")
+	}
+}
+
 func TestVerify(t *testing.T) {
 	server, database := setupTestServer(t)
 	defer func() { _ = database.Close() }()
@@ -419,45 +963,178 @@ func TestVerifyInvalidCredentials(t *testing.T) {
 	}
 }
 
-func TestUpdateUser(t *testing.T) {
+func TestCheckAuth(t *testing.T) {
 	server, database := setupTestServer(t)
 	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
 
-	// Create user
-	memKiB := 65536
-	parallelism := 4
-	user := &models.User{
-		Username:          "alice",
-		KDFType:           models.KDFTypeArgon2id,
-		KDFIterations:     3,
-		KDFMemoryKiB:      &memKiB,
-		KDFParallelism:    &parallelism,
-		LoginVerifierHash: []byte("old-hash"),
-		WrappedAccountKey: models.Container{
-			Nonce:      "old-nonce",
-			Ciphertext: "old-ciphertext",
-			Tag:        "old-tag",
-		},
+	user := createTestUser(t, database, "canary")
+	user.LoginVerifierHash = crypto.HashLoginVerifier(make([]byte, 32), "canary")
+	if err := database.UpdateUser(user); err != nil {
+		t.Fatalf("failed to update user: %v", err)
 	}
 
-	_ = database.CreateUser(user)
+	w := doRequest(router, "POST", "/v1/auth/check", "", VerifyRequest{
+		Username:      "canary",
+		LoginVerifier: crypto.EncodeBase64(make([]byte, 32)),
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "token") {
+		t.Errorf("check must not issue a token: %s", w.Body.String())
+	}
 
-	// Generate token
-	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	wrong := make([]byte, 32)
+	wrong[0] = 1
+	w = doRequest(router, "POST", "/v1/auth/check", "", VerifyRequest{
+		Username:      "canary",
+		LoginVerifier: crypto.EncodeBase64(wrong),
+	})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", w.Code)
+	}
 
-	// Update user
-	newUsername := "alice-new"
-	req := UpdateUserRequest{
-		Username:      &newUsername,
+	w = doRequest(router, "POST", "/v1/auth/check", "", VerifyRequest{
+		Username:      "nobody",
 		LoginVerifier: crypto.EncodeBase64(make([]byte, 32)),
-		WrappedAccountKey: models.Container{
-			Nonce:      "new-nonce",
-			Ciphertext: "new-ciphertext",
-			Tag:        "new-tag",
-		},
+	})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for unknown user, got %d", w.Code)
 	}
+}
 
-	body, _ := json.Marshal(req)
+func TestIntrospectToken(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	session := sessionToken(t, server, user.ID, "laptop")
+	readOnly, _ := server.jwtConfig.GenerateScopedToken(user.ID, middleware.ScopeRead)
+	expired, _ := server.jwtConfig.GenerateSessionToken(user.ID, middleware.ScopeReadWrite, "", 0, time.Now().Add(-48*time.Hour))
+	forged, _ := middleware.NewJWTConfig("other-secret").GenerateToken(user.ID)
+	gone := createTestUser(t, database, "bob")
+	orphaned, _ := server.jwtConfig.GenerateToken(gone.ID)
+	_ = database.DeleteUser(gone.ID)
+
+	introspect := func(token, bearer string) IntrospectResponse {
+		t.Helper()
+		w := doRequest(router, "POST", "/v1/auth/introspect", bearer, IntrospectRequest{Token: token})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), "test-jwt-secret") {
+			t.Fatal("introspection must never return the signing secret")
+		}
+		var resp IntrospectResponse
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		return resp
+	}
+
+	resp := introspect(session, "")
+	if !resp.Active || resp.UserID != user.ID || resp.Scope != middleware.ScopeReadWrite || resp.JTI == "" {
+		t.Errorf("unexpected introspection of a session token: %+v", resp)
+	}
+	if resp.IssuedAt == nil || resp.ExpiresAt == nil || !resp.ExpiresAt.After(resp.IssuedAt.Time) {
+		t.Errorf("expected issuedAt before expiresAt, got %+v", resp)
+	}
+	if resp := introspect("", readOnly); !resp.Active || resp.Scope != middleware.ScopeRead || resp.JTI != "" {
+		t.Errorf("expected the bearer token to be introspected as read scope, got %+v", resp)
+	}
+
+	for name, token := range map[string]string{"expired": expired, "forged": forged, "orphaned": orphaned, "garbage": "not-a-token"} {
+		if resp := introspect(token, session); resp != (IntrospectResponse{}) {
+			t.Errorf("%s: expected only active=false, got %+v", name, resp)
+		}
+	}
+
+	if w := doRequest(router, "POST", "/v1/auth/introspect", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 without any token, got %d", w.Code)
+	}
+}
+
+func TestKDFTiming(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	createTestUser(t, database, "alice")
+	check := VerifyRequest{Username: "alice", LoginVerifier: crypto.EncodeBase64(make([]byte, 32))}
+	label := "pbkdf2_sha256,iterations=600000"
+
+	// Disabled by default: the hash runs but nothing is recorded
+	before := expvarInt(metrics.KDFHashes, label)
+	doRequest(NewServer(database, "test-jwt-secret").NewRouter(), "POST", "/v1/auth/check", "", check)
+	if got := expvarInt(metrics.KDFHashes, label); got != before {
+		t.Errorf("expected no KDF samples while disabled, got %d new", got-before)
+	}
+
+	config := DefaultConfig()
+	config.KDFTiming = true
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+
+	w := doRequest(server.NewRouter(), "POST", "/v1/auth/check", "", check)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", w.Code)
+	}
+	if got := expvarInt(metrics.KDFHashes, label); got != before+1 {
+		t.Errorf("expected one KDF sample for a failed check, got %d", got-before)
+	}
+	if expvarInt(metrics.KDFHashNanos, label) <= 0 {
+		t.Error("expected KDF duration to be recorded")
+	}
+}
+
+// expvarInt reads an integer counter from an expvar map, 0 if unset
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestUpdateUser(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	// Create user
+	memKiB := 65536
+	parallelism := 4
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypeArgon2id,
+		KDFIterations:     3,
+		KDFMemoryKiB:      &memKiB,
+		KDFParallelism:    &parallelism,
+		LoginVerifierHash: []byte("old-hash"),
+		WrappedAccountKey: models.Container{
+			Nonce:      "old-nonce",
+			Ciphertext: "old-ciphertext",
+			Tag:        "old-tag",
+		},
+	}
+
+	_ = database.CreateUser(user)
+
+	// Generate token
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	// Update user
+	newUsername := "alice-new"
+	req := UpdateUserRequest{
+		Username:      &newUsername,
+		LoginVerifier: crypto.EncodeBase64(make([]byte, 32)),
+		WrappedAccountKey: models.Container{
+			Nonce:      "new-nonce",
+			Ciphertext: "new-ciphertext",
+			Tag:        "new-tag",
+		},
+	}
+
+	body, _ := json.Marshal(req)
 	httpReq := httptest.NewRequest("PATCH", "/v1/users/me", bytes.NewReader(body))
 	httpReq.Header.Set("Authorization", "Bearer "+token)
 
@@ -586,6 +1263,64 @@ func TestGetBlob(t *testing.T) {
 	}
 }
 
+func TestGetBlobIfVersionMatch(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	blob := &models.Blob{UserID: user.ID, BlobName: "vault", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c1", Tag: "t"}}
+	_ = database.UpsertBlob(blob)
+	blob.EncryptedBlob.Ciphertext = "c2"
+	_ = database.UpsertBlob(blob)
+
+	// Match via header: 304, no body
+	req := httptest.NewRequest("GET", "/v1/blobs/vault", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("If-Version-Match", "2")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("expected status 304, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("expected empty body on 304, got %q", w.Body.String())
+	}
+
+	// Match via query parameter
+	w = doRequest(router, "GET", "/v1/blobs/vault?ifVersion=2", token, nil)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("expected status 304 for ?ifVersion, got %d", w.Code)
+	}
+
+	// Mismatch: the full blob with its current version
+	w = doRequest(router, "GET", "/v1/blobs/vault?ifVersion=1", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var resp struct {
+		EncryptedBlob models.Container `json:"encryptedBlob"`
+		Version       int64            `json:"version"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Version != 2 || resp.EncryptedBlob.Ciphertext != "c2" {
+		t.Errorf("expected version 2 with current ciphertext, got %+v", resp)
+	}
+
+	w = doRequest(router, "GET", "/v1/blobs/vault?ifVersion=latest", token, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for non-numeric version, got %d", w.Code)
+	}
+	w = doRequest(router, "GET", "/v1/blobs/missing?ifVersion=1", token, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for missing blob, got %d", w.Code)
+	}
+}
+
 func TestListBlobs(t *testing.T) {
 	server, database := setupTestServer(t)
 	defer func() { _ = database.Close() }()
@@ -640,52 +1375,2307 @@ func TestListBlobs(t *testing.T) {
 	}
 }
 
-func TestDeleteBlob(t *testing.T) {
+func TestListBlobsByCollection(t *testing.T) {
 	server, database := setupTestServer(t)
 	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
 
-	// Create user and blob
-	user := &models.User{
-		Username:          "alice",
-		KDFType:           models.KDFTypePBKDF2SHA256,
-		KDFIterations:     600_000,
-		LoginVerifierHash: []byte("hash"),
-		WrappedAccountKey: models.Container{
-			Nonce:      "nonce",
-			Ciphertext: "ciphertext",
-			Tag:        "tag",
-		},
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	container := models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"}
+	for _, req := range []struct{ name, collection string }{{"vault", ""}, {"report", "work"}, {"diary", "home"}} {
+		w := doRequest(router, "PUT", "/v1/blobs/"+req.name, token, UpsertBlobRequest{EncryptedBlob: container, Collection: req.collection})
+		if w.Code != http.StatusOK {
+			t.Fatalf("failed to upsert %s: %d %s", req.name, w.Code, w.Body.String())
+		}
 	}
-	_ = database.CreateUser(user)
 
-	blob := &models.Blob{
-		UserID:   user.ID,
-		BlobName: "vault",
-		EncryptedBlob: models.Container{
-			Nonce:      "nonce",
-			Ciphertext: "ciphertext",
-			Tag:        "tag",
-		},
+	list := func(query string) []models.BlobListItem {
+		w := doRequest(router, "GET", "/v1/blobs"+query, token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+		var items []models.BlobListItem
+		_ = json.NewDecoder(w.Body).Decode(&items)
+		return items
 	}
-	_ = database.UpsertBlob(blob)
 
-	// Generate token and delete blob
+	if items := list("?collection=work"); len(items) != 1 || items[0].BlobName != "report" || items[0].Collection != "work" {
+		t.Errorf("expected only report in work, got %+v", items)
+	}
+	if items := list("?collection="); len(items) != 1 || items[0].BlobName != "vault" {
+		t.Errorf("expected only vault in the default collection, got %+v", items)
+	}
+	if items := list(""); len(items) != 3 {
+		t.Errorf("expected all 3 blobs by default, got %+v", items)
+	}
+	if items := list("?collection=Work"); len(items) != 0 {
+		t.Errorf("expected exact-match filtering, got %+v", items)
+	}
+}
+
+func TestListBlobsFields(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
 	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	for _, name := range []string{"notes", "vault"} {
+		_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: name, Collection: "work", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Y2lwaGVy", Tag: "t"}})
+	}
 
-	httpReq := httptest.NewRequest("DELETE", "/v1/blobs/vault", nil)
-	httpReq.Header.Set("Authorization", "Bearer "+token)
+	list := func(target string) []map[string]interface{} {
+		t.Helper()
+		w := doRequest(router, "GET", target, token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected status 200, got %d: %s", target, w.Code, w.Body.String())
+		}
+		var items []map[string]interface{}
+		_ = json.NewDecoder(w.Body).Decode(&items)
+		if len(items) != 2 {
+			t.Fatalf("GET %s: expected 2 blobs, got %d", target, len(items))
+		}
+		return items
+	}
+	keys := func(item map[string]interface{}) []string {
+		names := make([]string, 0, len(item))
+		for name := range item {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	item := list("/v1/blobs?fields=version,encryptedSize")[0]
+	if got := keys(item); !slices.Equal(got, []string{"blobName", "encryptedSize", "version"}) {
+		t.Errorf("expected blobName, encryptedSize and version, got %v", got)
+	}
+	if item["encryptedSize"] != float64(6) {
+		t.Errorf("expected encryptedSize 6, got %v", item["encryptedSize"])
+	}
+
+	item = list("/v1/blobs?fields=collection,updatedAt")[0]
+	if got := keys(item); !slices.Equal(got, []string{"blobName", "collection", "updatedAt"}) {
+		t.Errorf("expected blobName, collection and updatedAt, got %v", got)
+	}
+
+	// Snake_case aliases select the same fields
+	item = list("/v1/blobs?fields=id,updated_at,size")[0]
+	if got := keys(item); !slices.Equal(got, []string{"blobName", "encryptedSize", "updatedAt"}) {
+		t.Errorf("expected blobName, encryptedSize and updatedAt, got %v", got)
+	}
 
+	// Without the parameter the listing is unchanged
+	if got := keys(list("/v1/blobs")[0]); !slices.Contains(got, "seq") || !slices.Contains(got, "encryptedSize") {
+		t.Errorf("expected the full field set by default, got %v", got)
+	}
+
+	w := doRequest(router, "GET", "/v1/blobs?fields=version,content_type", token, nil)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_field") {
+		t.Errorf("expected 400 invalid_field for an unknown field, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "GET", "/v1/blobs?fields=version&sinceSeq=0", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for fields with sinceSeq, got %d", w.Code)
+	}
+}
+
+func TestListBlobsGroupByCollection(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+	config := DefaultConfig()
+	config.DefaultCollection = "inbox"
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
 	router := server.NewRouter()
-	w := httptest.NewRecorder()
-	router.ServeHTTP(w, httpReq)
 
-	if w.Code != http.StatusNoContent {
-		t.Errorf("expected status 204, got %d", w.Code)
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	container := models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"}
+	for _, req := range []struct{ name, collection string }{
+		{"vault", ""}, {"report", "work"}, {"diary", "home"}, {"budget", "work"}, {"todo", ""},
+	} {
+		w := doRequest(router, "PUT", "/v1/blobs/"+req.name, token, UpsertBlobRequest{EncryptedBlob: container, Collection: req.collection})
+		if w.Code != http.StatusOK {
+			t.Fatalf("failed to upsert %s: %d %s", req.name, w.Code, w.Body.String())
+		}
 	}
 
-	// Verify deletion
-	_, err := database.GetBlob(user.ID, "vault")
-	if err != db.ErrBlobNotFound {
-		t.Error("blob should be deleted")
+	w := doRequest(router, "GET", "/v1/blobs?groupByCollection=true", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var groups []BlobCollectionGroup
+	_ = json.NewDecoder(w.Body).Decode(&groups)
+
+	// Blobs written without a collection land in the configured default
+	expected := map[string][]string{"home": {"diary"}, "inbox": {"todo", "vault"}, "work": {"budget", "report"}}
+	var order []string
+	for _, group := range groups {
+		order = append(order, group.Collection)
+		var names []string
+		for _, blob := range group.Blobs {
+			names = append(names, blob.BlobName)
+		}
+		if !slices.Equal(names, expected[group.Collection]) {
+			t.Errorf("collection %q: expected %v, got %v", group.Collection, expected[group.Collection], names)
+		}
+	}
+	if !slices.Equal(order, []string{"home", "inbox", "work"}) {
+		t.Errorf("expected collections in order, got %v", order)
+	}
+
+	// Flat listing stays the default
+	w = doRequest(router, "GET", "/v1/blobs", token, nil)
+	var items []models.BlobListItem
+	_ = json.NewDecoder(w.Body).Decode(&items)
+	if len(items) != 5 || items[0].BlobName != "budget" {
+		t.Errorf("expected a flat list by name, got %+v", items)
+	}
+
+	if w := doRequest(router, "GET", "/v1/blobs?groupByCollection=true&limit=2", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 with pagination, got %d", w.Code)
+	}
+}
+
+func TestBlobWriteRateLimit(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+	config := DefaultConfig()
+	config.BlobWriteRate = 1
+	config.BlobWriteBurst = 3
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	alice := createTestUser(t, database, "alice")
+	aliceToken, _ := server.jwtConfig.GenerateToken(alice.ID)
+	bob := createTestUser(t, database, "bob")
+	bobToken, _ := server.jwtConfig.GenerateToken(bob.ID)
+	body := UpsertBlobRequest{EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"}}
+
+	// Writes of any kind share the burst
+	for i, req := range []struct{ method, target string }{
+		{"PUT", "/v1/blobs/a"}, {"PUT", "/v1/blobs/b"}, {"DELETE", "/v1/blobs/a"},
+	} {
+		var payload interface{}
+		if req.method == "PUT" {
+			payload = body
+		}
+		if w := doRequest(router, req.method, req.target, aliceToken, payload); w.Code >= 300 {
+			t.Fatalf("write %d: expected success, got %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+	w := doRequest(router, "PUT", "/v1/blobs/c", aliceToken, body)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 once the burst is spent, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After on a throttled write")
+	}
+
+	// Reads are not throttled, and other users have their own budget
+	if w := doRequest(router, "GET", "/v1/blobs/b", aliceToken, nil); w.Code != http.StatusOK {
+		t.Errorf("expected reads to pass, got %d", w.Code)
+	}
+	if w := doRequest(router, "PUT", "/v1/blobs/c", bobToken, body); w.Code != http.StatusOK {
+		t.Errorf("expected bob to be unaffected, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestListBlobsETag(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	body := UpsertBlobRequest{EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"}}
+	_ = doRequest(router, "PUT", "/v1/blobs/a", token, body)
+
+	list := func(target, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := list("/v1/blobs", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("expected 200 with a weak ETag, got %d %q", w.Code, etag)
+	}
+
+	// Unchanged: 304 without a body
+	w = list("/v1/blobs", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected an empty 304, got %d: %s", w.Code, w.Body.String())
+	}
+	// The same stamp under another query is a different list
+	if w := list("/v1/blobs?collection=work", etag); w.Code != http.StatusOK {
+		t.Errorf("expected 200 for another query, got %d", w.Code)
+	}
+
+	// Each kind of change moves the ETag
+	for _, change := range []struct{ method, target string }{
+		{"PUT", "/v1/blobs/b"},
+		{"POST", "/v1/blobs/a/touch"},
+		{"DELETE", "/v1/blobs/b"},
+	} {
+		var payload interface{}
+		if change.method == "PUT" {
+			payload = body
+		}
+		if w := doRequest(router, change.method, change.target, token, payload); w.Code >= 300 {
+			t.Fatalf("%s %s failed: %d", change.method, change.target, w.Code)
+		}
+		w := list("/v1/blobs", etag)
+		if w.Code != http.StatusOK {
+			t.Errorf("after %s %s: expected 200, got %d", change.method, change.target, w.Code)
+		}
+		if next := w.Header().Get("ETag"); next == etag {
+			t.Errorf("after %s %s: expected a new ETag", change.method, change.target)
+		} else {
+			etag = next
+		}
+	}
+}
+
+func TestListBlobsSinceSeq(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	alice := createTestUser(t, database, "alice")
+	bob := createTestUser(t, database, "bob")
+	token, _ := server.jwtConfig.GenerateToken(alice.ID)
+	container := models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"}
+
+	put := func(userID int64, name string) {
+		t.Helper()
+		if err := database.UpsertBlob(&models.Blob{UserID: userID, BlobName: name, EncryptedBlob: container}); err != nil {
+			t.Fatalf("failed to upsert %s: %v", name, err)
+		}
+	}
+	sync := func(query string) ([]models.BlobListItem, string) {
+		t.Helper()
+		w := doRequest(router, "GET", "/v1/blobs?"+query, token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var items []models.BlobListItem
+		_ = json.NewDecoder(w.Body).Decode(&items)
+		return items, w.Header().Get("X-Max-Seq")
+	}
+	names := func(items []models.BlobListItem) []string {
+		var out []string
+		for _, item := range items {
+			out = append(out, item.BlobName)
+		}
+		return out
+	}
+
+	put(alice.ID, "b")
+	put(alice.ID, "a")
+	put(bob.ID, "other")
+
+	// A full sync returns everything in write order and a watermark
+	items, watermark := sync("sinceSeq=0")
+	if got := names(items); !slices.Equal(got, []string{"b", "a"}) {
+		t.Fatalf("expected b then a in write order, got %v", got)
+	}
+	if watermark == "" {
+		t.Fatal("expected an X-Max-Seq header")
+	}
+
+	// Nothing changed: the watermark holds and the list is empty
+	if items, again := sync("sinceSeq=" + watermark); len(items) != 0 || again != watermark {
+		t.Errorf("expected no changes at %s, got %v at %s", watermark, names(items), again)
+	}
+
+	// An update moves a blob past the watermark; other users' writes are not listed
+	put(alice.ID, "b")
+	put(bob.ID, "other")
+	put(alice.ID, "c")
+	items, next := sync("sinceSeq=" + watermark)
+	if got := names(items); !slices.Equal(got, []string{"b", "c"}) {
+		t.Errorf("expected b then c after the watermark, got %v", got)
+	}
+
+	// A limited page ends its watermark at the last returned blob
+	items, paged := sync("sinceSeq=" + watermark + "&limit=1")
+	if len(items) != 1 || paged != strconv.FormatInt(items[0].Seq, 10) {
+		t.Errorf("expected the page watermark at the first change, got %v at %s", names(items), paged)
+	}
+	if items, _ := sync("sinceSeq=" + paged); !slices.Equal(names(items), []string{"c"}) {
+		t.Errorf("expected the rest after the page, got %v", names(items))
+	}
+	if _, final := sync("sinceSeq=" + next); final != next {
+		t.Errorf("expected the watermark to stay at %s, got %s", next, final)
+	}
+
+	for _, query := range []string{"sinceSeq=-1", "sinceSeq=x", "sinceSeq=0&cursor=" + pageCursor{Name: "a"}.encode()} {
+		if w := doRequest(router, "GET", "/v1/blobs?"+query, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestBlobDelta(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	container := models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"}
+	put := func(name string) {
+		t.Helper()
+		if err := database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: name, EncryptedBlob: container}); err != nil {
+			t.Fatalf("failed to upsert %s: %v", name, err)
+		}
+	}
+	delta := func(query string) ([]models.BlobChange, string) {
+		t.Helper()
+		w := doRequest(router, "GET", "/v1/blobs:delta?"+query, token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), "ciphertext") {
+			t.Error("delta records must not carry content")
+		}
+		var changes []models.BlobChange
+		_ = json.NewDecoder(w.Body).Decode(&changes)
+		return changes, w.Header().Get("X-Max-Seq")
+	}
+	ops := func(changes []models.BlobChange) []string {
+		var out []string
+		for _, change := range changes {
+			out = append(out, change.Op+":"+change.BlobName)
+		}
+		return out
+	}
+
+	put("a")
+	put("b")
+	changes, watermark := delta("sinceSeq=0")
+	if got := ops(changes); !slices.Equal(got, []string{"upsert:a", "upsert:b"}) {
+		t.Fatalf("expected two upserts, got %v", got)
+	}
+	if changes[0].Version != 1 || changes[0].Seq >= changes[1].Seq {
+		t.Errorf("expected versions and increasing seqs, got %+v", changes)
+	}
+
+	// Updates, deletes and renames after the watermark
+	put("a")
+	if w := doRequest(router, "DELETE", "/v1/blobs/b", token, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("failed to delete: %d", w.Code)
+	}
+	if _, err := database.RenameBlob(user.ID, "a", "c", container, nil, 0, db.Writer{}); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+	changes, next := delta("sinceSeq=" + watermark)
+	if got := ops(changes); !slices.Equal(got, []string{"delete:b", "delete:a", "upsert:c"}) {
+		t.Errorf("expected the delete, then the rename as delete and upsert, got %v", got)
+	}
+	if changes[2].Version != 3 || changes[0].Version != 0 {
+		t.Errorf("expected version 3 on the upsert and none on deletes, got %+v", changes)
+	}
+
+	// Recreating a deleted name replaces its tombstone
+	put("b")
+	changes, _ = delta("sinceSeq=" + next)
+	if got := ops(changes); !slices.Equal(got, []string{"upsert:b"}) {
+		t.Errorf("expected only the recreated blob, got %v", got)
+	}
+	if changes, _ := delta("sinceSeq=" + watermark); slices.Contains(ops(changes), "delete:b") {
+		t.Errorf("expected the tombstone for b to be cleared, got %v", ops(changes))
+	}
+
+	// Paging by limit
+	page, paged := delta("sinceSeq=0&limit=1")
+	if len(page) != 1 || paged != strconv.FormatInt(page[0].Seq, 10) {
+		t.Errorf("expected a one-record page ending at its seq, got %v at %s", ops(page), paged)
+	}
+
+	for _, query := range []string{"", "sinceSeq=-1", "sinceSeq=0&cursor=" + pageCursor{Name: "a"}.encode()} {
+		if w := doRequest(router, "GET", "/v1/blobs:delta?"+query, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestBlobFacets(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	alice := createTestUser(t, database, "alice")
+	bob := createTestUser(t, database, "bob")
+	token, _ := server.jwtConfig.GenerateToken(alice.ID)
+
+	past := models.NewTimestamp(time.Now().Add(-time.Minute))
+	container := models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"}
+	for _, blob := range []*models.Blob{
+		{UserID: alice.ID, BlobName: "vault"},
+		{UserID: alice.ID, BlobName: "report", Collection: "work"},
+		{UserID: alice.ID, BlobName: "plan", Collection: "work"},
+		{UserID: alice.ID, BlobName: "diary", Collection: "home"},
+		{UserID: alice.ID, BlobName: "otp", Collection: "home", ExpiresAt: &past},
+		{UserID: bob.ID, BlobName: "bob", Collection: "work"},
+	} {
+		blob.EncryptedBlob = container
+		if err := database.UpsertBlob(blob); err != nil {
+			t.Fatalf("failed to upsert %s: %v", blob.BlobName, err)
+		}
+	}
+
+	w := doRequest(router, "GET", "/v1/blobs:facets", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var facets BlobFacetsResponse
+	if err := json.NewDecoder(w.Body).Decode(&facets); err != nil {
+		t.Fatalf("failed to decode facets: %v", err)
+	}
+
+	expected := map[string]int64{"": 1, "work": 2, "home": 1}
+	if fmt.Sprint(facets.Collections) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, facets.Collections)
+	}
+
+	// A blob literally named "facets" is still addressable
+	if w := doRequest(router, "GET", "/v1/blobs/facets", token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for missing blob named facets, got %d", w.Code)
+	}
+}
+
+func TestBlobSummary(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	summary := func() BlobSummaryResponse {
+		t.Helper()
+		w := doRequest(router, "GET", "/v1/blobs:summary", token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp BlobSummaryResponse
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		return resp
+	}
+
+	// The documented format, recomputed the way a client would
+	digest := func(entries ...string) string {
+		h := sha256.New()
+		for _, entry := range entries {
+			name, version, _ := strings.Cut(entry, "@")
+			v, _ := strconv.ParseUint(version, 10, 64)
+			_ = binary.Write(h, binary.BigEndian, uint32(len(name)))
+			h.Write([]byte(name))
+			_ = binary.Write(h, binary.BigEndian, v)
+		}
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	empty := summary()
+	if empty.Count != 0 || empty.Digest != digest() {
+		t.Errorf("unexpected empty summary: %+v", empty)
+	}
+
+	container := models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"}
+	for _, name := range []string{"vault", "Notes", "a\x00b"} {
+		_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: name, EncryptedBlob: container})
+	}
+	_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "vault", EncryptedBlob: container})
+
+	got := summary()
+	if want := digest("Notes@1", "a\x00b@1", "vault@2"); got.Count != 3 || got.Digest != want {
+		t.Errorf("expected 3 blobs with digest %s, got %+v", want, got)
+	}
+
+	_ = database.DeleteBlob(user.ID, "Notes", db.Writer{})
+	if got := summary(); got.Count != 2 || got.Digest != digest("a\x00b@1", "vault@2") {
+		t.Errorf("expected summary without Notes, got %+v", got)
+	}
+}
+
+func TestListBlobsGzip(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	config := DefaultConfig()
+	config.GzipResponses = true
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	for i := 0; i < 50; i++ {
+		_ = database.UpsertBlob(&models.Blob{
+			UserID:        user.ID,
+			BlobName:      fmt.Sprintf("blob-%02d", i),
+			EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Y2lwaGVy", Tag: "t"},
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/v1/blobs", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzipped list, got Content-Encoding %q", w.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("invalid gzip stream: %v", err)
+	}
+	var items []models.BlobListItem
+	if err := json.NewDecoder(zr).Decode(&items); err != nil {
+		t.Fatalf("failed to decode gzipped list: %v", err)
+	}
+	if len(items) != 50 {
+		t.Errorf("expected 50 blobs, got %d", len(items))
+	}
+
+	// Without Accept-Encoding the same list is sent as plain JSON
+	w = doRequest(router, "GET", "/v1/blobs", token, nil)
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected uncompressed list, got Content-Encoding %q", w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestListBlobsTimeRangeValidation(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	tests := []struct {
+		name     string
+		query    string
+		expected int
+	}{
+		{"in order", "?from=2024-03-01T00:00:00Z&to=2024-03-02T00:00:00Z", http.StatusOK},
+		{"equal bounds", "?from=2024-03-01T00:00:00Z&to=2024-03-01T00:00:00Z", http.StatusOK},
+		{"from after to", "?from=2024-03-02T00:00:00Z&to=2024-03-01T00:00:00Z", http.StatusBadRequest},
+		{"not RFC3339", "?from=2024-03-01", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(router, "GET", "/v1/blobs"+tt.query, token, nil)
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d, got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestListBlobsPaginationLinks(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		_ = database.UpsertBlob(&models.Blob{
+			UserID:        user.ID,
+			BlobName:      name,
+			Collection:    "work",
+			EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"},
+		})
+	}
+
+	// page fetches target and returns its names and its Link targets by rel
+	page := func(target string) ([]string, map[string]string) {
+		t.Helper()
+		w := doRequest(router, "GET", target, token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200 for %s, got %d: %s", target, w.Code, w.Body.String())
+		}
+		var items []models.BlobListItem
+		_ = json.NewDecoder(w.Body).Decode(&items)
+		var names []string
+		for _, item := range items {
+			names = append(names, item.BlobName)
+		}
+
+		links := map[string]string{}
+		if header := w.Header().Get("Link"); header != "" {
+			for _, link := range strings.Split(header, ", ") {
+				url, rel, ok := strings.Cut(link, "; ")
+				if !ok || !strings.HasPrefix(url, "<http://example.com/v1/blobs?") || !strings.HasSuffix(url, ">") {
+					t.Fatalf("malformed Link entry %q", link)
+				}
+				links[strings.TrimSuffix(strings.TrimPrefix(rel, `rel="`), `"`)] = strings.TrimPrefix(strings.Trim(url, "<>"), "http://example.com")
+			}
+		}
+		return names, links
+	}
+
+	names, links := page("/v1/blobs?collection=work&limit=2")
+	if strings.Join(names, ",") != "a,b" || links["prev"] != "" || links["next"] == "" {
+		t.Fatalf("unexpected first page %v with links %v", names, links)
+	}
+	if !strings.Contains(links["next"], "collection=work") || !strings.Contains(links["next"], "limit=2") {
+		t.Errorf("expected the next link to keep the query, got %q", links["next"])
+	}
+
+	names, links = page(links["next"])
+	if strings.Join(names, ",") != "c,d" || links["prev"] == "" || links["next"] == "" {
+		t.Fatalf("unexpected second page %v with links %v", names, links)
+	}
+	second := links["prev"]
+
+	names, links = page(links["next"])
+	if strings.Join(names, ",") != "e" || links["next"] != "" {
+		t.Fatalf("unexpected last page %v with links %v", names, links)
+	}
+
+	// Following prev from the second page returns to the first
+	names, links = page(second)
+	if strings.Join(names, ",") != "a,b" || links["prev"] != "" || links["next"] == "" {
+		t.Errorf("unexpected page before c %v with links %v", names, links)
+	}
+
+	// Without limit or cursor the list is not paginated
+	w := doRequest(router, "GET", "/v1/blobs", token, nil)
+	if w.Header().Get("Link") != "" {
+		t.Errorf("expected no Link header on an unpaginated list, got %q", w.Header().Get("Link"))
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=1001", "?cursor=!!"} {
+		if w := doRequest(router, "GET", "/v1/blobs"+query, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
+
+func TestReadScopedToken(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	_ = database.UpsertBlob(&models.Blob{
+		UserID:        user.ID,
+		BlobName:      "vault",
+		EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Y2lwaGVy", Tag: "t"},
+	})
+	session, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	w := doRequest(router, "POST", "/v1/auth/token", session, TokenRequest{Scope: middleware.ScopeRead})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var minted TokenResponse
+	_ = json.NewDecoder(w.Body).Decode(&minted)
+
+	readToken := minted.Token
+	for _, tt := range []struct {
+		method, target string
+		body           interface{}
+		expected       int
+	}{
+		{"GET", "/v1/blobs", nil, http.StatusOK},
+		{"GET", "/v1/blobs/vault", nil, http.StatusOK},
+		{"PUT", "/v1/blobs/vault", UpsertBlobRequest{EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}}, http.StatusForbidden},
+		{"DELETE", "/v1/blobs/vault", nil, http.StatusForbidden},
+		{"POST", "/v1/auth/token", TokenRequest{Scope: middleware.ScopeReadWrite}, http.StatusForbidden},
+	} {
+		w := doRequest(router, tt.method, tt.target, readToken, tt.body)
+		if w.Code != tt.expected {
+			t.Errorf("%s %s: expected status %d, got %d: %s", tt.method, tt.target, tt.expected, w.Code, w.Body.String())
+		}
+	}
+
+	// The blob survived the rejected delete
+	if _, err := database.GetBlob(user.ID, "vault"); err != nil {
+		t.Errorf("blob should still exist: %v", err)
+	}
+
+	w = doRequest(router, "POST", "/v1/auth/token", session, TokenRequest{Scope: "admin"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for unknown scope, got %d", w.Code)
+	}
+}
+
+func TestUpdateUserConcurrentRotation(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	// Both devices fetch the account key and its ETag before rotating
+	w := doRequest(router, "GET", "/v1/users/me/account-key", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	etag := w.Header().Get("ETag")
+	var key AccountKeyResponse
+	_ = json.NewDecoder(w.Body).Decode(&key)
+	if etag != `"1"` || key.Rev != 1 {
+		t.Fatalf("expected ETag \"1\" and rev 1, got %s and %d", etag, key.Rev)
+	}
+
+	rotate := func(ifMatch, nonce string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(UpdateUserRequest{
+			LoginVerifier:     crypto.EncodeBase64(make([]byte, 32)),
+			WrappedAccountKey: models.Container{Nonce: nonce, Ciphertext: "c", Tag: "t"},
+		})
+		req := httptest.NewRequest("PATCH", "/v1/users/me", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = rotate(etag, "device-a")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("ETag"); got != `"2"` {
+		t.Errorf("expected new ETag \"2\", got %s", got)
+	}
+
+	// The second device still holds the old ETag and must not clobber the first
+	w = rotate(etag, "device-b")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "user_modified") {
+		t.Fatalf("expected 409 user_modified for stale rotation, got %d: %s", w.Code, w.Body.String())
+	}
+	stored, _ := database.GetUserByID(user.ID)
+	if stored.WrappedAccountKey.Nonce != "device-a" {
+		t.Errorf("expected device-a's key to stand, got %q", stored.WrappedAccountKey.Nonce)
+	}
+
+	// Retrying with the current ETag succeeds
+	if w := rotate(`"2"`, "device-b"); w.Code != http.StatusOK {
+		t.Errorf("expected status 200 on retry, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestUpdateUserRequiresCurrentVerifier(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	config := DefaultConfig()
+	config.RequireCurrentVerifier = true
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	oldVerifier := make([]byte, 32)
+	newVerifier := bytes.Repeat([]byte{1}, 32)
+	user := createTestUser(t, database, "alice")
+	user.LoginVerifierHash = crypto.HashLoginVerifier(oldVerifier, "alice")
+	if err := database.UpdateUser(user); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	rotate := func(verifier, current []byte) *httptest.ResponseRecorder {
+		req := UpdateUserRequest{
+			LoginVerifier:     crypto.EncodeBase64(verifier),
+			WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+		}
+		if current != nil {
+			req.CurrentLoginVerifier = crypto.EncodeBase64(current)
+		}
+		return doRequest(router, "PATCH", "/v1/users/me", token, req)
+	}
+
+	// A stolen token alone cannot change the password
+	if w := rotate(newVerifier, nil); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "reauth_required") {
+		t.Errorf("expected 401 reauth_required, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := rotate(newVerifier, newVerifier); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "reauth_failed") {
+		t.Errorf("expected 401 reauth_failed, got %d: %s", w.Code, w.Body.String())
+	}
+	stored, _ := database.GetUserByID(user.ID)
+	if !crypto.VerifyLoginVerifier(oldVerifier, "alice", stored.LoginVerifierHash) {
+		t.Fatal("expected the password to be unchanged after rejected rotations")
+	}
+
+	if w := rotate(newVerifier, oldVerifier); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 with the current verifier, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Re-wrapping the account key under the same credentials is exempt
+	if w := rotate(newVerifier, nil); w.Code != http.StatusOK {
+		t.Errorf("expected status 200 for a wrapped-key-only update, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A username change is a credential change even with an unchanged verifier
+	newUsername := "alice2"
+	w := doRequest(router, "PATCH", "/v1/users/me", token, UpdateUserRequest{
+		Username:          &newUsername,
+		LoginVerifier:     crypto.EncodeBase64(newVerifier),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a username change without the current verifier, got %d", w.Code)
+	}
+}
+
+func TestDeletedAccountToken(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	if err := database.DeleteUser(user.ID); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+
+	container := models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"}
+	for _, tt := range []struct {
+		method, target string
+		body           interface{}
+	}{
+		{"GET", "/v1/auth/verify", nil},
+		{"GET", "/v1/users/me/account-key", nil},
+		{"GET", "/v1/blobs", nil},
+		{"PUT", "/v1/blobs/vault", UpsertBlobRequest{EncryptedBlob: container}},
+		{"PATCH", "/v1/users/me", UpdateUserRequest{LoginVerifier: crypto.EncodeBase64(make([]byte, 32)), WrappedAccountKey: container}},
+		{"POST", "/v1/auth/token", map[string]string{"scope": "read"}},
+	} {
+		w := doRequest(router, tt.method, tt.target, token, tt.body)
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "account_not_found") {
+			t.Errorf("%s %s: expected 401 account_not_found, got %d: %s", tt.method, tt.target, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	for _, name := range []string{"vault", "notes"} {
+		_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: name, EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "old", Tag: "t"}})
+	}
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	newKey := models.Container{Nonce: "n2", Ciphertext: "c2", Tag: "t2"}
+	reencrypted := models.Container{Nonce: "n2", Ciphertext: "new", Tag: "t2"}
+
+	w := doRequest(router, "POST", "/v1/users/me/rotate-key", token, RotateKeyRequest{
+		WrappedAccountKey: newKey,
+		Blobs:             []RotateKeyBlob{{BlobName: "vault", EncryptedBlob: reencrypted}},
+	})
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 for incomplete blob set, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = doRequest(router, "POST", "/v1/users/me/rotate-key", token, RotateKeyRequest{
+		WrappedAccountKey: newKey,
+		Blobs: []RotateKeyBlob{
+			{BlobName: "vault", EncryptedBlob: reencrypted},
+			{BlobName: "notes", EncryptedBlob: reencrypted},
+		},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	stored, _ := database.GetUserByID(user.ID)
+	if stored.WrappedAccountKey != newKey {
+		t.Errorf("expected rotated wrapped key, got %+v", stored.WrappedAccountKey)
+	}
+}
+
+func TestRotateKeyRacesCredentialChange(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "vault", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "old", Tag: "t"}})
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	send := func(method, target, ifMatch string, payload interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Both devices saw rev 1; device A changes the password first
+	patch := UpdateUserRequest{
+		LoginVerifier:     crypto.EncodeBase64(make([]byte, 32)),
+		WrappedAccountKey: models.Container{Nonce: "device-a", Ciphertext: "c", Tag: "t"},
+	}
+	w := send("PATCH", "/v1/users/me", `"1"`, patch)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	rotate := func(ifMatch string) *httptest.ResponseRecorder {
+		return send("POST", "/v1/users/me/rotate-key", ifMatch, RotateKeyRequest{
+			WrappedAccountKey: models.Container{Nonce: "device-b", Ciphertext: "c", Tag: "t"},
+			Blobs:             []RotateKeyBlob{{BlobName: "vault", EncryptedBlob: models.Container{Nonce: "n2", Ciphertext: "new", Tag: "t"}}},
+		})
+	}
+
+	// Device B's rotation was built on rev 1 and must not replace A's wrapped key
+	w = rotate(`"1"`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "user_modified") {
+		t.Fatalf("expected 409 user_modified for stale rotation, got %d: %s", w.Code, w.Body.String())
+	}
+	stored, _ := database.GetUserByID(user.ID)
+	if stored.WrappedAccountKey.Nonce != "device-a" {
+		t.Errorf("expected device-a's key to stand, got %q", stored.WrappedAccountKey.Nonce)
+	}
+	if blob, _ := database.GetBlob(user.ID, "vault"); blob.EncryptedBlob.Ciphertext != "old" {
+		t.Errorf("expected blobs to be left alone, got %q", blob.EncryptedBlob.Ciphertext)
+	}
+
+	// A rev that moves between the handler's read and the write is caught too
+	if err := database.RotateAccountKey(user.ID, 1, models.Container{Nonce: "device-b", Ciphertext: "c", Tag: "t"},
+		[]models.Blob{{BlobName: "vault", EncryptedBlob: models.Container{Nonce: "n2", Ciphertext: "new", Tag: "t"}}}, 0, db.Writer{}); err != db.ErrUserConflict {
+		t.Errorf("expected ErrUserConflict, got %v", err)
+	}
+
+	w = rotate(`"2"`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 on retry, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("ETag"); got != `"3"` {
+		t.Errorf("expected new ETag \"3\", got %s", got)
+	}
+}
+
+func TestRenameBlob(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	for _, name := range []string{"draft", "taken"} {
+		_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: name, EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "old", Tag: "t"}})
+	}
+	original, _ := database.GetBlob(user.ID, "draft")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	reencrypted := models.Container{Nonce: "n2", Ciphertext: "renamed", Tag: "t2"}
+	tests := []struct {
+		name     string
+		source   string
+		newName  string
+		expected int
+	}{
+		{"missing source", "nope", "final", http.StatusNotFound},
+		{"name collision", "draft", "taken", http.StatusConflict},
+		{"same name", "draft", "draft", http.StatusBadRequest},
+		{"success", "draft", "final", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(router, "POST", "/v1/blobs/"+tt.source+"/rename", token, RenameBlobRequest{NewName: tt.newName, EncryptedBlob: reencrypted})
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d, got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	if _, err := database.GetBlob(user.ID, "draft"); err != db.ErrBlobNotFound {
+		t.Errorf("expected old name to be gone, got %v", err)
+	}
+	renamed, err := database.GetBlob(user.ID, "final")
+	if err != nil {
+		t.Fatalf("renamed blob missing: %v", err)
+	}
+	if renamed.ID != original.ID || !renamed.CreatedAt.Equal(original.CreatedAt.Time) {
+		t.Error("rename should keep the row identity and createdAt")
+	}
+	if renamed.EncryptedBlob != reencrypted {
+		t.Errorf("expected re-encrypted container, got %+v", renamed.EncryptedBlob)
+	}
+}
+
+func TestRewrapBlob(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	archive := "archive"
+	expiresAt := models.NewTimestamp(time.Now().Add(time.Hour))
+	_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "doc", Collection: archive, ExpiresAt: &expiresAt, EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "old", Tag: "t"}})
+	original, _ := database.GetBlob(user.ID, "doc")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	rewrapped := models.Container{Nonce: "n2", Ciphertext: "rewrapped", Tag: "t2"}
+	if w := doRequest(router, "POST", "/v1/blobs/nope/rewrap", token, RewrapBlobRequest{EncryptedBlob: rewrapped}); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for a missing blob, got %d", w.Code)
+	}
+	if w := doRequest(router, "POST", "/v1/blobs/doc/rewrap", token, RewrapBlobRequest{}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 without a container, got %d", w.Code)
+	}
+
+	w := doRequest(router, "POST", "/v1/blobs/doc/rewrap", token, RewrapBlobRequest{EncryptedBlob: rewrapped})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	blob, err := database.GetBlob(user.ID, "doc")
+	if err != nil {
+		t.Fatalf("rewrapped blob missing: %v", err)
+	}
+	if blob.EncryptedBlob != rewrapped || blob.Version != original.Version+1 {
+		t.Errorf("expected the new container at version %d, got %+v", original.Version+1, blob)
+	}
+	if blob.ID != original.ID || blob.Collection != archive || blob.ExpiresAt == nil || !blob.ExpiresAt.Equal(original.ExpiresAt.Time) {
+		t.Error("rewrap should keep the row identity, collection and expiry")
+	}
+}
+
+func TestTouchBlob(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	container := models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}
+	_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "doc", EncryptedBlob: container})
+	original, _ := database.GetBlob(user.ID, "doc")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	if w := doRequest(router, "POST", "/v1/blobs/nope/touch", token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for a missing blob, got %d", w.Code)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	w := doRequest(router, "POST", "/v1/blobs/doc/touch", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		UpdatedAt models.Timestamp `json:"updatedAt"`
+	}
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+
+	touched, err := database.GetBlob(user.ID, "doc")
+	if err != nil {
+		t.Fatalf("touched blob missing: %v", err)
+	}
+	if !touched.UpdatedAt.After(original.UpdatedAt.Time) || resp.UpdatedAt.String() != touched.UpdatedAt.String() {
+		t.Errorf("expected updatedAt to advance from %v and be returned, got %v (response %v)", original.UpdatedAt, touched.UpdatedAt, resp.UpdatedAt)
+	}
+	if touched.Version != original.Version || touched.EncryptedBlob != container || touched.Checksum != original.Checksum {
+		t.Errorf("touch should not change version or content, got %+v", touched)
+	}
+}
+
+func TestUpsertBlobValidatesAlg(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	config := DefaultConfig()
+	config.AllowedAlgs = []string{"XC20P"}
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	nonce24 := crypto.EncodeBase64(make([]byte, 24))
+	nonce12 := crypto.EncodeBase64(make([]byte, 12))
+	tag := crypto.EncodeBase64(make([]byte, 16))
+
+	tests := []struct {
+		name     string
+		blob     models.Container
+		expected int
+	}{
+		{"XC20P", models.Container{Alg: "XC20P", Nonce: nonce24, Ciphertext: "Y2lwaGVy", Tag: tag}, http.StatusOK},
+		{"XC20P wrong nonce size", models.Container{Alg: "XC20P", Nonce: nonce12, Ciphertext: "Y2lwaGVy", Tag: tag}, http.StatusBadRequest},
+		{"registered but not allowed", models.Container{Alg: "A256GCM", Nonce: nonce12, Ciphertext: "Y2lwaGVy", Tag: tag}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(router, "PUT", "/v1/blobs/vault", token, UpsertBlobRequest{EncryptedBlob: tt.blob})
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d, got %d: %s", tt.expected, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	blob, err := database.GetBlob(user.ID, "vault")
+	if err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+	if blob.EncryptedBlob.Alg != "XC20P" {
+		t.Errorf("expected alg to round-trip, got %q", blob.EncryptedBlob.Alg)
+	}
+}
+
+func TestGetBlobContent(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	raw := []byte{0x00, 0xff, 0x10, 'c', 'i', 'p', 'h', 'e', 'r'}
+	container := models.Container{
+		Nonce:      crypto.EncodeBase64(make([]byte, 12)),
+		Ciphertext: crypto.EncodeBase64(raw),
+		Tag:        crypto.EncodeBase64(make([]byte, 16)),
+		Alg:        "A256GCM",
+	}
+	_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "vault", EncryptedBlob: container})
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	w := doRequest(router, "GET", "/v1/blobs/vault/content", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("expected octet-stream, got %q", ct)
+	}
+	if !bytes.Equal(w.Body.Bytes(), raw) {
+		t.Errorf("expected raw ciphertext %x, got %x", raw, w.Body.Bytes())
+	}
+	if w.Header().Get("X-Blob-Nonce") != container.Nonce || w.Header().Get("X-Blob-Tag") != container.Tag || w.Header().Get("X-Blob-Alg") != "A256GCM" {
+		t.Errorf("container fields missing from headers: %v", w.Header())
+	}
+
+	if w := doRequest(router, "GET", "/v1/blobs/missing/content", token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for missing blob, got %d", w.Code)
+	}
+}
+
+func TestBlobChecksumRoundTrip(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	container := models.Container{
+		Nonce:      crypto.EncodeBase64(make([]byte, 12)),
+		Ciphertext: crypto.EncodeBase64([]byte("ciphertext")),
+		Tag:        crypto.EncodeBase64(make([]byte, 16)),
+	}
+
+	w := doRequest(router, "PUT", "/v1/blobs/vault", token, UpsertBlobRequest{EncryptedBlob: container})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var put struct {
+		Checksum string `json:"checksum"`
+	}
+	_ = json.NewDecoder(w.Body).Decode(&put)
+
+	// Clients can compute the same digest from the container they uploaded
+	sum := sha256.Sum256([]byte(container.Nonce + "\x00" + container.Ciphertext + "\x00" + container.Tag))
+	if put.Checksum != hex.EncodeToString(sum[:]) {
+		t.Fatalf("expected checksum %x, got %q", sum, put.Checksum)
+	}
+
+	for _, target := range []string{"/v1/blobs/vault", "/v1/blobs/vault/content"} {
+		w := doRequest(router, "GET", target, token, nil)
+		if got := w.Header().Get("X-Blob-Checksum"); got != put.Checksum {
+			t.Errorf("GET %s: expected X-Blob-Checksum %q, got %q", target, put.Checksum, got)
+		}
+	}
+}
+
+func TestEncryptedNames(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+	config := DefaultConfig()
+	config.EncryptedNames = true
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	// The client derives the token from the name under a key it never sends
+	nameKey := make([]byte, 32)
+	nameToken := func(name string) string {
+		mac := hmac.New(sha256.New, nameKey)
+		mac.Write([]byte(name))
+		return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	container := models.Container{
+		Nonce:      crypto.EncodeBase64(make([]byte, 12)),
+		Ciphertext: crypto.EncodeBase64([]byte("ciphertext")),
+		Tag:        crypto.EncodeBase64(make([]byte, 16)),
+	}
+	encryptedName := models.Container{
+		Nonce:      crypto.EncodeBase64(bytes.Repeat([]byte{1}, 12)),
+		Ciphertext: crypto.EncodeBase64([]byte("vault")),
+		Tag:        crypto.EncodeBase64(make([]byte, 16)),
+	}
+	vault := nameToken("vault")
+
+	w := doRequest(router, "PUT", "/v1/blobs/vault", token, UpsertBlobRequest{EncryptedBlob: container})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "encrypted_name_required") {
+		t.Fatalf("expected 400 encrypted_name_required, got %d: %s", w.Code, w.Body.String())
+	}
+	w = doRequest(router, "PUT", "/v1/blobs/vault", token, UpsertBlobRequest{EncryptedBlob: container, EncryptedName: &encryptedName})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_name_token") {
+		t.Fatalf("expected 400 invalid_name_token, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The name container is no place to store data beside the quota
+	oversized := encryptedName
+	oversized.Ciphertext = crypto.EncodeBase64(make([]byte, maxEncryptedNameSize+1))
+	w = doRequest(router, "PUT", "/v1/blobs/"+vault, token, UpsertBlobRequest{EncryptedBlob: container, EncryptedName: &oversized})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "encrypted_name_too_large") {
+		t.Fatalf("expected 400 encrypted_name_too_large, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = doRequest(router, "PUT", "/v1/blobs/"+vault, token, UpsertBlobRequest{EncryptedBlob: container, EncryptedName: &encryptedName})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Retrieval is by the same token, recomputed from the name
+	w = doRequest(router, "GET", "/v1/blobs/"+nameToken("vault"), token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var got struct {
+		EncryptedBlob models.Container  `json:"encryptedBlob"`
+		EncryptedName *models.Container `json:"encryptedName"`
+	}
+	_ = json.NewDecoder(w.Body).Decode(&got)
+	if got.EncryptedBlob != container || got.EncryptedName == nil || *got.EncryptedName != encryptedName {
+		t.Fatalf("expected the stored containers back, got %+v", got)
+	}
+	if w := doRequest(router, "GET", "/v1/blobs/"+nameToken("Vault"), token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another name's token, got %d", w.Code)
+	}
+
+	w = doRequest(router, "GET", "/v1/blobs", token, nil)
+	var items []models.BlobListItem
+	_ = json.NewDecoder(w.Body).Decode(&items)
+	if len(items) != 1 || items[0].BlobName != vault || items[0].EncryptedName == nil {
+		t.Fatalf("expected the blob listed by token with its encrypted name, got %+v", items)
+	}
+
+	// The plaintext name reaches the database nowhere
+	stored, err := database.GetBlob(user.ID, vault)
+	if err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+	if stored.BlobName == "vault" || *stored.EncryptedName != encryptedName {
+		t.Errorf("expected only the token and encrypted name stored, got %+v", stored)
+	}
+}
+
+func TestGetBlobContentRange(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	raw := []byte("0123456789abcdef")
+	_ = database.UpsertBlob(&models.Blob{
+		UserID:        user.ID,
+		BlobName:      "vault",
+		EncryptedBlob: models.Container{Nonce: "n", Ciphertext: crypto.EncodeBase64(raw), Tag: "t"},
+	})
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	get := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/blobs/vault/content", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	full := get(nil)
+	if full.Code != http.StatusOK || full.Header().Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("expected 200 with Accept-Ranges, got %d %v", full.Code, full.Header())
+	}
+	etag := full.Header().Get("ETag")
+
+	// Resume from byte 10
+	w := get(map[string]string{"Range": "bytes=10-", "If-Range": etag})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("expected status 206, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 10-15/16" {
+		t.Errorf("expected Content-Range bytes 10-15/16, got %q", got)
+	}
+	if w.Body.String() != "abcdef" {
+		t.Errorf("expected the tail of the ciphertext, got %q", w.Body.String())
+	}
+	if w.Header().Get("X-Blob-Nonce") != "n" {
+		t.Errorf("expected container headers on partial responses, got %v", w.Header())
+	}
+
+	// Out of bounds
+	w = get(map[string]string{"Range": "bytes=16-20"})
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("expected status 416, got %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes */16" {
+		t.Errorf("expected Content-Range bytes */16, got %q", got)
+	}
+
+	// After a write the old ETag no longer matches, so If-Range yields the whole blob
+	_ = database.UpsertBlob(&models.Blob{
+		UserID:        user.ID,
+		BlobName:      "vault",
+		EncryptedBlob: models.Container{Nonce: "n2", Ciphertext: crypto.EncodeBase64(raw), Tag: "t"},
+	})
+	w = get(map[string]string{"Range": "bytes=10-", "If-Range": etag})
+	if w.Code != http.StatusOK || w.Body.Len() != len(raw) {
+		t.Errorf("expected full 200 for a stale If-Range, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	// A blob deleted and re-created starts again at version 1, which must not
+	// pass for the content an earlier download was resuming
+	etag = get(nil).Header().Get("ETag")
+	if err := database.DeleteBlob(user.ID, "vault", db.Writer{}); err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		_ = database.UpsertBlob(&models.Blob{
+			UserID:        user.ID,
+			BlobName:      "vault",
+			EncryptedBlob: models.Container{Nonce: "n3", Ciphertext: crypto.EncodeBase64([]byte("fedcba9876543210")), Tag: "t"},
+		})
+	}
+	w = get(map[string]string{"Range": "bytes=10-", "If-Range": etag})
+	if w.Code != http.StatusOK || w.Body.String() != "fedcba9876543210" {
+		t.Errorf("expected full 200 for a re-created blob, got %d: %q", w.Code, w.Body.String())
+	}
+}
+
+func TestDeleteBlobConditional(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	for i := 0; i < 2; i++ {
+		_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "vault", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}})
+	}
+
+	deleteWith := func(target, ifMatch string) int {
+		req := httptest.NewRequest("DELETE", target, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The blob is at version 2, which GET reports as its ETag
+	if w := doRequest(router, "GET", "/v1/blobs/vault", token, nil); w.Header().Get("ETag") != `"2"` {
+		t.Errorf("expected ETag \"2\", got %q", w.Header().Get("ETag"))
+	}
+	if code := deleteWith("/v1/blobs/vault", `"1"`); code != http.StatusPreconditionFailed {
+		t.Errorf("expected status 412 for a stale If-Match, got %d", code)
+	}
+	if code := deleteWith("/v1/blobs/vault?ifVersion=1", ""); code != http.StatusPreconditionFailed {
+		t.Errorf("expected status 412 for a stale ifVersion, got %d", code)
+	}
+	if code := deleteWith("/v1/blobs/vault?ifVersion=abc", ""); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid version, got %d", code)
+	}
+	// If-Match compares strongly, so a weak tag never matches
+	if code := deleteWith("/v1/blobs/vault", `W/"2"`); code != http.StatusPreconditionFailed {
+		t.Errorf("expected status 412 for a weak If-Match, got %d", code)
+	}
+	if code := deleteWith("/v1/blobs/vault", `"1", W/"2", "abc"`); code != http.StatusPreconditionFailed {
+		t.Errorf("expected status 412 for a list without a strong match, got %d", code)
+	}
+	if code := deleteWith("/v1/blobs/vault", `2`); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unquoted If-Match, got %d", code)
+	}
+	if _, err := database.GetBlob(user.ID, "vault"); err != nil {
+		t.Fatalf("expected the blob to survive failed preconditions, got %v", err)
+	}
+
+	if code := deleteWith("/v1/blobs/vault", `"1", "2"`); code != http.StatusNoContent {
+		t.Errorf("expected status 204 for an If-Match list naming the version, got %d", code)
+	}
+	if code := deleteWith("/v1/blobs/vault?ifVersion=2", ""); code != http.StatusNotFound {
+		t.Errorf("expected status 404 once deleted, got %d", code)
+	}
+}
+
+func TestDeleteBlob(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	// Create user and blob
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{
+			Nonce:      "nonce",
+			Ciphertext: "ciphertext",
+			Tag:        "tag",
+		},
+	}
+	_ = database.CreateUser(user)
+
+	blob := &models.Blob{
+		UserID:   user.ID,
+		BlobName: "vault",
+		EncryptedBlob: models.Container{
+			Nonce:      "nonce",
+			Ciphertext: "ciphertext",
+			Tag:        "tag",
+		},
+	}
+	_ = database.UpsertBlob(blob)
+
+	// Generate token and delete blob
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	httpReq := httptest.NewRequest("DELETE", "/v1/blobs/vault", nil)
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+
+	router := server.NewRouter()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httpReq)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", w.Code)
+	}
+
+	// Verify deletion
+	_, err := database.GetBlob(user.ID, "vault")
+	if err != db.ErrBlobNotFound {
+		t.Error("blob should be deleted")
+	}
+}
+
+func TestForeignBlobsAreNotFound(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	alice := createTestUser(t, database, "alice")
+	bob := createTestUser(t, database, "bob")
+	container := models.Container{Nonce: "bm9uY2U=", Ciphertext: "c2VjcmV0", Tag: "dGFn"}
+	_ = database.UpsertBlob(&models.Blob{UserID: alice.ID, BlobName: "secret", EncryptedBlob: container})
+	if _, err := database.AcquireBlobLock(alice.ID, "secret", "alice-session", time.Hour); err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+	token := sessionToken(t, server, bob.ID, "probe")
+
+	// Every route addressing a blob must answer bob the same way for alice's
+	// blob as for a name nobody has, so responses reveal nothing about it
+	probes := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"GET", "", nil},
+		{"GET", "?ifVersion=1", nil},
+		{"GET", "/content", nil},
+		{"GET", "/verify", nil},
+		{"POST", "/signed-url", nil},
+		{"POST", "/rename", RenameBlobRequest{NewName: "mine", EncryptedBlob: container}},
+		{"POST", "/rewrap", RewrapBlobRequest{EncryptedBlob: container}},
+		{"POST", "/touch", nil},
+		{"POST", "/lock", nil},
+		{"DELETE", "/lock", nil},
+		{"DELETE", "", nil},
+		{"DELETE", "?version=1", nil},
+	}
+	for _, probe := range probes {
+		foreign := doRequest(router, probe.method, "/v1/blobs/secret"+probe.path, token, probe.body)
+		missing := doRequest(router, probe.method, "/v1/blobs/nothing"+probe.path, token, probe.body)
+		if foreign.Code != http.StatusNotFound {
+			t.Errorf("%s %s: expected status 404, got %d: %s", probe.method, probe.path, foreign.Code, foreign.Body.String())
+		}
+		if foreign.Code != missing.Code || foreign.Body.String() != missing.Body.String() {
+			t.Errorf("%s %s: foreign blob answered %d %s, missing blob %d %s", probe.method, probe.path,
+				foreign.Code, foreign.Body.String(), missing.Code, missing.Body.String())
+		}
+	}
+
+	work := "work"
+	w := doRequest(router, "POST", "/v1/blobs:batchUpdateMeta", token, BatchUpdateMetaRequest{Updates: []BlobMetaUpdate{{BlobName: "secret", Collection: &work}}})
+	if strings.Contains(w.Body.String(), "locked") || !strings.Contains(w.Body.String(), "not found") {
+		t.Errorf("expected a batch update of alice's blob to report not found, got %d: %s", w.Code, w.Body.String())
+	}
+
+	blob, err := database.GetBlob(alice.ID, "secret")
+	if err != nil || blob.Version != 1 {
+		t.Errorf("expected alice's blob to be untouched, got %+v, %v", blob, err)
+	}
+}
+
+func TestListBlobsTimestampFormat(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{
+			Nonce:      "nonce",
+			Ciphertext: "ciphertext",
+			Tag:        "tag",
+		},
+	}
+	_ = database.CreateUser(user)
+
+	blob := &models.Blob{
+		UserID:   user.ID,
+		BlobName: "vault",
+		EncryptedBlob: models.Container{
+			Nonce:      "nonce",
+			Ciphertext: "Y2lwaGVydGV4dA==",
+			Tag:        "tag",
+		},
+	}
+	_ = database.UpsertBlob(blob)
+
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	httpReq := httptest.NewRequest("GET", "/v1/blobs", nil)
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+
+	router := server.NewRouter()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httpReq)
+
+	var list []map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("expected 1 blob, got %d", len(list))
+	}
+
+	updatedAt, _ := list[0]["updatedAt"].(string)
+	expected := blob.UpdatedAt.UTC().Format(models.TimestampLayout)
+	if updatedAt != expected {
+		t.Errorf("expected updatedAt %q, got %q", expected, updatedAt)
+	}
+	if !strings.HasSuffix(updatedAt, "Z") || len(updatedAt) != len("2006-01-02T15:04:05.000Z") {
+		t.Errorf("updatedAt %q is not UTC RFC3339 with milliseconds", updatedAt)
+	}
+}
+
+func TestRegisterWithoutKDFUsesServerDefault(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	req := RegisterRequest{
+		Username:      "alice",
+		LoginVerifier: crypto.EncodeBase64(make([]byte, 32)),
+		WrappedAccountKey: models.Container{
+			Nonce:      "nonce",
+			Ciphertext: "ciphertext",
+			Tag:        "tag",
+		},
+	}
+
+	body, _ := json.Marshal(req)
+	httpReq := httptest.NewRequest("POST", "/v1/auth/register", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+
+	server.Register(w, httpReq)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp struct {
+		KDF models.KDFParams `json:"kdf"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	defaults := server.config.DefaultKDF
+	if resp.KDF.Type != defaults.Type || resp.KDF.Iterations != defaults.Iterations {
+		t.Errorf("expected default KDF %+v in response, got %+v", defaults, resp.KDF)
+	}
+
+	user, err := database.GetUserByUsername("alice")
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+
+	if user.KDFType != defaults.Type {
+		t.Errorf("expected KDF type %s, got %s", defaults.Type, user.KDFType)
+	}
+	if user.KDFIterations != defaults.Iterations {
+		t.Errorf("expected iterations %d, got %d", defaults.Iterations, user.KDFIterations)
+	}
+	if user.KDFMemoryKiB == nil || *user.KDFMemoryKiB != *defaults.MemoryKiB {
+		t.Errorf("expected memory %d KiB, got %v", *defaults.MemoryKiB, user.KDFMemoryKiB)
+	}
+	if user.KDFParallelism == nil || *user.KDFParallelism != *defaults.Parallelism {
+		t.Errorf("expected parallelism %d, got %v", *defaults.Parallelism, user.KDFParallelism)
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	req := httptest.NewRequest("GET", "/v1/capabilities", nil)
+	w := httptest.NewRecorder()
+
+	server.NewRouter().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var resp CapabilitiesResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	if resp.DefaultKDF.Type != models.KDFTypeArgon2id {
+		t.Errorf("expected default KDF argon2id, got %s", resp.DefaultKDF.Type)
+	}
+	if len(resp.KDFTypes) != 2 {
+		t.Errorf("expected 2 KDF types, got %d", len(resp.KDFTypes))
+	}
+}
+
+func TestGetCapabilitiesLimits(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	config := DefaultConfig()
+	config.UserQuotaBytes = 5 << 20
+	config.MaxImportEntries = 50
+	config.MaxImportBytes = 1 << 20
+	config.MaxBatchPut = 25
+	config.MaxBatchUpdateMeta = 250
+	config.MaxConcurrentUploads = 4
+	config.MaxConcurrentKDF = 8
+	config.UsernameChangeCooldown = time.Hour
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+
+	w := doRequest(server.NewRouter(), "GET", "/v1/capabilities", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var resp CapabilitiesResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	expected := Limits{
+		UserQuotaBytes:                5 << 20,
+		MaxImportEntries:              50,
+		MaxImportBytes:                1 << 20,
+		MaxBatchPut:                   25,
+		MaxBatchUpdateMeta:            250,
+		MaxBatchSize:                  25,
+		MaxVersionCheck:               1000,
+		MaxConcurrentUploads:          4,
+		MaxConcurrentKDF:              8,
+		UsernameChangeCooldownSeconds: 3600,
+		TokenTTLSeconds:               int64(server.jwtConfig.Expiration.Seconds()),
+		MaxSignedURLSeconds:           int64(maxShareTTL.Seconds()),
+		MaxSessionLabelLength:         maxSessionLabelLen,
+	}
+	if resp.Limits != expected {
+		t.Errorf("expected limits %+v, got %+v", expected, resp.Limits)
+	}
+}
+
+func TestVerifyBlobEndpoint(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+	}
+	_ = database.CreateUser(user)
+
+	blob := &models.Blob{
+		UserID:        user.ID,
+		BlobName:      "vault",
+		EncryptedBlob: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+	}
+	_ = database.UpsertBlob(blob)
+
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	router := server.NewRouter()
+
+	httpReq := httptest.NewRequest("GET", "/v1/blobs/vault/verify", nil)
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httpReq)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp map[string]interface{}
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if resp["ok"] != true || resp["checked"] != true {
+		t.Errorf("expected ok and checked, got %v", resp)
+	}
+
+	httpReq = httptest.NewRequest("GET", "/v1/blobs/missing/verify", nil)
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httpReq)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
+
+func TestBlobExpiryEndpoints(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+	}
+	_ = database.CreateUser(user)
+
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	router := server.NewRouter()
+
+	do := func(method, target string, body interface{}) *httptest.ResponseRecorder {
+		var reader *bytes.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		} else {
+			reader = bytes.NewReader(nil)
+		}
+		req := httptest.NewRequest(method, target, reader)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Expiry in the past is rejected on upsert
+	past := models.NewTimestamp(time.Now().Add(-time.Minute))
+	w := do("PUT", "/v1/blobs/otp", UpsertBlobRequest{
+		EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+		ExpiresAt:     &past,
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for past expiry, got %d", w.Code)
+	}
+
+	// Unexpired ephemeral blob is readable
+	future := models.NewTimestamp(time.Now().Add(time.Hour))
+	w = do("PUT", "/v1/blobs/otp", UpsertBlobRequest{
+		EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+		ExpiresAt:     &future,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w = do("GET", "/v1/blobs/otp", nil); w.Code != http.StatusOK {
+		t.Errorf("expected status 200 for unexpired blob, got %d", w.Code)
+	}
+
+	// An expired row that has not been swept yet is reported as gone
+	_ = database.UpsertBlob(&models.Blob{
+		UserID:        user.ID,
+		BlobName:      "stale",
+		EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+		ExpiresAt:     &past,
+	})
+	if w = do("GET", "/v1/blobs/stale", nil); w.Code != http.StatusGone {
+		t.Errorf("expected status 410 for expired blob, got %d", w.Code)
+	}
+
+	w = do("GET", "/v1/blobs", nil)
+	var list []models.BlobListItem
+	_ = json.NewDecoder(w.Body).Decode(&list)
+	if len(list) != 1 || list[0].BlobName != "otp" {
+		t.Errorf("expected only 'otp' to be listed, got %+v", list)
+	}
+
+	// Once swept, the blob is simply absent
+	_, _ = database.DeleteExpiredBlobs(time.Now())
+	if w = do("GET", "/v1/blobs/stale", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 after sweep, got %d", w.Code)
+	}
+}
+
+func TestUpdateUserUsernameCooldown(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	router := server.NewRouter()
+
+	rename := func(username string) *httptest.ResponseRecorder {
+		return doRequest(router, "PATCH", "/v1/users/me", token, UpdateUserRequest{
+			Username:          &username,
+			LoginVerifier:     crypto.EncodeBase64(make([]byte, 32)),
+			WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+		})
+	}
+
+	if w := rename("alice-2"); w.Code != http.StatusOK {
+		t.Fatalf("expected first rename to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w := rename("alice-3")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 for rapid rename, got %d", w.Code)
+	}
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retryAfter <= 0 || retryAfter > int((24*time.Hour).Seconds()) {
+		t.Errorf("expected Retry-After within the cooldown, got %q", w.Header().Get("Retry-After"))
+	}
+
+	updated, _ := database.GetUserByID(user.ID)
+	if updated.Username != "alice-2" {
+		t.Errorf("expected username to stay alice-2, got %s", updated.Username)
+	}
+
+	// Credential-only updates (same or omitted username) are not rate limited
+	if w := rename("alice-2"); w.Code != http.StatusOK {
+		t.Errorf("expected same-username update to succeed, got %d", w.Code)
+	}
+	w = doRequest(router, "PATCH", "/v1/users/me", token, UpdateUserRequest{
+		LoginVerifier:     crypto.EncodeBase64(make([]byte, 32)),
+		WrappedAccountKey: models.Container{Nonce: "n2", Ciphertext: "c2", Tag: "t2"},
+	})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected password-only update to succeed, got %d", w.Code)
+	}
+}
+
+func TestUpdateUserUsernameCooldownDisabled(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	config := DefaultConfig()
+	config.UsernameChangeCooldown = 0
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	router := server.NewRouter()
+
+	for _, name := range []string{"alice-2", "alice-3"} {
+		username := name
+		w := doRequest(router, "PATCH", "/v1/users/me", token, UpdateUserRequest{
+			Username:          &username,
+			LoginVerifier:     crypto.EncodeBase64(make([]byte, 32)),
+			WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+		})
+		if w.Code != http.StatusOK {
+			t.Errorf("expected rename to %s to succeed, got %d", name, w.Code)
+		}
+	}
+}
+
+func TestGetAccountKey(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	router := server.NewRouter()
+
+	w := doRequest(router, "GET", "/v1/users/me/account-key", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp AccountKeyResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.WrappedAccountKey != user.WrappedAccountKey {
+		t.Errorf("expected wrapped account key %+v, got %+v", user.WrappedAccountKey, resp.WrappedAccountKey)
+	}
+
+	// A session token is required
+	if w := doRequest(router, "GET", "/v1/users/me/account-key", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without token, got %d", w.Code)
+	}
+	if w := doRequest(router, "GET", "/v1/users/me/account-key", "invalid-token", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 with invalid token, got %d", w.Code)
+	}
+}
+
+func TestUsernameCaseModes(t *testing.T) {
+	loginVerifier := crypto.EncodeBase64(make([]byte, 32))
+	register := func(router http.Handler, username string) int {
+		return doRequest(router, "POST", "/v1/auth/register", "", RegisterRequest{
+			Username:          username,
+			LoginVerifier:     loginVerifier,
+			WrappedAccountKey: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+		}).Code
+	}
+	verify := func(router http.Handler, username string) int {
+		return doRequest(router, "POST", "/v1/auth/verify", "", VerifyRequest{Username: username, LoginVerifier: loginVerifier}).Code
+	}
+
+	for _, tt := range []struct {
+		name            string
+		caseInsensitive bool
+		registerAlice   int
+		verifyALICE     int
+	}{
+		{"sensitive", false, http.StatusCreated, http.StatusUnauthorized},
+		{"insensitive", true, http.StatusConflict, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			options := db.DefaultOptions()
+			options.CaseInsensitiveUsernames = tt.caseInsensitive
+			database, err := db.NewWithOptions(":memory:", options)
+			if err != nil {
+				t.Fatalf("failed to create test database: %v", err)
+			}
+			defer func() { _ = database.Close() }()
+			server := NewServer(database, "test-jwt-secret")
+			router := server.NewRouter()
+
+			if code := register(router, "Alice"); code != http.StatusCreated {
+				t.Fatalf("expected status 201, got %d", code)
+			}
+			if code := register(router, "alice"); code != tt.registerAlice {
+				t.Errorf("expected status %d registering alice next to Alice, got %d", tt.registerAlice, code)
+			}
+			if code := verify(router, "Alice"); code != http.StatusOK {
+				t.Errorf("expected status 200 for the registered form, got %d", code)
+			}
+			if code := verify(router, "ALICE"); code != tt.verifyALICE {
+				t.Errorf("expected status %d logging in as ALICE, got %d", tt.verifyALICE, code)
+			}
+
+			// The display form is kept as registered
+			if user, err := database.GetUserByUsername("Alice"); err != nil || user.Username != "Alice" {
+				t.Errorf("expected Alice to keep its display form, got %+v (%v)", user, err)
+			}
+
+			var caps CapabilitiesResponse
+			_ = json.NewDecoder(doRequest(router, "GET", "/v1/capabilities", "", nil).Body).Decode(&caps)
+			if caps.UsernameCaseInsensitive != tt.caseInsensitive {
+				t.Errorf("expected usernameCaseInsensitive %v, got %v", tt.caseInsensitive, caps.UsernameCaseInsensitive)
+			}
+		})
+	}
+}
+
+func TestUsernameReleaseHold(t *testing.T) {
+	options := db.DefaultOptions()
+	options.UsernameReleaseHold = time.Hour
+	database, err := db.NewWithOptions(":memory:", options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+	config := DefaultConfig()
+	config.UsernameChangeCooldown = 0
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	verifier := crypto.EncodeBase64(make([]byte, 32))
+	container := models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"}
+	register := func(username string) *httptest.ResponseRecorder {
+		return doRequest(router, "POST", "/v1/auth/register", "", RegisterRequest{Username: username, LoginVerifier: verifier, WrappedAccountKey: container})
+	}
+	rename := func(token, username string) *httptest.ResponseRecorder {
+		return doRequest(router, "PATCH", "/v1/users/me", token, UpdateUserRequest{Username: &username, LoginVerifier: verifier, WrappedAccountKey: container})
+	}
+
+	alice := createTestUser(t, database, "alice")
+	aliceToken, _ := server.jwtConfig.GenerateToken(alice.ID)
+	bob := createTestUser(t, database, "bob")
+	bobToken, _ := server.jwtConfig.GenerateToken(bob.ID)
+
+	if w := rename(aliceToken, "alice2"); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Nobody else can take the released name, by registering or renaming
+	if w := register("alice"); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "username_cooling_down") {
+		t.Errorf("expected 409 username_cooling_down on register, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := rename(bobToken, "alice"); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "username_cooling_down") {
+		t.Errorf("expected 409 username_cooling_down on rename, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The account that released it may take it back
+	if w := rename(aliceToken, "alice"); w.Code != http.StatusOK {
+		t.Errorf("expected alice to reclaim her old name, got %d: %s", w.Code, w.Body.String())
+	}
+	// ...which in turn holds alice2
+	if w := register("alice2"); w.Code != http.StatusConflict {
+		t.Errorf("expected status 409 for alice2, got %d", w.Code)
+	}
+}
+
+func TestUpsertBlobNonceReuse(t *testing.T) {
+	options := db.DefaultOptions()
+	options.RejectNonceReuse = true
+	database, err := db.NewWithOptions(":memory:", options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+	server := NewServer(database, "test-jwt-secret")
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	body := UpsertBlobRequest{EncryptedBlob: models.Container{Nonce: "bm9uY2Ux", Ciphertext: "b25l", Tag: "dGFn"}}
+	if w := doRequest(router, "PUT", "/v1/blobs/a", token, body); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	body.EncryptedBlob.Ciphertext = "dHdv"
+	w := doRequest(router, "PUT", "/v1/blobs/b", token, body)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "nonce_reuse") {
+		t.Errorf("expected 400 nonce_reuse, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestQuotaRejectionMetric(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	server.config.UserQuotaBytes = 4
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	label := metrics.UserLabel(user.ID)
+	rejections := func() int64 {
+		v, ok := metrics.QuotaRejections.Get(label).(*expvar.Int)
+		if !ok {
+			return 0
+		}
+		return v.Value()
+	}
+	before := rejections()
+
+	small := UpsertBlobRequest{EncryptedBlob: models.Container{Nonce: "bm9uY2Ux", Ciphertext: "b25l", Tag: "dGFn"}}
+	if w := doRequest(router, "PUT", "/v1/blobs/a", token, small); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 within quota, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := rejections() - before; got != 0 {
+		t.Errorf("expected no rejections within quota, got %d", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := doRequest(router, "PUT", "/v1/blobs/b", token, small); w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("expected status 413 over quota, got %d", w.Code)
+		}
+	}
+	if got := rejections() - before; got != 2 {
+		t.Errorf("expected 2 rejections for the user, got %d", got)
+	}
+}
+
+func TestUpsertBlobTooManyCollections(t *testing.T) {
+	options := db.DefaultOptions()
+	options.MaxCollections = 1
+	database, err := db.NewWithOptions(":memory:", options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+	server := NewServer(database, "test-jwt-secret")
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	container := models.Container{Nonce: "bm9uY2Ux", Ciphertext: "b25l", Tag: "dGFn"}
+	for _, name := range []string{"a", "b"} {
+		if w := doRequest(router, "PUT", "/v1/blobs/"+name, token, UpsertBlobRequest{EncryptedBlob: container, Collection: "work"}); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200 at the cap, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	w := doRequest(router, "PUT", "/v1/blobs/c", token, UpsertBlobRequest{EncryptedBlob: container, Collection: "home"})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "too_many_tags") {
+		t.Errorf("expected 400 too_many_tags beyond the cap, got %d: %s", w.Code, w.Body.String())
+	}
+
+	home := "home"
+	w = doRequest(router, "POST", "/v1/blobs:batchUpdateMeta", token, BatchUpdateMetaRequest{Updates: []BlobMetaUpdate{{BlobName: "a", Collection: &home}}})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "too_many_tags") {
+		t.Errorf("expected 400 too_many_tags from batchUpdateMeta, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestInternalErrorVerbosity(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		database, err := db.New(":memory:")
+		if err != nil {
+			t.Fatalf("failed to create test database: %v", err)
+		}
+		config := DefaultConfig()
+		config.DebugErrors = debug
+		server := NewServerWithConfig(database, "test-jwt-secret", config)
+		user := createTestUser(t, database, "alice")
+		token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+		// Every lookup now fails inside the database driver
+		_ = database.Close()
+		w := doRequest(server.NewRouter(), "GET", "/v1/blobs", token, nil)
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("debug=%v: expected status 500, got %d", debug, w.Code)
+		}
+		var resp map[string]string
+		_ = json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&resp)
+		if resp["requestId"] == "" {
+			t.Errorf("debug=%v: expected a request ID, got %s", debug, w.Body.String())
+		}
+		leaked := strings.Contains(w.Body.String(), "sql")
+		if !debug && (leaked || resp["detail"] != "") {
+			t.Errorf("expected no database detail in production mode, got %s", w.Body.String())
+		}
+		if debug && !leaked {
+			t.Errorf("expected the database error in debug mode, got %s", w.Body.String())
+		}
+	}
+}
+
+func TestProblemDetailsNegotiation(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/blobs/missing", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// The simple format stays the default
+	w := get("")
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected a 404 application/json error, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var simple map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &simple); err != nil || simple["error"] != "blob not found" {
+		t.Errorf("expected {error}, got %s", w.Body.String())
+	}
+
+	w = get("application/problem+json")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != middleware.ProblemContentType {
+		t.Errorf("expected Content-Type %s, got %q", middleware.ProblemContentType, got)
+	}
+	var problem struct {
+		Type     string `json:"type"`
+		Title    string `json:"title"`
+		Status   int    `json:"status"`
+		Detail   string `json:"detail"`
+		Instance string `json:"instance"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("failed to decode problem document: %v", err)
+	}
+	if problem.Type != "about:blank" || problem.Title != "Not Found" || problem.Status != http.StatusNotFound || problem.Detail != "blob not found" {
+		t.Errorf("unexpected problem document %s", w.Body.String())
+	}
+	if problem.Instance == "" {
+		t.Error("expected the request ID as instance")
+	}
+
+	// Coded errors map to a type URI, and the deployment switch needs no Accept
+	server.config.ProblemDetails = true
+	req := httptest.NewRequest("GET", "/v1/auth/kdf/bounds?type=scrypt", nil)
+	w = httptest.NewRecorder()
+	server.NewRouter().ServeHTTP(w, req)
+	if got := w.Header().Get("Content-Type"); got != middleware.ProblemContentType {
+		t.Errorf("expected Content-Type %s, got %q", middleware.ProblemContentType, got)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("failed to decode problem document: %v", err)
+	}
+	if problem.Type != middleware.ProblemTypeBase+"kdf_type_not_allowed" || problem.Status != http.StatusBadRequest {
+		t.Errorf("unexpected problem document %s", w.Body.String())
 	}
 }
@@ -0,0 +1,280 @@
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+var zipMagic = []byte("PK\x03\x04")
+
+// ImportEntry is the JSON envelope stored in each archive entry
+type ImportEntry struct {
+	BlobName      string            `json:"blobName"`
+	EncryptedBlob models.Container  `json:"encryptedBlob"`
+	EncryptedName *models.Container `json:"encryptedName,omitempty"`
+	Collection    string            `json:"collection,omitempty"`
+	ExpiresAt     *models.Timestamp `json:"expiresAt,omitempty"`
+	// CreatedAt preserves the creation time from the source account; only
+	// imports may set it
+	CreatedAt *models.Timestamp `json:"createdAt,omitempty"`
+	// Pinned pins the blob. A pinned blob never expires, so its ExpiresAt may
+	// have passed.
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// ImportEntryResult reports the outcome for one archive entry
+type ImportEntryResult struct {
+	Entry    string `json:"entry"`
+	BlobName string `json:"blobName,omitempty"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ImportArchiveResponse summarizes an archive import
+type ImportArchiveResponse struct {
+	Imported int                 `json:"imported"`
+	Failed   int                 `json:"failed"`
+	Results  []ImportEntryResult `json:"results"`
+}
+
+// archiveEntries iterates the regular files of an archive; Next returns io.EOF when done
+type archiveEntries interface {
+	Next() (name string, content io.Reader, err error)
+}
+
+type tarEntries struct {
+	r *tar.Reader
+}
+
+func (t *tarEntries) Next() (string, io.Reader, error) {
+	for {
+		hdr, err := t.r.Next()
+		if err != nil {
+			return "", nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			return hdr.Name, t.r, nil
+		}
+	}
+}
+
+type zipEntries struct {
+	files []*zip.File
+	open  io.ReadCloser
+}
+
+func (z *zipEntries) Next() (string, io.Reader, error) {
+	if z.open != nil {
+		_ = z.open.Close()
+		z.open = nil
+	}
+	for len(z.files) > 0 {
+		f := z.files[0]
+		z.files = z.files[1:]
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", nil, err
+		}
+		z.open = rc
+		return f.Name, rc, nil
+	}
+	return "", nil, io.EOF
+}
+
+// ImportArchive handles POST /v1/blobs:importArchive.
+// The body is a tar or zip archive whose entries are ImportEntry JSON documents.
+// Tar archives are read as a stream; zip keeps its index at the end, so it is
+// spooled to a temporary file first. Every entry is read and validated before
+// the database is touched; the valid ones are then applied in one transaction
+// so the quota is enforced against the whole import: if the result would exceed
+// it, nothing is stored. Entries that fail validation, or name a blob locked
+// by another session, are reported and skipped.
+func (s *Server) ImportArchive(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	writer, ok := blobWriter(w, r)
+	if !ok {
+		return
+	}
+
+	body := bufio.NewReader(http.MaxBytesReader(w, r.Body, s.config.MaxImportBytes))
+
+	var entries archiveEntries
+	if magic, _ := body.Peek(len(zipMagic)); bytes.Equal(magic, zipMagic) {
+		spool, err := os.CreateTemp("", "cryptd-import-*.zip")
+		if err != nil {
+			s.respondInternalError(w, r, "failed to buffer archive", err)
+			return
+		}
+		defer func() {
+			_ = spool.Close()
+			_ = os.Remove(spool.Name())
+		}()
+
+		size, err := io.Copy(spool, body)
+		if err != nil {
+			respondImportReadError(w, err)
+			return
+		}
+		zr, err := zip.NewReader(spool, size)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "invalid archive")
+			return
+		}
+		entries = &zipEntries{files: zr.File}
+	} else {
+		entries = &tarEntries{r: tar.NewReader(body)}
+	}
+
+	// Read and validate every entry before touching the database, so a slow
+	// upload does not hold the write lock; the body is capped at
+	// MaxImportBytes, which bounds what is kept in memory
+	type pendingImport struct {
+		result    int // index into resp.Results
+		blob      *models.Blob
+		createdAt *models.Timestamp
+	}
+	var pending []pendingImport
+	resp := ImportArchiveResponse{Results: []ImportEntryResult{}}
+	for {
+		name, content, err := entries.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			respondImportReadError(w, err)
+			return
+		}
+		if name == exportManifestName {
+			continue
+		}
+
+		if len(resp.Results) == s.config.MaxImportEntries {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("archive has more than %d entries", s.config.MaxImportEntries))
+			return
+		}
+
+		result := ImportEntryResult{Entry: name}
+		var entry ImportEntry
+		switch {
+		case json.NewDecoder(content).Decode(&entry) != nil:
+			result.Error = "invalid entry JSON"
+		case entry.BlobName == "":
+			result.Error = "blob name is required"
+		case entry.ExpiresAt != nil && !entry.Pinned && !entry.ExpiresAt.After(time.Now()):
+			result.Error = "expiresAt must be in the future"
+		case entry.CreatedAt != nil && entry.CreatedAt.After(time.Now()):
+			result.Error = "createdAt must be in the past"
+		default:
+			if err := s.validateContainer(entry.EncryptedBlob); err != nil {
+				result.Error = err.Error()
+			} else {
+				_, result.Error = s.checkBlobName(entry.BlobName, entry.EncryptedName)
+			}
+		}
+		result.BlobName = entry.BlobName
+
+		if result.Error == "" {
+			pending = append(pending, pendingImport{
+				result: len(resp.Results),
+				blob: &models.Blob{
+					BlobName:      entry.BlobName,
+					EncryptedBlob: entry.EncryptedBlob,
+					EncryptedName: entry.EncryptedName,
+					Collection:    s.collectionOrDefault(entry.Collection),
+					ExpiresAt:     entry.ExpiresAt,
+					Pinned:        entry.Pinned,
+				},
+				createdAt: entry.CreatedAt,
+			})
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	blobs := make([]*models.Blob, len(pending))
+	for i, p := range pending {
+		blobs[i] = p.blob
+	}
+	imp, err := s.db.BeginBlobImport(userID, writer, blobs...)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to import archive", err)
+		return
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = imp.Rollback()
+		}
+	}()
+
+	for _, p := range pending {
+		var err error
+		if p.createdAt != nil {
+			err = imp.UpsertWithCreatedAt(p.blob, p.createdAt.Time)
+		} else {
+			err = imp.Upsert(p.blob)
+		}
+		if err == db.ErrNonceReuse {
+			resp.Results[p.result].Error = nonceReuseMessage
+		} else if err == db.ErrTooManyCollections {
+			resp.Results[p.result].Error = tooManyCollectionsMessage
+		} else if err == db.ErrBlobLocked {
+			resp.Results[p.result].Error = blobLockedMessage
+		} else if err != nil {
+			s.respondInternalError(w, r, "failed to import archive", err)
+			return
+		}
+	}
+	for i := range resp.Results {
+		if resp.Results[i].Error == "" {
+			resp.Results[i].OK = true
+			resp.Imported++
+		} else {
+			resp.Failed++
+		}
+	}
+
+	committed = true
+	if err := imp.Commit(s.config.UserQuotaBytes); err != nil {
+		if err == db.ErrQuotaExceeded {
+			respondQuotaExceeded(w, userID)
+			return
+		}
+		s.respondInternalError(w, r, "failed to import archive", err)
+		return
+	}
+
+	if resp.Imported > 0 {
+		s.audit(r, auditBlobImported, userID, fmt.Sprintf("%d blob(s)", resp.Imported))
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// respondImportReadError distinguishes an oversized body from a malformed archive
+func respondImportReadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		respondError(w, http.StatusRequestEntityTooLarge, "archive too large")
+		return
+	}
+	respondError(w, http.StatusBadRequest, "invalid archive")
+}
@@ -0,0 +1,331 @@
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// archiveFile is one entry of a test archive
+type archiveFile struct {
+	name    string
+	content string
+}
+
+func entryJSON(blobName, ciphertext string) string {
+	data, _ := json.Marshal(ImportEntry{
+		BlobName:      blobName,
+		EncryptedBlob: models.Container{Nonce: "n", Ciphertext: ciphertext, Tag: "t"},
+	})
+	return string(data)
+}
+
+func buildTar(t *testing.T, files []archiveFile) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o600, Size: int64(len(f.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatalf("failed to write tar entry: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func buildZip(t *testing.T, files []archiveFile) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatalf("failed to create zip entry: %v", err)
+		}
+		if _, err := fw.Write([]byte(f.content)); err != nil {
+			t.Fatalf("failed to write zip entry: %v", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close zip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func importArchive(server *Server, token string, archive []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v1/blobs:importArchive", bytes.NewReader(archive))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	server.NewRouter().ServeHTTP(w, req)
+	return w
+}
+
+func TestImportArchive(t *testing.T) {
+	files := []archiveFile{
+		{"vault.json", entryJSON("vault", "Y2lwaGVy")},
+		{"notes.json", entryJSON("notes", "bm90ZXM=")},
+		{"broken.json", "{not json"},
+		{"anonymous.json", entryJSON("", "Y2lwaGVy")},
+	}
+
+	for _, format := range []struct {
+		name  string
+		build func(*testing.T, []archiveFile) []byte
+	}{{"tar", buildTar}, {"zip", buildZip}} {
+		t.Run(format.name, func(t *testing.T) {
+			server, database := setupTestServer(t)
+			defer func() { _ = database.Close() }()
+
+			user := createTestUser(t, database, "alice")
+			token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+			w := importArchive(server, token, format.build(t, files))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var resp ImportArchiveResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if resp.Imported != 2 || resp.Failed != 2 || len(resp.Results) != 4 {
+				t.Errorf("expected 2 imported and 2 failed, got %+v", resp)
+			}
+			for i, expectOK := range []bool{true, true, false, false} {
+				if resp.Results[i].OK != expectOK {
+					t.Errorf("entry %s: expected ok=%v, got %+v", files[i].name, expectOK, resp.Results[i])
+				}
+			}
+
+			blob, err := database.GetBlob(user.ID, "notes")
+			if err != nil {
+				t.Fatalf("imported blob missing: %v", err)
+			}
+			if blob.EncryptedBlob.Ciphertext != "bm90ZXM=" {
+				t.Errorf("unexpected ciphertext %q", blob.EncryptedBlob.Ciphertext)
+			}
+		})
+	}
+}
+
+func TestImportArchivePreservesCreatedAt(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	created := models.NewTimestamp(time.Date(2019, 3, 14, 15, 9, 26, 0, time.UTC))
+	future := models.NewTimestamp(time.Now().Add(time.Hour))
+	entry := func(blobName string, createdAt *models.Timestamp) string {
+		data, _ := json.Marshal(ImportEntry{
+			BlobName:      blobName,
+			EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Y2lwaGVy", Tag: "t"},
+			CreatedAt:     createdAt,
+		})
+		return string(data)
+	}
+
+	// An existing blob takes the creation time of the imported one
+	w := doRequest(server.NewRouter(), "PUT", "/v1/blobs/notes", token, UpsertBlobRequest{
+		EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "bm90ZXM=", Tag: "t"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = importArchive(server, token, buildTar(t, []archiveFile{
+		{"vault.json", entry("vault", &created)},
+		{"notes.json", entry("notes", &created)},
+		{"fresh.json", entry("fresh", nil)},
+		{"future.json", entry("future", &future)},
+	}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp ImportArchiveResponse
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Imported != 3 || resp.Results[3].Error != "createdAt must be in the past" {
+		t.Fatalf("expected the future createdAt to be rejected, got %+v", resp)
+	}
+
+	for _, name := range []string{"vault", "notes"} {
+		blob, err := database.GetBlob(user.ID, name)
+		if err != nil {
+			t.Fatalf("imported blob %s missing: %v", name, err)
+		}
+		if !blob.CreatedAt.Equal(created.Time) {
+			t.Errorf("%s: expected createdAt %v, got %v", name, created.Time, blob.CreatedAt.Time)
+		}
+	}
+	fresh, _ := database.GetBlob(user.ID, "fresh")
+	if time.Since(fresh.CreatedAt.Time) > time.Minute {
+		t.Errorf("expected an entry without createdAt to be stamped now, got %v", fresh.CreatedAt.Time)
+	}
+
+	// Regular writes neither backdate nor reset the creation time
+	w = doRequest(server.NewRouter(), "PUT", "/v1/blobs/vault", token, map[string]any{
+		"encryptedBlob": models.Container{Nonce: "n2", Ciphertext: "Y2lwaGVy", Tag: "t"},
+		"createdAt":     "2001-01-01T00:00:00Z",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	vault, _ := database.GetBlob(user.ID, "vault")
+	if !vault.CreatedAt.Equal(created.Time) {
+		t.Errorf("expected a regular write to keep createdAt %v, got %v", created.Time, vault.CreatedAt.Time)
+	}
+}
+
+func TestImportArchiveQuotaIsAtomic(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	config := DefaultConfig()
+	config.UserQuotaBytes = 20
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	// Each entry fits on its own, together they do not
+	archive := buildTar(t, []archiveFile{
+		{"a.json", entryJSON("a", "YWFhYWFhYWFhYWFh")},
+		{"b.json", entryJSON("b", "YmJiYmJiYmJiYmJi")},
+	})
+
+	w := importArchive(server, token, archive)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected status 413, got %d: %s", w.Code, w.Body.String())
+	}
+
+	list, err := database.ListBlobs(user.ID, db.BlobFilter{})
+	if err != nil {
+		t.Fatalf("failed to list blobs: %v", err)
+	}
+	if len(list) != 0 {
+		t.Errorf("expected nothing stored after quota rejection, got %d blobs", len(list))
+	}
+
+	// A single PUT within the quota still succeeds, and one past it is refused
+	w = doRequest(server.NewRouter(), "PUT", "/v1/blobs/a", token, UpsertBlobRequest{
+		EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "YWFhYWFhYWFhYWFh", Tag: "t"},
+	})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 within quota, got %d: %s", w.Code, w.Body.String())
+	}
+	w = doRequest(server.NewRouter(), "PUT", "/v1/blobs/b", token, UpsertBlobRequest{
+		EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "YmJiYmJiYmJiYmJi", Tag: "t"},
+	})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413 over quota, got %d", w.Code)
+	}
+}
+
+func TestImportArchiveLimits(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+
+	config := DefaultConfig()
+	config.MaxImportEntries = 1
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+
+	w := importArchive(server, token, buildTar(t, []archiveFile{
+		{"a.json", entryJSON("a", "YQ==")},
+		{"b.json", entryJSON("b", "Yg==")},
+	}))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for too many entries, got %d", w.Code)
+	}
+	if _, err := database.GetBlob(user.ID, "a"); err != db.ErrBlobNotFound {
+		t.Errorf("expected no blobs after rejected import, got %v", err)
+	}
+
+	w = importArchive(server, token, []byte("definitely not an archive"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for garbage body, got %d", w.Code)
+	}
+}
+
+func TestImportArchiveSlowUploadDoesNotBlockWriters(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	alice := createTestUser(t, database, "alice")
+	bob := createTestUser(t, database, "bob")
+	token, _ := server.jwtConfig.GenerateToken(alice.ID)
+	archive := buildTar(t, []archiveFile{
+		{"vault.json", entryJSON("vault", "Y2lwaGVy")},
+		{"notes.json", entryJSON("notes", "bm90ZXM=")},
+	})
+
+	// Send the first entry, then stall like a slow client
+	body, upload := io.Pipe()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest("POST", "/v1/blobs:importArchive", body)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		server.NewRouter().ServeHTTP(w, req)
+		done <- w
+	}()
+	// Each small entry is a 512-byte header and one 512-byte block. The pipe
+	// hands the second header over only once the server asks for it, which
+	// is after it has handled the first entry.
+	const firstEntry, secondHeader = 1024, 1536
+	if _, err := upload.Write(archive[:firstEntry]); err != nil {
+		t.Fatalf("failed to send the first entry: %v", err)
+	}
+	if _, err := upload.Write(archive[firstEntry:secondHeader]); err != nil {
+		t.Fatalf("failed to send the second header: %v", err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		written <- database.UpsertBlob(&models.Blob{UserID: bob.ID, BlobName: "b", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Yg==", Tag: "t"}})
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Errorf("expected another user's write to succeed during the upload, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("another user's write waited for the upload")
+	}
+
+	if _, err := upload.Write(archive[secondHeader:]); err != nil {
+		t.Fatalf("failed to send the rest: %v", err)
+	}
+	_ = upload.Close()
+	if w := <-done; w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := database.GetBlob(alice.ID, "notes"); err != nil {
+		t.Errorf("expected the import to complete, got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// errJSONTooComplex marks a body rejected by checkJSONComplexity
+var errJSONTooComplex = errors.New("JSON body too complex")
+
+// checkJSONComplexity walks the first JSON value in data with a streaming
+// tokenizer and fails once it nests deeper than maxDepth or holds more than
+// maxTokens tokens (delimiters, keys and values each count as one). A limit of
+// 0 disables it. Syntax errors are left for the real decode to report.
+func checkJSONComplexity(data []byte, maxDepth, maxTokens int) error {
+	if maxDepth == 0 && maxTokens == 0 {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	depth, tokens := 0, 0
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+
+		tokens++
+		if maxTokens > 0 && tokens > maxTokens {
+			return fmt.Errorf("%w: more than %d tokens", errJSONTooComplex, maxTokens)
+		}
+
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if maxDepth > 0 && depth > maxDepth {
+				return fmt.Errorf("%w: nested deeper than %d", errJSONTooComplex, maxDepth)
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			// The first value is complete; Decode ignores anything after it
+			return nil
+		}
+	}
+}
+
+// decodeJSON decodes the request body into v. An empty body and malformed JSON
+// get distinct codes so clients that forgot the body can tell, and bodies over
+// the configured nesting depth or token count are refused before decoding.
+// Bodies over MaxJSONBytes are cut off while reading, before either. On
+// failure it writes the 400 or 413 response and returns false.
+func (s *Server) decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body := io.Reader(r.Body)
+	if s.config.MaxJSONBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.config.MaxJSONBytes)
+	}
+	if s.config.MaxJSONDepth > 0 || s.config.MaxJSONTokens > 0 {
+		data, err := io.ReadAll(body)
+		if respondBodyTooLarge(w, err) {
+			return false
+		}
+		if err != nil {
+			respondErrorCode(w, http.StatusBadRequest, "invalid_json", "failed to read request body")
+			return false
+		}
+		if err := checkJSONComplexity(data, s.config.MaxJSONDepth, s.config.MaxJSONTokens); err != nil {
+			respondErrorCode(w, http.StatusBadRequest, "json_too_complex", err.Error())
+			return false
+		}
+		body = bytes.NewReader(data)
+	}
+
+	err := json.NewDecoder(body).Decode(v)
+	if respondBodyTooLarge(w, err) {
+		return false
+	}
+	if err == io.EOF {
+		respondErrorCode(w, http.StatusBadRequest, "missing_body", "missing request body")
+		return false
+	}
+	if err != nil {
+		respondErrorCode(w, http.StatusBadRequest, "invalid_json", "invalid JSON")
+		return false
+	}
+	return true
+}
+
+// respondBodyTooLarge answers 413 body_too_large and returns true if err comes
+// from reading past MaxJSONBytes
+func respondBodyTooLarge(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	respondErrorCode(w, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+	return true
+}
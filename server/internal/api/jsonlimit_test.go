@@ -0,0 +1,70 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckJSONComplexity(t *testing.T) {
+	tests := []struct {
+		name             string
+		body             string
+		maxDepth, tokens int
+		tooComplex       bool
+	}{
+		{"flat object", `{"a":1,"b":[1,2]}`, 2, 10, false},
+		{"at depth limit", `[[["x"]]]`, 3, 0, false},
+		{"over depth limit", `[[[["x"]]]]`, 3, 0, true},
+		{"over token limit", `[1,2,3,4]`, 0, 5, true},
+		{"trailing data ignored", `{} [[[[[[`, 1, 0, false},
+		{"malformed left to decode", `{"a":}`, 2, 10, false},
+		{"disabled", strings.Repeat("[", 100), 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkJSONComplexity([]byte(tt.body), tt.maxDepth, tt.tokens)
+			if tt.tooComplex != errors.Is(err, errJSONTooComplex) {
+				t.Errorf("expected too complex = %v, got %v", tt.tooComplex, err)
+			}
+		})
+	}
+}
+
+func TestDecodeJSONRejectsNestingBomb(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	// Well under any body-size limit, but 100k levels deep
+	bomb := `{"username":` + strings.Repeat("[", 100_000) + strings.Repeat("]", 100_000) + `}`
+	req := httptest.NewRequest("POST", "/v1/auth/verify", strings.NewReader(bomb))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "json_too_complex") {
+		t.Errorf("expected 400 json_too_complex, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDecodeJSONRejectsOversizedBody(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	server.config.MaxJSONBytes = 1024
+	router := server.NewRouter()
+
+	// Flat, so only the size limit can catch it, with or without the tokenizer
+	body := `{"username":"` + strings.Repeat("a", 4096) + `"}`
+	for _, tokens := range []int{1_000_000, 0} {
+		server.config.MaxJSONTokens = tokens
+		server.config.MaxJSONDepth = 0
+		req := httptest.NewRequest("POST", "/v1/auth/verify", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "body_too_large") {
+			t.Errorf("tokens %d: expected 413 body_too_large, got %d: %s", tokens, w.Code, w.Body.String())
+		}
+	}
+}
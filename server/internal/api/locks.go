@@ -0,0 +1,152 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// blobLockedMessage explains a 423 when the lock's expiry is not known
+const blobLockedMessage = "blob is locked by another session; retry later or pass force=true"
+
+const (
+	// defaultLockTTL applies when a lock request gives no ttlSeconds
+	defaultLockTTL = 5 * time.Minute
+	// maxLockTTL caps a single lock; holders extend it by locking again
+	maxLockTTL = time.Hour
+)
+
+// LockBlobRequest asks for a lock valid for TTLSeconds
+type LockBlobRequest struct {
+	TTLSeconds int64 `json:"ttlSeconds,omitempty"`
+}
+
+// LockBlob handles POST /v1/blobs/{blobName}/lock. The lock is advisory and
+// held by the token's session: writes from other sessions get 423 until it
+// is released or expires, unless they pass ?force=true. Locking again from
+// the same session extends the lock.
+func (s *Server) LockBlob(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	holder := middleware.GetSessionIDFromContext(r.Context())
+	if holder == "" {
+		respondError(w, http.StatusBadRequest, "locks need a session token")
+		return
+	}
+
+	var req LockBlobRequest
+	if r.ContentLength != 0 && !s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	ttl := defaultLockTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > maxLockTTL {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("ttlSeconds must be between 1 and %d", int64(maxLockTTL/time.Second)))
+		return
+	}
+
+	blobName := chi.URLParam(r, "blobName")
+	lock, err := s.db.AcquireBlobLock(userID, blobName, holder, ttl)
+	if err != nil {
+		switch err {
+		case db.ErrBlobNotFound:
+			respondBlobNotFound(w)
+		case db.ErrBlobLocked:
+			respondBlobLocked(w, lock.ExpiresAt)
+		default:
+			s.respondInternalError(w, r, "failed to lock blob", err)
+		}
+		return
+	}
+	s.audit(r, auditBlobLocked, userID, blobName)
+
+	respondJSON(w, http.StatusOK, lock)
+}
+
+// UnlockBlob handles DELETE /v1/blobs/{blobName}/lock. Only the holding
+// session may release an unexpired lock, unless ?force=true is passed.
+func (s *Server) UnlockBlob(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	force, err := forceParam(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	blobName := chi.URLParam(r, "blobName")
+	holder := middleware.GetSessionIDFromContext(r.Context())
+	if err := s.db.ReleaseBlobLock(userID, blobName, holder, force); err != nil {
+		switch err {
+		case db.ErrBlobNotFound:
+			respondBlobNotFound(w)
+		case db.ErrBlobLocked:
+			respondErrorCode(w, http.StatusLocked, "locked", "blob is locked by another session")
+		default:
+			s.respondInternalError(w, r, "failed to unlock blob", err)
+		}
+		return
+	}
+	s.audit(r, auditBlobUnlocked, userID, blobName)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// blobWriter returns the writer for a blob write made by the request: its
+// session, overriding other sessions' locks if ?force=true is passed. The db
+// layer checks locks inside the write's transaction. A malformed force
+// parameter writes 400 and returns false.
+func blobWriter(w http.ResponseWriter, r *http.Request) (db.Writer, bool) {
+	force, err := forceParam(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return db.Writer{}, false
+	}
+	return db.Writer{Session: middleware.GetSessionIDFromContext(r.Context()), Force: force}, true
+}
+
+// forceParam parses the optional ?force= lock override
+func forceParam(r *http.Request) (bool, error) {
+	raw := r.URL.Query().Get("force")
+	if raw == "" {
+		return false, nil
+	}
+	force, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("force must be true or false")
+	}
+	return force, nil
+}
+
+// respondBlobLocked writes 423 for a blob locked by another session until expiresAt
+func respondBlobLocked(w http.ResponseWriter, expiresAt models.Timestamp) {
+	respondErrorCode(w, http.StatusLocked, "locked",
+		"blob is locked by another session until "+expiresAt.String()+"; retry later or pass force=true")
+}
+
+// respondBlobWriteLocked writes 423 for a write to blobName that failed with
+// db.ErrBlobLocked, saying until when if the lock is still there
+func (s *Server) respondBlobWriteLocked(w http.ResponseWriter, userID int64, blobName string) {
+	if lock, err := s.db.GetBlobLock(userID, blobName); err == nil && lock != nil {
+		respondBlobLocked(w, lock.ExpiresAt)
+		return
+	}
+	respondErrorCode(w, http.StatusLocked, "locked", blobLockedMessage)
+}
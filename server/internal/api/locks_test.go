@@ -0,0 +1,162 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// sessionToken issues a readwrite token bound to a new session, as a login would
+func sessionToken(t *testing.T, server *Server, userID int64, label string) string {
+	t.Helper()
+
+	user, err := server.db.GetUserByID(userID)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	}
+	token, err := server.issueToken(httptest.NewRequest("POST", "/v1/auth/verify", nil), user, middleware.ScopeReadWrite, label)
+	if err != nil {
+		t.Fatalf("failed to issue token: %v", err)
+	}
+	return token
+}
+
+func TestBlobLock(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "doc", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}})
+	laptop := sessionToken(t, server, user.ID, "laptop")
+	phone := sessionToken(t, server, user.ID, "phone")
+	put := UpsertBlobRequest{EncryptedBlob: models.Container{Nonce: "n2", Ciphertext: "c2", Tag: "t2"}}
+
+	if w := doRequest(router, "POST", "/v1/blobs/nope/lock", laptop, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 locking a missing blob, got %d", w.Code)
+	}
+	if w := doRequest(router, "POST", "/v1/blobs/doc/lock", laptop, LockBlobRequest{TTLSeconds: 7200}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a TTL over the cap, got %d", w.Code)
+	}
+
+	// Acquire
+	w := doRequest(router, "POST", "/v1/blobs/doc/lock", laptop, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var lock models.BlobLock
+	_ = json.NewDecoder(w.Body).Decode(&lock)
+	if lock.BlobName != "doc" || lock.Holder == "" || lock.ExpiresAt.Before(time.Now().Add(defaultLockTTL-time.Minute)) {
+		t.Errorf("unexpected lock %+v", lock)
+	}
+
+	// The holder can keep writing; another session cannot write, lock or unlock
+	if w := doRequest(router, "PUT", "/v1/blobs/doc", laptop, put); w.Code != http.StatusOK {
+		t.Errorf("expected the holder's write to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	w = doRequest(router, "PUT", "/v1/blobs/doc", phone, put)
+	if w.Code != http.StatusLocked {
+		t.Fatalf("expected status 423 for a conflicting write, got %d: %s", w.Code, w.Body.String())
+	}
+	var errResp map[string]string
+	_ = json.NewDecoder(w.Body).Decode(&errResp)
+	if errResp["code"] != "locked" {
+		t.Errorf("expected code locked, got %v", errResp)
+	}
+	pinned := true
+	for _, req := range []struct {
+		method, target string
+		body           interface{}
+	}{
+		{"POST", "/v1/blobs/doc/lock", nil},
+		{"DELETE", "/v1/blobs/doc/lock", nil},
+		{"DELETE", "/v1/blobs/doc", nil},
+		{"POST", "/v1/blobs/doc/touch", nil},
+		{"POST", "/v1/blobs/doc/rewrap", RewrapBlobRequest{EncryptedBlob: put.EncryptedBlob}},
+		{"PATCH", "/v1/blobs/doc", BlobMetaUpdate{Pinned: &pinned}},
+		{"POST", "/v1/blobs:batchUpdateMeta", BatchUpdateMetaRequest{Updates: []BlobMetaUpdate{{BlobName: "doc", Pinned: &pinned}}}},
+		{"POST", "/v1/blobs:batchPut", BatchPutRequest{Blobs: []BatchPutBlob{{BlobName: "doc", EncryptedBlob: put.EncryptedBlob}}}},
+	} {
+		if w := doRequest(router, req.method, req.target, phone, req.body); w.Code != http.StatusLocked {
+			t.Errorf("%s %s: expected status 423, got %d: %s", req.method, req.target, w.Code, w.Body.String())
+		}
+	}
+	w = importArchive(server, phone, buildTar(t, []archiveFile{{"doc.json", entryJSON("doc", "c3")}}))
+	var imported ImportArchiveResponse
+	_ = json.NewDecoder(w.Body).Decode(&imported)
+	if w.Code != http.StatusOK || imported.Imported != 0 || imported.Results[0].Error != blobLockedMessage {
+		t.Errorf("expected the import to skip the locked blob, got %d: %+v", w.Code, imported)
+	}
+
+	// Release, after which anyone can write
+	if w := doRequest(router, "DELETE", "/v1/blobs/doc/lock", laptop, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "PUT", "/v1/blobs/doc", phone, put); w.Code != http.StatusOK {
+		t.Errorf("expected the write to succeed after unlock, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestBlobLockExpiry(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "doc", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}})
+	if _, err := database.AcquireBlobLock(user.ID, "doc", "stale-session", 10*time.Millisecond); err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	token := sessionToken(t, server, user.ID, "laptop")
+	put := UpsertBlobRequest{EncryptedBlob: models.Container{Nonce: "n2", Ciphertext: "c2", Tag: "t2"}}
+	if w := doRequest(router, "PUT", "/v1/blobs/doc", token, put); w.Code != http.StatusOK {
+		t.Errorf("expected an expired lock not to block writes, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, "POST", "/v1/blobs/doc/lock", token, nil); w.Code != http.StatusOK {
+		t.Errorf("expected an expired lock to be taken over, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestBlobLockForce(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	_ = database.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "doc", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}})
+	laptop := sessionToken(t, server, user.ID, "laptop")
+	if w := doRequest(router, "POST", "/v1/blobs/doc/lock", laptop, LockBlobRequest{TTLSeconds: 60}); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Tokens without a session can never hold a lock, so they need force too
+	plain, _ := server.jwtConfig.GenerateToken(user.ID)
+	put := UpsertBlobRequest{EncryptedBlob: models.Container{Nonce: "n2", Ciphertext: "c2", Tag: "t2"}}
+	if w := doRequest(router, "PUT", "/v1/blobs/doc", plain, put); w.Code != http.StatusLocked {
+		t.Errorf("expected status 423 without force, got %d", w.Code)
+	}
+	if w := doRequest(router, "PUT", "/v1/blobs/doc?force=maybe", plain, put); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid force flag, got %d", w.Code)
+	}
+	if w := doRequest(router, "PUT", "/v1/blobs/doc?force=true", plain, put); w.Code != http.StatusOK {
+		t.Errorf("expected a forced write to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Force leaves the lock in place until it is broken explicitly
+	if lock, _ := database.GetBlobLock(user.ID, "doc"); lock == nil {
+		t.Fatal("expected the lock to survive a forced write")
+	}
+	if w := doRequest(router, "DELETE", "/v1/blobs/doc/lock?force=true", plain, nil); w.Code != http.StatusNoContent {
+		t.Errorf("expected a forced unlock to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if lock, _ := database.GetBlobLock(user.ID, "doc"); lock != nil {
+		t.Errorf("expected the lock to be gone, got %+v", lock)
+	}
+}
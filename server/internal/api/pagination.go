@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultPageSize applies when a request has a cursor but no limit
+	defaultPageSize = 100
+	// maxPageSize caps ?limit= on paginated lists
+	maxPageSize = 1000
+)
+
+// pageCursor is a keyset position: the page starts after Name, or ends before
+// it when Backward is set. On the wire it is opaque base64url.
+type pageCursor struct {
+	Name     string
+	Backward bool
+}
+
+func (c pageCursor) encode() string {
+	prefix := "a:"
+	if c.Backward {
+		prefix = "b:"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(prefix + c.Name))
+}
+
+func decodePageCursor(raw string) (pageCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return pageCursor{}, fmt.Errorf("invalid cursor")
+	}
+	switch s := string(decoded); {
+	case strings.HasPrefix(s, "a:"):
+		return pageCursor{Name: s[2:]}, nil
+	case strings.HasPrefix(s, "b:"):
+		return pageCursor{Name: s[2:], Backward: true}, nil
+	}
+	return pageCursor{}, fmt.Errorf("invalid cursor")
+}
+
+// parsePage reads ?limit= and ?cursor=. A request with neither is not
+// paginated and yields a limit of 0.
+func parsePage(r *http.Request) (limit int, cursor *pageCursor, err error) {
+	query := r.URL.Query()
+	if raw := query.Get("cursor"); raw != "" {
+		c, err := decodePageCursor(raw)
+		if err != nil {
+			return 0, nil, err
+		}
+		cursor = &c
+		limit = defaultPageSize
+	}
+	if raw := query.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return 0, nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+	return limit, cursor, nil
+}
+
+// setPageLinks sets an RFC 8288 Link header with the next and prev pages of
+// the current request, keeping its other query parameters. Either cursor may
+// be nil when there is no such page.
+func setPageLinks(w http.ResponseWriter, r *http.Request, next, prev *pageCursor) {
+	var links []string
+	for _, link := range []struct {
+		cursor *pageCursor
+		rel    string
+	}{{next, "next"}, {prev, "prev"}} {
+		if link.cursor == nil {
+			continue
+		}
+		query := r.URL.Query()
+		query.Set("cursor", link.cursor.encode())
+		links = append(links, fmt.Sprintf(`<%s%s?%s>; rel="%s"`, requestOrigin(r), r.URL.Path, query.Encode(), link.rel))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
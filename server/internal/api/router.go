@@ -7,6 +7,9 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
+	authmw "github.com/shalteor/cryptd-poc/server/internal/middleware"
 )
 
 // getCORSOrigins returns the allowed CORS origins from environment variable or defaults
@@ -39,46 +42,150 @@ func (s *Server) NewRouter() *chi.Mux {
 	r := chi.NewRouter()
 
 	// Middleware
-	r.Use(middleware.Logger)
+	r.Use(authmw.SampledLogger(s.config.LogSampleRate))
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	if s.config.RequireHTTPS {
+		// Load balancers probe /health directly, often over plain HTTP
+		r.Use(authmw.RequireHTTPS(s.config.TrustedProxies, s.config.HTTPSRedirect, "/health"))
+	}
+	r.Use(authmw.RealIP(s.config.TrustedProxies))
+	r.Use(authmw.BodySizeMetrics)
+	r.Use(authmw.SecurityHeaders(s.config.SecurityHeaders))
 
 	// CORS
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   getCORSOrigins(),
 		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-Requested-With"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "If-Match", "If-None-Match", "If-Range", "If-Version-Match", "Range", "X-Requested-With"},
+		ExposedHeaders:   []string{"Accept-Ranges", "Content-Range", "ETag", "Link", "X-Blob-Nonce", "X-Blob-Tag", "X-Blob-Alg", "X-Blob-Checksum", "X-Max-Seq"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
+	r.Get("/health", s.Health)
+
+	// Metrics (admin token, only when configured)
+	if s.config.AdminToken != "" {
+		r.With(authmw.AdminAuthMiddleware(s.config.AdminToken)).Handle("/metrics", metrics.Handler())
+	}
+
+	// Each limiter is shared by the routes it wraps, so they count against one limit
+	limitKDF := authmw.ConcurrencyLimit("kdf", s.config.MaxConcurrentKDF)
+	limitUploads := authmw.ConcurrencyLimit("upload", s.config.MaxConcurrentUploads)
+	limitUsernameChecks := authmw.RateLimit("username_check", s.config.UsernameCheckRate, 0, authmw.ClientIPKey)
+	limitBlobWrites := authmw.RateLimit("blob_write", s.config.BlobWriteRate, s.config.BlobWriteBurst, authmw.UserIDKey)
+
 	// API routes
 	r.Route("/v1", func(r chi.Router) {
+		// Compression stays off /metrics; blob content is ciphertext, which does not compress
+		if s.config.GzipResponses {
+			r.Use(authmw.Gzip(s.config.GzipMinBytes, "application/json"))
+		}
+		// Inside Gzip, so errors are converted before they are compressed
+		r.Use(authmw.ProblemDetails(s.config.ProblemDetails))
+
+		r.Get("/capabilities", s.GetCapabilities)
+		r.Get("/version", s.GetVersion)
+		r.Get("/shared/{token}", s.GetSharedBlob)
+
 		// Auth routes (public)
 		r.Route("/auth", func(r chi.Router) {
 			r.Get("/kdf", s.GetKDFParams)
-			r.Post("/register", s.Register)
-			r.Post("/verify", s.Verify)
+			r.Get("/kdf/bounds", s.GetKDFBounds)
+			r.With(limitUsernameChecks).Get("/username-available", s.UsernameAvailable)
+			r.With(s.rejectWhenReadOnly, limitKDF).Post("/register", s.Register)
+			r.With(limitKDF).Post("/verify", s.Verify)
+			r.With(limitKDF).Post("/check", s.CheckAuth)
+			r.Post("/introspect", s.IntrospectToken)
 		})
 
 		// Protected routes
 		r.Group(func(r chi.Router) {
 			r.Use(s.jwtConfig.AuthMiddleware)
+			r.Use(s.requireAccount)
 
 			// Auth verification endpoint
 			r.Get("/auth/verify", s.VerifyAuth)
+			r.Post("/auth/token", s.IssueToken)
+			r.Get("/auth/events", s.ListAuthEvents)
 
-			// User routes
-			r.Patch("/users/me", s.UpdateUser)
-
-			// Blob routes
+			// Read routes (any scope)
+			r.Get("/users/me/account-key", s.GetAccountKey)
+			r.Get("/sessions", s.ListSessions)
+			r.Get("/sessions/summary", s.GetSessionSummary)
 			r.Get("/blobs", s.ListBlobs)
+			r.Get("/blobs:facets", s.GetBlobFacets)
+			r.Get("/blobs:summary", s.GetBlobSummary)
+			r.Get("/blobs:delta", s.BlobDelta)
+			r.Post("/blobs:versionCheck", s.VersionCheck)
 			r.Get("/blobs/{blobName}", s.GetBlob)
-			r.Put("/blobs/{blobName}", s.UpsertBlob)
-			r.Delete("/blobs/{blobName}", s.DeleteBlob)
+			r.Get("/blobs/{blobName}/content", s.GetBlobContent)
+			r.Get("/blobs/{blobName}/verify", s.VerifyBlob)
+			r.Get("/export.zip", s.ExportArchive)
+			r.Post("/blobs/{blobName}/signed-url", s.CreateSignedURL)
+
+			// Write routes (readwrite scope, closed in read-only mode)
+			r.Group(func(r chi.Router) {
+				r.Use(authmw.RequireScope(authmw.ScopeReadWrite))
+				r.Use(s.rejectWhenReadOnly)
+
+				r.With(limitKDF).Patch("/users/me", s.UpdateUser)
+				r.Post("/users/me/rotate-key", s.RotateKey)
+				if s.config.KeyEscrow {
+					r.Put("/users/me/escrow", s.PutKeyEscrow)
+				}
+				r.Patch("/sessions/{sessionID}", s.UpdateSession)
+				r.Post("/blobs/{blobName}/lock", s.LockBlob)
+				r.Delete("/blobs/{blobName}/lock", s.UnlockBlob)
+
+				// Blob writes count against the per-user write rate, one token per request
+				r.Group(func(r chi.Router) {
+					r.Use(limitBlobWrites)
+
+					r.With(limitUploads).Post("/blobs:importArchive", s.ImportArchive)
+					r.With(limitUploads).Post("/blobs:batchPut", s.BatchPut)
+					r.Post("/blobs:batchUpdateMeta", s.BatchUpdateMeta)
+					r.With(limitUploads).Put("/blobs/{blobName}", s.UpsertBlob)
+					r.Patch("/blobs/{blobName}", s.UpdateBlobMeta)
+					r.Post("/blobs/{blobName}/rename", s.RenameBlob)
+					r.Post("/blobs/{blobName}/rewrap", s.RewrapBlob)
+					r.Post("/blobs/{blobName}/touch", s.TouchBlob)
+					r.Delete("/blobs/{blobName}", s.DeleteBlob)
+				})
+			})
 		})
+
+		// Admin routes (static admin token, only when configured)
+		if s.config.AdminToken != "" {
+			r.Route("/admin", func(r chi.Router) {
+				r.Use(authmw.AdminAuthMiddleware(s.config.AdminToken))
+
+				r.Get("/read-only", s.GetReadOnly)
+				r.Put("/read-only", s.SetReadOnly)
+				r.Get("/audit/export", s.ExportAuditEvents)
+				r.Get("/stats/algs", s.GetAlgStats)
+				r.Post("/users/kdf", s.BulkKDFParams)
+				if s.config.KeyEscrow {
+					r.Get("/users/{userID}/escrow", s.GetUserKeyEscrow)
+				}
+
+				// Maintenance jobs and writes, closed in read-only mode like the user's
+				r.Group(func(r chi.Router) {
+					r.Use(s.rejectWhenReadOnly)
+
+					r.Post("/scrub", s.ScrubBlobs)
+					r.Post("/blobs/transfer", s.TransferBlob)
+					r.Post("/invites", s.CreateInvite)
+					r.Delete("/invites/{code}", s.RevokeInvite)
+					r.With(limitKDF).Post("/users", s.CreateUser)
+					r.Post("/users/{userID}/revoke-sessions", s.RevokeUserSessions)
+					if s.config.BackupDir != "" {
+						r.Post("/backup", s.CreateBackup)
+					}
+				})
+			})
+		}
 	})
 
 	return r
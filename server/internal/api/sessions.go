@@ -0,0 +1,183 @@
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/shalteor/cryptd-poc/server/internal/crypto"
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// maxSessionLabelLen caps session labels in characters
+const maxSessionLabelLen = 100
+
+// sessionActivityResolution is how stale a session's lastUsedAt may get
+// before a request refreshes it; coarser means fewer writes
+const sessionActivityResolution = time.Minute
+
+// sessionActivity remembers when each session's use was last written, so
+// requests within sessionActivityResolution of it skip the database entirely
+// instead of issuing an UPDATE that matches nothing. Entries older than the
+// resolution no longer suppress anything and are pruned.
+type sessionActivity struct {
+	mu        sync.Mutex
+	recorded  map[string]time.Time
+	lastPrune time.Time
+}
+
+// due reports whether sessionID's use at now should be written, and if so
+// counts it as written
+func (a *sessionActivity) due(sessionID string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now.Sub(a.lastPrune) >= sessionActivityResolution {
+		for id, at := range a.recorded {
+			if now.Sub(at) >= sessionActivityResolution {
+				delete(a.recorded, id)
+			}
+		}
+		a.lastPrune = now
+	}
+
+	if at, ok := a.recorded[sessionID]; ok && now.Sub(at) < sessionActivityResolution {
+		return false
+	}
+	if a.recorded == nil {
+		a.recorded = map[string]time.Time{}
+	}
+	a.recorded[sessionID] = now
+	return true
+}
+
+// SessionResponse is a session as listed to its owner
+type SessionResponse struct {
+	models.Session
+	// Current marks the session of the token making the request
+	Current bool `json:"current"`
+}
+
+// UpdateSessionRequest represents a session label change
+type UpdateSessionRequest struct {
+	Label *string `json:"label"`
+}
+
+// issueToken records a new session and returns a token bound to it and to the
+// user's current session epoch. The label is the one the client asked for, else its User-Agent, truncated
+// to maxSessionLabelLen.
+func (s *Server) issueToken(r *http.Request, user *models.User, scope middleware.Scope, label string) (string, error) {
+	if label == "" {
+		label = r.UserAgent()
+	}
+
+	id, err := crypto.GenerateRandomBytes(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		ID:        hex.EncodeToString(id),
+		UserID:    user.ID,
+		Label:     truncateRunes(label, maxSessionLabelLen),
+		Scope:     string(scope),
+		CreatedAt: models.NewTimestamp(now),
+		ExpiresAt: models.NewTimestamp(now.Add(s.jwtConfig.Expiration)),
+	}
+	if err := s.db.CreateSession(session); err != nil {
+		return "", err
+	}
+
+	return s.jwtConfig.GenerateSessionToken(user.ID, scope, session.ID, user.SessionEpoch, now)
+}
+
+// ListSessions handles GET /v1/sessions - the user's unexpired sessions, newest first
+func (s *Server) ListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	sessions, err := s.db.ListSessions(userID)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to list sessions", err)
+		return
+	}
+
+	current := middleware.GetSessionIDFromContext(r.Context())
+	resp := make([]SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		resp = append(resp, SessionResponse{Session: session, Current: session.ID == current})
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// GetSessionSummary handles GET /v1/sessions/summary - the number of the
+// user's unexpired sessions and when any of them was last used, for security
+// dashboards that do not need the full list
+func (s *Server) GetSessionSummary(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	summary, err := s.db.SessionSummary(userID)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to summarize sessions", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, summary)
+}
+
+// UpdateSession handles PATCH /v1/sessions/{sessionID} - renames a session
+func (s *Server) UpdateSession(w http.ResponseWriter, r *http.Request) {
+	userID, err := middleware.GetUserIDFromContext(r.Context())
+	if err != nil {
+		respondError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	var req UpdateSessionRequest
+	if !s.decodeJSON(w, r, &req) {
+		return
+	}
+	if req.Label == nil {
+		respondError(w, http.StatusBadRequest, "label is required")
+		return
+	}
+	if utf8.RuneCountInString(*req.Label) > maxSessionLabelLen {
+		respondError(w, http.StatusBadRequest, "label is too long")
+		return
+	}
+
+	session, err := s.db.UpdateSessionLabel(userID, chi.URLParam(r, "sessionID"), *req.Label)
+	if err == db.ErrSessionNotFound {
+		respondError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		s.respondInternalError(w, r, "failed to update session", err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, SessionResponse{
+		Session: *session,
+		Current: session.ID == middleware.GetSessionIDFromContext(r.Context()),
+	})
+}
+
+// truncateRunes shortens s to at most n characters without splitting a rune
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/crypto"
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+func listSessions(t *testing.T, router http.Handler, token string) []SessionResponse {
+	t.Helper()
+
+	w := doRequest(router, "GET", "/v1/sessions", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var sessions []SessionResponse
+	if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+		t.Fatalf("failed to decode sessions: %v", err)
+	}
+	return sessions
+}
+
+func TestSessionLabels(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	user.LoginVerifierHash = crypto.HashLoginVerifier(make([]byte, 32), "alice")
+	if err := database.UpdateUser(user); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+
+	// Login with an explicit label
+	w := doRequest(router, "POST", "/v1/auth/verify", "", VerifyRequest{
+		Username:      "alice",
+		LoginVerifier: crypto.EncodeBase64(make([]byte, 32)),
+		Label:         "MacBook",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var login VerifyResponse
+	_ = json.NewDecoder(w.Body).Decode(&login)
+
+	// A minted token without a label falls back to the User-Agent
+	req := httptest.NewRequest("POST", "/v1/auth/token", strings.NewReader(`{"scope":"read"}`))
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	req.Header.Set("User-Agent", "cryptd-cli/1.0")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var minted TokenResponse
+	_ = json.NewDecoder(w.Body).Decode(&minted)
+
+	sessions := listSessions(t, router, login.Token)
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+	labels := map[string]SessionResponse{}
+	for _, session := range sessions {
+		labels[session.Label] = session
+	}
+	if s, ok := labels["MacBook"]; !ok || !s.Current || s.Scope != string(middleware.ScopeReadWrite) {
+		t.Errorf("expected current readwrite MacBook session, got %+v", sessions)
+	}
+	cli, ok := labels["cryptd-cli/1.0"]
+	if !ok || cli.Current || cli.Scope != string(middleware.ScopeRead) {
+		t.Fatalf("expected non-current read session labelled by User-Agent, got %+v", sessions)
+	}
+
+	// Rename the CLI session
+	w = doRequest(router, "PATCH", "/v1/sessions/"+cli.ID, login.Token, map[string]string{"label": "Backup job"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, session := range listSessions(t, router, minted.Token) {
+		if session.ID == cli.ID && (session.Label != "Backup job" || !session.Current) {
+			t.Errorf("expected renamed current session, got %+v", session)
+		}
+	}
+
+	for _, tt := range []struct {
+		name, target string
+		body         interface{}
+		expected     int
+	}{
+		{"missing label", "/v1/sessions/" + cli.ID, map[string]string{}, http.StatusBadRequest},
+		{"label too long", "/v1/sessions/" + cli.ID, map[string]string{"label": strings.Repeat("x", maxSessionLabelLen+1)}, http.StatusBadRequest},
+		{"unknown session", "/v1/sessions/nope", map[string]string{"label": "x"}, http.StatusNotFound},
+	} {
+		if w := doRequest(router, "PATCH", tt.target, login.Token, tt.body); w.Code != tt.expected {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expected, w.Code)
+		}
+	}
+
+	// Read-scoped tokens cannot rename, and other users cannot see or rename the session
+	if w := doRequest(router, "PATCH", "/v1/sessions/"+cli.ID, minted.Token, map[string]string{"label": "x"}); w.Code != http.StatusForbidden {
+		t.Errorf("expected status 403 for read token, got %d", w.Code)
+	}
+	bob := createTestUser(t, database, "bob")
+	bobToken, _ := server.jwtConfig.GenerateToken(bob.ID)
+	if w := doRequest(router, "PATCH", "/v1/sessions/"+cli.ID, bobToken, map[string]string{"label": "x"}); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for another user's session, got %d", w.Code)
+	}
+	if sessions := listSessions(t, router, bobToken); len(sessions) != 0 {
+		t.Errorf("expected bob to see no sessions, got %+v", sessions)
+	}
+}
+
+func TestSessionSummary(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	now := time.Now().UTC()
+	for _, session := range []models.Session{
+		{ID: "laptop", CreatedAt: models.NewTimestamp(now.Add(-3 * time.Hour)), ExpiresAt: models.NewTimestamp(now.Add(time.Hour))},
+		{ID: "phone", CreatedAt: models.NewTimestamp(now.Add(-2 * time.Hour)), ExpiresAt: models.NewTimestamp(now.Add(time.Hour))},
+		{ID: "expired", CreatedAt: models.NewTimestamp(now.Add(-5 * time.Hour)), ExpiresAt: models.NewTimestamp(now.Add(-time.Hour))},
+	} {
+		session.UserID = user.ID
+		session.Scope = string(middleware.ScopeReadWrite)
+		if err := database.CreateSession(&session); err != nil {
+			t.Fatalf("failed to create session: %v", err)
+		}
+	}
+
+	summary := func(token string) models.SessionSummary {
+		t.Helper()
+		w := doRequest(router, "GET", "/v1/sessions/summary", token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var summary models.SessionSummary
+		if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+			t.Fatalf("failed to decode summary: %v", err)
+		}
+		if summary.LastActiveAt == nil {
+			t.Fatalf("expected lastActiveAt, got %+v", summary)
+		}
+		return summary
+	}
+	near := func(got *models.Timestamp, want time.Time) bool {
+		return got.Sub(want).Abs() < time.Second
+	}
+
+	// A token without a session is not counted and records no activity
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	got := summary(token)
+	if got.Active != 2 || !near(got.LastActiveAt, now.Add(-2*time.Hour)) {
+		t.Errorf("expected 2 sessions last active at the phone login, got %d at %v", got.Active, got.LastActiveAt)
+	}
+
+	if err := database.RecordSessionUse("laptop", now.Add(-30*time.Minute), sessionActivityResolution); err != nil {
+		t.Fatalf("failed to record session use: %v", err)
+	}
+	got = summary(token)
+	if got.Active != 2 || !near(got.LastActiveAt, now.Add(-30*time.Minute)) {
+		t.Errorf("expected the laptop's use as last activity, got %d at %v", got.Active, got.LastActiveAt)
+	}
+
+	// Requests with a session token count as activity
+	got = summary(sessionToken(t, server, user.ID, "tablet"))
+	if got.Active != 3 || !near(got.LastActiveAt, time.Now()) {
+		t.Errorf("expected 3 sessions active just now, got %d at %v", got.Active, got.LastActiveAt)
+	}
+}
+
+func TestSessionUseWrites(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	writes := func() int64 {
+		v, ok := metrics.DBQueries.Get("RecordSessionUse").(*expvar.Int)
+		if !ok {
+			return 0
+		}
+		return v.Value()
+	}
+
+	// Steady-state reads write once per resolution, not once per request
+	token := sessionToken(t, server, user.ID, "laptop")
+	before := writes()
+	for range 5 {
+		if w := doRequest(router, "GET", "/v1/blobs", token, nil); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if got := writes() - before; got != 1 {
+		t.Errorf("expected 1 session use write for 5 reads, got %d", got)
+	}
+
+	// Maintenance mode writes nothing, reads included
+	server.readOnly.Store(true)
+	token = sessionToken(t, server, user.ID, "phone")
+	before = writes()
+	if w := doRequest(router, "GET", "/v1/blobs", token, nil); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if got := writes() - before; got != 0 {
+		t.Errorf("expected no session use write in read-only mode, got %d", got)
+	}
+}
+
+func TestSessionActivityDue(t *testing.T) {
+	var activity sessionActivity
+	now := time.Now()
+
+	if !activity.due("a", now) {
+		t.Error("expected the first use to be due")
+	}
+	if activity.due("a", now.Add(sessionActivityResolution/2)) {
+		t.Error("expected a use within the resolution not to be due")
+	}
+	if !activity.due("b", now.Add(sessionActivityResolution/2)) {
+		t.Error("expected another session's use to be due")
+	}
+	if !activity.due("a", now.Add(2*sessionActivityResolution)) {
+		t.Error("expected a later use to be due")
+	}
+	if _, ok := activity.recorded["b"]; ok {
+		t.Error("expected the stale entry to be pruned")
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+const (
+	// defaultShareTTL applies when a signed-url request gives no expiresInSeconds
+	defaultShareTTL = 15 * time.Minute
+	// maxShareTTL caps how long a signed URL stays valid
+	maxShareTTL = 7 * 24 * time.Hour
+)
+
+// SignedURLRequest asks for a read URL valid for ExpiresInSeconds
+type SignedURLRequest struct {
+	ExpiresInSeconds int64 `json:"expiresInSeconds,omitempty"`
+}
+
+// SignedURLResponse is a time-limited read URL for one blob
+type SignedURLResponse struct {
+	URL       string           `json:"url"`
+	Token     string           `json:"token"`
+	ExpiresAt models.Timestamp `json:"expiresAt"`
+}
+
+// SharedBlobResponse is a blob as served to a signed-URL holder
+type SharedBlobResponse struct {
+	BlobName      string           `json:"blobName"`
+	EncryptedBlob models.Container `json:"encryptedBlob"`
+	Version       int64            `json:"version"`
+}
+
+// CreateSignedURL handles POST /v1/blobs/{blobName}/signed-url. The URL lets a
+// holder without a JWT fetch the still-encrypted blob until it expires; the
+// decryption key has to reach them out-of-band.
+func (s *Server) CreateSignedURL(w http.ResponseWriter, r *http.Request) {
+	var req SignedURLRequest
+	if r.ContentLength != 0 && !s.decodeJSON(w, r, &req) {
+		return
+	}
+
+	ttl := defaultShareTTL
+	if req.ExpiresInSeconds != 0 {
+		ttl = time.Duration(req.ExpiresInSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > maxShareTTL {
+		respondError(w, http.StatusBadRequest, "expiresInSeconds must be between 1 and 604800")
+		return
+	}
+
+	blob, ok := s.loadBlob(w, r)
+	if !ok {
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	if !blob.Pinned && blob.ExpiresAt != nil && blob.ExpiresAt.Before(expiresAt) {
+		expiresAt = blob.ExpiresAt.Time
+	}
+
+	token, err := s.jwtConfig.SignShareToken(blob.UserID, blob.ID, blob.Version, blob.BlobName, expiresAt)
+	if err != nil {
+		s.respondInternalError(w, r, "failed to sign URL", err)
+		return
+	}
+
+	respondJSON(w, http.StatusCreated, SignedURLResponse{
+		URL:       requestOrigin(r) + "/v1/shared/" + token,
+		Token:     token,
+		ExpiresAt: models.NewTimestamp(expiresAt),
+	})
+}
+
+// GetSharedBlob handles GET /v1/shared/{token}, which needs no session
+func (s *Server) GetSharedBlob(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.jwtConfig.ParseShareToken(chi.URLParam(r, "token"), time.Now())
+	if err == middleware.ErrShareTokenExpired {
+		respondErrorCode(w, http.StatusForbidden, "share_expired", "signed URL has expired")
+		return
+	}
+	if err != nil {
+		respondErrorCode(w, http.StatusForbidden, "share_invalid", "invalid signed URL")
+		return
+	}
+
+	blob, err := s.db.GetBlob(claims.UserID, claims.BlobName)
+	if err == db.ErrBlobNotFound || err == db.ErrBlobExpired {
+		respondBlobNotFound(w)
+		return
+	}
+	if err != nil {
+		s.respondInternalError(w, r, "failed to get blob", err)
+		return
+	}
+	// The name now holds another blob, or a later write of the shared one
+	if blob.ID != claims.BlobID || blob.Version != claims.Version {
+		respondBlobNotFound(w)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, SharedBlobResponse{
+		BlobName:      blob.BlobName,
+		EncryptedBlob: blob.EncryptedBlob,
+		Version:       blob.Version,
+	})
+}
+
+// requestOrigin is the scheme and host the client used to reach the server,
+// including https terminated by a trusted proxy
+func requestOrigin(r *http.Request) string {
+	return middleware.Scheme(r) + "://" + r.Host
+}
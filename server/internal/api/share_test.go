@@ -0,0 +1,162 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/db"
+	"github.com/shalteor/cryptd-poc/server/internal/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+func TestSignedURL(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateScopedToken(user.ID, middleware.ScopeRead)
+	vault := &models.Blob{
+		UserID:        user.ID,
+		BlobName:      "vault",
+		EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"},
+	}
+	if err := database.UpsertBlob(vault); err != nil {
+		t.Fatalf("failed to upsert blob: %v", err)
+	}
+
+	w := doRequest(router, "POST", "/v1/blobs/vault/signed-url", token, SignedURLRequest{ExpiresInSeconds: 60})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var signed SignedURLResponse
+	_ = json.NewDecoder(w.Body).Decode(&signed)
+	if !strings.HasSuffix(signed.URL, "/v1/shared/"+signed.Token) {
+		t.Errorf("expected URL to end in the token, got %q", signed.URL)
+	}
+	if until := time.Until(signed.ExpiresAt.Time); until <= 0 || until > time.Minute {
+		t.Errorf("expected expiry within a minute, got %s", signed.ExpiresAt)
+	}
+
+	// Valid: no Authorization header needed
+	w = doRequest(router, "GET", "/v1/shared/"+signed.Token, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var shared SharedBlobResponse
+	_ = json.NewDecoder(w.Body).Decode(&shared)
+	if shared.BlobName != "vault" || shared.EncryptedBlob.Ciphertext != "Yw==" || shared.Version != 1 {
+		t.Errorf("unexpected shared blob: %+v", shared)
+	}
+
+	// Expired
+	expired, _ := server.jwtConfig.SignShareToken(user.ID, vault.ID, 1, "vault", time.Now().Add(-time.Second))
+	w = doRequest(router, "GET", "/v1/shared/"+expired, "", nil)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "share_expired") {
+		t.Errorf("expected 403 share_expired, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Tampered: another blob's claims under the original signature
+	other, _ := server.jwtConfig.SignShareToken(user.ID, vault.ID+1, 1, "other", time.Now().Add(time.Minute))
+	payload, _, _ := strings.Cut(other, ".")
+	_, signature, _ := strings.Cut(signed.Token, ".")
+	w = doRequest(router, "GET", "/v1/shared/"+payload+"."+signature, "", nil)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "share_invalid") {
+		t.Errorf("expected 403 share_invalid, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A deleted blob is gone for the URL holder too
+	_ = database.DeleteBlob(user.ID, "vault", db.Writer{})
+	if w := doRequest(router, "GET", "/v1/shared/"+signed.Token, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 after delete, got %d", w.Code)
+	}
+
+	// and stays gone when another blob takes its name
+	recreated := &models.Blob{
+		UserID:        user.ID,
+		BlobName:      "vault",
+		EncryptedBlob: models.Container{Nonce: "n2", Ciphertext: "ZA==", Tag: "t"},
+	}
+	if err := database.UpsertBlob(recreated); err != nil {
+		t.Fatalf("failed to re-create blob: %v", err)
+	}
+	if w := doRequest(router, "GET", "/v1/shared/"+signed.Token, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for a re-created blob, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A URL shares one version: a later write ends it
+	w = doRequest(router, "POST", "/v1/blobs/vault/signed-url", token, nil)
+	_ = json.NewDecoder(w.Body).Decode(&signed)
+	if w := doRequest(router, "GET", "/v1/shared/"+signed.Token, "", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	recreated.EncryptedBlob.Nonce = "n3"
+	if err := database.UpsertBlob(recreated); err != nil {
+		t.Fatalf("failed to update blob: %v", err)
+	}
+	if w := doRequest(router, "GET", "/v1/shared/"+signed.Token, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for a rewritten blob, got %d", w.Code)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		target   string
+		body     interface{}
+		expected int
+	}{
+		{"ttl too long", "/v1/blobs/vault/signed-url", SignedURLRequest{ExpiresInSeconds: int64(maxShareTTL/time.Second) + 1}, http.StatusBadRequest},
+		{"negative ttl", "/v1/blobs/vault/signed-url", SignedURLRequest{ExpiresInSeconds: -1}, http.StatusBadRequest},
+		{"missing blob", "/v1/blobs/missing/signed-url", nil, http.StatusNotFound},
+	} {
+		if w := doRequest(router, "POST", tt.target, token, tt.body); w.Code != tt.expected {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.expected, w.Code)
+		}
+	}
+}
+
+func TestSignedURLBehindTrustedProxy(t *testing.T) {
+	database, err := db.New(":memory:")
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = database.Close() }()
+	config := DefaultConfig()
+	config.TrustedProxies, _ = middleware.ParseTrustedProxies("10.0.0.1")
+	server := NewServerWithConfig(database, "test-jwt-secret", config)
+	router := server.NewRouter()
+
+	user := createTestUser(t, database, "alice")
+	token, _ := server.jwtConfig.GenerateToken(user.ID)
+	_ = database.UpsertBlob(&models.Blob{
+		UserID:        user.ID,
+		BlobName:      "vault",
+		EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"},
+	})
+
+	for _, tt := range []struct {
+		name     string
+		peer     string
+		expected string
+	}{
+		{"trusted proxy terminated tls", "10.0.0.1:4000", "https://cryptd.example/"},
+		{"untrusted peer cannot claim https", "203.0.113.9:4000", "http://cryptd.example/"},
+	} {
+		req := httptest.NewRequest("POST", "/v1/blobs/vault/signed-url", nil)
+		req.Host = "cryptd.example"
+		req.RemoteAddr = tt.peer
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var signed SignedURLResponse
+		_ = json.NewDecoder(w.Body).Decode(&signed)
+		if !strings.HasPrefix(signed.URL, tt.expected) {
+			t.Errorf("%s: expected URL under %s, got %q", tt.name, tt.expected, signed.URL)
+		}
+	}
+}
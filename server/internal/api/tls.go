@@ -0,0 +1,73 @@
+package api
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// TLSPolicy is the protocol policy used when the server terminates TLS itself
+type TLSPolicy struct {
+	// MinVersion is "1.2" or "1.3"; the highest version both sides support is negotiated
+	MinVersion string
+	// CipherSuites are the allowed TLS 1.2 suites by IANA name. Go does not
+	// make TLS 1.3 suites configurable; all of them are secure.
+	CipherSuites []string
+}
+
+// DefaultTLSPolicy allows TLS 1.2 with forward-secret AEAD suites only
+func DefaultTLSPolicy() TLSPolicy {
+	return TLSPolicy{
+		MinVersion: "1.2",
+		CipherSuites: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+			"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+		},
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig validates the policy and builds the tls.Config for http.Server.
+// Suites Go considers insecure, and TLS 1.3 suite names, are rejected rather
+// than silently ignored.
+func (p TLSPolicy) TLSConfig() (*tls.Config, error) {
+	version, ok := tlsVersions[p.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("minimum TLS version must be 1.2 or 1.3, got %q", p.MinVersion)
+	}
+
+	config := &tls.Config{MinVersion: version}
+	if version == tls.VersionTLS13 {
+		// No TLS 1.2 handshake can happen, so the suite list does not apply
+		return config, nil
+	}
+	if len(p.CipherSuites) == 0 {
+		return nil, fmt.Errorf("TLS cipher suite list must not be empty")
+	}
+
+	available := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		for _, v := range suite.SupportedVersions {
+			if v == tls.VersionTLS12 {
+				available[suite.Name] = suite.ID
+			}
+		}
+	}
+	for _, name := range p.CipherSuites {
+		name = strings.TrimSpace(name)
+		id, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS 1.2 cipher suite %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	return config, nil
+}
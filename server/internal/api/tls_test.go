@@ -0,0 +1,64 @@
+package api
+
+import (
+	"crypto/tls"
+	"slices"
+	"testing"
+)
+
+func TestDefaultTLSPolicy(t *testing.T) {
+	config, err := DefaultTLSPolicy().TLSConfig()
+	if err != nil {
+		t.Fatalf("default policy should be valid: %v", err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || config.MaxVersion != 0 {
+		t.Errorf("expected TLS 1.2 minimum with TLS 1.3 allowed, got min %x max %x", config.MinVersion, config.MaxVersion)
+	}
+	expected := []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	}
+	if !slices.Equal(config.CipherSuites, expected) {
+		t.Errorf("expected suites %v, got %v", expected, config.CipherSuites)
+	}
+}
+
+func TestTLSPolicyCustom(t *testing.T) {
+	config, err := TLSPolicy{MinVersion: "1.2", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}}.TLSConfig()
+	if err != nil {
+		t.Fatalf("expected a valid policy: %v", err)
+	}
+	if !slices.Equal(config.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}) {
+		t.Errorf("expected only the requested suite, got %v", config.CipherSuites)
+	}
+
+	config, err = TLSPolicy{MinVersion: "1.3"}.TLSConfig()
+	if err != nil || config.MinVersion != tls.VersionTLS13 {
+		t.Errorf("expected a TLS 1.3-only config without suites, got %+v, %v", config, err)
+	}
+}
+
+func TestTLSPolicyInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy TLSPolicy
+	}{
+		{"empty suites", TLSPolicy{MinVersion: "1.2"}},
+		{"old version", TLSPolicy{MinVersion: "1.0", CipherSuites: DefaultTLSPolicy().CipherSuites}},
+		{"unknown suite", TLSPolicy{MinVersion: "1.2", CipherSuites: []string{"TLS_MADE_UP"}}},
+		{"insecure suite", TLSPolicy{MinVersion: "1.2", CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}},
+		{"tls 1.3 suite", TLSPolicy{MinVersion: "1.2", CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.policy.TLSConfig(); err == nil {
+				t.Error("expected the policy to be rejected")
+			}
+		})
+	}
+}
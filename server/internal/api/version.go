@@ -0,0 +1,120 @@
+package api
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/crypto"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// Version and Commit identify the build. Release builds set them with
+// -ldflags "-X github.com/shalteor/cryptd-poc/server/internal/api.Version=v1.2.3
+// -X github.com/shalteor/cryptd-poc/server/internal/api.Commit=abc123".
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+// VersionResponse describes the running build, process and configuration
+type VersionResponse struct {
+	Version       string           `json:"version"`
+	Commit        string           `json:"commit"`
+	GoVersion     string           `json:"goVersion"`
+	StartedAt     models.Timestamp `json:"startedAt"`
+	UptimeSeconds int64            `json:"uptimeSeconds"`
+	Config        ConfigSummary    `json:"config"`
+}
+
+// ConfigSummary is the non-secret part of the active configuration
+type ConfigSummary struct {
+	DefaultKDF                    models.KDFParams `json:"defaultKdf"`
+	KDFMinimums                   KDFMinimums      `json:"kdfMinimums"`
+	VerifierHashAlg               string           `json:"verifierHashAlg"`
+	AllowedAlgs                   []string         `json:"allowedAlgs"`
+	TokenTTLSeconds               int64            `json:"tokenTtlSeconds"`
+	UsernameChangeCooldownSeconds int64            `json:"usernameChangeCooldownSeconds"`
+	UserQuotaBytes                int64            `json:"userQuotaBytes"`
+	MaxImportEntries              int              `json:"maxImportEntries"`
+	MaxImportBytes                int64            `json:"maxImportBytes"`
+	RequireInvite                 bool             `json:"requireInvite"`
+	DisableRegistration           bool             `json:"disableRegistration"`
+	RequireCurrentVerifier        bool             `json:"requireCurrentVerifier"`
+	KeyEscrow                     bool             `json:"keyEscrow"`
+	ReadOnly                      bool             `json:"readOnly"`
+	AdminEnabled                  bool             `json:"adminEnabled"`
+	GzipResponses                 bool             `json:"gzipResponses"`
+	MaxConcurrentUploads          int              `json:"maxConcurrentUploads"`
+	MaxConcurrentKDF              int              `json:"maxConcurrentKdf"`
+}
+
+// KDFMinimums are the floors enforced on client-chosen KDF params
+type KDFMinimums struct {
+	PBKDF2Iterations   int `json:"pbkdf2Iterations"`
+	Argon2Iterations   int `json:"argon2Iterations"`
+	Argon2MemoryKiB    int `json:"argon2MemoryKiB"`
+	Argon2Parallelism  int `json:"argon2Parallelism"`
+	VerifierIterations int `json:"verifierIterations"`
+}
+
+// buildCommit returns Commit, falling back to the VCS revision the Go
+// toolchain embeds when building from a checkout
+func buildCommit() string {
+	if Commit != "" {
+		return Commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// Health handles GET /health, a liveness probe for load balancers. It is
+// public, exempt from -require-https, and does not touch the database.
+func (s *Server) Health(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GetVersion handles GET /v1/version. It is public, so it must only report
+// settings that are safe to disclose: no secrets, tokens or paths.
+func (s *Server) GetVersion(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, VersionResponse{
+		Version:       Version,
+		Commit:        buildCommit(),
+		GoVersion:     runtime.Version(),
+		StartedAt:     models.NewTimestamp(s.startedAt),
+		UptimeSeconds: int64(time.Since(s.startedAt).Seconds()),
+		Config: ConfigSummary{
+			DefaultKDF: s.config.DefaultKDF,
+			KDFMinimums: KDFMinimums{
+				PBKDF2Iterations:   crypto.MinPBKDF2Iterations,
+				Argon2Iterations:   crypto.MinArgon2Iterations,
+				Argon2MemoryKiB:    crypto.MinArgon2Memory,
+				Argon2Parallelism:  crypto.MinArgon2Parallelism,
+				VerifierIterations: crypto.LoginVerifierIterations,
+			},
+			VerifierHashAlg:               string(s.config.VerifierHashAlg),
+			AllowedAlgs:                   s.config.AllowedAlgs,
+			TokenTTLSeconds:               int64(s.jwtConfig.Expiration.Seconds()),
+			UsernameChangeCooldownSeconds: int64(s.config.UsernameChangeCooldown.Seconds()),
+			UserQuotaBytes:                s.config.UserQuotaBytes,
+			MaxImportEntries:              s.config.MaxImportEntries,
+			MaxImportBytes:                s.config.MaxImportBytes,
+			RequireInvite:                 s.config.RequireInvite,
+			DisableRegistration:           s.config.DisableRegistration,
+			RequireCurrentVerifier:        s.config.RequireCurrentVerifier,
+			KeyEscrow:                     s.config.KeyEscrow,
+			ReadOnly:                      s.readOnly.Load(),
+			AdminEnabled:                  s.config.AdminToken != "",
+			GzipResponses:                 s.config.GzipResponses,
+			MaxConcurrentUploads:          s.config.MaxConcurrentUploads,
+			MaxConcurrentKDF:              s.config.MaxConcurrentKDF,
+		},
+	})
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	server, database := setupTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	// Plain HTTP health checks keep working under -require-https
+	server.config.RequireHTTPS = true
+	router := server.NewRouter()
+	if w := doRequest(router, "GET", "/health", "", nil); w.Code != http.StatusOK {
+		t.Errorf("expected status 200 for /health over plain HTTP, got %d", w.Code)
+	}
+	if w := doRequest(router, "GET", "/v1/version", "", nil); w.Code != http.StatusUpgradeRequired {
+		t.Errorf("expected status 426 for other routes over plain HTTP, got %d", w.Code)
+	}
+}
+
+func TestGetVersion(t *testing.T) {
+	server, database := setupAdminTestServer(t)
+	defer func() { _ = database.Close() }()
+
+	w := doRequest(server.NewRouter(), "GET", "/v1/version", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 without auth, got %d", w.Code)
+	}
+	body := w.Body.String()
+
+	var resp map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	for _, field := range []string{"version", "commit", "goVersion", "startedAt", "uptimeSeconds", "config"} {
+		if _, ok := resp[field]; !ok {
+			t.Errorf("expected %q in response: %s", field, body)
+		}
+	}
+	if resp["goVersion"] != runtime.Version() {
+		t.Errorf("expected goVersion %s, got %v", runtime.Version(), resp["goVersion"])
+	}
+
+	config, _ := resp["config"].(map[string]interface{})
+	for _, field := range []string{"defaultKdf", "kdfMinimums", "userQuotaBytes", "tokenTtlSeconds", "adminEnabled"} {
+		if _, ok := config[field]; !ok {
+			t.Errorf("expected config.%s in response: %s", field, body)
+		}
+	}
+	if config["adminEnabled"] != true {
+		t.Errorf("expected adminEnabled true, got %v", config["adminEnabled"])
+	}
+
+	// Secrets never appear, even though both are configured
+	for _, secret := range []string{testAdminToken, "test-jwt-secret"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("version response leaks a secret: %s", body)
+		}
+	}
+}
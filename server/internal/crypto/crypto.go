@@ -3,10 +3,15 @@ package crypto
 import (
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"math"
+	"time"
 
 	"github.com/shalteor/cryptd-poc/server/internal/models"
 	"golang.org/x/crypto/argon2"
@@ -21,21 +26,54 @@ const (
 	HKDFInfoMaster   = "master-key:v1"
 	HKDFOutputLength = 32
 
+	// LoginVerifierLength is the size of a decoded login verifier, which is
+	// one HKDF output
+	LoginVerifierLength = HKDFOutputLength
+
 	// Login verifier hash constants
 	LoginVerifierIterations = 600_000
+	DefaultVerifierHashAlg  = models.VerifierHashPBKDF2SHA256
 
 	// Minimum KDF parameter floors
 	MinPBKDF2Iterations  = 100_000
 	MinArgon2Memory      = 16384 // 16 MiB in KiB
 	MinArgon2Iterations  = 2
 	MinArgon2Parallelism = 1
+
+	// KDF parameter ceilings: x/crypto/argon2 takes lanes as a uint8, and the
+	// rest are kept within 32 bits so every client can represent them
+	MaxPBKDF2Iterations  = math.MaxInt32
+	MaxArgon2Memory      = math.MaxInt32
+	MaxArgon2Iterations  = math.MaxInt32
+	MaxArgon2Parallelism = math.MaxUint8
+
+	// Scaled-down work sampled by EstimateKDFDuration
+	estimatePBKDF2Iterations = 10_000
+	estimateArgon2MemoryKiB  = 8192
 )
 
 var (
 	ErrInvalidKDFParams = errors.New("invalid KDF parameters")
 	ErrInvalidKDFType   = errors.New("invalid KDF type")
+
+	ErrInvalidVerifierHashAlg = errors.New("invalid verifier hash algorithm")
+
+	ErrInvalidContainer = errors.New("invalid container")
 )
 
+// AEADSpec describes the envelope sizes of a container algorithm
+type AEADSpec struct {
+	NonceSize int
+	TagSize   int
+}
+
+// AEADAlgorithms maps container "alg" values to their envelope sizes.
+// Supporting a new algorithm only takes a new entry here.
+var AEADAlgorithms = map[string]AEADSpec{
+	"A256GCM": {NonceSize: 12, TagSize: 16},
+	"XC20P":   {NonceSize: 24, TagSize: 16},
+}
+
 // DerivePasswordSecret derives masterSecret from password using the specified KDF
 func DerivePasswordSecret(password, username string, params models.KDFParams) ([]byte, error) {
 	switch params.Type {
@@ -98,14 +136,63 @@ func deriveHKDF(masterSecret []byte, info string) ([]byte, error) {
 	return key, nil
 }
 
-// HashLoginVerifier hashes the login verifier for storage
+// HashLoginVerifier hashes the login verifier for storage with the default PBKDF2-HMAC-SHA256
 func HashLoginVerifier(loginVerifier []byte, username string) []byte {
-	return pbkdf2.Key(loginVerifier, []byte(username), LoginVerifierIterations, 32, sha256.New)
+	hash, _ := HashLoginVerifierWith(DefaultVerifierHashAlg, loginVerifier, username)
+	return hash
+}
+
+// verifierHashParams is the PBKDF2 setup behind a verifier hash algorithm
+type verifierHashParams struct {
+	newHash    func() hash.Hash
+	iterations int
+}
+
+// verifierHashes lists the supported verifier hash algorithms
+var verifierHashes = map[models.VerifierHashAlg]verifierHashParams{
+	models.VerifierHashPBKDF2SHA256: {sha256.New, LoginVerifierIterations},
+	models.VerifierHashPBKDF2SHA512: {sha512.New, LoginVerifierIterations},
+}
+
+// HashLoginVerifierWith hashes the login verifier for storage with the given algorithm
+func HashLoginVerifierWith(alg models.VerifierHashAlg, loginVerifier []byte, username string) ([]byte, error) {
+	params, ok := verifierHashes[alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidVerifierHashAlg, alg)
+	}
+	return pbkdf2.Key(loginVerifier, []byte(username), params.iterations, 32, params.newHash), nil
+}
+
+// VerifierHashLabel describes the params HashLoginVerifierWith uses for alg,
+// e.g. "pbkdf2_sha256,iterations=600000", for labelling timings. An
+// unsupported alg is described by its name alone.
+func VerifierHashLabel(alg models.VerifierHashAlg) string {
+	params, ok := verifierHashes[alg]
+	if !ok {
+		return string(alg)
+	}
+	return fmt.Sprintf("%s,iterations=%d", alg, params.iterations)
 }
 
-// VerifyLoginVerifier verifies a login verifier against a stored hash
+// ValidateVerifierHashAlg reports whether alg is a supported verifier hash algorithm
+func ValidateVerifierHashAlg(alg models.VerifierHashAlg) error {
+	if _, ok := verifierHashes[alg]; !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidVerifierHashAlg, alg)
+	}
+	return nil
+}
+
+// VerifyLoginVerifier verifies a login verifier against a PBKDF2-HMAC-SHA256 stored hash
 func VerifyLoginVerifier(loginVerifier []byte, username string, storedHash []byte) bool {
-	computedHash := HashLoginVerifier(loginVerifier, username)
+	return VerifyLoginVerifierWith(DefaultVerifierHashAlg, loginVerifier, username, storedHash)
+}
+
+// VerifyLoginVerifierWith verifies a login verifier against a hash stored with the given algorithm
+func VerifyLoginVerifierWith(alg models.VerifierHashAlg, loginVerifier []byte, username string, storedHash []byte) bool {
+	computedHash, err := HashLoginVerifierWith(alg, loginVerifier, username)
+	if err != nil {
+		return false
+	}
 	return constantTimeCompare(computedHash, storedHash)
 }
 
@@ -144,13 +231,60 @@ func DecodeBase64(s string) ([]byte, error) {
 	return data, nil
 }
 
-// ValidateKDFParams validates KDF parameters against minimum requirements
+// KDFParamRange is the inclusive range accepted for one KDF parameter
+type KDFParamRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// check returns ErrInvalidKDFParams if value is outside the range
+func (r KDFParamRange) check(name, unit string, value int) error {
+	if value < r.Min {
+		return fmt.Errorf("%w: %s %d%s < minimum %d%s", ErrInvalidKDFParams, name, value, unit, r.Min, unit)
+	}
+	if value > r.Max {
+		return fmt.Errorf("%w: %s %d%s > maximum %d%s", ErrInvalidKDFParams, name, value, unit, r.Max, unit)
+	}
+	return nil
+}
+
+// KDFBounds are the parameter ranges ValidateKDFParams accepts for one KDF
+// type. MemoryKiB and Parallelism are nil for types that do not take them.
+type KDFBounds struct {
+	Iterations  KDFParamRange  `json:"iterations"`
+	MemoryKiB   *KDFParamRange `json:"memoryKiB,omitempty"`
+	Parallelism *KDFParamRange `json:"parallelism,omitempty"`
+}
+
+// BoundsForKDF returns the parameter ranges accepted for kdfType
+func BoundsForKDF(kdfType models.KDFType) (KDFBounds, error) {
+	switch kdfType {
+	case models.KDFTypePBKDF2SHA256:
+		return KDFBounds{
+			Iterations: KDFParamRange{Min: MinPBKDF2Iterations, Max: MaxPBKDF2Iterations},
+		}, nil
+	case models.KDFTypeArgon2id:
+		return KDFBounds{
+			Iterations:  KDFParamRange{Min: MinArgon2Iterations, Max: MaxArgon2Iterations},
+			MemoryKiB:   &KDFParamRange{Min: MinArgon2Memory, Max: MaxArgon2Memory},
+			Parallelism: &KDFParamRange{Min: MinArgon2Parallelism, Max: MaxArgon2Parallelism},
+		}, nil
+	default:
+		return KDFBounds{}, ErrInvalidKDFType
+	}
+}
+
+// ValidateKDFParams validates KDF parameters against the floors and ceilings
+// reported by BoundsForKDF
 func ValidateKDFParams(params models.KDFParams) error {
+	bounds, err := BoundsForKDF(params.Type)
+	if err != nil {
+		return err
+	}
+
 	switch params.Type {
 	case models.KDFTypePBKDF2SHA256:
-		if params.Iterations < MinPBKDF2Iterations {
-			return fmt.Errorf("%w: PBKDF2 iterations %d < minimum %d", ErrInvalidKDFParams, params.Iterations, MinPBKDF2Iterations)
-		}
+		return bounds.Iterations.check("PBKDF2 iterations", "", params.Iterations)
 	case models.KDFTypeArgon2id:
 		if params.MemoryKiB == nil {
 			return fmt.Errorf("%w: Argon2 memory must be specified", ErrInvalidKDFParams)
@@ -158,17 +292,81 @@ func ValidateKDFParams(params models.KDFParams) error {
 		if params.Parallelism == nil {
 			return fmt.Errorf("%w: Argon2 parallelism must be specified", ErrInvalidKDFParams)
 		}
-		if *params.MemoryKiB < MinArgon2Memory {
-			return fmt.Errorf("%w: Argon2 memory %d KiB < minimum %d KiB", ErrInvalidKDFParams, *params.MemoryKiB, MinArgon2Memory)
+		if err := bounds.MemoryKiB.check("Argon2 memory", " KiB", *params.MemoryKiB); err != nil {
+			return err
 		}
-		if params.Iterations < MinArgon2Iterations {
-			return fmt.Errorf("%w: Argon2 iterations %d < minimum %d", ErrInvalidKDFParams, params.Iterations, MinArgon2Iterations)
+		if err := bounds.Iterations.check("Argon2 iterations", "", params.Iterations); err != nil {
+			return err
 		}
-		if *params.Parallelism < MinArgon2Parallelism {
-			return fmt.Errorf("%w: Argon2 parallelism %d < minimum %d", ErrInvalidKDFParams, *params.Parallelism, MinArgon2Parallelism)
-		}
-	default:
-		return ErrInvalidKDFType
+		return bounds.Parallelism.check("Argon2 parallelism", "", *params.Parallelism)
 	}
 	return nil
 }
+
+// EstimateKDFDuration projects how long deriving with params takes on this
+// machine, by timing a scaled-down derivation and scaling it up linearly:
+// PBKDF2 by iterations, Argon2id by iterations times memory. It takes a few
+// milliseconds whatever the params. params must pass ValidateKDFParams.
+func EstimateKDFDuration(params models.KDFParams) time.Duration {
+	password, salt := []byte("estimate"), []byte("estimate")
+
+	switch params.Type {
+	case models.KDFTypePBKDF2SHA256:
+		sample := min(params.Iterations, estimatePBKDF2Iterations)
+		start := time.Now()
+		pbkdf2.Key(password, salt, sample, 32, sha256.New)
+		return time.Since(start) * time.Duration(params.Iterations) / time.Duration(sample)
+
+	case models.KDFTypeArgon2id:
+		lanes := min(max(*params.Parallelism, 1), 255)
+		memoryKiB := max(min(*params.MemoryKiB, estimateArgon2MemoryKiB), 8*lanes)
+		start := time.Now()
+		argon2.IDKey(password, salt, 1, uint32(memoryKiB), uint8(lanes), 32)
+		scale := float64(params.Iterations) * float64(*params.MemoryKiB) / float64(memoryKiB)
+		return time.Duration(float64(time.Since(start)) * scale)
+	}
+	return 0
+}
+
+// ContainerChecksum returns the hex SHA-256 of a container's stored fields.
+// Fields are NUL-separated so that shifting bytes between them changes the digest.
+func ContainerChecksum(c models.Container) string {
+	h := sha256.New()
+	h.Write([]byte(c.Nonce))
+	h.Write([]byte{0})
+	h.Write([]byte(c.Ciphertext))
+	h.Write([]byte{0})
+	h.Write([]byte(c.Tag))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ValidateContainer checks a container's nonce and tag sizes against its
+// algorithm. Containers without an alg predate the registry and are not checked.
+func ValidateContainer(c models.Container) error {
+	if c.Alg == "" {
+		return nil
+	}
+
+	spec, ok := AEADAlgorithms[c.Alg]
+	if !ok {
+		return fmt.Errorf("%w: unsupported alg %q", ErrInvalidContainer, c.Alg)
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(c.Nonce)
+	if err != nil {
+		return fmt.Errorf("%w: nonce is not valid base64", ErrInvalidContainer)
+	}
+	if len(nonce) != spec.NonceSize {
+		return fmt.Errorf("%w: %s nonce must be %d bytes, got %d", ErrInvalidContainer, c.Alg, spec.NonceSize, len(nonce))
+	}
+
+	tag, err := base64.StdEncoding.DecodeString(c.Tag)
+	if err != nil {
+		return fmt.Errorf("%w: tag is not valid base64", ErrInvalidContainer)
+	}
+	if len(tag) != spec.TagSize {
+		return fmt.Errorf("%w: %s tag must be %d bytes, got %d", ErrInvalidContainer, c.Alg, spec.TagSize, len(tag))
+	}
+
+	return nil
+}
@@ -2,8 +2,10 @@ package crypto
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/hex"
 	"testing"
+	"time"
 
 	"github.com/shalteor/cryptd-poc/server/internal/models"
 )
@@ -228,6 +230,49 @@ func TestHashAndVerifyLoginVerifier(t *testing.T) {
 	}
 }
 
+func TestHashLoginVerifierWith(t *testing.T) {
+	loginVerifier := []byte("test-login-verifier-32-bytes")
+	username := "alice"
+
+	sha512Hash, err := HashLoginVerifierWith(models.VerifierHashPBKDF2SHA512, loginVerifier, username)
+	if err != nil {
+		t.Fatalf("failed to hash login verifier: %v", err)
+	}
+	if len(sha512Hash) != 32 {
+		t.Errorf("expected hash length 32, got %d", len(sha512Hash))
+	}
+
+	if !VerifyLoginVerifierWith(models.VerifierHashPBKDF2SHA512, loginVerifier, username, sha512Hash) {
+		t.Error("failed to verify SHA-512 login verifier")
+	}
+
+	// Hashes are only valid under the algorithm that produced them
+	sha256Hash := HashLoginVerifier(loginVerifier, username)
+	if VerifyLoginVerifierWith(models.VerifierHashPBKDF2SHA512, loginVerifier, username, sha256Hash) {
+		t.Error("SHA-256 hash should not verify as SHA-512")
+	}
+	if VerifyLoginVerifier(loginVerifier, username, sha512Hash) {
+		t.Error("SHA-512 hash should not verify as SHA-256")
+	}
+
+	if _, err := HashLoginVerifierWith("md5", loginVerifier, username); err == nil {
+		t.Error("expected error for unknown algorithm")
+	}
+	if VerifyLoginVerifierWith("md5", loginVerifier, username, sha256Hash) {
+		t.Error("unknown algorithm should never verify")
+	}
+
+	for alg, expected := range map[models.VerifierHashAlg]string{
+		models.VerifierHashPBKDF2SHA256: "pbkdf2_sha256,iterations=600000",
+		models.VerifierHashPBKDF2SHA512: "pbkdf2_sha512,iterations=600000",
+		"md5":                           "md5",
+	} {
+		if got := VerifierHashLabel(alg); got != expected {
+			t.Errorf("expected label %q for %s, got %q", expected, alg, got)
+		}
+	}
+}
+
 func TestConstantTimeCompare(t *testing.T) {
 	a := []byte{1, 2, 3, 4, 5}
 	b := []byte{1, 2, 3, 4, 5}
@@ -323,6 +368,20 @@ func TestValidateKDFParams(t *testing.T) {
 			}(),
 			expectError: false,
 		},
+		{
+			name: "Argon2id parallelism over the ceiling",
+			params: func() models.KDFParams {
+				mem := 65536
+				par := MaxArgon2Parallelism + 1
+				return models.KDFParams{
+					Type:        models.KDFTypeArgon2id,
+					Iterations:  3,
+					MemoryKiB:   &mem,
+					Parallelism: &par,
+				}
+			}(),
+			expectError: true,
+		},
 		{
 			name: "Argon2id missing memory",
 			params: models.KDFParams{
@@ -353,3 +412,81 @@ func TestValidateKDFParams(t *testing.T) {
 		})
 	}
 }
+
+func TestEstimateKDFDuration(t *testing.T) {
+	memKiB := 64 * 1024
+	parallelism := 1
+	argon2Params := models.KDFParams{Type: models.KDFTypeArgon2id, Iterations: 3, MemoryKiB: &memKiB, Parallelism: &parallelism}
+	pbkdf2Params := models.KDFParams{Type: models.KDFTypePBKDF2SHA256, Iterations: MinPBKDF2Iterations}
+
+	for _, params := range []models.KDFParams{argon2Params, pbkdf2Params} {
+		if estimate := EstimateKDFDuration(params); estimate <= 0 {
+			t.Errorf("%s: expected a positive estimate, got %s", params.Type, estimate)
+		}
+	}
+
+	// The projection scales with the work, without doing it
+	heavy := pbkdf2Params
+	heavy.Iterations = 1000 * MinPBKDF2Iterations
+	start := time.Now()
+	estimate := EstimateKDFDuration(heavy)
+	if elapsed := time.Since(start); elapsed*100 > estimate {
+		t.Errorf("expected the estimate (%s) to far exceed the time taken (%s)", estimate, elapsed)
+	}
+}
+
+func TestContainerChecksum(t *testing.T) {
+	c := models.Container{Nonce: "bm9uY2U=", Ciphertext: "Y2lwaGVydGV4dA==", Tag: "dGFn"}
+
+	sum := ContainerChecksum(c)
+	if len(sum) != 64 {
+		t.Errorf("expected 64 hex chars, got %d", len(sum))
+	}
+
+	if ContainerChecksum(c) != sum {
+		t.Error("checksum should be deterministic")
+	}
+
+	flipped := c
+	flipped.Ciphertext = "Y2lwaGVydGV4dQ=="
+	if ContainerChecksum(flipped) == sum {
+		t.Error("checksum should change when ciphertext changes")
+	}
+
+	// Moving bytes across field boundaries must not collide
+	shifted := models.Container{Nonce: "bm9uY2U=Y", Ciphertext: "2lwaGVydGV4dA==", Tag: "dGFn"}
+	if ContainerChecksum(shifted) == sum {
+		t.Error("checksum should be sensitive to field boundaries")
+	}
+}
+
+func TestValidateContainer(t *testing.T) {
+	b64 := func(n int) string { return base64.StdEncoding.EncodeToString(make([]byte, n)) }
+
+	tests := []struct {
+		name        string
+		container   models.Container
+		expectError bool
+	}{
+		{"A256GCM 12-byte nonce", models.Container{Alg: "A256GCM", Nonce: b64(12), Ciphertext: "x", Tag: b64(16)}, false},
+		{"A256GCM 24-byte nonce", models.Container{Alg: "A256GCM", Nonce: b64(24), Ciphertext: "x", Tag: b64(16)}, true},
+		{"XC20P 24-byte nonce", models.Container{Alg: "XC20P", Nonce: b64(24), Ciphertext: "x", Tag: b64(16)}, false},
+		{"XC20P 12-byte nonce", models.Container{Alg: "XC20P", Nonce: b64(12), Ciphertext: "x", Tag: b64(16)}, true},
+		{"short tag", models.Container{Alg: "A256GCM", Nonce: b64(12), Ciphertext: "x", Tag: b64(8)}, true},
+		{"nonce not base64", models.Container{Alg: "A256GCM", Nonce: "!!", Ciphertext: "x", Tag: b64(16)}, true},
+		{"unknown alg", models.Container{Alg: "ROT13", Nonce: b64(12), Ciphertext: "x", Tag: b64(16)}, true},
+		{"legacy without alg", models.Container{Nonce: "nonce", Ciphertext: "x", Tag: "tag"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateContainer(tt.container)
+			if tt.expectError && err == nil {
+				t.Error("expected error but got none")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
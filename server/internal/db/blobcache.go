@@ -0,0 +1,149 @@
+package db
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// blobCacheEntryOverhead approximates the memory an entry holds beyond its
+// container strings, so many tiny blobs still count against the bound
+const blobCacheEntryOverhead = 256
+
+// blobCacheKey identifies a cached blob. Lookups come in by name, so the id
+// and version are part of the cached value rather than the key: any write that
+// gives a name a new row or version invalidates the entry.
+type blobCacheKey struct {
+	userID int64
+	name   string
+}
+
+type blobCacheEntry struct {
+	key  blobCacheKey
+	blob models.Blob
+	size int64
+}
+
+// blobCache is a size-bounded LRU of GetBlob results. A stored version of a
+// blob never changes, so an entry stays valid until a write to its name, and
+// every write path invalidates the names it touches after committing. A nil
+// *blobCache caches nothing.
+type blobCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	order    *list.List // of *blobCacheEntry, most recently used first
+	entries  map[blobCacheKey]*list.Element
+
+	// gen counts invalidations. A read that raced one may have seen the row
+	// before the write, so add only stores results read within one generation.
+	gen uint64
+}
+
+// newBlobCache returns a cache holding up to maxBytes, or nil if maxBytes is 0
+func newBlobCache(maxBytes int64) *blobCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &blobCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[blobCacheKey]*list.Element),
+	}
+}
+
+// get returns a copy of the cached blob and counts the hit or miss
+func (c *blobCache) get(userID int64, name string) (*models.Blob, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[blobCacheKey{userID, name}]
+	if !ok {
+		metrics.BlobCacheMisses.Add(1)
+		return nil, false
+	}
+	metrics.BlobCacheHits.Add(1)
+	c.order.MoveToFront(elem)
+	blob := elem.Value.(*blobCacheEntry).blob
+	return &blob, true
+}
+
+// generation returns the value to pass to add for a read starting now
+func (c *blobCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+// add caches blob if nothing was invalidated since gen was taken. Blobs larger
+// than the whole cache are not cached.
+func (c *blobCache) add(blob *models.Blob, gen uint64) {
+	if c == nil {
+		return
+	}
+	size := int64(len(blob.BlobName)+len(blob.EncryptedBlob.Nonce)+len(blob.EncryptedBlob.Ciphertext)+
+		len(blob.EncryptedBlob.Tag)) + blobCacheEntryOverhead
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	key := blobCacheKey{blob.UserID, blob.BlobName}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.order.PushFront(&blobCacheEntry{key: key, blob: *blob, size: size})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate drops the user's blobs with the given names
+func (c *blobCache) invalidate(userID int64, names ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, name := range names {
+		if elem, ok := c.entries[blobCacheKey{userID, name}]; ok {
+			c.remove(elem)
+		}
+	}
+}
+
+// invalidateUser drops all of the user's blobs
+func (c *blobCache) invalidateUser(userID int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for key, elem := range c.entries {
+		if key.userID == userID {
+			c.remove(elem)
+		}
+	}
+}
+
+// remove drops one entry; c.mu must be held
+func (c *blobCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*blobCacheEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size
+}
@@ -0,0 +1,423 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// ErrBlobStoreRequired is returned on open when blob rows reference content
+// in a blob store but Options.BlobStore is not set
+var ErrBlobStoreRequired = errors.New("blobs are stored in a blob store that is not configured")
+
+// BlobStore keeps blob ciphertext outside SQLite. The database assigns every
+// stored version of a blob its own ref, which a blob row points to in
+// content_ref; the store only maps refs to content. A ref is never written
+// twice, so the content under it never changes.
+type BlobStore interface {
+	// Put stores ciphertext under ref. It must not return before the content
+	// is durable: a row pointing to it may be committed next.
+	Put(ref, ciphertext string) error
+	// Get returns the ciphertext stored under ref
+	Get(ref string) (string, error)
+	// Delete removes the content under ref; a ref with no content is not an error
+	Delete(ref string) error
+	// Snapshot copies the content of every ref into a new directory at dir,
+	// laid out so that a FilesystemBlobStore rooted there serves it
+	Snapshot(dir string) error
+}
+
+// FilesystemBlobStore keeps each ref in its own file under a directory,
+// grouped in one subdirectory per user
+type FilesystemBlobStore struct {
+	dir string
+}
+
+// NewFilesystemBlobStore returns a store rooted at dir, creating it if needed
+func NewFilesystemBlobStore(dir string) (*FilesystemBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create blob store directory: %w", err)
+	}
+	return &FilesystemBlobStore{dir: dir}, nil
+}
+
+// path returns the file holding ref. Refs come from the database, but one
+// that would leave the directory is refused all the same.
+func (s *FilesystemBlobStore) path(ref string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(ref)) {
+		return "", fmt.Errorf("invalid blob content ref %q", ref)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(ref)), nil
+}
+
+// Put writes ciphertext to a temporary file, syncs it and renames it over
+// the ref's file, so a reader never sees partial content
+func (s *FilesystemBlobStore) Put(ref, ciphertext string) error {
+	path, err := s.path(ref)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create blob content directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create blob content file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.WriteString(ciphertext); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write blob content: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to sync blob content: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close blob content file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store blob content: %w", err)
+	}
+	return nil
+}
+
+// Get reads the ref's file
+func (s *FilesystemBlobStore) Get(ref string) (string, error) {
+	path, err := s.path(ref)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read blob content: %w", err)
+	}
+	return string(data), nil
+}
+
+// Delete removes the ref's file
+func (s *FilesystemBlobStore) Delete(ref string) error {
+	path, err := s.path(ref)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete blob content: %w", err)
+	}
+	return nil
+}
+
+// Snapshot hard-links every stored file into dir, copying where a link is not
+// possible, such as across filesystems. Files are never rewritten in place, so
+// a link is as good as a copy. The snapshot is built under a temporary name
+// and renamed into place when complete. Content deleted while the walk runs is
+// skipped; callers keep content they need from being collected meanwhile.
+func (s *FilesystemBlobStore) Snapshot(dir string) error {
+	tmp := dir + ".tmp"
+	_ = os.RemoveAll(tmp)
+
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(tmp, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0o700)
+		}
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			return nil
+		}
+
+		err = os.Link(path, target)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			err = copyFile(path, target)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return fmt.Errorf("failed to snapshot blob store: %w", err)
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		_ = os.RemoveAll(tmp)
+		return fmt.Errorf("failed to move blob store snapshot into place: %w", err)
+	}
+	return nil
+}
+
+// copyFile copies src to a new file at dst and syncs it
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// newBlobContentRef returns a fresh ref for content of one of a user's blobs.
+// Content is put before the row that points to it is written, so the ref
+// cannot be derived from the row; 128 random bits keep it unique instead.
+func newBlobContentRef(userID int64) (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("failed to generate blob content ref: %w", err)
+	}
+	return strconv.FormatInt(userID, 10) + "/" + hex.EncodeToString(id[:]), nil
+}
+
+// stagedContent is ciphertext put in the blob store ahead of the transaction
+// that references it, so files are written and synced without holding
+// SQLite's write lock. Every staged ciphertext gets a ref of its own, which
+// at most one row claims. Once the transaction is over, release deletes the
+// staged content no committed row points to. A crash in between leaves those
+// files behind, unreferenced. A nil *stagedContent, as staged without a blob
+// store, holds nothing.
+type stagedContent struct {
+	store   BlobStore
+	userID  int64
+	refs    map[string][]string // unclaimed refs by ciphertext
+	claimed []stagedRef
+}
+
+// stagedRef is a ref claimed by a row written in the transaction
+type stagedRef struct {
+	ciphertext string
+	ref        string
+}
+
+// stageBlobContent puts each of a user's ciphertexts in the blob store under
+// a fresh ref. On error nothing it staged is left in the store.
+func (db *DB) stageBlobContent(userID int64, ciphertexts ...string) (*stagedContent, error) {
+	if db.options.BlobStore == nil {
+		return nil, nil
+	}
+
+	staged := &stagedContent{store: db.options.BlobStore, userID: userID, refs: make(map[string][]string)}
+	for _, ciphertext := range ciphertexts {
+		ref, err := staged.put(ciphertext)
+		if err != nil {
+			staged.release(false)
+			return nil, err
+		}
+		staged.refs[ciphertext] = append(staged.refs[ciphertext], ref)
+	}
+	return staged, nil
+}
+
+// put stores ciphertext under a fresh ref
+func (s *stagedContent) put(ciphertext string) (string, error) {
+	ref, err := newBlobContentRef(s.userID)
+	if err != nil {
+		return "", err
+	}
+	if err := s.store.Put(ref, ciphertext); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+// take claims a staged ref holding ciphertext for the row being written. A
+// ciphertext that was not staged is put now, inside the transaction.
+func (s *stagedContent) take(ciphertext string) (string, error) {
+	var ref string
+	if refs := s.refs[ciphertext]; len(refs) > 0 {
+		ref, s.refs[ciphertext] = refs[len(refs)-1], refs[:len(refs)-1]
+	} else {
+		var err error
+		if ref, err = s.put(ciphertext); err != nil {
+			return "", err
+		}
+	}
+	s.claimed = append(s.claimed, stagedRef{ciphertext: ciphertext, ref: ref})
+	return ref, nil
+}
+
+// reset makes every claimed ref unclaimed again, for when the writes that
+// claimed them were rolled back but may be tried again
+func (s *stagedContent) reset() {
+	if s == nil {
+		return
+	}
+	for _, c := range s.claimed {
+		s.refs[c.ciphertext] = append(s.refs[c.ciphertext], c.ref)
+	}
+	s.claimed = nil
+}
+
+// release deletes the staged content no row points to: the unclaimed refs
+// after a commit, every ref otherwise. Releasing again does nothing.
+func (s *stagedContent) release(committed bool) {
+	if s == nil {
+		return
+	}
+	if !committed {
+		s.reset()
+	}
+	for _, refs := range s.refs {
+		for _, ref := range refs {
+			if err := s.store.Delete(ref); err != nil {
+				log.Printf("Failed to delete unused blob content %s: %v", ref, err)
+			}
+		}
+	}
+	s.refs = make(map[string][]string)
+	s.claimed = nil
+}
+
+// putBlobContent points a just-written blob row at staged content holding
+// its ciphertext, which storeCiphertext left out of the inline column. The
+// release triggers queue the ref the row held before for collectBlobContent.
+// Without a blob store it does nothing.
+func putBlobContent(q querier, staged *stagedContent, blobID int64, ciphertext string) error {
+	if staged == nil {
+		return nil
+	}
+
+	ref, err := staged.take(ciphertext)
+	if err != nil {
+		return err
+	}
+
+	// Listings report the decoded size without reading the content
+	var decodedSize *int
+	if decoded, err := base64.StdEncoding.DecodeString(ciphertext); err == nil {
+		n := len(decoded)
+		decodedSize = &n
+	}
+	if _, err := q.Exec(
+		`UPDATE blobs SET content_ref = ?, content_size = ?, content_decoded_size = ? WHERE id = ?`,
+		ref, len(ciphertext), decodedSize, blobID,
+	); err != nil {
+		return fmt.Errorf("failed to reference blob content: %w", err)
+	}
+	return nil
+}
+
+// holdBlobContent keeps collectBlobContent from deleting content while a
+// reader goes from reading a row's content_ref to loading it, since a write
+// committing in between queues the ref the reader holds. The returned func
+// releases it. Without a blob store it does nothing.
+func (db *DB) holdBlobContent() (release func()) {
+	if db.options.BlobStore == nil {
+		return func() {}
+	}
+	db.contentMu.RLock()
+	return db.contentMu.RUnlock
+}
+
+// loadBlobContent fills in container's ciphertext from the blob store when the
+// row it was read from references one. The caller holds holdBlobContent from
+// before it read the row.
+func (db *DB) loadBlobContent(ref sql.NullString, container *models.Container) error {
+	if !ref.Valid {
+		return nil
+	}
+	if db.options.BlobStore == nil {
+		return ErrBlobStoreRequired
+	}
+	ciphertext, err := db.options.BlobStore.Get(ref.String)
+	if err != nil {
+		return err
+	}
+	container.Ciphertext = ciphertext
+	return nil
+}
+
+// collectBlobContent deletes the content of refs no row points to any more.
+// Write paths call it after committing; the expiry sweep catches anything a
+// failed deletion left behind. Without a blob store it does nothing.
+func (db *DB) collectBlobContent() {
+	if db.options.BlobStore == nil {
+		return
+	}
+	// A reader or a backup copying the store, or another collection, holds
+	// the lock; the refs stay queued for the next collection
+	if !db.contentMu.TryLock() {
+		return
+	}
+	defer db.contentMu.Unlock()
+
+	var refs []string
+	err := db.queryEach(`SELECT ref FROM blob_content_garbage`, nil, func(rows *sql.Rows) error {
+		var ref string
+		if err := rows.Scan(&ref); err != nil {
+			return fmt.Errorf("failed to scan blob content ref: %w", err)
+		}
+		refs = append(refs, ref)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to list released blob content: %v", err)
+		return
+	}
+
+	for _, ref := range refs {
+		if err := db.options.BlobStore.Delete(ref); err != nil {
+			log.Printf("Failed to delete blob content %s: %v", ref, err)
+			continue
+		}
+		if _, err := db.conn.Exec(`DELETE FROM blob_content_garbage WHERE ref = ?`, ref); err != nil {
+			log.Printf("Failed to forget blob content %s: %v", ref, err)
+		}
+	}
+}
+
+// checkBlobStore refuses to open a database whose blobs reference a blob store
+// when none is configured, and a blob store combined with DedupContent
+func (db *DB) checkBlobStore() error {
+	if db.options.BlobStore != nil {
+		if db.options.DedupContent {
+			return errors.New("a blob store cannot be combined with content deduplication")
+		}
+		return nil
+	}
+
+	var referenced bool
+	err := db.conn.QueryRow(`SELECT EXISTS(SELECT 1 FROM blobs WHERE content_ref IS NOT NULL)`).Scan(&referenced)
+	if err != nil {
+		return fmt.Errorf("failed to check blob content refs: %w", err)
+	}
+	if referenced {
+		return ErrBlobStoreRequired
+	}
+	return nil
+}
@@ -1,48 +1,422 @@
 package db
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/shalteor/cryptd-poc/server/internal/crypto"
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
 	"github.com/shalteor/cryptd-poc/server/internal/models"
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 var (
-	ErrUserNotFound   = errors.New("user not found")
-	ErrUserExists     = errors.New("user already exists")
-	ErrBlobNotFound   = errors.New("blob not found")
-	ErrInvalidKDFType = errors.New("invalid KDF type")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrUserExists          = errors.New("user already exists")
+	ErrUserConflict        = errors.New("user was modified concurrently")
+	ErrBlobNotFound        = errors.New("blob not found")
+	ErrBlobExists          = errors.New("blob already exists")
+	ErrVersionMismatch     = errors.New("blob version does not match")
+	ErrBlobLocked          = errors.New("blob is locked by another holder")
+	ErrInvalidKDFType      = errors.New("invalid KDF type")
+	ErrBlobCorrupted       = errors.New("blob corrupted")
+	ErrBlobExpired         = errors.New("blob expired")
+	ErrQuotaExceeded       = errors.New("storage quota exceeded")
+	ErrNonceReuse          = errors.New("nonce was already used with different content")
+	ErrTooManyCollections  = errors.New("too many collections")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrInviteNotFound      = errors.New("invite not found")
+	ErrInviteInvalid       = errors.New("invite code is invalid or already used")
+	ErrEscrowNotFound      = errors.New("key escrow not found")
+	ErrSchemaTooNew        = errors.New("database schema is newer than this server")
+	ErrUsernamesCollide    = errors.New("usernames collide when compared case-insensitively")
+	ErrUsernameCoolingDown = errors.New("username was released recently and is not available yet")
+
+	ErrRotationIncomplete = errors.New("rotation does not cover exactly the stored blobs")
 )
 
 type DB struct {
-	conn *sql.DB
+	conn    *sql.DB
+	options Options
+
+	// blobs caches GetBlob results; nil unless Options.BlobCacheBytes is set
+	blobs *blobCache
+	// writes coalesces UpsertBlobWithinQuota calls; nil unless Options.WriteBatchMax is above 1
+	writes *writeBatcher
+
+	// backupMu serializes scheduled and on-demand backups
+	backupMu sync.Mutex
+	// contentMu is held for reading while a reader loads blob store content
+	// or a backup copies the store, so collectBlobContent cannot delete
+	// content either of them references
+	contentMu sync.RWMutex
+}
+
+// Options holds tunable database behavior
+type Options struct {
+	// SlowQueryThreshold is the duration above which operations are logged; 0 disables logging
+	SlowQueryThreshold time.Duration
+
+	// CacheSizeKiB is the page cache size per connection (PRAGMA cache_size); 0 keeps the SQLite default
+	CacheSizeKiB int
+	// MmapSizeBytes is the memory-mapped I/O window (PRAGMA mmap_size); 0 keeps the SQLite default
+	MmapSizeBytes int64
+	// TempStoreMemory keeps temporary tables and indices in memory (PRAGMA temp_store)
+	TempStoreMemory bool
+
+	// ConnMaxLifetime and ConnMaxIdleTime recycle pooled connections older or
+	// idle longer than this, so stale ones do not pile up; 0 keeps them forever.
+	// They are ignored for ":memory:", whose single connection is the database.
+	// A replacement connection gets the same PRAGMAs, foreign_keys included,
+	// since they travel in the DSN.
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// BlobCacheBytes bounds an in-process LRU of GetBlob results, for blobs
+	// such as a vault index that are read on nearly every request. Writes
+	// invalidate the names they touch; 0 disables the cache.
+	BlobCacheBytes int64
+
+	// WriteBatchMax above 1 coalesces concurrent UpsertBlobWithinQuota calls
+	// into shared transactions of up to this many writes, each still getting
+	// its own result. A write with none in flight is applied at once; while
+	// writes queue up, a batch waits up to WriteBatchWindow to fill.
+	WriteBatchMax    int
+	WriteBatchWindow time.Duration
+
+	// BusyTimeout is how long a connection waits for another one's lock
+	// before SQLite reports the database busy (PRAGMA busy_timeout); 0 fails
+	// at once
+	BusyTimeout time.Duration
+
+	// BusyRetries is how many times blob upserts and deletes are retried
+	// when SQLite still reports the database busy or locked after
+	// BusyTimeout, waiting BusyRetryBackoff before the first retry and
+	// doubling it each time. Writes that are not safe to repeat are never
+	// retried; 0 disables retries.
+	BusyRetries      int
+	BusyRetryBackoff time.Duration
+
+	// MaxSessions caps the sessions table across all users; 0 leaves it unbounded
+	MaxSessions int
+
+	// DedupContent stores each distinct ciphertext once in blob_content and has
+	// blobs reference it by hash. Containers use random nonces, so only
+	// byte-identical re-uploads share storage.
+	DedupContent bool
+
+	// BlobStore, if set, keeps the ciphertext of every blob written from now
+	// on outside SQLite, while its row keeps the metadata. Blobs written
+	// before stay inline until rewritten. It cannot be combined with
+	// DedupContent, and once set, the database no longer opens without one.
+	BlobStore BlobStore
+
+	// RejectNonceReuse records the nonce of every stored container per user and
+	// key context, and fails writes that reuse one for different content with
+	// ErrNonceReuse
+	RejectNonceReuse bool
+
+	// MaxCollections caps the distinct named collections per user; writes that
+	// would add one more fail with ErrTooManyCollections. 0 leaves it unbounded.
+	MaxCollections int
+
+	// CaseInsensitiveUsernames makes usernames that differ only in case the
+	// same account: "Alice" logs in as alice and blocks registering "alice".
+	// The display form is kept as registered.
+	CaseInsensitiveUsernames bool
+
+	// UsernameReleaseHold keeps a username given up by a rename or account
+	// deletion from other accounts for this long; registering or renaming to
+	// it fails with ErrUsernameCoolingDown. 0 releases names immediately.
+	UsernameReleaseHold time.Duration
+}
+
+// DefaultOptions returns the options used by New
+func DefaultOptions() Options {
+	return Options{
+		SlowQueryThreshold: 100 * time.Millisecond,
+		CacheSizeKiB:       16 * 1024,
+		MmapSizeBytes:      256 << 20,
+		TempStoreMemory:    true,
+		BusyTimeout:        5 * time.Second,
+		ConnMaxLifetime:    time.Hour,
+		ConnMaxIdleTime:    5 * time.Minute,
+	}
+}
+
+// pragmas returns the per-connection PRAGMAs implied by the options.
+// foreign_keys is always on: it is per connection, and the cascades from
+// users and blobs depend on it. A file database is put in WAL mode, so
+// readers do not block the writer and the writer does not block readers.
+func (o Options) pragmas(inMemory bool) []string {
+	pragmas := []string{"foreign_keys(1)"}
+	if !inMemory {
+		pragmas = append(pragmas, "journal_mode(WAL)")
+	}
+	if o.BusyTimeout > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("busy_timeout(%d)", o.BusyTimeout.Milliseconds()))
+	}
+	if o.CacheSizeKiB > 0 {
+		// Negative cache_size is in KiB rather than pages
+		pragmas = append(pragmas, fmt.Sprintf("cache_size(-%d)", o.CacheSizeKiB))
+	}
+	if o.MmapSizeBytes > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("mmap_size(%d)", o.MmapSizeBytes))
+	}
+	if o.TempStoreMemory {
+		pragmas = append(pragmas, "temp_store(memory)")
+	}
+	return pragmas
+}
+
+// withPragmas appends _pragma parameters to a DSN so the driver applies them
+// to every pooled connection, not just the first one
+func withPragmas(dataSourceName string, pragmas []string) string {
+	if len(pragmas) == 0 {
+		return dataSourceName
+	}
+
+	params := make([]string, len(pragmas))
+	for i, pragma := range pragmas {
+		params[i] = "_pragma=" + url.QueryEscape(pragma)
+	}
+
+	separator := "?"
+	if strings.Contains(dataSourceName, "?") {
+		separator = "&"
+	}
+	return dataSourceName + separator + strings.Join(params, "&")
 }
 
-// New creates a new database connection and initializes the schema
+// New creates a new database connection with default options and initializes the schema
 func New(dataSourceName string) (*DB, error) {
-	conn, err := sql.Open("sqlite", dataSourceName)
+	return NewWithOptions(dataSourceName, DefaultOptions())
+}
+
+// NewWithOptions creates a new database connection and initializes the schema
+func NewWithOptions(dataSourceName string, options Options) (*DB, error) {
+	inMemory := strings.HasPrefix(dataSourceName, ":memory:")
+	dsn := withPragmas(dataSourceName, options.pragmas(inMemory))
+	// Every transaction here writes. Beginning them IMMEDIATE takes the write
+	// lock up front, where busy_timeout waits for it; a deferred transaction
+	// that reads first gets SQLITE_BUSY at once when it then tries to write
+	// after another writer committed.
+	if strings.Contains(dsn, "?") {
+		dsn += "&_txlock=immediate"
+	} else {
+		dsn += "?_txlock=immediate"
+	}
+	conn, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	// Enable foreign keys
-	if _, err := conn.Exec("PRAGMA foreign_keys = ON"); err != nil {
+	// Every connection to ":memory:" opens a separate empty database, so keep
+	// the pool at one connection or transactions would see a different schema
+	if inMemory {
+		conn.SetMaxOpenConns(1)
+	} else {
+		conn.SetConnMaxLifetime(options.ConnMaxLifetime)
+		conn.SetConnMaxIdleTime(options.ConnMaxIdleTime)
+	}
+
+	// A database written by a newer server is refused before anything touches it
+	current, err := schemaVersion(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if current > len(migrations) {
 		_ = conn.Close()
-		return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
+		return nil, fmt.Errorf("%w: database is at version %d, this server supports up to %d", ErrSchemaTooNew, current, len(migrations))
 	}
 
-	// Initialize schema
+	// Initialize schema; a blank or pre-migration file is brought up to date here
 	if _, err := conn.Exec(schema); err != nil {
 		_ = conn.Close()
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
 
-	return &DB{conn: conn}, nil
+	if err := migrate(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	db := &DB{conn: conn, options: options, blobs: newBlobCache(options.BlobCacheBytes)}
+	db.writes = newWriteBatcher(db, options.WriteBatchWindow, options.WriteBatchMax)
+	if err := db.checkBlobStore(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := db.syncUsernameCanonical(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// canonicalUsername returns the form of username used for uniqueness and lookup
+func (db *DB) canonicalUsername(username string) string {
+	if db.options.CaseInsensitiveUsernames {
+		return strings.ToLower(username)
+	}
+	return username
+}
+
+// CaseInsensitiveUsernames reports whether usernames are compared without case
+func (db *DB) CaseInsensitiveUsernames() bool {
+	return db.options.CaseInsensitiveUsernames
+}
+
+// syncUsernameCanonical re-derives username_canonical for rows written under
+// the other case mode. Switching to case-insensitive fails with
+// ErrUsernamesCollide, changing nothing, if two accounts differ only in case.
+func (db *DB) syncUsernameCanonical() error {
+	type rename struct {
+		id        int64
+		canonical string
+	}
+	var stale []rename
+	// The rows must be closed before the transaction below, which needs the
+	// only connection of a :memory: pool; queryEach returns with them closed
+	err := db.queryEach(`SELECT id, username, COALESCE(username_canonical, '') FROM users`, nil, func(rows *sql.Rows) error {
+		var id int64
+		var username, canonical string
+		if err := rows.Scan(&id, &username, &canonical); err != nil {
+			return fmt.Errorf("failed to scan username: %w", err)
+		}
+		if want := db.canonicalUsername(username); want != canonical {
+			stale = append(stale, rename{id, want})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read usernames: %w", err)
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin username sync: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Clear first so rows swapping forms do not trip the unique index midway
+	for _, row := range stale {
+		if _, err := tx.Exec(`UPDATE users SET username_canonical = NULL WHERE id = ?`, row.id); err != nil {
+			return fmt.Errorf("failed to sync usernames: %w", err)
+		}
+	}
+	for _, row := range stale {
+		if _, err := tx.Exec(`UPDATE users SET username_canonical = ? WHERE id = ?`, row.canonical, row.id); err != nil {
+			if isUniqueViolation(err) {
+				return fmt.Errorf("%w: %q is taken by more than one account", ErrUsernamesCollide, row.canonical)
+			}
+			return fmt.Errorf("failed to sync usernames: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit username sync: %w", err)
+	}
+	return nil
+}
+
+// schemaVersion returns the latest applied migration, 0 for a database that
+// has none or no schema_migrations table yet
+func schemaVersion(conn *sql.DB) (int, error) {
+	var exists bool
+	err := conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations')`).Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if !exists {
+		return 0, nil
+	}
+	var version int
+	if err := conn.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// migrate applies all pending schema migrations, each in its own transaction
+func migrate(conn *sql.DB) error {
+	current, err := schemaVersion(conn)
+	if err != nil {
+		return err
+	}
+
+	for version := current + 1; version <= len(migrations); version++ {
+		tx, err := conn.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", version, err)
+		}
+
+		if _, err := tx.Exec(migrations[version-1]); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().UTC()); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", version, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", version, err)
+		}
+	}
+
+	return nil
+}
+
+// observe counts a database operation and logs it if it exceeded the slow-query threshold.
+// Call it deferred at the top of each operation: defer db.observe("Op", userID, time.Now()).
+func (db *DB) observe(op string, userID int64, start time.Time) {
+	metrics.DBQueries.Add(op, 1)
+
+	if db.options.SlowQueryThreshold <= 0 {
+		return
+	}
+
+	elapsed := time.Since(start)
+	if elapsed < db.options.SlowQueryThreshold {
+		return
+	}
+
+	metrics.DBSlowQueries.Add(op, 1)
+	log.Printf("Slow query: op=%s user_id=%d duration=%s", op, userID, elapsed)
+}
+
+// isUniqueViolation reports whether err is a UNIQUE constraint failure, by
+// SQLite extended result code rather than by message text
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// isForeignKeyViolation reports whether err is a FOREIGN KEY constraint failure
+func isForeignKeyViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY
 }
 
 // Close closes the database connection
@@ -52,37 +426,94 @@ func (db *DB) Close() error {
 
 // CreateUser creates a new user
 func (db *DB) CreateUser(user *models.User) error {
+	defer db.observe("CreateUser", 0, time.Now())
+
+	canonical := db.canonicalUsername(user.Username)
+	if err := db.checkUsernameHold(db.conn, canonical, 0); err != nil {
+		return err
+	}
+	return createUser(db.conn, user, canonical)
+}
+
+// CreateUserWithInvite creates a user and consumes the invite code in one
+// transaction, so a code can never admit two accounts. An unknown or used code
+// yields ErrInviteInvalid and no user is created.
+func (db *DB) CreateUserWithInvite(user *models.User, code string) error {
+	defer db.observe("CreateUserWithInvite", 0, time.Now())
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin registration: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	canonical := db.canonicalUsername(user.Username)
+	if err := db.checkUsernameHold(tx, canonical, 0); err != nil {
+		return err
+	}
+	if err := createUser(tx, user, canonical); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(
+		`UPDATE invites SET used_at = ?, used_by = ? WHERE code = ? AND used_at IS NULL`,
+		user.CreatedAt, user.ID, code,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to consume invite: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	} else if n == 0 {
+		return ErrInviteInvalid
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit registration: %w", err)
+	}
+	return nil
+}
+
+func createUser(q querier, user *models.User, canonical string) error {
 	// Validate KDF type
 	if user.KDFType != models.KDFTypePBKDF2SHA256 && user.KDFType != models.KDFTypeArgon2id {
 		return ErrInvalidKDFType
 	}
 
+	if user.VerifierHashAlg == "" {
+		user.VerifierHashAlg = models.VerifierHashPBKDF2SHA256
+	}
+
 	query := `
 		INSERT INTO users (
-			username, kdf_type, kdf_iterations, kdf_memory_kib, kdf_parallelism,
-			login_verifier_hash, wrapped_account_key_nonce, wrapped_account_key_ciphertext, 
-			wrapped_account_key_tag, created_at, updated_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			username, username_canonical, kdf_type, kdf_iterations, kdf_memory_kib, kdf_parallelism,
+			login_verifier_hash, login_verifier_hash_alg, wrapped_account_key_nonce,
+			wrapped_account_key_ciphertext, wrapped_account_key_tag, wrapped_account_key_alg,
+			created_at, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
 	now := time.Now().UTC()
-	result, err := db.conn.Exec(
+	result, err := q.Exec(
 		query,
 		user.Username,
+		canonical,
 		string(user.KDFType),
 		user.KDFIterations,
 		user.KDFMemoryKiB,
 		user.KDFParallelism,
 		user.LoginVerifierHash,
+		string(user.VerifierHashAlg),
 		user.WrappedAccountKey.Nonce,
 		user.WrappedAccountKey.Ciphertext,
 		user.WrappedAccountKey.Tag,
+		user.WrappedAccountKey.Alg,
 		now,
 		now,
 	)
 
 	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint failed: users.username") {
+		if isUniqueViolation(err) {
 			return ErrUserExists
 		}
 		return fmt.Errorf("failed to create user: %w", err)
@@ -94,26 +525,26 @@ func (db *DB) CreateUser(user *models.User) error {
 	}
 
 	user.ID = id
-	user.CreatedAt = now
-	user.UpdatedAt = now
+	user.Rev = 1
+	user.CreatedAt = models.NewTimestamp(now)
+	user.UpdatedAt = models.NewTimestamp(now)
 
 	return nil
 }
 
-// GetUserByUsername retrieves a user by username
-func (db *DB) GetUserByUsername(username string) (*models.User, error) {
-	query := `
-		SELECT id, username, kdf_type, kdf_iterations, kdf_memory_kib, kdf_parallelism,
-			   login_verifier_hash, wrapped_account_key_nonce, wrapped_account_key_ciphertext,
-			   wrapped_account_key_tag, created_at, updated_at
-		FROM users
-		WHERE username = ?
-	`
+// userColumns is the column list scanned by scanUser
+const userColumns = `
+	id, username, kdf_type, kdf_iterations, kdf_memory_kib, kdf_parallelism,
+	login_verifier_hash, login_verifier_hash_alg, wrapped_account_key_nonce,
+	wrapped_account_key_ciphertext, wrapped_account_key_tag, wrapped_account_key_alg,
+	username_changed_at, rev, session_epoch, created_at, updated_at`
 
+// scanUser scans a row selected with userColumns
+func scanUser(row *sql.Row) (*models.User, error) {
 	user := &models.User{}
-	var kdfType string
+	var kdfType, verifierHashAlg string
 
-	err := db.conn.QueryRow(query, username).Scan(
+	err := row.Scan(
 		&user.ID,
 		&user.Username,
 		&kdfType,
@@ -121,9 +552,14 @@ func (db *DB) GetUserByUsername(username string) (*models.User, error) {
 		&user.KDFMemoryKiB,
 		&user.KDFParallelism,
 		&user.LoginVerifierHash,
+		&verifierHashAlg,
 		&user.WrappedAccountKey.Nonce,
 		&user.WrappedAccountKey.Ciphertext,
 		&user.WrappedAccountKey.Tag,
+		&user.WrappedAccountKey.Alg,
+		&user.UsernameChangedAt,
+		&user.Rev,
+		&user.SessionEpoch,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -136,76 +572,256 @@ func (db *DB) GetUserByUsername(username string) (*models.User, error) {
 	}
 
 	user.KDFType = models.KDFType(kdfType)
+	user.VerifierHashAlg = models.VerifierHashAlg(verifierHashAlg)
 	return user, nil
 }
 
+// GetUserByUsername retrieves a user by username, ignoring case under
+// Options.CaseInsensitiveUsernames
+func (db *DB) GetUserByUsername(username string) (*models.User, error) {
+	defer db.observe("GetUserByUsername", 0, time.Now())
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE username_canonical = ?`
+	return scanUser(db.conn.QueryRow(query, db.canonicalUsername(username)))
+}
+
+// UsernameAvailable reports whether a new account could register username:
+// no account holds its canonical form and it is not held after a release
+func (db *DB) UsernameAvailable(username string) (bool, error) {
+	defer db.observe("UsernameAvailable", 0, time.Now())
+
+	canonical := db.canonicalUsername(username)
+	var taken bool
+	err := db.conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username_canonical = ?)`, canonical).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("failed to check username: %w", err)
+	}
+	if taken {
+		return false, nil
+	}
+	if err := db.checkUsernameHold(db.conn, canonical, 0); err == ErrUsernameCoolingDown {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // GetUserByID retrieves a user by ID
 func (db *DB) GetUserByID(id int64) (*models.User, error) {
-	query := `
-		SELECT id, username, kdf_type, kdf_iterations, kdf_memory_kib, kdf_parallelism,
-			   login_verifier_hash, wrapped_account_key_nonce, wrapped_account_key_ciphertext,
-			   wrapped_account_key_tag, created_at, updated_at
+	defer db.observe("GetUserByID", id, time.Now())
+
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = ?`
+	return scanUser(db.conn.QueryRow(query, id))
+}
+
+// GetKDFParamsByUsernames returns the KDF params of each existing user among
+// usernames, keyed by the names as given, in one query. Unknown names are left out.
+func (db *DB) GetKDFParamsByUsernames(usernames []string) (map[string]models.KDFParams, error) {
+	defer db.observe("GetKDFParamsByUsernames", 0, time.Now())
+
+	params := make(map[string]models.KDFParams, len(usernames))
+	if len(usernames) == 0 {
+		return params, nil
+	}
+
+	// Several given names may share a canonical form
+	requested := make(map[string][]string, len(usernames))
+	args := make([]interface{}, len(usernames))
+	for i, username := range usernames {
+		canonical := db.canonicalUsername(username)
+		requested[canonical] = append(requested[canonical], username)
+		args[i] = canonical
+	}
+	err := db.queryEach(`
+		SELECT username_canonical, kdf_type, kdf_iterations, kdf_memory_kib, kdf_parallelism
 		FROM users
-		WHERE id = ?
-	`
+		WHERE username_canonical IN (?`+strings.Repeat(", ?", len(usernames)-1)+`)
+	`, args, func(rows *sql.Rows) error {
+		var canonical string
+		var kdf models.KDFParams
+		if err := rows.Scan(&canonical, &kdf.Type, &kdf.Iterations, &kdf.MemoryKiB, &kdf.Parallelism); err != nil {
+			return fmt.Errorf("failed to scan KDF params: %w", err)
+		}
+		for _, username := range requested[canonical] {
+			params[username] = kdf
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get KDF params: %w", err)
+	}
 
-	user := &models.User{}
-	var kdfType string
+	return params, nil
+}
 
-	err := db.conn.QueryRow(query, id).Scan(
-		&user.ID,
-		&user.Username,
-		&kdfType,
-		&user.KDFIterations,
-		&user.KDFMemoryKiB,
-		&user.KDFParallelism,
-		&user.LoginVerifierHash,
-		&user.WrappedAccountKey.Nonce,
-		&user.WrappedAccountKey.Ciphertext,
-		&user.WrappedAccountKey.Tag,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+// DeleteUser deletes a user; their blobs and sessions go with them, and
+// their username is held under Options.UsernameReleaseHold
+func (db *DB) DeleteUser(id int64) error {
+	defer db.observe("DeleteUser", id, time.Now())
 
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin user deletion: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var canonical string
+	err = tx.QueryRow(`DELETE FROM users WHERE id = ? RETURNING username_canonical`, id).Scan(&canonical)
 	if err == sql.ErrNoRows {
-		return nil, ErrUserNotFound
+		return ErrUserNotFound
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user: %w", err)
+		return fmt.Errorf("failed to delete user: %w", err)
 	}
 
-	user.KDFType = models.KDFType(kdfType)
-	return user, nil
+	if err := db.releaseUsername(tx, canonical, nil); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit user deletion: %w", err)
+	}
+	db.blobs.invalidateUser(id)
+	db.collectBlobContent()
+	return nil
+}
+
+// checkUsernameHold returns ErrUsernameCoolingDown if canonical was released
+// within Options.UsernameReleaseHold by an account other than userID
+func (db *DB) checkUsernameHold(q querier, canonical string, userID int64) error {
+	if db.options.UsernameReleaseHold <= 0 {
+		return nil
+	}
+	var held bool
+	err := q.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM released_usernames
+			WHERE username_canonical = ? AND released_at > ? AND (released_by IS NULL OR released_by != ?)
+		)
+	`, canonical, time.Now().UTC().Add(-db.options.UsernameReleaseHold), userID).Scan(&held)
+	if err != nil {
+		return fmt.Errorf("failed to check released usernames: %w", err)
+	}
+	if held {
+		return ErrUsernameCoolingDown
+	}
+	return nil
+}
+
+// releaseUsername starts the hold on canonical, released by the account
+// releasedBy or by a deleted one if nil, and drops holds that have lapsed
+func (db *DB) releaseUsername(q querier, canonical string, releasedBy *int64) error {
+	if db.options.UsernameReleaseHold <= 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	if _, err := q.Exec(`DELETE FROM released_usernames WHERE released_at <= ?`, now.Add(-db.options.UsernameReleaseHold)); err != nil {
+		return fmt.Errorf("failed to prune released usernames: %w", err)
+	}
+	if _, err := q.Exec(
+		`INSERT OR REPLACE INTO released_usernames (username_canonical, released_by, released_at) VALUES (?, ?, ?)`,
+		canonical, releasedBy, now,
+	); err != nil {
+		return fmt.Errorf("failed to release username: %w", err)
+	}
+	return nil
+}
+
+// RehashLoginVerifier replaces the stored verifier hash with one of the same
+// verifier under another algorithm. The credentials do not change, so rev is
+// kept and clients' If-Match values stay valid; the write only applies while
+// rev still equals the one the hash was verified against, and otherwise fails
+// with ErrUserConflict.
+func (db *DB) RehashLoginVerifier(userID, rev int64, hash []byte, alg models.VerifierHashAlg) error {
+	defer db.observe("RehashLoginVerifier", userID, time.Now())
+
+	result, err := db.conn.Exec(
+		`UPDATE users SET login_verifier_hash = ?, login_verifier_hash_alg = ? WHERE id = ? AND rev = ?`,
+		hash, string(alg), userID, rev,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to rehash login verifier: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrUserConflict
+	}
+	return nil
 }
 
-// UpdateUser updates a user's credentials
+// UpdateUser updates a user's credentials. The update only applies if the
+// stored rev still equals user.Rev, so a read-modify-write racing another
+// credential change fails with ErrUserConflict instead of mixing the two.
 func (db *DB) UpdateUser(user *models.User) error {
+	defer db.observe("UpdateUser", user.ID, time.Now())
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin user update: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if db.options.RejectNonceReuse {
+		if err := recordAccountKeyNonce(tx, user.ID, user.WrappedAccountKey); err != nil {
+			return err
+		}
+	}
+
+	canonical := db.canonicalUsername(user.Username)
+	if db.options.UsernameReleaseHold > 0 {
+		var previous string
+		err := tx.QueryRow(`SELECT username_canonical FROM users WHERE id = ?`, user.ID).Scan(&previous)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to read username: %w", err)
+		}
+		if err == nil && previous != canonical {
+			if err := db.checkUsernameHold(tx, canonical, user.ID); err != nil {
+				return err
+			}
+			if err := db.releaseUsername(tx, previous, &user.ID); err != nil {
+				return err
+			}
+		}
+	}
+
 	query := `
 		UPDATE users
-		SET username = ?, kdf_type = ?, kdf_iterations = ?, kdf_memory_kib = ?, 
-		    kdf_parallelism = ?, login_verifier_hash = ?, wrapped_account_key_nonce = ?,
-		    wrapped_account_key_ciphertext = ?, wrapped_account_key_tag = ?, updated_at = ?
-		WHERE id = ?
+		SET username = ?, username_canonical = ?, kdf_type = ?, kdf_iterations = ?, kdf_memory_kib = ?, 
+		    kdf_parallelism = ?, login_verifier_hash = ?, login_verifier_hash_alg = ?,
+		    wrapped_account_key_nonce = ?,
+		    wrapped_account_key_ciphertext = ?, wrapped_account_key_tag = ?,
+		    wrapped_account_key_alg = ?, username_changed_at = ?, updated_at = ?,
+		    rev = rev + 1
+		WHERE id = ? AND rev = ?
 	`
 
 	now := time.Now().UTC()
-	result, err := db.conn.Exec(
+	result, err := tx.Exec(
 		query,
 		user.Username,
+		canonical,
 		string(user.KDFType),
 		user.KDFIterations,
 		user.KDFMemoryKiB,
 		user.KDFParallelism,
 		user.LoginVerifierHash,
+		string(user.VerifierHashAlg),
 		user.WrappedAccountKey.Nonce,
 		user.WrappedAccountKey.Ciphertext,
 		user.WrappedAccountKey.Tag,
+		user.WrappedAccountKey.Alg,
+		user.UsernameChangedAt,
 		now,
 		user.ID,
+		user.Rev,
 	)
 
 	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint failed: users.username") {
+		if isUniqueViolation(err) {
 			return ErrUserExists
 		}
 		return fmt.Errorf("failed to update user: %w", err)
@@ -217,134 +833,2475 @@ func (db *DB) UpdateUser(user *models.User) error {
 	}
 
 	if rowsAffected == 0 {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)`, user.ID).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to check user: %w", err)
+		}
+		if exists {
+			return ErrUserConflict
+		}
 		return ErrUserNotFound
 	}
 
-	user.UpdatedAt = now
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit user update: %w", err)
+	}
+
+	user.Rev++
+	user.UpdatedAt = models.NewTimestamp(now)
 	return nil
 }
 
-// UpsertBlob creates or updates a blob
-func (db *DB) UpsertBlob(blob *models.Blob) error {
-	query := `
-		INSERT INTO blobs (user_id, blob_name, encrypted_blob_nonce, encrypted_blob_ciphertext, 
-		                   encrypted_blob_tag, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(user_id, blob_name) DO UPDATE SET
-			encrypted_blob_nonce = excluded.encrypted_blob_nonce,
-			encrypted_blob_ciphertext = excluded.encrypted_blob_ciphertext,
-			encrypted_blob_tag = excluded.encrypted_blob_tag,
-			updated_at = excluded.updated_at
-		RETURNING id, created_at, updated_at
-	`
+// RenameBlob moves a blob to newName, replacing its container with one
+// re-encrypted for the new name (the blob AAD binds the name). encryptedName
+// replaces the stored encrypted name; nil clears it. The row keeps its id and
+// created_at. An expired blob at newName is discarded first. Like an upsert
+// it fails with ErrQuotaExceeded (writing nothing) if the user's stored bytes
+// would exceed quotaBytes; 0 disables the check. A lock on the blob held for
+// another session than writer's yields ErrBlobLocked.
+func (db *DB) RenameBlob(userID int64, blobName, newName string, container models.Container, encryptedName *models.Container, quotaBytes int64, writer Writer) (*models.Blob, error) {
+	defer db.observe("RenameBlob", userID, time.Now())
 
-	now := time.Now().UTC()
-	err := db.conn.QueryRow(
-		query,
-		blob.UserID,
-		blob.BlobName,
-		blob.EncryptedBlob.Nonce,
-		blob.EncryptedBlob.Ciphertext,
-		blob.EncryptedBlob.Tag,
-		now,
-		now,
-	).Scan(&blob.ID, &blob.CreatedAt, &blob.UpdatedAt)
+	staged, err := db.stageBlobContent(userID, container.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	defer staged.release(false)
 
+	tx, err := db.conn.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to upsert blob: %w", err)
+		return nil, fmt.Errorf("failed to begin rename: %w", err)
 	}
+	defer func() { _ = tx.Rollback() }()
 
-	return nil
-}
+	if err := checkBlobLock(tx, userID, blobName, writer); err != nil {
+		return nil, err
+	}
 
-// GetBlob retrieves a blob by user ID and blob name
-func (db *DB) GetBlob(userID int64, blobName string) (*models.Blob, error) {
-	query := `
-		SELECT id, user_id, blob_name, encrypted_blob_nonce, encrypted_blob_ciphertext,
-		       encrypted_blob_tag, created_at, updated_at
-		FROM blobs
-		WHERE user_id = ? AND blob_name = ?
-	`
+	now := time.Now().UTC()
+	if _, err := tx.Exec(
+		`DELETE FROM blobs WHERE user_id = ? AND blob_name = ? AND expires_at IS NOT NULL AND expires_at <= ? AND NOT pinned`,
+		userID, newName, now,
+	); err != nil {
+		return nil, fmt.Errorf("failed to clear expired target: %w", err)
+	}
 
-	blob := &models.Blob{}
-	err := db.conn.QueryRow(query, userID, blobName).Scan(
-		&blob.ID,
-		&blob.UserID,
-		&blob.BlobName,
-		&blob.EncryptedBlob.Nonce,
-		&blob.EncryptedBlob.Ciphertext,
-		&blob.EncryptedBlob.Tag,
-		&blob.CreatedAt,
-		&blob.UpdatedAt,
-	)
+	if db.options.RejectNonceReuse {
+		if err := recordNonce(tx, userID, nonceContextBlob, container); err != nil {
+			return nil, err
+		}
+	}
+	stored, contentHash, err := storeCiphertext(tx, db.options, container.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	nameValue, err := encryptedNameValue(encryptedName)
+	if err != nil {
+		return nil, err
+	}
 
+	blob := &models.Blob{UserID: userID, BlobName: newName, EncryptedBlob: container, EncryptedName: encryptedName}
+	blob.Checksum = crypto.ContainerChecksum(container)
+	err = tx.QueryRow(`
+		UPDATE blobs
+		SET blob_name = ?, encrypted_blob_nonce = ?, encrypted_blob_ciphertext = ?, content_hash = ?,
+		    encrypted_blob_tag = ?, encrypted_blob_alg = ?, encrypted_name = ?, stored_size = ?, checksum = ?,
+		    updated_at = ?, version = version + 1
+		WHERE user_id = ? AND blob_name = ? AND (expires_at IS NULL OR expires_at > ? OR pinned)
+		RETURNING id, collection, version, expires_at, pinned, created_at, updated_at
+	`,
+		newName, container.Nonce, stored, contentHash, container.Tag, container.Alg, nameValue,
+		storedSize(container.Ciphertext, nameValue), blob.Checksum, now,
+		userID, blobName, now,
+	).Scan(&blob.ID, &blob.Collection, &blob.Version, &blob.ExpiresAt, &blob.Pinned, &blob.CreatedAt, &blob.UpdatedAt)
 	if err == sql.ErrNoRows {
 		return nil, ErrBlobNotFound
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to get blob: %w", err)
+		if isUniqueViolation(err) {
+			return nil, ErrBlobExists
+		}
+		return nil, fmt.Errorf("failed to rename blob: %w", err)
+	}
+	if err := putBlobContent(tx, staged, blob.ID, container.Ciphertext); err != nil {
+		return nil, err
+	}
+
+	if quotaBytes > 0 {
+		used, err := usageBytes(tx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if used > quotaBytes {
+			return nil, ErrQuotaExceeded
+		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit rename: %w", err)
+	}
+	staged.release(true)
+	db.blobs.invalidate(userID, blobName, newName)
+	db.collectBlobContent()
 	return blob, nil
 }
 
-// ListBlobs retrieves all blob metadata for a user
-func (db *DB) ListBlobs(userID int64) ([]models.BlobListItem, error) {
-	query := `
-		SELECT blob_name, updated_at, encrypted_blob_ciphertext
-		FROM blobs
-		WHERE user_id = ?
-		ORDER BY blob_name
-	`
+// RewrapBlob replaces a blob's container with one re-encrypted under the same
+// name, keeping its collection and expiry, and bumps its version. Like an
+// upsert it fails with ErrQuotaExceeded (writing nothing) if the user's stored
+// bytes would exceed quotaBytes; 0 disables the check. A lock on the blob
+// held for another session than writer's yields ErrBlobLocked.
+func (db *DB) RewrapBlob(userID int64, blobName string, container models.Container, quotaBytes int64, writer Writer) (*models.Blob, error) {
+	defer db.observe("RewrapBlob", userID, time.Now())
 
-	rows, err := db.conn.Query(query, userID)
+	staged, err := db.stageBlobContent(userID, container.Ciphertext)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list blobs: %w", err)
+		return nil, err
 	}
-	defer func() { _ = rows.Close() }()
+	defer staged.release(false)
 
-	var blobs []models.BlobListItem
-	for rows.Next() {
-		var item models.BlobListItem
-		var ciphertext string
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin rewrap: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
 
-		if err := rows.Scan(&item.BlobName, &item.UpdatedAt, &ciphertext); err != nil {
-			return nil, fmt.Errorf("failed to scan blob: %w", err)
+	if err := checkBlobLock(tx, userID, blobName, writer); err != nil {
+		return nil, err
+	}
+
+	if db.options.RejectNonceReuse {
+		if err := recordNonce(tx, userID, nonceContextBlob, container); err != nil {
+			return nil, err
 		}
+	}
+	stored, contentHash, err := storeCiphertext(tx, db.options, container.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	blob := &models.Blob{UserID: userID, BlobName: blobName, EncryptedBlob: container}
+	blob.Checksum = crypto.ContainerChecksum(container)
+	err = tx.QueryRow(`
+		UPDATE blobs
+		SET encrypted_blob_nonce = ?, encrypted_blob_ciphertext = ?, content_hash = ?,
+		    encrypted_blob_tag = ?, encrypted_blob_alg = ?, checksum = ?, updated_at = ?,
+		    stored_size = ? + COALESCE(length(encrypted_name), 0), version = version + 1
+		WHERE user_id = ? AND blob_name = ? AND (expires_at IS NULL OR expires_at > ? OR pinned)
+		RETURNING id, collection, version, expires_at, pinned, created_at, updated_at
+	`,
+		container.Nonce, stored, contentHash, container.Tag, container.Alg, blob.Checksum, now,
+		storedSize(container.Ciphertext, nil),
+		userID, blobName, now,
+	).Scan(&blob.ID, &blob.Collection, &blob.Version, &blob.ExpiresAt, &blob.Pinned, &blob.CreatedAt, &blob.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to rewrap blob: %w", err)
+	}
+	if err := putBlobContent(tx, staged, blob.ID, container.Ciphertext); err != nil {
+		return nil, err
+	}
 
-		// Calculate encrypted size from base64 ciphertext
-		decoded, err := base64.StdEncoding.DecodeString(ciphertext)
-		if err == nil {
-			item.EncryptedSize = len(decoded)
+	if quotaBytes > 0 {
+		used, err := usageBytes(tx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if used > quotaBytes {
+			return nil, ErrQuotaExceeded
 		}
+	}
 
-		blobs = append(blobs, item)
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit rewrap: %w", err)
+	}
+	staged.release(true)
+	db.blobs.invalidate(userID, blobName)
+	db.collectBlobContent()
+	return blob, nil
+}
+
+// TouchBlob sets a blob's updated_at to now without changing its content or
+// version, and returns the new timestamp. A lock on the blob held for another
+// session than writer's yields ErrBlobLocked.
+func (db *DB) TouchBlob(userID int64, blobName string, writer Writer) (models.Timestamp, error) {
+	defer db.observe("TouchBlob", userID, time.Now())
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return models.Timestamp{}, fmt.Errorf("failed to begin touch: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := checkBlobLock(tx, userID, blobName, writer); err != nil {
+		return models.Timestamp{}, err
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("failed to iterate blobs: %w", err)
+	now := time.Now().UTC()
+	var updatedAt models.Timestamp
+	err = tx.QueryRow(`
+		UPDATE blobs SET updated_at = ?
+		WHERE user_id = ? AND blob_name = ? AND (expires_at IS NULL OR expires_at > ? OR pinned)
+		RETURNING updated_at
+	`, now, userID, blobName, now).Scan(&updatedAt)
+	if err == sql.ErrNoRows {
+		return models.Timestamp{}, ErrBlobNotFound
+	}
+	if err != nil {
+		return models.Timestamp{}, fmt.Errorf("failed to touch blob: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return models.Timestamp{}, fmt.Errorf("failed to commit touch: %w", err)
+	}
+	db.blobs.invalidate(userID, blobName)
+	return updatedAt, nil
+}
+
+// TransferBlob reassigns a blob to another user in one transaction, for support
+// workflows. Only ownership changes: the container stays encrypted under the
+// source user's account key. An expired blob at the destination name is
+// discarded first; an unexpired one yields ErrBlobExists. The blob counts
+// against the destination user's quota (when quotaBytes > 0) and
+// Options.MaxCollections like any other write to their account. Blob locks
+// do not hold up a transfer; the blob's lock, held by a session of the source
+// user, is dropped.
+func (db *DB) TransferBlob(fromUserID, toUserID int64, blobName string, quotaBytes int64) (*models.Blob, error) {
+	defer db.observe("TransferBlob", fromUserID, time.Now())
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transfer: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)`, toUserID).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up destination user: %w", err)
+	}
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	now := time.Now().UTC()
+	var collection string
+	err = tx.QueryRow(
+		`SELECT collection FROM blobs WHERE user_id = ? AND blob_name = ? AND (expires_at IS NULL OR expires_at > ? OR pinned)`,
+		fromUserID, blobName, now,
+	).Scan(&collection)
+	if err == sql.ErrNoRows {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up blob: %w", err)
+	}
+	if err := checkCollectionCap(tx, db.options, toUserID, collection); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(
+		`DELETE FROM blobs WHERE user_id = ? AND blob_name = ? AND expires_at IS NOT NULL AND expires_at <= ? AND NOT pinned`,
+		toUserID, blobName, now,
+	); err != nil {
+		return nil, fmt.Errorf("failed to clear expired target: %w", err)
+	}
+
+	blob := &models.Blob{UserID: toUserID, BlobName: blobName}
+	err = tx.QueryRow(`
+		UPDATE blobs SET user_id = ?, updated_at = ?, version = version + 1
+		WHERE user_id = ? AND blob_name = ? AND (expires_at IS NULL OR expires_at > ? OR pinned)
+		RETURNING id, version, updated_at
+	`, toUserID, now, fromUserID, blobName, now).Scan(&blob.ID, &blob.Version, &blob.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, ErrBlobExists
+		}
+		return nil, fmt.Errorf("failed to transfer blob: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM blob_locks WHERE blob_id = ?`, blob.ID); err != nil {
+		return nil, fmt.Errorf("failed to drop blob lock: %w", err)
+	}
+
+	if quotaBytes > 0 {
+		used, err := usageBytes(tx, toUserID)
+		if err != nil {
+			return nil, err
+		}
+		if used > quotaBytes {
+			return nil, ErrQuotaExceeded
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transfer: %w", err)
+	}
+	db.blobs.invalidate(fromUserID, blobName)
+	db.blobs.invalidate(toUserID, blobName)
+	db.collectBlobContent()
+	return blob, nil
+}
+
+// BlobMetaUpdate changes a blob's metadata without touching its container;
+// nil fields are left as they are
+type BlobMetaUpdate struct {
+	BlobName   string
+	Collection *string
+	ExpiresAt  *models.Timestamp
+	Pinned     *bool
+}
+
+// UpdateBlobsMeta applies metadata updates to a user's blobs in one
+// transaction, bumping each blob's version. The result is parallel to
+// updates, with nil where no unexpired blob has that name. If an update would
+// exceed Options.MaxCollections, nothing is applied and ErrTooManyCollections
+// is returned; likewise ErrBlobLocked if one of the blobs is locked for
+// another session than writer's.
+func (db *DB) UpdateBlobsMeta(userID int64, updates []BlobMetaUpdate, writer Writer) ([]*models.Blob, error) {
+	defer db.observe("UpdateBlobsMeta", userID, time.Now())
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin metadata update: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := time.Now().UTC()
+	blobs := make([]*models.Blob, len(updates))
+	for i, update := range updates {
+		if err := checkBlobLock(tx, userID, update.BlobName, writer); err != nil {
+			return nil, err
+		}
+		if update.Collection != nil {
+			if err := checkCollectionCap(tx, db.options, userID, *update.Collection); err != nil {
+				return nil, err
+			}
+		}
+		blob := &models.Blob{UserID: userID, BlobName: update.BlobName}
+		err := tx.QueryRow(`
+			UPDATE blobs
+			SET collection = COALESCE(?, collection), expires_at = COALESCE(?, expires_at),
+			    pinned = COALESCE(?, pinned), updated_at = ?, version = version + 1
+			WHERE user_id = ? AND blob_name = ? AND (expires_at IS NULL OR expires_at > ? OR pinned)
+			RETURNING id, collection, version, expires_at, pinned, created_at, updated_at
+		`,
+			update.Collection, update.ExpiresAt, update.Pinned, now,
+			userID, update.BlobName, now,
+		).Scan(&blob.ID, &blob.Collection, &blob.Version, &blob.ExpiresAt, &blob.Pinned, &blob.CreatedAt, &blob.UpdatedAt)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to update blob %q: %w", update.BlobName, err)
+		}
+		blobs[i] = blob
 	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit metadata update: %w", err)
+	}
+	for _, update := range updates {
+		db.blobs.invalidate(userID, update.BlobName)
+	}
 	return blobs, nil
 }
 
-// DeleteBlob deletes a blob by user ID and blob name
-func (db *DB) DeleteBlob(userID int64, blobName string) error {
-	query := `DELETE FROM blobs WHERE user_id = ? AND blob_name = ?`
+// RotateAccountKey replaces the user's wrapped account key and the container of
+// every unexpired blob in one transaction. blobs must name each unexpired blob
+// exactly once; otherwise ErrRotationIncomplete is returned and nothing changes.
+// Expired blobs are deleted, since they could not be decrypted after rotation.
+// If the new containers would take the user's stored bytes past quotaBytes, it
+// fails with ErrQuotaExceeded and nothing changes; 0 disables the check. A
+// blob locked for another session than writer's yields ErrBlobLocked. Like
+// UpdateUser, it only applies while the stored rev still equals rev, and
+// otherwise fails with ErrUserConflict.
+func (db *DB) RotateAccountKey(userID, rev int64, wrappedAccountKey models.Container, blobs []models.Blob, quotaBytes int64, writer Writer) error {
+	defer db.observe("RotateAccountKey", userID, time.Now())
 
-	result, err := db.conn.Exec(query, userID, blobName)
+	seen := make(map[string]bool, len(blobs))
+	for _, blob := range blobs {
+		if seen[blob.BlobName] {
+			return ErrRotationIncomplete
+		}
+		seen[blob.BlobName] = true
+	}
+
+	ciphertexts := make([]string, len(blobs))
+	for i, blob := range blobs {
+		ciphertexts[i] = blob.EncryptedBlob.Ciphertext
+	}
+	staged, err := db.stageBlobContent(userID, ciphertexts...)
 	if err != nil {
-		return fmt.Errorf("failed to delete blob: %w", err)
+		return err
 	}
+	defer staged.release(false)
 
-	rowsAffected, err := result.RowsAffected()
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin rotation: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec(`DELETE FROM blobs WHERE user_id = ? AND expires_at IS NOT NULL AND expires_at <= ? AND NOT pinned`, userID, now); err != nil {
+		return fmt.Errorf("failed to delete expired blobs: %w", err)
+	}
+
+	var stored int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM blobs WHERE user_id = ?`, userID).Scan(&stored); err != nil {
+		return fmt.Errorf("failed to count blobs: %w", err)
+	}
+	if stored != len(blobs) {
+		return ErrRotationIncomplete
+	}
+
+	if db.options.RejectNonceReuse {
+		if err := recordAccountKeyNonce(tx, userID, wrappedAccountKey); err != nil {
+			return err
+		}
+		// Blob nonces from here on are under the new account key
+		if _, err := tx.Exec(`DELETE FROM nonces WHERE user_id = ? AND context = ?`, userID, nonceContextBlob); err != nil {
+			return fmt.Errorf("failed to reset blob nonces: %w", err)
+		}
+	}
+
+	result, err := tx.Exec(`
+		UPDATE users
+		SET wrapped_account_key_nonce = ?, wrapped_account_key_ciphertext = ?,
+		    wrapped_account_key_tag = ?, wrapped_account_key_alg = ?, updated_at = ?,
+		    rev = rev + 1
+		WHERE id = ? AND rev = ?
+	`, wrappedAccountKey.Nonce, wrappedAccountKey.Ciphertext, wrappedAccountKey.Tag, wrappedAccountKey.Alg, now, userID, rev)
 	if err != nil {
+		return fmt.Errorf("failed to update account key: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
 		return fmt.Errorf("failed to get rows affected: %w", err)
+	} else if n == 0 {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)`, userID).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to check user: %w", err)
+		}
+		if exists {
+			return ErrUserConflict
+		}
+		return ErrUserNotFound
 	}
 
-	if rowsAffected == 0 {
-		return ErrBlobNotFound
+	// An escrow holds the old account key, so it cannot recover the new one
+	if _, err := tx.Exec(`DELETE FROM key_escrow WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to clear key escrow: %w", err)
+	}
+
+	// Names are distinct and the count matches, so every name must hit a row
+	for _, blob := range blobs {
+		if err := checkBlobLock(tx, userID, blob.BlobName, writer); err != nil {
+			return err
+		}
+		if db.options.RejectNonceReuse {
+			if err := recordNonce(tx, userID, nonceContextBlob, blob.EncryptedBlob); err != nil {
+				return err
+			}
+		}
+		stored, contentHash, err := storeCiphertext(tx, db.options, blob.EncryptedBlob.Ciphertext)
+		if err != nil {
+			return err
+		}
+		var id int64
+		err = tx.QueryRow(`
+			UPDATE blobs
+			SET encrypted_blob_nonce = ?, encrypted_blob_ciphertext = ?, content_hash = ?, encrypted_blob_tag = ?,
+			    encrypted_blob_alg = ?, checksum = ?, updated_at = ?,
+			    stored_size = ? + COALESCE(length(encrypted_name), 0), version = version + 1
+			WHERE user_id = ? AND blob_name = ?
+			RETURNING id
+		`,
+			blob.EncryptedBlob.Nonce,
+			stored,
+			contentHash,
+			blob.EncryptedBlob.Tag,
+			blob.EncryptedBlob.Alg,
+			crypto.ContainerChecksum(blob.EncryptedBlob),
+			now,
+			storedSize(blob.EncryptedBlob.Ciphertext, nil),
+			userID,
+			blob.BlobName,
+		).Scan(&id)
+		if err == sql.ErrNoRows {
+			return ErrRotationIncomplete
+		}
+		if err != nil {
+			return fmt.Errorf("failed to rotate blob %q: %w", blob.BlobName, err)
+		}
+		if err := putBlobContent(tx, staged, id, blob.EncryptedBlob.Ciphertext); err != nil {
+			return err
+		}
+	}
+
+	if quotaBytes > 0 {
+		used, err := usageBytes(tx, userID)
+		if err != nil {
+			return err
+		}
+		if used > quotaBytes {
+			return ErrQuotaExceeded
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit rotation: %w", err)
+	}
+	staged.release(true)
+	db.blobs.invalidateUser(userID)
+	db.collectBlobContent()
+	return nil
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// queryEach runs a query and calls fn for each row. The rows are closed on
+// every path, so a read cannot hold its pooled connection after returning:
+// use it instead of calling Query directly. An error from fn stops the scan
+// and is returned as is.
+func (db *DB) queryEach(query string, args []interface{}, fn func(*sql.Rows) error) error {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// blobCiphertext selects a blob's ciphertext whether it is stored inline or in blob_content
+const blobCiphertext = `COALESCE((SELECT data FROM blob_content WHERE hash = blobs.content_hash), encrypted_blob_ciphertext)`
+
+// blobCiphertextSize selects the length of a blob's ciphertext wherever it is
+// stored; content in the blob store is not read
+const blobCiphertextSize = `COALESCE(content_size, length(` + blobCiphertext + `))`
+
+// storedSize returns a blob row's stored_size, the bytes it counts against its
+// user's quota: its ciphertext plus its encrypted_name column value, as stored
+func storedSize(ciphertext string, encryptedName interface{}) int64 {
+	size := int64(len(ciphertext))
+	if name, ok := encryptedName.(string); ok {
+		size += int64(len(name))
+	}
+	return size
+}
+
+// storeCiphertext returns the values for a blob row's encrypted_blob_ciphertext
+// and content_hash columns. With dedup it takes a reference on the ciphertext's
+// blob_content row, creating it if needed, and leaves the inline column empty;
+// the release triggers drop the reference the row held before. Call it in the
+// transaction that writes the row, so a failed write takes no reference.
+// With a blob store the inline column is left empty too, for putBlobContent
+// to point the row at its staged content once the row is written.
+func storeCiphertext(q querier, options Options, ciphertext string) (string, *string, error) {
+	if options.BlobStore != nil {
+		return "", nil, nil
+	}
+	if !options.DedupContent {
+		return ciphertext, nil, nil
+	}
+
+	sum := sha256.Sum256([]byte(ciphertext))
+	hash := hex.EncodeToString(sum[:])
+	if _, err := q.Exec(`
+		INSERT INTO blob_content (hash, data, refcount) VALUES (?, ?, 1)
+		ON CONFLICT(hash) DO UPDATE SET refcount = refcount + 1
+	`, hash, ciphertext); err != nil {
+		return "", nil, fmt.Errorf("failed to store blob content: %w", err)
+	}
+	return "", &hash, nil
+}
+
+// encryptedNameValue returns the encrypted_name column value for a blob: its
+// name container as JSON, or NULL when the name is stored in plaintext
+func encryptedNameValue(name *models.Container) (interface{}, error) {
+	if name == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode encrypted name: %w", err)
+	}
+	return string(data), nil
+}
+
+// encryptedNameScanner scans the encrypted_name column into *dst, leaving it
+// nil for NULL
+type encryptedNameScanner struct {
+	dst **models.Container
+}
+
+func (s encryptedNameScanner) Scan(src interface{}) error {
+	*s.dst = nil
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("unexpected encrypted name type %T", src)
+	}
+	name := &models.Container{}
+	if err := json.Unmarshal(data, name); err != nil {
+		return fmt.Errorf("failed to decode encrypted name: %w", err)
+	}
+	*s.dst = name
+	return nil
+}
+
+// Key contexts for recorded nonces. Blobs are encrypted under the account key,
+// the wrapped account key under a key derived from the password.
+const (
+	nonceContextBlob       = "blob"
+	nonceContextAccountKey = "account_key"
+)
+
+// recordNonce notes container's nonce for the user and key context, failing
+// with ErrNonceReuse if it was seen before with a different container. Storing
+// the identical container again, as a retried request does, is not a reuse.
+func recordNonce(q querier, userID int64, context string, container models.Container) error {
+	nonce, err := crypto.DecodeBase64(container.Nonce)
+	if err != nil {
+		nonce = []byte(container.Nonce)
+	}
+	sum := sha256.Sum256(nonce)
+	nonceHash := hex.EncodeToString(sum[:])
+	checksum := crypto.ContainerChecksum(container)
+
+	var seen string
+	err = q.QueryRow(
+		`SELECT checksum FROM nonces WHERE user_id = ? AND context = ? AND nonce_hash = ?`,
+		userID, context, nonceHash,
+	).Scan(&seen)
+	if err == nil {
+		if seen != checksum {
+			return ErrNonceReuse
+		}
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to look up nonce: %w", err)
+	}
+
+	if _, err := q.Exec(
+		`INSERT INTO nonces (user_id, context, nonce_hash, checksum) VALUES (?, ?, ?, ?)`,
+		userID, context, nonceHash, checksum,
+	); err != nil {
+		return fmt.Errorf("failed to record nonce: %w", err)
+	}
+	return nil
+}
+
+// recordAccountKeyNonce records the user's stored wrapped account key, so the
+// one from registration is covered, and then its replacement. A missing user
+// records nothing; the caller's update reports ErrUserNotFound.
+func recordAccountKeyNonce(q querier, userID int64, replacement models.Container) error {
+	var stored models.Container
+	err := q.QueryRow(`
+		SELECT wrapped_account_key_nonce, wrapped_account_key_ciphertext, wrapped_account_key_tag
+		FROM users WHERE id = ?
+	`, userID).Scan(&stored.Nonce, &stored.Ciphertext, &stored.Tag)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read account key: %w", err)
+	}
+
+	if err := recordNonce(q, userID, nonceContextAccountKey, stored); err != nil {
+		return err
+	}
+	return recordNonce(q, userID, nonceContextAccountKey, replacement)
+}
+
+// UpsertBlob creates or updates a blob, ignoring blob locks
+func (db *DB) UpsertBlob(blob *models.Blob) error {
+	if db.options.DedupContent || db.options.BlobStore != nil || db.options.RejectNonceReuse || db.options.MaxCollections > 0 {
+		// The bookkeeping rows and the blob row have to land together
+		return db.UpsertBlobWithinQuota(blob, 0, Writer{Force: true})
 	}
 
+	defer db.observe("UpsertBlob", blob.UserID, time.Now())
+
+	err := db.retryBusy("UpsertBlob", func() error {
+		return upsertBlob(db.conn, db.options, nil, blob, nil, Writer{Force: true})
+	})
+	if err != nil {
+		return err
+	}
+	db.blobs.invalidate(blob.UserID, blob.BlobName)
 	return nil
 }
+
+// UpsertBlobWithinQuota creates or updates a blob, failing with ErrQuotaExceeded
+// (and writing nothing) if the user's stored bytes would exceed quotaBytes.
+// A quotaBytes of 0 disables the check. A lock on the blob held for another
+// session than writer's yields ErrBlobLocked.
+func (db *DB) UpsertBlobWithinQuota(blob *models.Blob, quotaBytes int64, writer Writer) error {
+	if db.writes != nil {
+		return db.writes.upsert(blob, quotaBytes, writer)
+	}
+
+	return db.retryBusy("UpsertBlobWithinQuota", func() error {
+		imp, err := db.BeginBlobImport(blob.UserID, writer, blob)
+		if err != nil {
+			return err
+		}
+		if err := imp.Upsert(blob); err != nil {
+			_ = imp.Rollback()
+			return err
+		}
+		return imp.Commit(quotaBytes)
+	})
+}
+
+// upsertBlob creates or updates a blob, taking its content from staged when
+// there is a blob store. A nil createdAt stamps new rows with the current time
+// and keeps the creation time of existing ones. A blob with Pinned set is
+// pinned; otherwise an existing blob keeps its pin. A lock on the blob held
+// for another session than writer's yields ErrBlobLocked.
+func upsertBlob(q querier, options Options, staged *stagedContent, blob *models.Blob, createdAt *time.Time, writer Writer) error {
+	if err := checkBlobLock(q, blob.UserID, blob.BlobName, writer); err != nil {
+		return err
+	}
+	if err := checkCollectionCap(q, options, blob.UserID, blob.Collection); err != nil {
+		return err
+	}
+	if options.RejectNonceReuse {
+		if err := recordNonce(q, blob.UserID, nonceContextBlob, blob.EncryptedBlob); err != nil {
+			return err
+		}
+	}
+	stored, contentHash, err := storeCiphertext(q, options, blob.EncryptedBlob.Ciphertext)
+	if err != nil {
+		return err
+	}
+
+	encryptedName, err := encryptedNameValue(blob.EncryptedName)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO blobs (user_id, blob_name, encrypted_blob_nonce, encrypted_blob_ciphertext, content_hash,
+		                   encrypted_blob_tag, encrypted_blob_alg, encrypted_name, stored_size, collection,
+		                   checksum, expires_at, pinned, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id, blob_name) DO UPDATE SET
+			encrypted_blob_nonce = excluded.encrypted_blob_nonce,
+			encrypted_blob_ciphertext = excluded.encrypted_blob_ciphertext,
+			content_hash = excluded.content_hash,
+			encrypted_blob_tag = excluded.encrypted_blob_tag,
+			encrypted_blob_alg = excluded.encrypted_blob_alg,
+			encrypted_name = excluded.encrypted_name,
+			stored_size = excluded.stored_size,
+			collection = excluded.collection,
+			checksum = excluded.checksum,
+			expires_at = excluded.expires_at,
+			pinned = blobs.pinned OR excluded.pinned,
+			created_at = CASE WHEN ? THEN excluded.created_at ELSE blobs.created_at END,
+			updated_at = excluded.updated_at,
+			version = blobs.version + 1
+		RETURNING id, version, pinned, created_at, updated_at
+	`
+
+	now := time.Now().UTC()
+	created := now
+	if createdAt != nil {
+		created = createdAt.UTC()
+	}
+	blob.Checksum = crypto.ContainerChecksum(blob.EncryptedBlob)
+	err = q.QueryRow(
+		query,
+		blob.UserID,
+		blob.BlobName,
+		blob.EncryptedBlob.Nonce,
+		stored,
+		contentHash,
+		blob.EncryptedBlob.Tag,
+		blob.EncryptedBlob.Alg,
+		encryptedName,
+		storedSize(blob.EncryptedBlob.Ciphertext, encryptedName),
+		blob.Collection,
+		blob.Checksum,
+		blob.ExpiresAt,
+		blob.Pinned,
+		created,
+		now,
+		createdAt != nil,
+	).Scan(&blob.ID, &blob.Version, &blob.Pinned, &blob.CreatedAt, &blob.UpdatedAt)
+
+	if err != nil {
+		return fmt.Errorf("failed to upsert blob: %w", err)
+	}
+
+	return putBlobContent(q, staged, blob.ID, blob.EncryptedBlob.Ciphertext)
+}
+
+// countCollections returns the number of distinct named collections a user
+// has blobs in; the default collection is not counted
+func countCollections(q querier, userID int64) (int, error) {
+	var count int
+	err := q.QueryRow(
+		`SELECT COUNT(DISTINCT collection) FROM blobs WHERE user_id = ? AND collection != ''`,
+		userID,
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count collections: %w", err)
+	}
+	return count, nil
+}
+
+// checkCollectionCap returns ErrTooManyCollections if putting a blob in
+// collection would take the user past options.MaxCollections. Existing
+// collections and the default one are always allowed.
+func checkCollectionCap(q querier, options Options, userID int64, collection string) error {
+	if options.MaxCollections <= 0 || collection == "" {
+		return nil
+	}
+	var exists bool
+	err := q.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM blobs WHERE user_id = ? AND collection = ?)`,
+		userID, collection,
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to look up collection: %w", err)
+	}
+	if exists {
+		return nil
+	}
+	count, err := countCollections(q, userID)
+	if err != nil {
+		return err
+	}
+	if count >= options.MaxCollections {
+		return ErrTooManyCollections
+	}
+	return nil
+}
+
+// usageBytes returns a user's stored ciphertext size (base64, as stored),
+// encrypted names included, from the usage_bytes counter the blob triggers
+// maintain. Deduplicated ciphertext counts in full for every blob referencing it.
+func usageBytes(q querier, userID int64) (int64, error) {
+	var used int64
+	err := q.QueryRow(`SELECT usage_bytes FROM users WHERE id = ?`, userID).Scan(&used)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to compute usage: %w", err)
+	}
+	return used, nil
+}
+
+// UsageBytes returns the bytes counted against a user's quota
+func (db *DB) UsageBytes(userID int64) (int64, error) {
+	defer db.observe("UsageBytes", userID, time.Now())
+
+	return usageBytes(db.conn, userID)
+}
+
+// UserUsage is one user's stored bytes, as counted against the quota
+type UserUsage struct {
+	UserID int64
+	Bytes  int64
+}
+
+// TopUsersByUsage returns the limit users storing the most bytes, largest
+// first. It reads the maintained usage_bytes counters through their index,
+// so its cost does not grow with the number of blobs.
+func (db *DB) TopUsersByUsage(limit int) ([]UserUsage, error) {
+	defer db.observe("TopUsersByUsage", 0, time.Now())
+
+	var usage []UserUsage
+	err := db.queryEach(`
+		SELECT id, usage_bytes
+		FROM users
+		WHERE usage_bytes > 0
+		ORDER BY usage_bytes DESC, id
+		LIMIT ?
+	`, []interface{}{limit}, func(rows *sql.Rows) error {
+		var u UserUsage
+		if err := rows.Scan(&u.UserID, &u.Bytes); err != nil {
+			return fmt.Errorf("failed to scan usage: %w", err)
+		}
+		usage = append(usage, u)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to rank users by usage: %w", err)
+	}
+	return usage, nil
+}
+
+// RefreshStorageMetrics publishes the top users by usage as the
+// storage_top_users_bytes gauge, keyed by metrics.UserLabel
+func (db *DB) RefreshStorageMetrics(top int) error {
+	usage, err := db.TopUsersByUsage(top)
+	if err != nil {
+		return err
+	}
+	bytes := make(map[string]int64, len(usage))
+	for _, u := range usage {
+		bytes[metrics.UserLabel(u.UserID)] = u.Bytes
+	}
+	metrics.SetStorageTopUsers(bytes)
+	return nil
+}
+
+// BlobImport upserts many blobs for one user in a single transaction, so the
+// quota is checked against the final state and a rejected import leaves no trace.
+// Callers must end it with Commit or Rollback.
+type BlobImport struct {
+	db      *DB
+	tx      *retryTx
+	userID  int64
+	started time.Time
+	names   []string // upserted so far, invalidated in the blob cache on commit
+	staged  *stagedContent
+	writer  Writer
+}
+
+// BeginBlobImport opens the transaction for a BlobImport. With a blob store,
+// the content of blobs is put there first, so the transaction does not hold
+// the write lock while files are written; pass every blob the import will
+// upsert. Content of a blob not passed is put when it is upserted. Upserts to
+// a blob locked for another session than writer's fail with ErrBlobLocked.
+func (db *DB) BeginBlobImport(userID int64, writer Writer, blobs ...*models.Blob) (*BlobImport, error) {
+	ciphertexts := make([]string, len(blobs))
+	for i, blob := range blobs {
+		ciphertexts[i] = blob.EncryptedBlob.Ciphertext
+	}
+	staged, err := db.stageBlobContent(userID, ciphertexts...)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.beginRetryTx()
+	if err != nil {
+		staged.release(false)
+		return nil, fmt.Errorf("failed to begin import: %w", err)
+	}
+	return &BlobImport{db: db, tx: tx, userID: userID, started: time.Now(), staged: staged, writer: writer}, nil
+}
+
+// Upsert creates or updates one blob within the import
+func (i *BlobImport) Upsert(blob *models.Blob) error {
+	blob.UserID = i.userID
+	i.names = append(i.names, blob.BlobName)
+	return upsertBlob(i.tx, i.db.options, i.staged, blob, nil, i.writer)
+}
+
+// UpsertWithCreatedAt is Upsert with a historical creation time, which also
+// replaces the creation time of an existing blob. It is reserved for imports
+// of data created elsewhere; regular writes cannot backdate blobs.
+func (i *BlobImport) UpsertWithCreatedAt(blob *models.Blob, createdAt time.Time) error {
+	blob.UserID = i.userID
+	i.names = append(i.names, blob.BlobName)
+	return upsertBlob(i.tx, i.db.options, i.staged, blob, &createdAt, i.writer)
+}
+
+// Commit checks the user's resulting usage against quotaBytes (0 disables the
+// check) and commits, or rolls back and returns ErrQuotaExceeded
+func (i *BlobImport) Commit(quotaBytes int64) error {
+	defer i.db.observe("BlobImport", i.userID, i.started)
+
+	if quotaBytes > 0 {
+		used, err := usageBytes(i.tx, i.userID)
+		if err != nil {
+			_ = i.tx.Rollback()
+			i.staged.release(false)
+			return err
+		}
+		if used > quotaBytes {
+			_ = i.tx.Rollback()
+			i.staged.release(false)
+			return ErrQuotaExceeded
+		}
+	}
+
+	if err := i.tx.Commit(); err != nil {
+		i.staged.release(false)
+		return fmt.Errorf("failed to commit import: %w", err)
+	}
+	i.staged.release(true)
+	i.db.blobs.invalidate(i.userID, i.names...)
+	i.db.collectBlobContent()
+	return nil
+}
+
+// Rollback discards every upsert in the import
+func (i *BlobImport) Rollback() error {
+	defer i.db.observe("BlobImport", i.userID, i.started)
+
+	err := i.tx.Rollback()
+	i.staged.release(false)
+	return err
+}
+
+// GetBlob retrieves a blob by user ID and blob name.
+// An unpinned blob past its expiry that has not been swept yet yields ErrBlobExpired.
+func (db *DB) GetBlob(userID int64, blobName string) (*models.Blob, error) {
+	defer db.observe("GetBlob", userID, time.Now())
+
+	// A cached blob past its expiry is read again: it may have been swept
+	if blob, ok := db.blobs.get(userID, blobName); ok && !blobExpired(blob) {
+		return blob, nil
+	}
+	gen := db.blobs.generation()
+	defer db.holdBlobContent()()
+
+	query := `
+		SELECT id, user_id, blob_name, encrypted_blob_nonce, ` + blobCiphertext + `,
+		       encrypted_blob_tag, encrypted_blob_alg, encrypted_name, collection, COALESCE(checksum, ''),
+		       version, expires_at, pinned, created_at, updated_at, content_ref
+		FROM blobs
+		WHERE user_id = ? AND blob_name = ?
+	`
+
+	blob := &models.Blob{}
+	var contentRef sql.NullString
+	err := db.conn.QueryRow(query, userID, blobName).Scan(
+		&blob.ID,
+		&blob.UserID,
+		&blob.BlobName,
+		&blob.EncryptedBlob.Nonce,
+		&blob.EncryptedBlob.Ciphertext,
+		&blob.EncryptedBlob.Tag,
+		&blob.EncryptedBlob.Alg,
+		encryptedNameScanner{&blob.EncryptedName},
+		&blob.Collection,
+		&blob.Checksum,
+		&blob.Version,
+		&blob.ExpiresAt,
+		&blob.Pinned,
+		&blob.CreatedAt,
+		&blob.UpdatedAt,
+		&contentRef,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob: %w", err)
+	}
+
+	if blobExpired(blob) {
+		return nil, ErrBlobExpired
+	}
+	if err := db.loadBlobContent(contentRef, &blob.EncryptedBlob); err != nil {
+		return nil, fmt.Errorf("failed to get blob: %w", err)
+	}
+
+	db.blobs.add(blob, gen)
+	return blob, nil
+}
+
+// blobExpired reports whether an unpinned blob is past its expiry
+func blobExpired(blob *models.Blob) bool {
+	return !blob.Pinned && blob.ExpiresAt != nil && !blob.ExpiresAt.After(time.Now())
+}
+
+// BlobVersion returns the stored version of a blob without reading its ciphertext.
+// Like GetBlob, an unswept expired blob yields ErrBlobExpired.
+func (db *DB) BlobVersion(userID int64, blobName string) (int64, error) {
+	defer db.observe("BlobVersion", userID, time.Now())
+
+	var version int64
+	var expiresAt *models.Timestamp
+	var pinned bool
+	err := db.conn.QueryRow(
+		`SELECT version, expires_at, pinned FROM blobs WHERE user_id = ? AND blob_name = ?`,
+		userID, blobName,
+	).Scan(&version, &expiresAt, &pinned)
+	if err == sql.ErrNoRows {
+		return 0, ErrBlobNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get blob version: %w", err)
+	}
+
+	if !pinned && expiresAt != nil && !expiresAt.After(time.Now()) {
+		return 0, ErrBlobExpired
+	}
+
+	return version, nil
+}
+
+// VerifyBlob recomputes a blob's checksum and compares it to the stored one.
+// It reports whether a checksum was available; legacy rows without one are not verifiable.
+func (db *DB) VerifyBlob(userID int64, blobName string) (bool, error) {
+	blob, err := db.GetBlob(userID, blobName)
+	if err != nil {
+		return false, err
+	}
+
+	if blob.Checksum == "" {
+		return false, nil
+	}
+
+	if crypto.ContainerChecksum(blob.EncryptedBlob) != blob.Checksum {
+		return true, ErrBlobCorrupted
+	}
+
+	return true, nil
+}
+
+// ScrubBlobs verifies the checksum of every stored blob
+func (db *DB) ScrubBlobs() (*models.ScrubReport, error) {
+	defer db.observe("ScrubBlobs", 0, time.Now())
+
+	query := `
+		SELECT user_id, blob_name, encrypted_blob_nonce, ` + blobCiphertext + `,
+		       encrypted_blob_tag, COALESCE(checksum, ''), content_ref
+		FROM blobs
+		ORDER BY id
+	`
+
+	defer db.holdBlobContent()()
+
+	report := &models.ScrubReport{Corrupted: []models.BlobRef{}}
+	err := db.queryEach(query, nil, func(rows *sql.Rows) error {
+		var ref models.BlobRef
+		var container models.Container
+		var checksum string
+		var contentRef sql.NullString
+
+		if err := rows.Scan(&ref.UserID, &ref.BlobName, &container.Nonce, &container.Ciphertext, &container.Tag, &checksum, &contentRef); err != nil {
+			return fmt.Errorf("failed to scan blob: %w", err)
+		}
+
+		report.Scanned++
+		// Content missing from the blob store is as lost as a bad checksum
+		if err := db.loadBlobContent(contentRef, &container); err != nil {
+			report.Corrupted = append(report.Corrupted, ref)
+			return nil
+		}
+		if checksum == "" {
+			report.Unchecksummed++
+			return nil
+		}
+		if crypto.ContainerChecksum(container) != checksum {
+			report.Corrupted = append(report.Corrupted, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrub blobs: %w", err)
+	}
+
+	return report, nil
+}
+
+// BlobFilter narrows ListBlobs; zero-value fields do not filter
+type BlobFilter struct {
+	// UpdatedFrom and UpdatedTo bound updated_at, both inclusive
+	UpdatedFrom *time.Time
+	UpdatedTo   *time.Time
+	// Collection, if set, keeps only blobs in exactly that collection ("" is the default one)
+	Collection *string
+	// SinceSeq, if set, keeps only blobs written after that change sequence
+	// value and orders them by seq instead of name
+	SinceSeq *int64
+
+	// ByCollection orders by collection, then name, so callers can group in one pass
+	ByCollection bool
+	// SkipSize leaves EncryptedSize zero instead of reading every ciphertext,
+	// by far the most expensive part of a listing
+	SkipSize bool
+
+	// After and Before, if set, keep only names strictly after or before them,
+	// for keyset pagination. With Before, the page nearest to it is returned.
+	After  *string
+	Before *string
+	// Limit caps the number of results; 0 returns all
+	Limit int
+}
+
+// ListBlobs retrieves unexpired blob metadata for a user that matches filter
+func (db *DB) ListBlobs(userID int64, filter BlobFilter) ([]models.BlobListItem, error) {
+	defer db.observe("ListBlobs", userID, time.Now())
+
+	where := []string{"user_id = ?", "(expires_at IS NULL OR expires_at > ? OR pinned)"}
+	args := []interface{}{userID, time.Now().UTC()}
+	if filter.UpdatedFrom != nil {
+		where = append(where, "updated_at >= ?")
+		args = append(args, filter.UpdatedFrom.UTC())
+	}
+	if filter.UpdatedTo != nil {
+		where = append(where, "updated_at <= ?")
+		args = append(args, filter.UpdatedTo.UTC())
+	}
+	if filter.Collection != nil {
+		where = append(where, "collection = ?")
+		args = append(args, *filter.Collection)
+	}
+	if filter.After != nil {
+		where = append(where, "blob_name > ?")
+		args = append(args, *filter.After)
+	}
+	order := "blob_name"
+	if filter.ByCollection {
+		order = "collection, blob_name"
+	}
+	if filter.SinceSeq != nil {
+		where = append(where, "seq > ?")
+		args = append(args, *filter.SinceSeq)
+		order = "seq"
+	}
+	if filter.Before != nil {
+		where = append(where, "blob_name < ?")
+		args = append(args, *filter.Before)
+		order = "blob_name DESC"
+	}
+
+	ciphertextColumn := blobCiphertext
+	if filter.SkipSize {
+		ciphertextColumn = `''`
+	}
+	query := `
+		SELECT blob_name, encrypted_name, collection, updated_at, ` + ciphertextColumn + `, content_decoded_size,
+		       expires_at, pinned, version, seq
+		FROM blobs
+		WHERE ` + strings.Join(where, " AND ") + `
+		ORDER BY ` + order
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	var blobs []models.BlobListItem
+	err := db.queryEach(query, args, func(rows *sql.Rows) error {
+		var item models.BlobListItem
+		var ciphertext string
+		var decodedSize sql.NullInt64
+
+		if err := rows.Scan(&item.BlobName, encryptedNameScanner{&item.EncryptedName}, &item.Collection, &item.UpdatedAt, &ciphertext, &decodedSize, &item.ExpiresAt, &item.Pinned, &item.Version, &item.Seq); err != nil {
+			return fmt.Errorf("failed to scan blob: %w", err)
+		}
+
+		// Calculate encrypted size from base64 ciphertext; content in the
+		// blob store had its size recorded when written
+		if !filter.SkipSize && decodedSize.Valid {
+			item.EncryptedSize = int(decodedSize.Int64)
+		} else if !filter.SkipSize {
+			decoded, err := base64.StdEncoding.DecodeString(ciphertext)
+			if err == nil {
+				item.EncryptedSize = len(decoded)
+			}
+		}
+
+		blobs = append(blobs, item)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blobs: %w", err)
+	}
+
+	// A Before page was read backwards
+	if filter.Before != nil {
+		slices.Reverse(blobs)
+	}
+
+	return blobs, nil
+}
+
+// BlobSeq returns the last value of the server-wide change sequence. Read it
+// before listing with BlobFilter.SinceSeq: every write committed later gets a
+// higher value.
+func (db *DB) BlobSeq() (int64, error) {
+	var seq int64
+	if err := db.conn.QueryRow(`SELECT value FROM blob_seq WHERE id = 1`).Scan(&seq); err != nil {
+		return 0, fmt.Errorf("failed to get change sequence: %w", err)
+	}
+	return seq, nil
+}
+
+// BlobListStamp summarizes a user's unexpired blobs as their highest seq and
+// their count, from one aggregate over the (user_id, seq) index. Any write
+// raises the seq and any delete or expiry lowers the count, so an unchanged
+// stamp means an unchanged list.
+func (db *DB) BlobListStamp(userID int64) (maxSeq, count int64, err error) {
+	defer db.observe("BlobListStamp", userID, time.Now())
+
+	err = db.conn.QueryRow(`
+		SELECT COALESCE(MAX(seq), 0), COUNT(*)
+		FROM blobs
+		WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ? OR pinned)
+	`, userID, time.Now().UTC()).Scan(&maxSeq, &count)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to stamp blob list: %w", err)
+	}
+	return maxSeq, count, nil
+}
+
+// ListBlobChanges returns a user's unexpired blobs and tombstones with seq
+// above sinceSeq, in seq order, as one delta. A limit of 0 returns all.
+func (db *DB) ListBlobChanges(userID int64, sinceSeq int64, limit int) ([]models.BlobChange, error) {
+	defer db.observe("ListBlobChanges", userID, time.Now())
+
+	query := `
+		SELECT blob_name, seq, ?, version FROM blobs
+		WHERE user_id = ? AND seq > ? AND (expires_at IS NULL OR expires_at > ? OR pinned)
+		UNION ALL
+		SELECT blob_name, seq, ?, 0 FROM blob_tombstones
+		WHERE user_id = ? AND seq > ?
+		ORDER BY 2`
+	args := []interface{}{
+		models.BlobChangeUpsert, userID, sinceSeq, time.Now().UTC(),
+		models.BlobChangeDelete, userID, sinceSeq,
+	}
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	var changes []models.BlobChange
+	err := db.queryEach(query, args, func(rows *sql.Rows) error {
+		var change models.BlobChange
+		if err := rows.Scan(&change.BlobName, &change.Seq, &change.Op, &change.Version); err != nil {
+			return fmt.Errorf("failed to scan blob change: %w", err)
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blob changes: %w", err)
+	}
+
+	return changes, nil
+}
+
+// BlobNameVersion is a blob's name and version without its content
+type BlobNameVersion struct {
+	BlobName string
+	Version  int64
+}
+
+// ListBlobVersions returns the name and version of each unexpired blob,
+// ordered by name in byte order, without reading any ciphertext
+func (db *DB) ListBlobVersions(userID int64) ([]BlobNameVersion, error) {
+	defer db.observe("ListBlobVersions", userID, time.Now())
+
+	var blobs []BlobNameVersion
+	err := db.queryEach(`
+		SELECT blob_name, version
+		FROM blobs
+		WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ? OR pinned)
+		ORDER BY blob_name
+	`, []interface{}{userID, time.Now().UTC()}, func(rows *sql.Rows) error {
+		var blob BlobNameVersion
+		if err := rows.Scan(&blob.BlobName, &blob.Version); err != nil {
+			return fmt.Errorf("failed to scan blob version: %w", err)
+		}
+		blobs = append(blobs, blob)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blob versions: %w", err)
+	}
+
+	return blobs, nil
+}
+
+// MaxBlobVersionsNames is the most names one BlobVersions call can look up:
+// SQLite binds at most 32766 parameters per statement, and two of them are
+// taken by the user and the current time
+const MaxBlobVersionsNames = 32766 - 2
+
+// BlobVersions returns the version of each of a user's unexpired blobs among
+// names, keyed by name, from one metadata query. Names without such a blob
+// are left out. Callers must pass at most MaxBlobVersionsNames names.
+func (db *DB) BlobVersions(userID int64, names []string) (map[string]int64, error) {
+	defer db.observe("BlobVersions", userID, time.Now())
+
+	versions := make(map[string]int64, len(names))
+	if len(names) == 0 {
+		return versions, nil
+	}
+
+	args := []interface{}{userID, time.Now().UTC()}
+	for _, name := range names {
+		args = append(args, name)
+	}
+	err := db.queryEach(`
+		SELECT blob_name, version
+		FROM blobs
+		WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ? OR pinned)
+		  AND blob_name IN (?`+strings.Repeat(", ?", len(names)-1)+`)
+	`, args, func(rows *sql.Rows) error {
+		var name string
+		var version int64
+		if err := rows.Scan(&name, &version); err != nil {
+			return fmt.Errorf("failed to scan blob version: %w", err)
+		}
+		versions[name] = version
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob versions: %w", err)
+	}
+	return versions, nil
+}
+
+// EachBlob calls fn for each of the user's unexpired blobs, ciphertext
+// included, in id order and without loading them all into memory. An error
+// from fn stops the scan and is returned as is.
+func (db *DB) EachBlob(userID int64, fn func(*models.Blob) error) error {
+	defer db.observe("EachBlob", userID, time.Now())
+	defer db.holdBlobContent()()
+
+	var fnErr error
+	err := db.queryEach(`
+		SELECT id, user_id, blob_name, encrypted_blob_nonce, `+blobCiphertext+`,
+		       encrypted_blob_tag, encrypted_blob_alg, encrypted_name, collection, COALESCE(checksum, ''),
+		       version, expires_at, pinned, created_at, updated_at, content_ref
+		FROM blobs
+		WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ? OR pinned)
+		ORDER BY id
+	`, []interface{}{userID, time.Now().UTC()}, func(rows *sql.Rows) error {
+		blob := &models.Blob{}
+		var contentRef sql.NullString
+		if err := rows.Scan(
+			&blob.ID,
+			&blob.UserID,
+			&blob.BlobName,
+			&blob.EncryptedBlob.Nonce,
+			&blob.EncryptedBlob.Ciphertext,
+			&blob.EncryptedBlob.Tag,
+			&blob.EncryptedBlob.Alg,
+			encryptedNameScanner{&blob.EncryptedName},
+			&blob.Collection,
+			&blob.Checksum,
+			&blob.Version,
+			&blob.ExpiresAt,
+			&blob.Pinned,
+			&blob.CreatedAt,
+			&blob.UpdatedAt,
+			&contentRef,
+		); err != nil {
+			return fmt.Errorf("failed to scan blob: %w", err)
+		}
+		if err := db.loadBlobContent(contentRef, &blob.EncryptedBlob); err != nil {
+			return err
+		}
+		fnErr = fn(blob)
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list blobs: %w", err)
+	}
+	return nil
+}
+
+// CountBlobsByAlg returns the number of unexpired blobs across all users per
+// container algorithm; blobs stored without one are counted under ""
+func (db *DB) CountBlobsByAlg() (map[string]int64, error) {
+	defer db.observe("CountBlobsByAlg", 0, time.Now())
+
+	counts := make(map[string]int64)
+	err := db.queryEach(`
+		SELECT encrypted_blob_alg, COUNT(*)
+		FROM blobs
+		WHERE expires_at IS NULL OR expires_at > ? OR pinned
+		GROUP BY encrypted_blob_alg
+	`, []interface{}{time.Now().UTC()}, func(rows *sql.Rows) error {
+		var alg string
+		var count int64
+		if err := rows.Scan(&alg, &count); err != nil {
+			return fmt.Errorf("failed to scan blob count: %w", err)
+		}
+		counts[alg] = count
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to count blobs: %w", err)
+	}
+
+	return counts, nil
+}
+
+// CountBlobsByCollection returns the number of unexpired blobs in each of the
+// user's collections; blobs in the default collection are counted under ""
+func (db *DB) CountBlobsByCollection(userID int64) (map[string]int64, error) {
+	defer db.observe("CountBlobsByCollection", userID, time.Now())
+
+	counts := make(map[string]int64)
+	err := db.queryEach(`
+		SELECT collection, COUNT(*)
+		FROM blobs
+		WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ? OR pinned)
+		GROUP BY collection
+	`, []interface{}{userID, time.Now().UTC()}, func(rows *sql.Rows) error {
+		var collection string
+		var count int64
+		if err := rows.Scan(&collection, &count); err != nil {
+			return fmt.Errorf("failed to scan blob count: %w", err)
+		}
+		counts[collection] = count
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to count blobs: %w", err)
+	}
+
+	return counts, nil
+}
+
+// DeleteBlob deletes a blob by user ID and blob name. A lock on the blob held
+// for another session than writer's yields ErrBlobLocked.
+func (db *DB) DeleteBlob(userID int64, blobName string, writer Writer) error {
+	defer db.observe("DeleteBlob", userID, time.Now())
+
+	var rowsAffected int64
+	err := db.retryBusy("DeleteBlob", func() error {
+		tx, err := db.beginRetryTx()
+		if err != nil {
+			return err
+		}
+		defer func() { _ = tx.Rollback() }()
+
+		if err := checkBlobLock(tx, userID, blobName, writer); err != nil {
+			return err
+		}
+		result, err := tx.Exec(`DELETE FROM blobs WHERE user_id = ? AND blob_name = ?`, userID, blobName)
+		if err != nil {
+			return err
+		}
+		if rowsAffected, err = result.RowsAffected(); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err == ErrBlobLocked {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	db.blobs.invalidate(userID, blobName)
+	db.collectBlobContent()
+
+	if rowsAffected == 0 {
+		return ErrBlobNotFound
+	}
+
+	return nil
+}
+
+// DeleteBlobIfVersion deletes a blob only if its version is one of versions.
+// It returns ErrVersionMismatch if the blob exists at another version, and
+// ErrBlobNotFound if it does not exist. A lock on the blob held for another
+// session than writer's yields ErrBlobLocked.
+func (db *DB) DeleteBlobIfVersion(userID int64, blobName string, versions []int64, writer Writer) error {
+	defer db.observe("DeleteBlobIfVersion", userID, time.Now())
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin delete: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := checkBlobLock(tx, userID, blobName, writer); err != nil {
+		return err
+	}
+	var rowsAffected int64
+	if len(versions) > 0 {
+		args := []interface{}{userID, blobName}
+		for _, version := range versions {
+			args = append(args, version)
+		}
+		result, err := tx.Exec(
+			`DELETE FROM blobs WHERE user_id = ? AND blob_name = ? AND version IN (?`+strings.Repeat(", ?", len(versions)-1)+`)`,
+			args...,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to delete blob: %w", err)
+		}
+		if rowsAffected, err = result.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+	}
+	if rowsAffected > 0 {
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit delete: %w", err)
+		}
+		db.blobs.invalidate(userID, blobName)
+		db.collectBlobContent()
+		return nil
+	}
+
+	var exists bool
+	err = tx.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM blobs WHERE user_id = ? AND blob_name = ?)`,
+		userID, blobName,
+	).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to look up blob: %w", err)
+	}
+	if exists {
+		return ErrVersionMismatch
+	}
+	return ErrBlobNotFound
+}
+
+// liveBlobID returns the id of a user's unexpired blob, or ErrBlobNotFound
+func liveBlobID(q querier, userID int64, blobName string, now time.Time) (int64, error) {
+	var id int64
+	err := q.QueryRow(
+		`SELECT id FROM blobs WHERE user_id = ? AND blob_name = ? AND (expires_at IS NULL OR expires_at > ? OR pinned)`,
+		userID, blobName, now,
+	).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrBlobNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up blob: %w", err)
+	}
+	return id, nil
+}
+
+// liveBlobLock returns the unexpired lock on a blob, or nil if there is none
+func liveBlobLock(q querier, blobID int64, now time.Time) (*models.BlobLock, error) {
+	lock := &models.BlobLock{}
+	err := q.QueryRow(
+		`SELECT holder, expires_at FROM blob_locks WHERE blob_id = ? AND expires_at > ?`,
+		blobID, now,
+	).Scan(&lock.Holder, &lock.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up blob lock: %w", err)
+	}
+	return lock, nil
+}
+
+// Writer is the session a blob write is made for. A blob locked by another
+// session cannot be written unless Force is set; the zero Writer can only
+// write unlocked blobs.
+type Writer struct {
+	Session string
+	Force   bool
+}
+
+// checkBlobLock returns ErrBlobLocked if a session other than writer's holds
+// an unexpired lock on a user's blob. It runs in the write's transaction, so
+// a lock cannot be taken between the check and the write.
+func checkBlobLock(q querier, userID int64, blobName string, writer Writer) error {
+	if writer.Force {
+		return nil
+	}
+	var holder string
+	err := q.QueryRow(`
+		SELECT l.holder
+		FROM blob_locks l JOIN blobs b ON b.id = l.blob_id
+		WHERE b.user_id = ? AND b.blob_name = ? AND l.expires_at > ?
+	`, userID, blobName, time.Now().UTC()).Scan(&holder)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check blob lock: %w", err)
+	}
+	if holder != writer.Session {
+		return ErrBlobLocked
+	}
+	return nil
+}
+
+// AcquireBlobLock locks a blob for holder until ttl from now. A holder
+// re-acquiring its own lock extends it. If another holder has an unexpired
+// lock, it returns that lock with ErrBlobLocked.
+func (db *DB) AcquireBlobLock(userID int64, blobName, holder string, ttl time.Duration) (*models.BlobLock, error) {
+	defer db.observe("AcquireBlobLock", userID, time.Now())
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin lock: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := time.Now().UTC()
+	blobID, err := liveBlobID(tx, userID, blobName, now)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := liveBlobLock(tx, blobID, now)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Holder != holder {
+		existing.BlobName = blobName
+		return existing, ErrBlobLocked
+	}
+
+	lock := &models.BlobLock{BlobName: blobName, Holder: holder, ExpiresAt: models.NewTimestamp(now.Add(ttl))}
+	if _, err := tx.Exec(`
+		INSERT INTO blob_locks (blob_id, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(blob_id) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+	`, blobID, holder, lock.ExpiresAt); err != nil {
+		return nil, fmt.Errorf("failed to store blob lock: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit lock: %w", err)
+	}
+	return lock, nil
+}
+
+// ReleaseBlobLock removes holder's lock on a blob. Releasing a blob that is
+// not locked is a no-op; an unexpired lock held by someone else yields
+// ErrBlobLocked unless force is set.
+func (db *DB) ReleaseBlobLock(userID int64, blobName, holder string, force bool) error {
+	defer db.observe("ReleaseBlobLock", userID, time.Now())
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin unlock: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := time.Now().UTC()
+	blobID, err := liveBlobID(tx, userID, blobName, now)
+	if err != nil {
+		return err
+	}
+	existing, err := liveBlobLock(tx, blobID, now)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Holder != holder && !force {
+		return ErrBlobLocked
+	}
+
+	if _, err := tx.Exec(`DELETE FROM blob_locks WHERE blob_id = ?`, blobID); err != nil {
+		return fmt.Errorf("failed to delete blob lock: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit unlock: %w", err)
+	}
+	return nil
+}
+
+// GetBlobLock returns the unexpired lock on a blob, or nil if it is unlocked
+// or does not exist
+func (db *DB) GetBlobLock(userID int64, blobName string) (*models.BlobLock, error) {
+	defer db.observe("GetBlobLock", userID, time.Now())
+
+	lock := &models.BlobLock{BlobName: blobName}
+	err := db.conn.QueryRow(`
+		SELECT l.holder, l.expires_at
+		FROM blob_locks l JOIN blobs b ON b.id = l.blob_id
+		WHERE b.user_id = ? AND b.blob_name = ? AND l.expires_at > ?
+	`, userID, blobName, time.Now().UTC()).Scan(&lock.Holder, &lock.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob lock: %w", err)
+	}
+	return lock, nil
+}
+
+// DeleteExpiredBlobs removes all unpinned blobs whose expiry is at or before now
+func (db *DB) DeleteExpiredBlobs(now time.Time) (int64, error) {
+	defer db.observe("DeleteExpiredBlobs", 0, time.Now())
+
+	result, err := db.conn.Exec(`DELETE FROM blobs WHERE expires_at IS NOT NULL AND expires_at <= ? AND NOT pinned`, now.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired blobs: %w", err)
+	}
+	db.collectBlobContent()
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return deleted, nil
+}
+
+// RunExpirySweeper deletes expired blobs every interval until ctx is cancelled
+func (db *DB) RunExpirySweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			deleted, err := db.DeleteExpiredBlobs(now)
+			if err != nil {
+				log.Printf("Expiry sweep failed: %v", err)
+				continue
+			}
+			if deleted > 0 {
+				log.Printf("Expiry sweep deleted %d blob(s)", deleted)
+			}
+		}
+	}
+}
+
+// RunStorageMetrics refreshes the per-user storage gauge now and then every
+// interval until ctx is cancelled
+func (db *DB) RunStorageMetrics(ctx context.Context, interval time.Duration, top int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := db.RefreshStorageMetrics(top); err != nil {
+			log.Printf("Storage metrics refresh failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// backupStepPages is how many pages one backup step copies. The source is
+// only locked during a step, so writers can commit between steps.
+const backupStepPages = 256
+
+// backupStepPause gives waiting writers a chance to take the lock between steps
+const backupStepPause = 5 * time.Millisecond
+
+// backupPrefix and backupSuffix frame the timestamped names of backup files;
+// a snapshot of the blob store goes in a directory named like the file but
+// with backupBlobsSuffix
+const (
+	backupPrefix      = "cryptd-"
+	backupSuffix      = ".db"
+	backupBlobsSuffix = ".blobs"
+)
+
+// BackupInfo describes a written backup file
+type BackupInfo struct {
+	Path          string           `json:"path"`
+	BlobStorePath string           `json:"blobStorePath,omitempty"`
+	SizeBytes     int64            `json:"sizeBytes"`
+	CreatedAt     models.Timestamp `json:"createdAt"`
+}
+
+// Backup copies the database to path with SQLite's online backup API. The copy
+// is written next to path and renamed into place, so path never holds a
+// partial backup.
+func (db *DB) Backup(ctx context.Context, path string) error {
+	conn, err := db.conn.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	tmp := path + ".tmp"
+	_ = os.Remove(tmp)
+
+	err = conn.Raw(func(driverConn any) error {
+		source, ok := driverConn.(interface {
+			NewBackup(string) (*sqlite.Backup, error)
+		})
+		if !ok {
+			return errors.New("driver does not support online backup")
+		}
+
+		backup, err := source.NewBackup(tmp)
+		if err != nil {
+			return err
+		}
+		for {
+			more, err := backup.Step(backupStepPages)
+			if err != nil {
+				_ = backup.Finish()
+				return err
+			}
+			if !more {
+				return backup.Finish()
+			}
+			select {
+			case <-ctx.Done():
+				_ = backup.Finish()
+				return ctx.Err()
+			case <-time.After(backupStepPause):
+			}
+		}
+	})
+	if err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to back up database: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to move backup into place: %w", err)
+	}
+
+	return nil
+}
+
+// BackupToDir writes a timestamped backup into dir and then deletes all but
+// the newest retention backups there; retention 0 keeps every backup. With a
+// blob store, the store is snapshotted next to the file, and content the
+// backup references is not collected until the snapshot is complete.
+func (db *DB) BackupToDir(ctx context.Context, dir string, retention int, now time.Time) (*BackupInfo, error) {
+	db.backupMu.Lock()
+	defer db.backupMu.Unlock()
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	// Millisecond timestamps keep names unique and make them sort by age
+	name := backupPrefix + now.UTC().Format("20060102T150405.000Z") + backupSuffix
+	path := filepath.Join(dir, name)
+	store := db.options.BlobStore
+	if store != nil {
+		db.contentMu.RLock()
+		defer db.contentMu.RUnlock()
+	}
+	if err := db.Backup(ctx, path); err != nil {
+		return nil, err
+	}
+
+	var storePath string
+	if store != nil {
+		storePath = strings.TrimSuffix(path, backupSuffix) + backupBlobsSuffix
+		if err := store.Snapshot(storePath); err != nil {
+			_ = os.Remove(path)
+			return nil, err
+		}
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat backup: %w", err)
+	}
+
+	if retention > 0 {
+		if err := pruneBackups(dir, retention); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Backup written to %s (%d bytes) in %s", path, stat.Size(), time.Since(now).Round(time.Millisecond))
+	return &BackupInfo{Path: path, BlobStorePath: storePath, SizeBytes: stat.Size(), CreatedAt: models.NewTimestamp(now)}, nil
+}
+
+// pruneBackups deletes the oldest backups in dir, with their blob store
+// snapshots, until at most keep remain
+func pruneBackups(dir string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			names = append(names, name)
+		}
+	}
+	if len(names) <= keep {
+		return nil
+	}
+
+	sort.Strings(names)
+	for _, name := range names[:len(names)-keep] {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("failed to delete old backup: %w", err)
+		}
+		blobs := filepath.Join(dir, strings.TrimSuffix(name, backupSuffix)+backupBlobsSuffix)
+		if err := os.RemoveAll(blobs); err != nil {
+			return fmt.Errorf("failed to delete old blob store snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// RunBackups writes a backup into dir every interval until ctx is cancelled
+func (db *DB) RunBackups(ctx context.Context, dir string, interval time.Duration, retention int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := db.BackupToDir(ctx, dir, retention, now); err != nil {
+				log.Printf("Backup failed: %v", err)
+			}
+		}
+	}
+}
+
+// CreateSession records an issued token. When the table already holds
+// Options.MaxSessions rows, it first evicts expired sessions and then the
+// globally oldest ones, so a login flood cannot grow it without bound.
+func (db *DB) CreateSession(session *models.Session) error {
+	defer db.observe("CreateSession", session.UserID, time.Now())
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin session creation: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var evicted int64
+	if db.options.MaxSessions > 0 {
+		result, err := tx.Exec(`
+			DELETE FROM sessions WHERE id IN (
+				SELECT id FROM sessions
+				ORDER BY expires_at <= ? DESC, created_at, id
+				LIMIT max(0, (SELECT COUNT(*) FROM sessions) - ?)
+			)
+		`, session.CreatedAt, db.options.MaxSessions-1)
+		if err != nil {
+			return fmt.Errorf("failed to evict sessions: %w", err)
+		}
+		if evicted, err = result.RowsAffected(); err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+	}
+
+	session.LastUsedAt = session.CreatedAt
+	_, err = tx.Exec(`
+		INSERT INTO sessions (id, user_id, label, scope, created_at, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, session.ID, session.UserID, session.Label, session.Scope, session.CreatedAt, session.LastUsedAt, session.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit session: %w", err)
+	}
+
+	if evicted > 0 {
+		log.Printf("Warning: session store full (max %d), evicted %d oldest session(s)", db.options.MaxSessions, evicted)
+	}
+	return nil
+}
+
+// ListSessions returns a user's unexpired sessions, newest first
+func (db *DB) ListSessions(userID int64) ([]models.Session, error) {
+	defer db.observe("ListSessions", userID, time.Now())
+
+	sessions := []models.Session{}
+	err := db.queryEach(`
+		SELECT id, user_id, label, scope, created_at, COALESCE(last_used_at, created_at), expires_at
+		FROM sessions
+		WHERE user_id = ? AND expires_at > ?
+		ORDER BY created_at DESC, id
+	`, []interface{}{userID, time.Now().UTC()}, func(rows *sql.Rows) error {
+		var session models.Session
+		if err := rows.Scan(&session.ID, &session.UserID, &session.Label, &session.Scope, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt); err != nil {
+			return fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, session)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// SessionSummary counts the user's unexpired sessions and finds the latest
+// use of any of them, in one aggregate over the user's sessions index
+func (db *DB) SessionSummary(userID int64) (*models.SessionSummary, error) {
+	defer db.observe("SessionSummary", userID, time.Now())
+
+	summary := &models.SessionSummary{}
+	var lastActive sql.NullString
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*), MAX(COALESCE(last_used_at, created_at))
+		FROM sessions
+		WHERE user_id = ? AND expires_at > ?
+	`, userID, time.Now().UTC()).Scan(&summary.Active, &lastActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize sessions: %w", err)
+	}
+	if lastActive.Valid {
+		summary.LastActiveAt = &models.Timestamp{}
+		if err := summary.LastActiveAt.Scan(lastActive.String); err != nil {
+			return nil, fmt.Errorf("failed to parse last activity: %w", err)
+		}
+	}
+	return summary, nil
+}
+
+// RecordSessionUse sets a session's last_used_at to now, unless it is already
+// within resolution of now. Authenticated requests call it on every use, so the
+// resolution bounds it to one write per session per interval.
+func (db *DB) RecordSessionUse(sessionID string, now time.Time, resolution time.Duration) error {
+	defer db.observe("RecordSessionUse", 0, time.Now())
+
+	now = now.UTC()
+	if _, err := db.conn.Exec(`
+		UPDATE sessions SET last_used_at = ?
+		WHERE id = ? AND (last_used_at IS NULL OR last_used_at <= ?)
+	`, now, sessionID, now.Add(-resolution)); err != nil {
+		return fmt.Errorf("failed to record session use: %w", err)
+	}
+	return nil
+}
+
+// UpdateSessionLabel renames one of the user's unexpired sessions
+func (db *DB) UpdateSessionLabel(userID int64, sessionID, label string) (*models.Session, error) {
+	defer db.observe("UpdateSessionLabel", userID, time.Now())
+
+	session := &models.Session{}
+	err := db.conn.QueryRow(`
+		UPDATE sessions SET label = ?
+		WHERE id = ? AND user_id = ? AND expires_at > ?
+		RETURNING id, user_id, label, scope, created_at, COALESCE(last_used_at, created_at), expires_at
+	`, label, sessionID, userID, time.Now().UTC()).Scan(
+		&session.ID, &session.UserID, &session.Label, &session.Scope, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update session: %w", err)
+	}
+
+	return session, nil
+}
+
+// RevokeSessions bumps the user's session epoch, so every token issued so far
+// is rejected, and deletes their session records. It returns the number of
+// sessions deleted.
+func (db *DB) RevokeSessions(userID int64) (int64, error) {
+	defer db.observe("RevokeSessions", userID, time.Now())
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin session revocation: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	result, err := tx.Exec(`UPDATE users SET session_epoch = session_epoch + 1 WHERE id = ?`, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to bump session epoch: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return 0, ErrUserNotFound
+	}
+
+	result, err = tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete sessions: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit session revocation: %w", err)
+	}
+	return deleted, nil
+}
+
+// CreateInvite stores a new unused invite code
+func (db *DB) CreateInvite(code string) (*models.Invite, error) {
+	defer db.observe("CreateInvite", 0, time.Now())
+
+	invite := &models.Invite{Code: code, CreatedAt: models.NewTimestamp(time.Now())}
+	if _, err := db.conn.Exec(`INSERT INTO invites (code, created_at) VALUES (?, ?)`, invite.Code, invite.CreatedAt); err != nil {
+		return nil, fmt.Errorf("failed to create invite: %w", err)
+	}
+
+	return invite, nil
+}
+
+// RevokeInvite deletes an unused invite code. Used codes are kept as a record
+// of who registered with them, so revoking one yields ErrInviteNotFound.
+func (db *DB) RevokeInvite(code string) error {
+	defer db.observe("RevokeInvite", 0, time.Now())
+
+	result, err := db.conn.Exec(`DELETE FROM invites WHERE code = ? AND used_at IS NULL`, code)
+	if err != nil {
+		return fmt.Errorf("failed to revoke invite: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rows == 0 {
+		return ErrInviteNotFound
+	}
+
+	return nil
+}
+
+// PutKeyEscrow stores or replaces the user's escrowed account key
+func (db *DB) PutKeyEscrow(userID int64, escrowedAccountKey models.Container) (*models.KeyEscrow, error) {
+	defer db.observe("PutKeyEscrow", userID, time.Now())
+
+	escrow := &models.KeyEscrow{UserID: userID, EscrowedAccountKey: escrowedAccountKey, UpdatedAt: models.NewTimestamp(time.Now())}
+	_, err := db.conn.Exec(`
+		INSERT INTO key_escrow (user_id, nonce, ciphertext, tag, alg, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET
+			nonce = excluded.nonce, ciphertext = excluded.ciphertext, tag = excluded.tag,
+			alg = excluded.alg, updated_at = excluded.updated_at
+	`, userID, escrowedAccountKey.Nonce, escrowedAccountKey.Ciphertext, escrowedAccountKey.Tag, escrowedAccountKey.Alg, escrow.UpdatedAt)
+	if isForeignKeyViolation(err) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to store key escrow: %w", err)
+	}
+
+	return escrow, nil
+}
+
+// GetKeyEscrow returns the user's escrowed account key, ErrUserNotFound for an
+// unknown user or ErrEscrowNotFound if the user has none
+func (db *DB) GetKeyEscrow(userID int64) (*models.KeyEscrow, error) {
+	defer db.observe("GetKeyEscrow", userID, time.Now())
+
+	var escrow models.KeyEscrow
+	var nonce, ciphertext, tag, alg sql.NullString
+	var updatedAt *models.Timestamp
+	err := db.conn.QueryRow(`
+		SELECT u.id, e.nonce, e.ciphertext, e.tag, e.alg, e.updated_at
+		FROM users u LEFT JOIN key_escrow e ON e.user_id = u.id
+		WHERE u.id = ?
+	`, userID).Scan(&escrow.UserID, &nonce, &ciphertext, &tag, &alg, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key escrow: %w", err)
+	}
+	if updatedAt == nil {
+		return nil, ErrEscrowNotFound
+	}
+
+	escrow.EscrowedAccountKey = models.Container{Nonce: nonce.String, Ciphertext: ciphertext.String, Tag: tag.String, Alg: alg.String}
+	escrow.UpdatedAt = *updatedAt
+	return &escrow, nil
+}
+
+// RecordAuditEvent appends an event to the audit trail, filling in its ID and,
+// if unset, CreatedAt
+func (db *DB) RecordAuditEvent(event *models.AuditEvent) error {
+	var userID int64
+	if event.UserID != nil {
+		userID = *event.UserID
+	}
+	defer db.observe("RecordAuditEvent", userID, time.Now())
+
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = models.NewTimestamp(time.Now())
+	}
+	err := db.conn.QueryRow(`
+		INSERT INTO audit_events (event_type, user_id, ip, detail, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		RETURNING id
+	`, event.Type, event.UserID, event.IP, event.Detail, event.CreatedAt).Scan(&event.ID)
+	if err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+	return nil
+}
+
+// DeleteAuditEventsBefore removes audit events created before cutoff
+func (db *DB) DeleteAuditEventsBefore(cutoff time.Time) (int64, error) {
+	defer db.observe("DeleteAuditEventsBefore", 0, time.Now())
+
+	result, err := db.conn.Exec(`DELETE FROM audit_events WHERE created_at < ?`, cutoff.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old audit events: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	return deleted, nil
+}
+
+// RunAuditRetention deletes audit events older than retention now and then
+// every interval until ctx is cancelled. Failed logins are recorded for anyone
+// who asks, so without it the table grows without bound.
+func (db *DB) RunAuditRetention(ctx context.Context, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := db.DeleteAuditEventsBefore(time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Audit retention sweep failed: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Audit retention sweep deleted %d event(s)", deleted)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// AuditFilter selects a range of audit events in id order
+type AuditFilter struct {
+	// Since, if set, skips events created before it
+	Since *time.Time
+	// AfterID skips events up to and including this id
+	AfterID int64
+	// Limit caps the number of events; 0 means no cap
+	Limit int
+}
+
+// where builds the WHERE clause shared by the audit event queries
+func (f AuditFilter) where() (string, []interface{}) {
+	where := "id > ?"
+	args := []interface{}{f.AfterID}
+	if f.Since != nil {
+		where += " AND created_at >= ?"
+		args = append(args, f.Since.UTC())
+	}
+	return where, args
+}
+
+// AuditCursor is a keyset position in ListAuthEvents: the next page starts
+// with the events that sort after it
+type AuditCursor struct {
+	CreatedAt time.Time
+	ID        int64
+}
+
+// ListAuthEvents returns up to limit of the user's auth.* events, newest
+// first, after cursor (nil for the first page). Pages are keyed on
+// (created_at, id) rather than an offset, so deep pages cost the same as the
+// first and events recorded meanwhile do not shift them.
+func (db *DB) ListAuthEvents(userID int64, cursor *AuditCursor, limit int) ([]models.AuditEvent, error) {
+	defer db.observe("ListAuthEvents", userID, time.Now())
+
+	where := `user_id = ? AND event_type LIKE 'auth.%'`
+	args := []interface{}{userID}
+	if cursor != nil {
+		createdAt := cursor.CreatedAt.UTC()
+		where += ` AND (created_at < ? OR (created_at = ? AND id < ?))`
+		args = append(args, createdAt, createdAt, cursor.ID)
+	}
+	args = append(args, limit)
+
+	events := []models.AuditEvent{}
+	err := db.queryEach(`
+		SELECT id, event_type, user_id, ip, detail, created_at
+		FROM audit_events
+		WHERE `+where+`
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?
+	`, args, func(rows *sql.Rows) error {
+		var event models.AuditEvent
+		if err := rows.Scan(&event.ID, &event.Type, &event.UserID, &event.IP, &event.Detail, &event.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list auth events: %w", err)
+	}
+	return events, nil
+}
+
+// EachAuditEvent calls fn for each event matching filter, oldest first,
+// without loading them all into memory. An error from fn stops the scan and
+// is returned as is.
+func (db *DB) EachAuditEvent(filter AuditFilter, fn func(models.AuditEvent) error) error {
+	defer db.observe("EachAuditEvent", 0, time.Now())
+
+	where, args := filter.where()
+	query := `SELECT id, event_type, user_id, ip, detail, created_at FROM audit_events WHERE ` + where + ` ORDER BY id`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	var fnErr error
+	err := db.queryEach(query, args, func(rows *sql.Rows) error {
+		var event models.AuditEvent
+		if err := rows.Scan(&event.ID, &event.Type, &event.UserID, &event.IP, &event.Detail, &event.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan audit event: %w", err)
+		}
+		fnErr = fn(event)
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list audit events: %w", err)
+	}
+	return nil
+}
+
+// LastAuditEventID returns the id of the filter.Limit-th matching event, and
+// whether any event follows it. Exporters use it to fix a page's boundary, and
+// so its next link, before streaming the page.
+func (db *DB) LastAuditEventID(filter AuditFilter) (lastID int64, more bool, err error) {
+	defer db.observe("LastAuditEventID", 0, time.Now())
+
+	where, args := filter.where()
+	args = append(args, filter.Limit-1)
+
+	var ids []int64
+	err = db.queryEach(`SELECT id FROM audit_events WHERE `+where+` ORDER BY id LIMIT 2 OFFSET ?`, args, func(rows *sql.Rows) error {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("failed to scan audit event id: %w", err)
+		}
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to page audit events: %w", err)
+	}
+	if len(ids) == 0 {
+		return 0, false, nil
+	}
+	return ids[0], len(ids) == 2, nil
+}
@@ -1,9 +1,22 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
 	"github.com/shalteor/cryptd-poc/server/internal/models"
 )
 
@@ -236,6 +249,52 @@ func TestUpdateUser(t *testing.T) {
 	}
 }
 
+func TestUpdateUserConflict(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	// Two devices load the same revision
+	first, _ := db.GetUserByID(user.ID)
+	second, _ := db.GetUserByID(user.ID)
+	if first.Rev != 1 {
+		t.Fatalf("expected new user at rev 1, got %d", first.Rev)
+	}
+
+	first.LoginVerifierHash = []byte("first")
+	if err := db.UpdateUser(first); err != nil {
+		t.Fatalf("failed to update user: %v", err)
+	}
+	if first.Rev != 2 {
+		t.Errorf("expected rev 2 after update, got %d", first.Rev)
+	}
+
+	second.LoginVerifierHash = []byte("second")
+	if err := db.UpdateUser(second); err != ErrUserConflict {
+		t.Fatalf("expected ErrUserConflict for stale update, got %v", err)
+	}
+
+	stored, _ := db.GetUserByID(user.ID)
+	if string(stored.LoginVerifierHash) != "first" || stored.Rev != 2 {
+		t.Errorf("expected the first update to stand, got hash %q rev %d", stored.LoginVerifierHash, stored.Rev)
+	}
+
+	second.ID = 9999
+	if err := db.UpdateUser(second); err != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound for unknown user, got %v", err)
+	}
+}
+
 func TestUpsertBlob(t *testing.T) {
 	db := setupTestDB(t)
 	defer func() { _ = db.Close() }()
@@ -413,7 +472,7 @@ func TestListBlobs(t *testing.T) {
 	}
 
 	// List blobs
-	list, err := db.ListBlobs(user.ID)
+	list, err := db.ListBlobs(user.ID, BlobFilter{})
 	if err != nil {
 		t.Fatalf("failed to list blobs: %v", err)
 	}
@@ -470,7 +529,7 @@ func TestDeleteBlob(t *testing.T) {
 	}
 
 	// Delete blob
-	err = db.DeleteBlob(user.ID, "vault")
+	err = db.DeleteBlob(user.ID, "vault", Writer{})
 	if err != nil {
 		t.Fatalf("failed to delete blob: %v", err)
 	}
@@ -503,7 +562,7 @@ func TestDeleteBlobNotFound(t *testing.T) {
 		t.Fatalf("failed to create user: %v", err)
 	}
 
-	err = db.DeleteBlob(user.ID, "nonexistent")
+	err = db.DeleteBlob(user.ID, "nonexistent", Writer{})
 	if err != ErrBlobNotFound {
 		t.Errorf("expected ErrBlobNotFound, got %v", err)
 	}
@@ -514,3 +573,2367 @@ func TestMain(m *testing.M) {
 	code := m.Run()
 	os.Exit(code)
 }
+
+func TestUpsertBlobStoresChecksum(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	blob := &models.Blob{
+		UserID:        user.ID,
+		BlobName:      "vault",
+		EncryptedBlob: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+	}
+	if err := db.UpsertBlob(blob); err != nil {
+		t.Fatalf("failed to upsert blob: %v", err)
+	}
+
+	stored, err := db.GetBlob(user.ID, "vault")
+	if err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+	if stored.Checksum == "" || stored.Checksum != blob.Checksum {
+		t.Errorf("expected checksum %q, got %q", blob.Checksum, stored.Checksum)
+	}
+
+	checked, err := db.VerifyBlob(user.ID, "vault")
+	if err != nil {
+		t.Fatalf("expected intact blob, got %v", err)
+	}
+	if !checked {
+		t.Error("expected blob to be checked")
+	}
+}
+
+func TestVerifyBlobDetectsCorruption(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	for _, name := range []string{"intact", "corrupt", "legacy"} {
+		blob := &models.Blob{
+			UserID:        user.ID,
+			BlobName:      name,
+			EncryptedBlob: models.Container{Nonce: "nonce", Ciphertext: "ciphertext", Tag: "tag"},
+		}
+		_ = db.UpsertBlob(blob)
+	}
+
+	// Simulate a flipped bit in storage and a row written before checksums existed
+	if _, err := db.conn.Exec(`UPDATE blobs SET encrypted_blob_ciphertext = 'ciphertexu' WHERE blob_name = 'corrupt'`); err != nil {
+		t.Fatalf("failed to corrupt blob: %v", err)
+	}
+	if _, err := db.conn.Exec(`UPDATE blobs SET checksum = NULL WHERE blob_name = 'legacy'`); err != nil {
+		t.Fatalf("failed to clear checksum: %v", err)
+	}
+
+	if _, err := db.VerifyBlob(user.ID, "corrupt"); err != ErrBlobCorrupted {
+		t.Errorf("expected ErrBlobCorrupted, got %v", err)
+	}
+
+	checked, err := db.VerifyBlob(user.ID, "legacy")
+	if err != nil || checked {
+		t.Errorf("expected unchecked legacy blob, got checked=%v err=%v", checked, err)
+	}
+
+	report, err := db.ScrubBlobs()
+	if err != nil {
+		t.Fatalf("failed to scrub: %v", err)
+	}
+
+	if report.Scanned != 3 {
+		t.Errorf("expected 3 scanned, got %d", report.Scanned)
+	}
+	if report.Unchecksummed != 1 {
+		t.Errorf("expected 1 unchecksummed, got %d", report.Unchecksummed)
+	}
+	if len(report.Corrupted) != 1 || report.Corrupted[0].BlobName != "corrupt" {
+		t.Errorf("expected only 'corrupt' to be reported, got %+v", report.Corrupted)
+	}
+}
+
+func TestBlobCache(t *testing.T) {
+	options := DefaultOptions()
+	options.BlobCacheBytes = 1 << 20
+	db, err := NewWithOptions(":memory:", options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if err := db.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "index", EncryptedBlob: models.Container{Nonce: "n1", Ciphertext: "v1", Tag: "t"}}); err != nil {
+		t.Fatalf("failed to upsert blob: %v", err)
+	}
+
+	if _, err := db.GetBlob(user.ID, "index"); err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+
+	// Change the row behind the cache's back: a cached read must not see it
+	if _, err := db.conn.Exec(`UPDATE blobs SET encrypted_blob_ciphertext = 'changed' WHERE user_id = ?`, user.ID); err != nil {
+		t.Fatalf("failed to update row: %v", err)
+	}
+	hits := metrics.BlobCacheHits.Value()
+	blob, err := db.GetBlob(user.ID, "index")
+	if err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+	if blob.EncryptedBlob.Ciphertext != "v1" {
+		t.Errorf("expected the cached ciphertext, got %q", blob.EncryptedBlob.Ciphertext)
+	}
+	if got := metrics.BlobCacheHits.Value() - hits; got != 1 {
+		t.Errorf("expected 1 cache hit, got %d", got)
+	}
+
+	// An upsert invalidates the entry
+	if err := db.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "index", EncryptedBlob: models.Container{Nonce: "n2", Ciphertext: "v2", Tag: "t"}}); err != nil {
+		t.Fatalf("failed to upsert blob: %v", err)
+	}
+	misses := metrics.BlobCacheMisses.Value()
+	blob, err = db.GetBlob(user.ID, "index")
+	if err != nil {
+		t.Fatalf("failed to get blob: %v", err)
+	}
+	if blob.EncryptedBlob.Ciphertext != "v2" || blob.Version != 2 {
+		t.Errorf("expected version 2 after the upsert, got %q at version %d", blob.EncryptedBlob.Ciphertext, blob.Version)
+	}
+	if got := metrics.BlobCacheMisses.Value() - misses; got != 1 {
+		t.Errorf("expected 1 cache miss, got %d", got)
+	}
+
+	// So does a delete
+	if err := db.DeleteBlob(user.ID, "index", Writer{}); err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+	if _, err := db.GetBlob(user.ID, "index"); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound after delete, got %v", err)
+	}
+}
+
+func TestBlobCacheEviction(t *testing.T) {
+	cache := newBlobCache(3 * (blobCacheEntryOverhead + 10))
+	for i := 0; i < 4; i++ {
+		cache.add(&models.Blob{UserID: 1, BlobName: fmt.Sprintf("b%d", i), EncryptedBlob: models.Container{Ciphertext: "12345678"}}, 0)
+		if i == 2 {
+			// Reading b0 makes b1 the least recently used
+			if _, ok := cache.get(1, "b0"); !ok {
+				t.Fatal("expected b0 to be cached")
+			}
+		}
+	}
+
+	for name, want := range map[string]bool{"b0": true, "b1": false, "b2": true, "b3": true} {
+		if _, ok := cache.get(1, name); ok != want {
+			t.Errorf("%s: expected cached=%v", name, want)
+		}
+	}
+	if cache.bytes > cache.maxBytes {
+		t.Errorf("cache holds %d bytes, over its bound of %d", cache.bytes, cache.maxBytes)
+	}
+
+	// A read that raced an invalidation is not cached
+	gen := cache.generation()
+	cache.invalidate(1, "b4")
+	cache.add(&models.Blob{UserID: 1, BlobName: "b4"}, gen)
+	if _, ok := cache.get(1, "b4"); ok {
+		t.Error("expected a stale read not to be cached")
+	}
+}
+
+func TestQueriesReleaseConnections(t *testing.T) {
+	db, err := New(filepath.Join(t.TempDir(), "pool.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	// A single leaked connection would make the next query wait forever
+	db.conn.SetMaxOpenConns(2)
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		blob := &models.Blob{UserID: user.ID, BlobName: fmt.Sprintf("blob-%d", i), EncryptedBlob: models.Container{Nonce: fmt.Sprintf("n%d", i), Ciphertext: "Y2lwaGVy", Tag: "t"}}
+		if err := db.UpsertBlob(blob); err != nil {
+			t.Fatalf("failed to upsert blob: %v", err)
+		}
+	}
+
+	stop := errors.New("stop")
+	for i := 0; i < 500; i++ {
+		if _, err := db.ListBlobs(user.ID, BlobFilter{}); err != nil {
+			t.Fatalf("list %d failed: %v", i, err)
+		}
+		// Stopping a scan early must release the rows too
+		if err := db.EachBlob(user.ID, func(*models.Blob) error { return stop }); err != stop {
+			t.Fatalf("expected the callback error, got %v", err)
+		}
+	}
+
+	stats := db.conn.Stats()
+	if stats.InUse != 0 {
+		t.Errorf("expected no connections in use, got %d", stats.InUse)
+	}
+	if stats.OpenConnections > 2 {
+		t.Errorf("expected at most 2 open connections, got %d", stats.OpenConnections)
+	}
+	if stats.WaitCount != 0 {
+		t.Errorf("expected queries to reuse idle connections without waiting, waited %d times", stats.WaitCount)
+	}
+}
+
+func TestNewInitializesBlankFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blank.db")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatalf("failed to create blank file: %v", err)
+	}
+
+	db, err := New(path)
+	if err != nil {
+		t.Fatalf("failed to open blank file: %v", err)
+	}
+	version, err := schemaVersion(db.conn)
+	if err != nil || version != len(migrations) {
+		t.Errorf("expected schema version %d, got %d (%v)", len(migrations), version, err)
+	}
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	blob := &models.Blob{UserID: user.ID, BlobName: "vault", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Y2lwaGVy", Tag: "t"}}
+	if err := db.UpsertBlob(blob); err != nil {
+		t.Fatalf("failed to upsert blob: %v", err)
+	}
+
+	// A database from a newer server is refused on the next open, untouched
+	if _, err := db.conn.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, len(migrations)+1, time.Now().UTC()); err != nil {
+		t.Fatalf("failed to record future migration: %v", err)
+	}
+	_ = db.Close()
+
+	if _, err := New(path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+}
+
+func TestUsernameCaseModeSwitch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	open := func(caseInsensitive bool) (*DB, error) {
+		options := DefaultOptions()
+		options.CaseInsensitiveUsernames = caseInsensitive
+		return NewWithOptions(path, options)
+	}
+	create := func(db *DB, username string) error {
+		return db.CreateUser(&models.User{
+			Username:          username,
+			KDFType:           models.KDFTypePBKDF2SHA256,
+			KDFIterations:     600_000,
+			LoginVerifierHash: []byte("hash"),
+			WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+		})
+	}
+
+	db, err := open(false)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	for _, username := range []string{"Alice", "alice", "Bob"} {
+		if err := create(db, username); err != nil {
+			t.Fatalf("failed to create %s: %v", username, err)
+		}
+	}
+	if _, err := db.GetUserByUsername("bob"); err != ErrUserNotFound {
+		t.Errorf("expected case-sensitive lookup to miss, got %v", err)
+	}
+	_ = db.Close()
+
+	// Alice and alice would become one account
+	if _, err := open(true); !errors.Is(err, ErrUsernamesCollide) {
+		t.Fatalf("expected ErrUsernamesCollide, got %v", err)
+	}
+
+	db, _ = open(false)
+	user, _ := db.GetUserByUsername("alice")
+	if err := db.DeleteUser(user.ID); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	_ = db.Close()
+
+	db, err = open(true)
+	if err != nil {
+		t.Fatalf("failed to switch to case-insensitive usernames: %v", err)
+	}
+	if user, err := db.GetUserByUsername("BOB"); err != nil || user.Username != "Bob" {
+		t.Errorf("expected BOB to find Bob, got %+v (%v)", user, err)
+	}
+	if err := create(db, "ALICE"); err != ErrUserExists {
+		t.Errorf("expected ErrUserExists for ALICE, got %v", err)
+	}
+	params, err := db.GetKDFParamsByUsernames([]string{"bob", "BOB", "carol"})
+	if err != nil || len(params) != 2 {
+		t.Errorf("expected KDF params for both spellings of bob, got %v (%v)", params, err)
+	}
+	_ = db.Close()
+
+	// And back: lookups are exact again
+	db, err = open(false)
+	if err != nil {
+		t.Fatalf("failed to switch back: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+	if _, err := db.GetUserByUsername("BOB"); err != ErrUserNotFound {
+		t.Errorf("expected case-sensitive lookup to miss after switching back, got %v", err)
+	}
+}
+
+func TestUsernameReleaseHold(t *testing.T) {
+	options := DefaultOptions()
+	options.UsernameReleaseHold = time.Hour
+	db, err := NewWithOptions(":memory:", options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	newUser := func(username string) *models.User {
+		return &models.User{
+			Username:          username,
+			KDFType:           models.KDFTypePBKDF2SHA256,
+			KDFIterations:     600_000,
+			LoginVerifierHash: []byte("hash"),
+			WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+		}
+	}
+
+	alice := newUser("alice")
+	if err := db.CreateUser(alice); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if err := db.DeleteUser(alice.ID); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	if err := db.CreateUser(newUser("alice")); err != ErrUsernameCoolingDown {
+		t.Fatalf("expected ErrUsernameCoolingDown after deletion, got %v", err)
+	}
+
+	// Once the hold lapses the name is free again
+	if _, err := db.conn.Exec(`UPDATE released_usernames SET released_at = ?`, time.Now().UTC().Add(-2*time.Hour)); err != nil {
+		t.Fatalf("failed to age hold: %v", err)
+	}
+	if err := db.CreateUser(newUser("alice")); err != nil {
+		t.Errorf("expected alice to be available after the hold, got %v", err)
+	}
+
+	// Without a hold, names are released immediately and nothing is recorded
+	db.options.UsernameReleaseHold = 0
+	bob := newUser("bob")
+	_ = db.CreateUser(bob)
+	_ = db.DeleteUser(bob.ID)
+	if err := db.CreateUser(newUser("bob")); err != nil {
+		t.Errorf("expected bob to be available without a hold, got %v", err)
+	}
+	var held int
+	_ = db.conn.QueryRow(`SELECT COUNT(*) FROM released_usernames WHERE username_canonical = 'bob'`).Scan(&held)
+	if held != 0 {
+		t.Errorf("expected no hold recorded for bob, got %d", held)
+	}
+}
+
+func TestMigrationsAreRecorded(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	var version int
+	if err := db.conn.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatalf("failed to read schema version: %v", err)
+	}
+
+	if version != len(migrations) {
+		t.Errorf("expected schema version %d, got %d", len(migrations), version)
+	}
+}
+
+func TestBlobExpiry(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	past := models.NewTimestamp(time.Now().Add(-time.Minute))
+	future := models.NewTimestamp(time.Now().Add(time.Hour))
+
+	blobs := map[string]*models.Timestamp{"expired": &past, "ephemeral": &future, "permanent": nil}
+	for name, expiresAt := range blobs {
+		blob := &models.Blob{
+			UserID:        user.ID,
+			BlobName:      name,
+			EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Y2lwaGVy", Tag: "t"},
+			ExpiresAt:     expiresAt,
+		}
+		if err := db.UpsertBlob(blob); err != nil {
+			t.Fatalf("failed to upsert %s: %v", name, err)
+		}
+	}
+
+	if _, err := db.GetBlob(user.ID, "expired"); err != ErrBlobExpired {
+		t.Errorf("expected ErrBlobExpired, got %v", err)
+	}
+
+	ephemeral, err := db.GetBlob(user.ID, "ephemeral")
+	if err != nil {
+		t.Fatalf("failed to get unexpired blob: %v", err)
+	}
+	if ephemeral.ExpiresAt == nil || !ephemeral.ExpiresAt.Equal(future.Time) {
+		t.Errorf("expected expiresAt %v, got %v", future, ephemeral.ExpiresAt)
+	}
+
+	list, err := db.ListBlobs(user.ID, BlobFilter{})
+	if err != nil {
+		t.Fatalf("failed to list blobs: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expected 2 unexpired blobs, got %d", len(list))
+	}
+	for _, item := range list {
+		if item.BlobName == "expired" {
+			t.Error("expired blob should not be listed")
+		}
+	}
+
+	deleted, err := db.DeleteExpiredBlobs(time.Now())
+	if err != nil {
+		t.Fatalf("failed to sweep: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected 1 swept blob, got %d", deleted)
+	}
+
+	if _, err := db.GetBlob(user.ID, "expired"); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound after sweep, got %v", err)
+	}
+}
+
+func TestPinnedBlobsDoNotExpire(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	upsert := func(name string, expiresAt models.Timestamp) {
+		blob := &models.Blob{
+			UserID:        user.ID,
+			BlobName:      name,
+			EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Y2lwaGVy", Tag: "t"},
+			ExpiresAt:     &expiresAt,
+		}
+		if err := db.UpsertBlob(blob); err != nil {
+			t.Fatalf("failed to upsert %s: %v", name, err)
+		}
+	}
+
+	// Pin while unexpired, then let a rewrite move the expiry into the past;
+	// the pin survives writes to the container
+	pinned := true
+	upsert("critical", models.NewTimestamp(time.Now().Add(time.Hour)))
+	if updated, err := db.UpdateBlobsMeta(user.ID, []BlobMetaUpdate{{BlobName: "critical", Pinned: &pinned}}, Writer{}); err != nil || updated[0] == nil || !updated[0].Pinned {
+		t.Fatalf("failed to pin blob: %v", err)
+	}
+	past := models.NewTimestamp(time.Now().Add(-time.Minute))
+	upsert("critical", past)
+	upsert("scratch", past)
+
+	deleted, err := db.DeleteExpiredBlobs(time.Now())
+	if err != nil {
+		t.Fatalf("failed to sweep: %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("expected only the unpinned blob to be swept, got %d", deleted)
+	}
+	if _, err := db.GetBlob(user.ID, "scratch"); err != ErrBlobNotFound {
+		t.Errorf("expected the unpinned sibling to be swept, got %v", err)
+	}
+
+	blob, err := db.GetBlob(user.ID, "critical")
+	if err != nil {
+		t.Fatalf("expected pinned blob to survive the sweep: %v", err)
+	}
+	if !blob.Pinned || blob.ExpiresAt == nil {
+		t.Errorf("expected pinned blob to keep its expiry, got %+v", blob)
+	}
+	list, _ := db.ListBlobs(user.ID, BlobFilter{})
+	if len(list) != 1 || !list[0].Pinned {
+		t.Errorf("expected the pinned blob to be listed as pinned, got %+v", list)
+	}
+
+	// Unpinning lets the expiry take effect again
+	pinned = false
+	if _, err := db.UpdateBlobsMeta(user.ID, []BlobMetaUpdate{{BlobName: "critical", Pinned: &pinned}}, Writer{}); err != nil {
+		t.Fatalf("failed to unpin blob: %v", err)
+	}
+	if _, err := db.GetBlob(user.ID, "critical"); err != ErrBlobExpired {
+		t.Errorf("expected ErrBlobExpired after unpinning, got %v", err)
+	}
+}
+
+func TestListBlobsUpdatedRange(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	// One blob per day, backdated directly since UpsertBlob always stamps now
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	names := []string{"day0", "day1", "day2", "day3", "day4"}
+	for i, name := range names {
+		blob := &models.Blob{
+			UserID:        user.ID,
+			BlobName:      name,
+			EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Y2lwaGVy", Tag: "t"},
+		}
+		if err := db.UpsertBlob(blob); err != nil {
+			t.Fatalf("failed to upsert %s: %v", name, err)
+		}
+		updatedAt := base.AddDate(0, 0, i)
+		if _, err := db.conn.Exec(`UPDATE blobs SET updated_at = ? WHERE blob_name = ?`, updatedAt, name); err != nil {
+			t.Fatalf("failed to backdate %s: %v", name, err)
+		}
+	}
+
+	from := base.AddDate(0, 0, 1)
+	to := base.AddDate(0, 0, 3)
+	tests := []struct {
+		name     string
+		filter   BlobFilter
+		expected []string
+	}{
+		{"both bounds inclusive", BlobFilter{UpdatedFrom: &from, UpdatedTo: &to}, []string{"day1", "day2", "day3"}},
+		{"from only", BlobFilter{UpdatedFrom: &to}, []string{"day3", "day4"}},
+		{"to only", BlobFilter{UpdatedTo: &from}, []string{"day0", "day1"}},
+		{"no bounds", BlobFilter{}, names},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := db.ListBlobs(user.ID, tt.filter)
+			if err != nil {
+				t.Fatalf("failed to list blobs: %v", err)
+			}
+			var got []string
+			for _, item := range list {
+				got = append(got, item.BlobName)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestListBlobsByCollection(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	for name, collection := range map[string]string{"vault": "", "report": "work", "memo": "work", "diary": "home"} {
+		blob := &models.Blob{UserID: user.ID, BlobName: name, Collection: collection, EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Yw==", Tag: "t"}}
+		if err := db.UpsertBlob(blob); err != nil {
+			t.Fatalf("failed to upsert %s: %v", name, err)
+		}
+	}
+
+	names := func(filter BlobFilter) []string {
+		items, err := db.ListBlobs(user.ID, filter)
+		if err != nil {
+			t.Fatalf("failed to list blobs: %v", err)
+		}
+		var out []string
+		for _, item := range items {
+			out = append(out, item.Collection+"/"+item.BlobName)
+		}
+		return out
+	}
+
+	work, none := "work", ""
+	if got := strings.Join(names(BlobFilter{Collection: &work}), ","); got != "work/memo,work/report" {
+		t.Errorf("expected only the work collection, got %s", got)
+	}
+	if got := strings.Join(names(BlobFilter{Collection: &none}), ","); got != "/vault" {
+		t.Errorf("expected only the default collection, got %s", got)
+	}
+	if got := len(names(BlobFilter{})); got != 4 {
+		t.Errorf("expected all 4 blobs without a collection filter, got %d", got)
+	}
+}
+
+func TestBlobImportQuota(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	imp, err := db.BeginBlobImport(user.ID, Writer{})
+	if err != nil {
+		t.Fatalf("failed to begin import: %v", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		blob := &models.Blob{BlobName: name, EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "0123456789", Tag: "t"}}
+		if err := imp.Upsert(blob); err != nil {
+			t.Fatalf("failed to upsert %s: %v", name, err)
+		}
+	}
+	if err := imp.Commit(15); err != ErrQuotaExceeded {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+
+	used, err := db.UsageBytes(user.ID)
+	if err != nil {
+		t.Fatalf("failed to get usage: %v", err)
+	}
+	if used != 0 {
+		t.Errorf("expected rejected import to store nothing, got %d bytes", used)
+	}
+
+	// Overwriting a blob counts its new size, not both
+	blob := &models.Blob{UserID: user.ID, BlobName: "a", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "0123456789", Tag: "t"}}
+	if err := db.UpsertBlobWithinQuota(blob, 15, Writer{}); err != nil {
+		t.Fatalf("expected upsert within quota, got %v", err)
+	}
+	if err := db.UpsertBlobWithinQuota(blob, 15, Writer{}); err != nil {
+		t.Errorf("expected overwrite within quota, got %v", err)
+	}
+
+	// An encrypted name counts as stored, JSON and all
+	blob.EncryptedName = &models.Container{Nonce: "n", Ciphertext: "name", Tag: "t"}
+	if err := db.UpsertBlobWithinQuota(blob, 15, Writer{}); err != ErrQuotaExceeded {
+		t.Errorf("expected the encrypted name to count against the quota, got %v", err)
+	}
+	name, _ := encryptedNameValue(blob.EncryptedName)
+	if err := db.UpsertBlobWithinQuota(blob, 0, Writer{}); err != nil {
+		t.Fatalf("failed to upsert with an encrypted name: %v", err)
+	}
+	if used, _ := db.UsageBytes(user.ID); used != int64(len("0123456789")+len(name.(string))) {
+		t.Errorf("expected usage to include the encrypted name, got %d", used)
+	}
+}
+
+func TestBlobVersion(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	blob := &models.Blob{UserID: user.ID, BlobName: "vault", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c1", Tag: "t"}}
+	if err := db.UpsertBlob(blob); err != nil {
+		t.Fatalf("failed to upsert blob: %v", err)
+	}
+	if blob.Version != 1 {
+		t.Errorf("expected new blob at version 1, got %d", blob.Version)
+	}
+
+	blob.EncryptedBlob.Ciphertext = "c2"
+	if err := db.UpsertBlob(blob); err != nil {
+		t.Fatalf("failed to update blob: %v", err)
+	}
+	renamed, err := db.RenameBlob(user.ID, "vault", "safe", blob.EncryptedBlob, nil, 0, Writer{})
+	if err != nil {
+		t.Fatalf("failed to rename blob: %v", err)
+	}
+	if renamed.Version != 3 {
+		t.Errorf("expected version 3 after update and rename, got %d", renamed.Version)
+	}
+
+	version, err := db.BlobVersion(user.ID, "safe")
+	if err != nil {
+		t.Fatalf("failed to get version: %v", err)
+	}
+	if version != 3 {
+		t.Errorf("expected BlobVersion 3, got %d", version)
+	}
+	if _, err := db.BlobVersion(user.ID, "vault"); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound for old name, got %v", err)
+	}
+}
+
+func TestBackupToDirRetention(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	dir := t.TempDir()
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	var last *BackupInfo
+	for i := 0; i < 3; i++ {
+		backup, err := db.BackupToDir(context.Background(), dir, 2, start.Add(time.Duration(i)*time.Hour))
+		if err != nil {
+			t.Fatalf("backup %d failed: %v", i, err)
+		}
+		last = backup
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "cryptd-*.db"))
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 retained backups, got %v", matches)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cryptd-20260102T030405.000Z.db")); !os.IsNotExist(err) {
+		t.Errorf("expected the oldest backup to be pruned, got %v", err)
+	}
+
+	restored, err := New(last.Path)
+	if err != nil {
+		t.Fatalf("failed to open backup: %v", err)
+	}
+	defer func() { _ = restored.Close() }()
+	if _, err := restored.GetUserByUsername("alice"); err != nil {
+		t.Errorf("expected alice in the backup: %v", err)
+	}
+}
+
+func TestBackupToDirBlobStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFilesystemBlobStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	options := DefaultOptions()
+	options.BlobStore = store
+	db, err := NewWithOptions(filepath.Join(dir, "test.db"), options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+	blob := &models.Blob{UserID: user.ID, BlobName: "a", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "kept", Tag: "t"}}
+	if err := db.UpsertBlob(blob); err != nil {
+		t.Fatalf("failed to upsert: %v", err)
+	}
+
+	backups := filepath.Join(dir, "backups")
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	first, err := db.BackupToDir(context.Background(), backups, 1, start)
+	if err != nil {
+		t.Fatalf("backup failed: %v", err)
+	}
+	if first.BlobStorePath != filepath.Join(backups, "cryptd-20260102T030405.000Z.blobs") {
+		t.Errorf("unexpected blob store snapshot path %q", first.BlobStorePath)
+	}
+
+	// Deleting the blob collects its live file, but not the snapshot
+	if err := db.DeleteBlob(user.ID, "a", Writer{}); err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+	snapshot, err := NewFilesystemBlobStore(first.BlobStorePath)
+	if err != nil {
+		t.Fatalf("failed to open snapshot: %v", err)
+	}
+	restoredOptions := DefaultOptions()
+	restoredOptions.BlobStore = snapshot
+	restored, err := NewWithOptions(first.Path, restoredOptions)
+	if err != nil {
+		t.Fatalf("failed to open backup: %v", err)
+	}
+	got, err := restored.GetBlob(user.ID, "a")
+	_ = restored.Close()
+	if err != nil || got.EncryptedBlob.Ciphertext != "kept" {
+		t.Errorf("expected the backup to restore the blob, got %+v, %v", got, err)
+	}
+
+	// Pruning a backup removes its snapshot too
+	if _, err := db.BackupToDir(context.Background(), backups, 1, start.Add(time.Hour)); err != nil {
+		t.Fatalf("second backup failed: %v", err)
+	}
+	if _, err := os.Stat(first.BlobStorePath); !os.IsNotExist(err) {
+		t.Errorf("expected the pruned backup's snapshot to be gone, got %v", err)
+	}
+}
+
+func TestRotateAccountKey(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	oldKey := models.Container{Nonce: "old-n", Ciphertext: "old-c", Tag: "old-t"}
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: oldKey,
+	}
+	_ = db.CreateUser(user)
+
+	names := []string{"a", "b", "c"}
+	for _, name := range names {
+		blob := &models.Blob{UserID: user.ID, BlobName: name, EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "old-" + name, Tag: "t"}}
+		if err := db.UpsertBlob(blob); err != nil {
+			t.Fatalf("failed to upsert %s: %v", name, err)
+		}
+	}
+
+	newKey := models.Container{Nonce: "new-n", Ciphertext: "new-c", Tag: "new-t"}
+	rotated := func(names ...string) []models.Blob {
+		var blobs []models.Blob
+		for _, name := range names {
+			blobs = append(blobs, models.Blob{BlobName: name, EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "new-" + name, Tag: "t"}})
+		}
+		return blobs
+	}
+
+	assertOldState := func(t *testing.T) {
+		t.Helper()
+		stored, _ := db.GetUserByID(user.ID)
+		if stored.WrappedAccountKey != oldKey {
+			t.Errorf("expected old wrapped key, got %+v", stored.WrappedAccountKey)
+		}
+		for _, name := range names {
+			blob, _ := db.GetBlob(user.ID, name)
+			if blob.EncryptedBlob.Ciphertext != "old-"+name {
+				t.Errorf("blob %s was modified: %q", name, blob.EncryptedBlob.Ciphertext)
+			}
+		}
+	}
+
+	t.Run("failure midway rolls back", func(t *testing.T) {
+		// The count matches, so the key and the first blobs are updated before the unknown name fails
+		err := db.RotateAccountKey(user.ID, user.Rev, newKey, rotated("a", "b", "unknown"), 0, Writer{})
+		if err != ErrRotationIncomplete {
+			t.Fatalf("expected ErrRotationIncomplete, got %v", err)
+		}
+		assertOldState(t)
+	})
+
+	t.Run("missing blob", func(t *testing.T) {
+		if err := db.RotateAccountKey(user.ID, user.Rev, newKey, rotated("a", "b"), 0, Writer{}); err != ErrRotationIncomplete {
+			t.Fatalf("expected ErrRotationIncomplete, got %v", err)
+		}
+		assertOldState(t)
+	})
+
+	t.Run("duplicate blob", func(t *testing.T) {
+		if err := db.RotateAccountKey(user.ID, user.Rev, newKey, rotated("a", "a", "b"), 0, Writer{}); err != ErrRotationIncomplete {
+			t.Fatalf("expected ErrRotationIncomplete, got %v", err)
+		}
+		assertOldState(t)
+	})
+
+	t.Run("over quota", func(t *testing.T) {
+		// Each container is 5 bytes; a grown one pushes the total past 15
+		blobs := rotated(names...)
+		blobs[0].EncryptedBlob.Ciphertext = "new-a-grown"
+		if err := db.RotateAccountKey(user.ID, user.Rev, newKey, blobs, 15, Writer{}); err != ErrQuotaExceeded {
+			t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+		}
+		assertOldState(t)
+	})
+
+	t.Run("stale rev", func(t *testing.T) {
+		if err := db.RotateAccountKey(user.ID, user.Rev-1, newKey, rotated(names...), 0, Writer{}); err != ErrUserConflict {
+			t.Fatalf("expected ErrUserConflict, got %v", err)
+		}
+		assertOldState(t)
+	})
+
+	t.Run("complete", func(t *testing.T) {
+		if err := db.RotateAccountKey(user.ID, user.Rev, newKey, rotated(names...), 15, Writer{}); err != nil {
+			t.Fatalf("failed to rotate: %v", err)
+		}
+		stored, _ := db.GetUserByID(user.ID)
+		if stored.WrappedAccountKey != newKey {
+			t.Errorf("expected new wrapped key, got %+v", stored.WrappedAccountKey)
+		}
+		if stored.Rev != user.Rev+1 {
+			t.Errorf("expected rev %d, got %d", user.Rev+1, stored.Rev)
+		}
+		for _, name := range names {
+			ok, err := db.VerifyBlob(user.ID, name)
+			if err != nil || !ok {
+				t.Errorf("blob %s: expected valid checksum after rotation, got %v %v", name, ok, err)
+			}
+			blob, _ := db.GetBlob(user.ID, name)
+			if blob.EncryptedBlob.Ciphertext != "new-"+name {
+				t.Errorf("blob %s not rotated: %q", name, blob.EncryptedBlob.Ciphertext)
+			}
+		}
+	})
+}
+
+func TestSlowQueryObservation(t *testing.T) {
+	// Any positive duration exceeds a 1ns threshold
+	db, err := NewWithOptions(":memory:", Options{SlowQueryThreshold: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	before := slowQueryCount("ListBlobs")
+	if _, err := db.ListBlobs(1, BlobFilter{}); err != nil {
+		t.Fatalf("failed to list blobs: %v", err)
+	}
+
+	if got := slowQueryCount("ListBlobs") - before; got != 1 {
+		t.Errorf("expected 1 slow ListBlobs, got %d", got)
+	}
+}
+
+func TestTopUsersByUsage(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	var ids []int64
+	for i, size := range []int{3, 10, 6} {
+		user := &models.User{Username: fmt.Sprintf("user%d", i), KDFType: models.KDFTypePBKDF2SHA256, KDFIterations: 600_000, LoginVerifierHash: []byte("hash")}
+		if err := db.CreateUser(user); err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		ids = append(ids, user.ID)
+		_ = db.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "a", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: strings.Repeat("x", size), Tag: "t"}})
+	}
+
+	usage, err := db.TopUsersByUsage(2)
+	if err != nil {
+		t.Fatalf("failed to rank users: %v", err)
+	}
+	expected := []UserUsage{{ids[1], 10}, {ids[2], 6}}
+	if len(usage) != 2 || usage[0] != expected[0] || usage[1] != expected[1] {
+		t.Errorf("expected %v, got %v", expected, usage)
+	}
+
+	if err := db.RefreshStorageMetrics(2); err != nil {
+		t.Fatalf("failed to refresh storage metrics: %v", err)
+	}
+	var gauge map[string]int64
+	_ = json.Unmarshal([]byte(expvar.Get("storage_top_users_bytes").String()), &gauge)
+	if len(gauge) != 2 || gauge[metrics.UserLabel(ids[1])] != 10 {
+		t.Errorf("expected the top 2 users in the gauge, got %v", gauge)
+	}
+
+	// The maintained counters match a full recount after every kind of write
+	recount := func(userID int64) int64 {
+		var n int64
+		_ = db.conn.QueryRow(
+			`SELECT COALESCE(SUM(`+blobCiphertextSize+` + COALESCE(length(encrypted_name), 0)), 0) FROM blobs WHERE user_id = ?`,
+			userID,
+		).Scan(&n)
+		return n
+	}
+	name := &models.Container{Nonce: "nn", Ciphertext: "name", Tag: "nt"}
+	steps := []struct {
+		name  string
+		write func() error
+	}{
+		{"rewrite", func() error {
+			return db.UpsertBlob(&models.Blob{UserID: ids[0], BlobName: "a", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: strings.Repeat("x", 20), Tag: "t"}})
+		}},
+		{"rename", func() error {
+			_, err := db.RenameBlob(ids[0], "a", "b", models.Container{Nonce: "n", Ciphertext: "renamed", Tag: "t"}, name, 0, Writer{})
+			return err
+		}},
+		{"rewrap", func() error {
+			_, err := db.RewrapBlob(ids[1], "a", models.Container{Nonce: "n", Ciphertext: "wrap", Tag: "t"}, 0, Writer{})
+			return err
+		}},
+		{"transfer", func() error {
+			_, err := db.TransferBlob(ids[2], ids[0], "a", 0)
+			return err
+		}},
+		{"delete", func() error { return db.DeleteBlob(ids[1], "a", Writer{}) }},
+		{"delete user", func() error { return db.DeleteUser(ids[0]) }},
+	}
+	for _, step := range steps {
+		if err := step.write(); err != nil {
+			t.Fatalf("%s failed: %v", step.name, err)
+		}
+		for _, id := range ids {
+			if used, err := db.UsageBytes(id); err != nil || used != recount(id) {
+				t.Errorf("after %s, expected user %d to use %d bytes, got %d, %v", step.name, id, recount(id), used, err)
+			}
+		}
+	}
+	if usage, err := db.TopUsersByUsage(3); err != nil || len(usage) != 0 {
+		t.Errorf("expected no users with usage left, got %v, %v", usage, err)
+	}
+}
+
+func slowQueryCount(op string) int64 {
+	v, ok := metrics.DBSlowQueries.Get(op).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestCreateSessionEvictsOldest(t *testing.T) {
+	options := DefaultOptions()
+	options.MaxSessions = 3
+	db, err := NewWithOptions(":memory:", options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 4; i++ {
+		createdAt := start.Add(time.Duration(i) * time.Minute)
+		if err := db.CreateSession(&models.Session{
+			ID:        fmt.Sprintf("s%d", i),
+			UserID:    user.ID,
+			Scope:     "readwrite",
+			CreatedAt: models.NewTimestamp(createdAt),
+			ExpiresAt: models.NewTimestamp(createdAt.Add(24 * time.Hour)),
+		}); err != nil {
+			t.Fatalf("failed to create session %d: %v", i, err)
+		}
+	}
+
+	sessions, err := db.ListSessions(user.ID)
+	if err != nil {
+		t.Fatalf("failed to list sessions: %v", err)
+	}
+	var ids []string
+	for _, session := range sessions {
+		ids = append(ids, session.ID)
+	}
+	if strings.Join(ids, ",") != "s3,s2,s1" {
+		t.Errorf("expected the oldest session to be evicted, got %v", ids)
+	}
+}
+
+func TestBlobContentDedup(t *testing.T) {
+	options := DefaultOptions()
+	options.DedupContent = true
+	db, err := NewWithOptions(":memory:", options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	refcounts := func() map[string]int64 {
+		t.Helper()
+		rows, err := db.conn.Query(`SELECT data, refcount FROM blob_content`)
+		if err != nil {
+			t.Fatalf("failed to read blob_content: %v", err)
+		}
+		defer func() { _ = rows.Close() }()
+		counts := map[string]int64{}
+		for rows.Next() {
+			var data string
+			var refcount int64
+			_ = rows.Scan(&data, &refcount)
+			counts[data] = refcount
+		}
+		return counts
+	}
+	put := func(name, ciphertext string) {
+		t.Helper()
+		if err := db.UpsertBlob(&models.Blob{
+			UserID:        user.ID,
+			BlobName:      name,
+			EncryptedBlob: models.Container{Nonce: "n", Ciphertext: ciphertext, Tag: "t"},
+		}); err != nil {
+			t.Fatalf("failed to upsert %s: %v", name, err)
+		}
+	}
+
+	// Duplicate ciphertext shares one row
+	put("a", "same")
+	put("b", "same")
+	if counts := refcounts(); len(counts) != 1 || counts["same"] != 2 {
+		t.Fatalf("expected one shared row with refcount 2, got %v", counts)
+	}
+	blob, err := db.GetBlob(user.ID, "b")
+	if err != nil || blob.EncryptedBlob.Ciphertext != "same" {
+		t.Fatalf("expected deduplicated ciphertext to read back, got %+v, %v", blob, err)
+	}
+	if used, _ := db.UsageBytes(user.ID); used != 2*int64(len("same")) {
+		t.Errorf("expected usage to count both blobs, got %d", used)
+	}
+
+	// Rewriting with the same content keeps the count; new content moves the reference
+	put("a", "same")
+	put("b", "other")
+	if counts := refcounts(); counts["same"] != 1 || counts["other"] != 1 {
+		t.Errorf("expected refcounts same=1 other=1, got %v", counts)
+	}
+
+	// Deleting the last reference removes the content
+	_ = db.DeleteBlob(user.ID, "a", Writer{})
+	_ = db.DeleteBlob(user.ID, "b", Writer{})
+	if counts := refcounts(); len(counts) != 0 {
+		t.Errorf("expected blob_content to be empty, got %v", counts)
+	}
+
+	// So does the cascade from deleting the owner
+	put("c", "cascade")
+	if err := db.DeleteUser(user.ID); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	if counts := refcounts(); len(counts) != 0 {
+		t.Errorf("expected blob_content to be empty after deleting the user, got %v", counts)
+	}
+}
+
+func TestFilesystemBlobStore(t *testing.T) {
+	store, err := NewFilesystemBlobStore(filepath.Join(t.TempDir(), "blobs"))
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+
+	// Round trip, then an overwrite of the same ref
+	for _, ciphertext := range []string{"first", "second"} {
+		if err := store.Put("1/2-1", ciphertext); err != nil {
+			t.Fatalf("failed to put: %v", err)
+		}
+		if got, err := store.Get("1/2-1"); err != nil || got != ciphertext {
+			t.Fatalf("expected %q back, got %q, %v", ciphertext, got, err)
+		}
+	}
+
+	if err := store.Delete("1/2-1"); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if _, err := store.Get("1/2-1"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected deleted content to be gone, got %v", err)
+	}
+	if err := store.Delete("1/2-1"); err != nil {
+		t.Errorf("expected deleting missing content to succeed, got %v", err)
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(filepath.Join(store.dir, "1"))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected an empty user directory, got %v, %v", entries, err)
+	}
+
+	if err := store.Put("../escape", "x"); err == nil {
+		t.Error("expected a ref outside the directory to be refused")
+	}
+}
+
+func TestBlobStoreReadsRaceOverwrites(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFilesystemBlobStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	options := DefaultOptions()
+	options.BlobStore = store
+	db, err := NewWithOptions(filepath.Join(dir, "test.db"), options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+	put := func(i int) error {
+		return db.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "a", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: fmt.Sprint("v", i), Tag: "t"}})
+	}
+	if err := put(0); err != nil {
+		t.Fatalf("failed to upsert: %v", err)
+	}
+
+	// Every overwrite collects the previous version's file; a reader that
+	// already holds that ref must still be able to load it
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 1; i <= 200; i++ {
+			if err := put(i); err != nil {
+				t.Errorf("failed to overwrite: %v", err)
+				return
+			}
+		}
+	}()
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := db.GetBlob(user.ID, "a"); err != nil {
+					t.Errorf("read raced an overwrite: %v", err)
+					return
+				}
+				if err := db.EachBlob(user.ID, func(*models.Blob) error { return nil }); err != nil {
+					t.Errorf("export raced an overwrite: %v", err)
+					return
+				}
+				if report, err := db.ScrubBlobs(); err != nil || len(report.Corrupted) != 0 {
+					t.Errorf("scrub raced an overwrite: %+v, %v", report, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// With the readers gone, the next write collects every old version
+	if err := put(201); err != nil {
+		t.Fatalf("failed to upsert: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(store.dir, fmt.Sprint(user.ID)))
+	if len(entries) != 1 {
+		t.Errorf("expected only the current version's file, got %d", len(entries))
+	}
+}
+
+func TestBlobStoreOption(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFilesystemBlobStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatalf("failed to create blob store: %v", err)
+	}
+	options := DefaultOptions()
+	options.BlobStore = store
+	dbPath := filepath.Join(dir, "test.db")
+	db, err := NewWithOptions(dbPath, options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	files := func() []string {
+		t.Helper()
+		entries, _ := os.ReadDir(filepath.Join(store.dir, fmt.Sprint(user.ID)))
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+	ref := func(blob *models.Blob) string {
+		t.Helper()
+		var ref string
+		if err := db.conn.QueryRow(`SELECT content_ref FROM blobs WHERE id = ?`, blob.ID).Scan(&ref); err != nil {
+			t.Fatalf("failed to read content ref: %v", err)
+		}
+		return ref
+	}
+	put := func(name, ciphertext string) *models.Blob {
+		t.Helper()
+		blob := &models.Blob{
+			UserID:        user.ID,
+			BlobName:      name,
+			EncryptedBlob: models.Container{Nonce: "n", Ciphertext: ciphertext, Tag: "t"},
+		}
+		if err := db.UpsertBlob(blob); err != nil {
+			t.Fatalf("failed to upsert %s: %v", name, err)
+		}
+		return blob
+	}
+
+	// The ciphertext goes to a file; the row keeps none of it
+	ciphertext := base64.StdEncoding.EncodeToString([]byte("hello"))
+	blob := put("a", ciphertext)
+	if names := files(); len(names) != 1 || fmt.Sprintf("%d/%s", user.ID, names[0]) != ref(blob) {
+		t.Fatalf("expected one file, the row's ref, got %v", names)
+	}
+	var inline string
+	_ = db.conn.QueryRow(`SELECT encrypted_blob_ciphertext FROM blobs WHERE id = ?`, blob.ID).Scan(&inline)
+	if inline != "" {
+		t.Errorf("expected an empty inline column, got %q", inline)
+	}
+
+	got, err := db.GetBlob(user.ID, "a")
+	if err != nil || got.EncryptedBlob.Ciphertext != ciphertext {
+		t.Fatalf("expected ciphertext to read back, got %+v, %v", got, err)
+	}
+	if used, _ := db.UsageBytes(user.ID); used != int64(len(ciphertext)) {
+		t.Errorf("expected usage %d, got %d", len(ciphertext), used)
+	}
+	items, err := db.ListBlobs(user.ID, BlobFilter{})
+	if err != nil || len(items) != 1 || items[0].EncryptedSize != len("hello") {
+		t.Errorf("expected a listed size of %d, got %+v, %v", len("hello"), items, err)
+	}
+	var exported []string
+	_ = db.EachBlob(user.ID, func(b *models.Blob) error {
+		exported = append(exported, b.EncryptedBlob.Ciphertext)
+		return nil
+	})
+	if len(exported) != 1 || exported[0] != ciphertext {
+		t.Errorf("expected EachBlob to load content, got %v", exported)
+	}
+
+	// Rewriting replaces the file of the previous version
+	first := ref(blob)
+	blob = put("a", "rewritten")
+	if names := files(); len(names) != 1 || fmt.Sprintf("%d/%s", user.ID, names[0]) != ref(blob) || ref(blob) == first {
+		t.Errorf("expected only the file of the new version, got %v", names)
+	}
+
+	// A write that is rolled back leaves no file behind
+	big := &models.Blob{UserID: user.ID, BlobName: "big", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "too much", Tag: "t"}}
+	if err := db.UpsertBlobWithinQuota(big, 1, Writer{}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if names := files(); len(names) != 1 {
+		t.Errorf("expected the rejected write's file to be deleted, got %v", names)
+	}
+
+	// Deleting the blob deletes its file
+	if err := db.DeleteBlob(user.ID, "a", Writer{}); err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+	if names := files(); len(names) != 0 {
+		t.Errorf("expected no files after delete, got %v", names)
+	}
+
+	// So does expiry
+	expired := put("b", "short-lived")
+	_, _ = db.conn.Exec(`UPDATE blobs SET expires_at = ? WHERE id = ?`, time.Now().Add(-time.Minute).UTC(), expired.ID)
+	if _, err := db.DeleteExpiredBlobs(time.Now()); err != nil {
+		t.Fatalf("failed to delete expired blobs: %v", err)
+	}
+	if names := files(); len(names) != 0 {
+		t.Errorf("expected no files after expiry, got %v", names)
+	}
+
+	// Content missing from the store is reported by a scrub
+	lost := put("c", "lost")
+	_ = os.Remove(filepath.Join(store.dir, ref(lost)))
+	report, err := db.ScrubBlobs()
+	if err != nil || len(report.Corrupted) != 1 || report.Corrupted[0].BlobName != "c" {
+		t.Errorf("expected c to be reported corrupted, got %+v, %v", report, err)
+	}
+
+	// The database does not open without the store its blobs live in
+	_ = db.Close()
+	if _, err := New(dbPath); !errors.Is(err, ErrBlobStoreRequired) {
+		t.Errorf("expected ErrBlobStoreRequired, got %v", err)
+	}
+}
+
+func TestMaxCollections(t *testing.T) {
+	options := DefaultOptions()
+	options.MaxCollections = 2
+	db, err := NewWithOptions(":memory:", options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{Username: "alice", KDFType: models.KDFTypePBKDF2SHA256, KDFIterations: 600_000, LoginVerifierHash: []byte("hash")}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	put := func(name, collection string) error {
+		return db.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: name, Collection: collection, EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}})
+	}
+
+	// The default collection does not count, and existing collections can be reused
+	for _, blob := range [][2]string{{"a", "work"}, {"b", "home"}, {"c", ""}, {"d", "work"}} {
+		if err := put(blob[0], blob[1]); err != nil {
+			t.Fatalf("failed to put %s in %q: %v", blob[0], blob[1], err)
+		}
+	}
+	if count, _ := countCollections(db.conn, user.ID); count != 2 {
+		t.Errorf("expected 2 collections, got %d", count)
+	}
+
+	if err := put("e", "archive"); err != ErrTooManyCollections {
+		t.Errorf("expected ErrTooManyCollections for a third collection, got %v", err)
+	}
+	if _, err := db.GetBlob(user.ID, "e"); err != ErrBlobNotFound {
+		t.Errorf("expected the rejected blob not to be stored, got %v", err)
+	}
+
+	archive := "archive"
+	if _, err := db.UpdateBlobsMeta(user.ID, []BlobMetaUpdate{{BlobName: "c", Collection: &archive}}, Writer{}); err != ErrTooManyCollections {
+		t.Errorf("expected ErrTooManyCollections from a metadata update, got %v", err)
+	}
+
+	// Emptying a collection frees its slot
+	if err := put("b", ""); err != nil {
+		t.Fatalf("failed to move b to the default collection: %v", err)
+	}
+	if err := put("e", "archive"); err != nil {
+		t.Errorf("expected a freed slot to be usable, got %v", err)
+	}
+
+	// A transfer counts against the destination user's collections
+	bob := &models.User{Username: "bob", KDFType: models.KDFTypePBKDF2SHA256, KDFIterations: 600_000, LoginVerifierHash: []byte("hash")}
+	if err := db.CreateUser(bob); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	for _, collection := range []string{"x", "y"} {
+		_ = db.UpsertBlob(&models.Blob{UserID: bob.ID, BlobName: collection, Collection: collection, EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}})
+	}
+	if _, err := db.TransferBlob(user.ID, bob.ID, "a", 0); err != ErrTooManyCollections {
+		t.Errorf("expected ErrTooManyCollections from a transfer, got %v", err)
+	}
+	if _, err := db.GetBlob(user.ID, "a"); err != nil {
+		t.Errorf("expected the rejected transfer to leave the blob with its owner, got %v", err)
+	}
+}
+
+func TestRenameBlobQuota(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{Username: "alice", KDFType: models.KDFTypePBKDF2SHA256, KDFIterations: 600_000, LoginVerifierHash: []byte("hash")}
+	_ = db.CreateUser(user)
+	_ = db.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "a", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "0123456789", Tag: "t"}})
+
+	// The container re-encrypted for the new name is not a free resize
+	grown := models.Container{Nonce: "n2", Ciphertext: "0123456789abcdef", Tag: "t"}
+	if _, err := db.RenameBlob(user.ID, "a", "b", grown, nil, 15, Writer{}); err != ErrQuotaExceeded {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if got, err := db.GetBlob(user.ID, "a"); err != nil || got.EncryptedBlob.Ciphertext != "0123456789" {
+		t.Errorf("expected the rejected rename to leave the blob as it was, got %+v, %v", got, err)
+	}
+	if _, err := db.RenameBlob(user.ID, "a", "b", grown, nil, 20, Writer{}); err != nil {
+		t.Errorf("expected a rename within quota, got %v", err)
+	}
+}
+
+func TestTransferBlobQuota(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	newUser := func(name string) *models.User {
+		user := &models.User{Username: name, KDFType: models.KDFTypePBKDF2SHA256, KDFIterations: 600_000, LoginVerifierHash: []byte("hash")}
+		_ = db.CreateUser(user)
+		return user
+	}
+	alice, bob := newUser("alice"), newUser("bob")
+	_ = db.UpsertBlob(&models.Blob{UserID: alice.ID, BlobName: "gift", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "0123456789", Tag: "t"}})
+	_ = db.UpsertBlob(&models.Blob{UserID: bob.ID, BlobName: "own", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "0123456789", Tag: "t"}})
+
+	if _, err := db.TransferBlob(alice.ID, bob.ID, "gift", 15); err != ErrQuotaExceeded {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if _, err := db.GetBlob(alice.ID, "gift"); err != nil {
+		t.Errorf("expected the rejected transfer to leave the blob with alice, got %v", err)
+	}
+	if _, err := db.TransferBlob(alice.ID, bob.ID, "gift", 20); err != nil {
+		t.Errorf("expected a transfer within quota, got %v", err)
+	}
+}
+
+func TestRejectNonceReuse(t *testing.T) {
+	options := DefaultOptions()
+	options.RejectNonceReuse = true
+	db, err := NewWithOptions(":memory:", options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "a2V5bm9uY2U=", Ciphertext: "key", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	put := func(name string, container models.Container) error {
+		return db.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: name, EncryptedBlob: container})
+	}
+	first := models.Container{Nonce: "bm9uY2Ux", Ciphertext: "one", Tag: "t"}
+	if err := put("a", first); err != nil {
+		t.Fatalf("failed to upsert blob: %v", err)
+	}
+
+	// A retry of the identical container is fine
+	if err := put("a", first); err != nil {
+		t.Errorf("expected an identical retry to succeed, got %v", err)
+	}
+
+	// The same nonce with other content is rejected, and nothing is written
+	if err := put("b", models.Container{Nonce: "bm9uY2Ux", Ciphertext: "two", Tag: "t"}); err != ErrNonceReuse {
+		t.Errorf("expected ErrNonceReuse, got %v", err)
+	}
+	if _, err := db.GetBlob(user.ID, "b"); err != ErrBlobNotFound {
+		t.Errorf("expected the rejected blob not to be stored, got %v", err)
+	}
+
+	// The wrapped key from registration counts on the first credential update
+	user.WrappedAccountKey = models.Container{Nonce: "a2V5bm9uY2U=", Ciphertext: "rewrapped", Tag: "t"}
+	if err := db.UpdateUser(user); err != ErrNonceReuse {
+		t.Errorf("expected ErrNonceReuse for the account key, got %v", err)
+	}
+
+	// Rotation moves blobs to a new key, so their old nonces no longer clash
+	rotated := models.Container{Nonce: "bm9uY2Ux", Ciphertext: "rotated", Tag: "t"}
+	newKey := models.Container{Nonce: "bmV3a2V5", Ciphertext: "newkey", Tag: "t"}
+	if err := db.RotateAccountKey(user.ID, user.Rev, newKey, []models.Blob{{BlobName: "a", EncryptedBlob: rotated}}, 0, Writer{}); err != nil {
+		t.Errorf("expected rotation to reset blob nonces, got %v", err)
+	}
+}
+
+func TestConnectionPragmas(t *testing.T) {
+	db, err := NewWithOptions(":memory:", Options{
+		CacheSizeKiB:    4096,
+		MmapSizeBytes:   64 << 20,
+		TempStoreMemory: true,
+		BusyTimeout:     2 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	var cacheSize, tempStore, busyTimeout int
+	if err := db.conn.QueryRow("PRAGMA cache_size").Scan(&cacheSize); err != nil {
+		t.Fatalf("failed to read cache_size: %v", err)
+	}
+	if cacheSize != -4096 {
+		t.Errorf("expected cache_size -4096, got %d", cacheSize)
+	}
+
+	if err := db.conn.QueryRow("PRAGMA temp_store").Scan(&tempStore); err != nil {
+		t.Fatalf("failed to read temp_store: %v", err)
+	}
+	if tempStore != 2 { // 2 = MEMORY
+		t.Errorf("expected temp_store 2, got %d", tempStore)
+	}
+
+	if err := db.conn.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout); err != nil {
+		t.Fatalf("failed to read busy_timeout: %v", err)
+	}
+	if busyTimeout != 2000 {
+		t.Errorf("expected busy_timeout 2000, got %d", busyTimeout)
+	}
+}
+
+func TestFileDatabaseUsesWAL(t *testing.T) {
+	db, err := New(filepath.Join(t.TempDir(), "wal.db"))
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	var journalMode string
+	if err := db.conn.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		t.Fatalf("failed to read journal_mode: %v", err)
+	}
+	if journalMode != "wal" {
+		t.Errorf("expected journal_mode wal, got %q", journalMode)
+	}
+}
+
+func TestForeignKeysOnEveryConnection(t *testing.T) {
+	db, err := New(filepath.Join(t.TempDir(), "fk.db"))
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	// Hold several connections at once so the pool has to open new ones
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		conn, err := db.conn.Conn(ctx)
+		if err != nil {
+			t.Fatalf("failed to get connection: %v", err)
+		}
+		defer func() { _ = conn.Close() }()
+
+		var enabled int
+		if err := conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&enabled); err != nil {
+			t.Fatalf("failed to read foreign_keys: %v", err)
+		}
+		if enabled != 1 {
+			t.Errorf("connection %d: expected foreign_keys on, got %d", i, enabled)
+		}
+	}
+}
+
+func TestRecycledConnectionsCascade(t *testing.T) {
+	options := DefaultOptions()
+	options.ConnMaxLifetime = time.Millisecond
+	db, err := NewWithOptions(filepath.Join(t.TempDir(), "recycle.db"), options)
+	if err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	if err := db.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "a", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}}); err != nil {
+		t.Fatalf("failed to upsert blob: %v", err)
+	}
+
+	// Every connection opened so far has outlived its lifetime by now
+	time.Sleep(10 * time.Millisecond)
+	if err := db.DeleteUser(user.ID); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+
+	if closed := db.conn.Stats().MaxLifetimeClosed; closed == 0 {
+		t.Fatal("expected connections to have been recycled")
+	}
+	var orphans int
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM blobs WHERE user_id = ?`, user.ID).Scan(&orphans); err != nil {
+		t.Fatalf("failed to count blobs: %v", err)
+	}
+	if orphans != 0 {
+		t.Errorf("expected the user's blobs to be deleted with them, %d left", orphans)
+	}
+}
+
+func TestWithPragmas(t *testing.T) {
+	tests := []struct {
+		dsn      string
+		pragmas  []string
+		expected string
+	}{
+		{"cryptd.db", nil, "cryptd.db"},
+		{"cryptd.db", []string{"cache_size(-2000)"}, "cryptd.db?_pragma=cache_size%28-2000%29"},
+		{"file:cryptd.db?mode=rwc", []string{"temp_store(memory)"}, "file:cryptd.db?mode=rwc&_pragma=temp_store%28memory%29"},
+	}
+
+	for _, tt := range tests {
+		if got := withPragmas(tt.dsn, tt.pragmas); got != tt.expected {
+			t.Errorf("withPragmas(%q, %v) = %q, expected %q", tt.dsn, tt.pragmas, got, tt.expected)
+		}
+	}
+}
+
+// setupBenchDB creates a file-backed database populated with blobs for one user
+func setupBenchDB(b *testing.B, options Options) (*DB, int64) {
+	b.Helper()
+
+	db, err := NewWithOptions(filepath.Join(b.TempDir(), "bench.db"), options)
+	if err != nil {
+		b.Fatalf("failed to create bench database: %v", err)
+	}
+
+	user := &models.User{
+		Username:          "bench",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	if err := db.CreateUser(user); err != nil {
+		b.Fatalf("failed to create user: %v", err)
+	}
+
+	ciphertext := base64.StdEncoding.EncodeToString(make([]byte, 16<<10))
+	for i := 0; i < 500; i++ {
+		blob := &models.Blob{
+			UserID:        user.ID,
+			BlobName:      fmt.Sprintf("blob-%03d", i),
+			EncryptedBlob: models.Container{Nonce: "n", Ciphertext: ciphertext, Tag: "t"},
+		}
+		if err := db.UpsertBlob(blob); err != nil {
+			b.Fatalf("failed to upsert blob: %v", err)
+		}
+	}
+
+	return db, user.ID
+}
+
+// benchOptions compares SQLite defaults against the tuned defaults
+var benchOptions = map[string]Options{
+	"sqlite-defaults": {},
+	"tuned":           DefaultOptions(),
+}
+
+func BenchmarkGetBlob(b *testing.B) {
+	for name, options := range benchOptions {
+		b.Run(name, func(b *testing.B) {
+			options.SlowQueryThreshold = 0
+			db, userID := setupBenchDB(b, options)
+			defer func() { _ = db.Close() }()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.GetBlob(userID, fmt.Sprintf("blob-%03d", i%500)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkListBlobs(b *testing.B) {
+	for name, options := range benchOptions {
+		b.Run(name, func(b *testing.B) {
+			options.SlowQueryThreshold = 0
+			db, userID := setupBenchDB(b, options)
+			defer func() { _ = db.Close() }()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.ListBlobs(userID, BlobFilter{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUpsertBlobBurst(b *testing.B) {
+	// Concurrent immediate writes queue for the write lock in busy_timeout
+	immediateOptions := DefaultOptions()
+	batchOptions := DefaultOptions()
+	batchOptions.WriteBatchMax = 64
+	batchOptions.WriteBatchWindow = time.Millisecond
+	for name, options := range map[string]Options{
+		"immediate": immediateOptions,
+		"batched":   batchOptions,
+	} {
+		b.Run(name, func(b *testing.B) {
+			options.SlowQueryThreshold = 0
+			db, userID := setupBenchDB(b, options)
+			defer func() { _ = db.Close() }()
+
+			var next atomic.Int64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					blob := &models.Blob{
+						UserID:        userID,
+						BlobName:      fmt.Sprintf("burst-%d", next.Add(1)),
+						EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "Y2lwaGVydGV4dA==", Tag: "t"},
+					}
+					if err := db.UpsertBlobWithinQuota(blob, 0, Writer{}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	userID := int64(7)
+	old := models.NewTimestamp(time.Now().Add(-time.Hour))
+	for _, event := range []*models.AuditEvent{
+		{Type: "auth.login", UserID: &userID, CreatedAt: old},
+		{Type: "blob.put", UserID: &userID, Detail: "vault"},
+		{Type: "auth.login_failed", IP: "192.0.2.1"},
+	} {
+		if err := db.RecordAuditEvent(event); err != nil {
+			t.Fatalf("failed to record event: %v", err)
+		}
+	}
+
+	since := time.Now().Add(-time.Minute)
+	var types []string
+	err := db.EachAuditEvent(AuditFilter{Since: &since}, func(event models.AuditEvent) error {
+		types = append(types, event.Type)
+		return nil
+	})
+	if err != nil || strings.Join(types, ",") != "blob.put,auth.login_failed" {
+		t.Errorf("expected the two recent events, got %v, %v", types, err)
+	}
+
+	lastID, more, err := db.LastAuditEventID(AuditFilter{Limit: 2})
+	if err != nil || lastID != 2 || !more {
+		t.Errorf("expected a first page ending at 2 with more, got %d, %v, %v", lastID, more, err)
+	}
+	if _, more, _ := db.LastAuditEventID(AuditFilter{AfterID: 2, Limit: 2}); more {
+		t.Error("expected the last page to have no more events")
+	}
+
+	// Retention drops only the events older than the cutoff
+	deleted, err := db.DeleteAuditEventsBefore(since)
+	if err != nil || deleted != 1 {
+		t.Fatalf("expected 1 old event deleted, got %d, %v", deleted, err)
+	}
+	types = nil
+	_ = db.EachAuditEvent(AuditFilter{}, func(event models.AuditEvent) error {
+		types = append(types, event.Type)
+		return nil
+	})
+	if strings.Join(types, ",") != "blob.put,auth.login_failed" {
+		t.Errorf("expected the recent events to remain, got %v", types)
+	}
+}
+
+func TestBlobLocks(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+	_ = db.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "doc", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}})
+
+	if _, err := db.AcquireBlobLock(user.ID, "missing", "a", time.Minute); err != ErrBlobNotFound {
+		t.Errorf("expected ErrBlobNotFound, got %v", err)
+	}
+	first, err := db.AcquireBlobLock(user.ID, "doc", "a", time.Minute)
+	if err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+	held, err := db.AcquireBlobLock(user.ID, "doc", "b", time.Minute)
+	if err != ErrBlobLocked || held.Holder != "a" {
+		t.Errorf("expected ErrBlobLocked with holder a, got %+v, %v", held, err)
+	}
+	extended, err := db.AcquireBlobLock(user.ID, "doc", "a", time.Hour)
+	if err != nil || !extended.ExpiresAt.After(first.ExpiresAt.Time) {
+		t.Errorf("expected the holder to extend its lock, got %+v, %v", extended, err)
+	}
+	if err := db.ReleaseBlobLock(user.ID, "doc", "b", false); err != ErrBlobLocked {
+		t.Errorf("expected another holder's unlock to fail, got %v", err)
+	}
+
+	// Every write path refuses other sessions unless forced
+	other := Writer{Session: "b"}
+	container := models.Container{Nonce: "n3", Ciphertext: "c", Tag: "t"}
+	writes := []struct {
+		name string
+		fn   func(Writer) error
+	}{
+		{"upsert", func(w Writer) error {
+			return db.UpsertBlobWithinQuota(&models.Blob{UserID: user.ID, BlobName: "doc", EncryptedBlob: container}, 0, w)
+		}},
+		{"rewrap", func(w Writer) error { _, err := db.RewrapBlob(user.ID, "doc", container, 0, w); return err }},
+		{"touch", func(w Writer) error { _, err := db.TouchBlob(user.ID, "doc", w); return err }},
+		{"meta", func(w Writer) error {
+			pinned := true
+			_, err := db.UpdateBlobsMeta(user.ID, []BlobMetaUpdate{{BlobName: "doc", Pinned: &pinned}}, w)
+			return err
+		}},
+		{"delete if version", func(w Writer) error { return db.DeleteBlobIfVersion(user.ID, "doc", []int64{1}, w) }},
+		{"delete", func(w Writer) error { return db.DeleteBlob(user.ID, "doc", w) }},
+	}
+	for _, write := range writes {
+		if err := write.fn(other); err != ErrBlobLocked {
+			t.Errorf("%s: expected ErrBlobLocked for another session, got %v", write.name, err)
+		}
+		if err := write.fn(Writer{}); err != ErrBlobLocked {
+			t.Errorf("%s: expected ErrBlobLocked without a session, got %v", write.name, err)
+		}
+	}
+	if _, err := db.TouchBlob(user.ID, "doc", Writer{Session: "b", Force: true}); err != nil {
+		t.Errorf("expected a forced touch to succeed, got %v", err)
+	}
+
+	// The lock follows a rename and goes away with the blob
+	if _, err := db.RenameBlob(user.ID, "doc", "renamed", models.Container{Nonce: "n2", Ciphertext: "c", Tag: "t"}, nil, 0, Writer{Session: "a"}); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+	if lock, _ := db.GetBlobLock(user.ID, "renamed"); lock == nil || lock.Holder != "a" {
+		t.Errorf("expected the lock to follow the rename, got %+v", lock)
+	}
+	if err := db.DeleteBlob(user.ID, "renamed", Writer{Session: "a"}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	var count int
+	_ = db.conn.QueryRow(`SELECT COUNT(*) FROM blob_locks`).Scan(&count)
+	if count != 0 {
+		t.Errorf("expected the lock to be deleted with the blob, %d left", count)
+	}
+}
+
+func TestBlobSeq(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	seqOf := func(name string) int64 {
+		t.Helper()
+		var seq int64
+		if err := db.conn.QueryRow(`SELECT seq FROM blobs WHERE user_id = ? AND blob_name = ?`, user.ID, name).Scan(&seq); err != nil {
+			t.Fatalf("failed to read seq of %s: %v", name, err)
+		}
+		return seq
+	}
+
+	start, err := db.BlobSeq()
+	if err != nil {
+		t.Fatalf("failed to read sequence: %v", err)
+	}
+	_ = db.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "a", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}})
+	_ = db.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "b", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}})
+	if seqOf("a") != start+1 || seqOf("b") != start+2 {
+		t.Errorf("expected inserts to take consecutive values after %d, got %d and %d", start, seqOf("a"), seqOf("b"))
+	}
+
+	// Every kind of write moves the blob to the end of the sequence
+	last := seqOf("b")
+	writes := []struct {
+		name  string
+		write func() error
+		blob  string
+	}{
+		{"upsert", func() error {
+			return db.UpsertBlob(&models.Blob{UserID: user.ID, BlobName: "a", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c2", Tag: "t"}})
+		}, "a"},
+		{"rename", func() error {
+			_, err := db.RenameBlob(user.ID, "a", "renamed", models.Container{Nonce: "n", Ciphertext: "c3", Tag: "t"}, nil, 0, Writer{})
+			return err
+		}, "renamed"},
+		{"metadata", func() error {
+			collection := "work"
+			_, err := db.UpdateBlobsMeta(user.ID, []BlobMetaUpdate{{BlobName: "b", Collection: &collection}}, Writer{})
+			return err
+		}, "b"},
+	}
+	for _, tt := range writes {
+		if err := tt.write(); err != nil {
+			t.Fatalf("%s failed: %v", tt.name, err)
+		}
+		seq := seqOf(tt.blob)
+		if seq <= last {
+			t.Errorf("%s: expected seq after %d, got %d", tt.name, last, seq)
+		}
+		last = seq
+	}
+	if current, _ := db.BlobSeq(); current != last {
+		t.Errorf("expected the sequence at %d, got %d", last, current)
+	}
+
+	since := seqOf("renamed")
+	items, err := db.ListBlobs(user.ID, BlobFilter{SinceSeq: &since})
+	if err != nil {
+		t.Fatalf("failed to list: %v", err)
+	}
+	if len(items) != 1 || items[0].BlobName != "b" || items[0].Seq != last {
+		t.Errorf("expected only b after seq %d, got %+v", since, items)
+	}
+}
+
+func TestBlobTombstones(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	newUser := func(name string) *models.User {
+		user := &models.User{
+			Username:          name,
+			KDFType:           models.KDFTypePBKDF2SHA256,
+			KDFIterations:     600_000,
+			LoginVerifierHash: []byte("hash"),
+			WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+		}
+		_ = db.CreateUser(user)
+		return user
+	}
+	alice, bob := newUser("alice"), newUser("bob")
+	for _, name := range []string{"doc", "gift"} {
+		_ = db.UpsertBlob(&models.Blob{UserID: alice.ID, BlobName: name, EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}})
+	}
+
+	// A transfer away leaves a tombstone for the source user only
+	if _, err := db.TransferBlob(alice.ID, bob.ID, "gift", 0); err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+	changes, err := db.ListBlobChanges(alice.ID, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to list changes: %v", err)
+	}
+	if len(changes) != 2 || changes[1].BlobName != "gift" || changes[1].Op != models.BlobChangeDelete {
+		t.Errorf("expected doc then a gift tombstone, got %+v", changes)
+	}
+	if changes, _ := db.ListBlobChanges(bob.ID, 0, 0); len(changes) != 1 || changes[0].Op != models.BlobChangeUpsert {
+		t.Errorf("expected gift as an upsert for bob, got %+v", changes)
+	}
+
+	// Deleting the user with blobs works and drops its tombstones
+	if err := db.DeleteUser(alice.ID); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	var count int
+	_ = db.conn.QueryRow(`SELECT COUNT(*) FROM blob_tombstones`).Scan(&count)
+	if count != 0 {
+		t.Errorf("expected no tombstones left, got %d", count)
+	}
+}
+
+func TestKeyEscrow(t *testing.T) {
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	_ = db.CreateUser(user)
+
+	if _, err := db.GetKeyEscrow(user.ID); err != ErrEscrowNotFound {
+		t.Errorf("expected ErrEscrowNotFound, got %v", err)
+	}
+	if _, err := db.GetKeyEscrow(999); err != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+	if _, err := db.PutKeyEscrow(999, models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}); err != ErrUserNotFound {
+		t.Errorf("expected ErrUserNotFound storing for a missing user, got %v", err)
+	}
+
+	// A second put replaces the first
+	_, _ = db.PutKeyEscrow(user.ID, models.Container{Nonce: "n1", Ciphertext: "c1", Tag: "t1"})
+	replacement := models.Container{Nonce: "n2", Ciphertext: "c2", Tag: "t2", Alg: "A256GCM"}
+	if _, err := db.PutKeyEscrow(user.ID, replacement); err != nil {
+		t.Fatalf("failed to replace escrow: %v", err)
+	}
+	escrow, err := db.GetKeyEscrow(user.ID)
+	if err != nil {
+		t.Fatalf("failed to get escrow: %v", err)
+	}
+	if escrow.EscrowedAccountKey != replacement {
+		t.Errorf("expected the replacement escrow, got %+v", escrow.EscrowedAccountKey)
+	}
+
+	if err := db.DeleteUser(user.ID); err != nil {
+		t.Fatalf("failed to delete user: %v", err)
+	}
+	var count int
+	_ = db.conn.QueryRow(`SELECT COUNT(*) FROM key_escrow`).Scan(&count)
+	if count != 0 {
+		t.Errorf("expected the escrow to go with the user, got %d rows", count)
+	}
+}
+
+func TestWriteBatchResults(t *testing.T) {
+	options := DefaultOptions()
+	options.WriteBatchMax = 8
+	options.WriteBatchWindow = 20 * time.Millisecond
+	db, err := NewWithOptions(filepath.Join(t.TempDir(), "batch.db"), options)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	var users []*models.User
+	for _, name := range []string{"alice", "bob"} {
+		user := &models.User{
+			Username:          name,
+			KDFType:           models.KDFTypePBKDF2SHA256,
+			KDFIterations:     600_000,
+			LoginVerifierHash: []byte("hash"),
+			WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+		}
+		if err := db.CreateUser(user); err != nil {
+			t.Fatalf("failed to create user: %v", err)
+		}
+		users = append(users, user)
+	}
+
+	// Alice's writes fit her quota; bob's second blob pushes him over his, and
+	// only that write may fail
+	type write struct {
+		blob  *models.Blob
+		quota int64
+		want  error
+	}
+	var writes []write
+	for i := 0; i < 20; i++ {
+		writes = append(writes, write{
+			blob:  &models.Blob{UserID: users[0].ID, BlobName: fmt.Sprintf("a-%02d", i), EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "0123456789", Tag: "t"}},
+			quota: 1000,
+		})
+	}
+	writes = append(writes,
+		write{blob: &models.Blob{UserID: users[1].ID, BlobName: "small", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "0123456789", Tag: "t"}}, quota: 15},
+		write{blob: &models.Blob{UserID: users[1].ID, BlobName: "big", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "01234567890123456789", Tag: "t"}}, quota: 15, want: ErrQuotaExceeded},
+	)
+
+	errs := make([]error, len(writes))
+	var wg sync.WaitGroup
+	for i, w := range writes {
+		wg.Add(1)
+		go func(i int, w write) {
+			defer wg.Done()
+			errs[i] = db.UpsertBlobWithinQuota(w.blob, w.quota, Writer{})
+		}(i, w)
+	}
+	wg.Wait()
+
+	for i, w := range writes {
+		if errs[i] != w.want {
+			t.Errorf("%s: expected %v, got %v", w.blob.BlobName, w.want, errs[i])
+			continue
+		}
+		if w.want != nil {
+			if _, err := db.GetBlob(w.blob.UserID, w.blob.BlobName); err != ErrBlobNotFound {
+				t.Errorf("%s: expected the rejected write to store nothing, got %v", w.blob.BlobName, err)
+			}
+			continue
+		}
+		if w.blob.ID == 0 || w.blob.Version != 1 {
+			t.Errorf("%s: expected the caller's blob to get its own id and version 1, got id %d version %d", w.blob.BlobName, w.blob.ID, w.blob.Version)
+		}
+		got, err := db.GetBlob(w.blob.UserID, w.blob.BlobName)
+		if err != nil {
+			t.Errorf("%s: expected the blob to be stored, got %v", w.blob.BlobName, err)
+		} else if got.ID != w.blob.ID {
+			t.Errorf("%s: expected id %d, got %d", w.blob.BlobName, w.blob.ID, got.ID)
+		}
+	}
+}
+
+func TestRetryTxRollsBackFailedCommit(t *testing.T) {
+	// ":memory:" has a single connection, so a transaction left open on it
+	// would break every later one
+	db := setupTestDB(t)
+	defer func() { _ = db.Close() }()
+
+	tx, err := db.beginRetryTx()
+	if err != nil {
+		t.Fatalf("failed to begin: %v", err)
+	}
+	// A deferred foreign key violation fails the COMMIT itself, which, like
+	// a busy one, leaves SQLite's transaction open
+	if _, err := tx.Exec(`PRAGMA defer_foreign_keys = ON`); err != nil {
+		t.Fatalf("failed to defer foreign keys: %v", err)
+	}
+	if _, err := tx.Exec(`INSERT INTO sessions (id, user_id, scope, created_at, expires_at) VALUES ('s', 999, 'read', 0, 0)`); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+	_ = tx.Rollback()
+
+	next, err := db.beginRetryTx()
+	if err != nil {
+		t.Fatalf("expected a new transaction to begin, got %v", err)
+	}
+	defer func() { _ = next.Rollback() }()
+	var count int
+	if err := next.QueryRow(`SELECT COUNT(*) FROM sessions`).Scan(&count); err != nil || count != 0 {
+		t.Errorf("expected the failed write to be rolled back, got %d, %v", count, err)
+	}
+}
+
+func TestRetryBusy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "busy.db")
+	options := DefaultOptions()
+	// Without busy_timeout, a held lock surfaces as busy at once
+	options.BusyTimeout = 0
+	options.BusyRetries = 6
+	options.BusyRetryBackoff = 10 * time.Millisecond
+	db, err := NewWithOptions(path, options)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer func() { _ = db.Close() }()
+
+	user := &models.User{
+		Username:          "alice",
+		KDFType:           models.KDFTypePBKDF2SHA256,
+		KDFIterations:     600_000,
+		LoginVerifierHash: []byte("hash"),
+		WrappedAccountKey: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"},
+	}
+	if err := db.CreateUser(user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+
+	// A second handle on the file stands in for a competing writer
+	other, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("failed to open second handle: %v", err)
+	}
+	defer func() { _ = other.Close() }()
+	ctx := context.Background()
+	lock, err := other.Conn(ctx)
+	if err != nil {
+		t.Fatalf("failed to get connection: %v", err)
+	}
+	defer func() { _ = lock.Close() }()
+
+	blob := &models.Blob{UserID: user.ID, BlobName: "a", EncryptedBlob: models.Container{Nonce: "n", Ciphertext: "c", Tag: "t"}}
+
+	// Without retries the write fails while the lock is held
+	db.options.BusyRetries = 0
+	if _, err := lock.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		t.Fatalf("failed to take the write lock: %v", err)
+	}
+	if err := db.UpsertBlob(blob); !isBusy(err) {
+		t.Fatalf("expected a busy error, got %v", err)
+	}
+	if _, err := lock.ExecContext(ctx, `ROLLBACK`); err != nil {
+		t.Fatalf("failed to release the write lock: %v", err)
+	}
+
+	// With retries it waits out a lock released shortly after
+	db.options.BusyRetries = options.BusyRetries
+	retries := busyRetryCount("UpsertBlob")
+	if _, err := lock.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		t.Fatalf("failed to take the write lock: %v", err)
+	}
+	release := time.AfterFunc(50*time.Millisecond, func() { _, _ = lock.ExecContext(ctx, `ROLLBACK`) })
+	defer release.Stop()
+
+	if err := db.UpsertBlob(blob); err != nil {
+		t.Fatalf("expected the retried write to succeed, got %v", err)
+	}
+	if busyRetryCount("UpsertBlob") == retries {
+		t.Error("expected the write to have been retried")
+	}
+	if got, err := db.GetBlob(user.ID, "a"); err != nil || got.Version != 1 {
+		t.Errorf("expected the blob stored once at version 1, got %+v, %v", got, err)
+	}
+}
+
+func busyRetryCount(op string) int64 {
+	v, ok := metrics.DBBusyRetries.Get(op).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
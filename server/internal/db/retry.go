@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// isBusy reports whether err is SQLITE_BUSY or SQLITE_LOCKED, in any of
+// their extended forms: another connection held a lock the statement needed
+func isBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	}
+	return false
+}
+
+// retryBusy runs fn, running it again up to Options.BusyRetries times while
+// it fails with a busy or locked error, waiting Options.BusyRetryBackoff
+// before the first retry and twice as long before each one after. With
+// busy_timeout set on every connection, SQLite has already waited that long
+// before reporting busy, so this is a last resort.
+//
+// A busy error does not undo what fn wrote: a busy statement leaves its
+// transaction open, and so does a busy COMMIT. fn must therefore be a single
+// statement, or run its own retryTx and roll it back on every failure; a busy
+// commit is retried only once that rollback has run. fn must also be safe to
+// repeat from scratch: only wrap writes keyed by name, such as upserts, whose
+// outcome does not depend on how many times they were attempted.
+func (db *DB) retryBusy(op string, fn func() error) error {
+	backoff := db.options.BusyRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= db.options.BusyRetries || !isBusy(err) {
+			return err
+		}
+		metrics.DBBusyRetries.Add(op, 1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// retryTx is a transaction that retryBusy can run again. It keeps its
+// connection so that a failed commit can still be rolled back: a busy COMMIT
+// leaves SQLite's transaction open, but database/sql already counts the Tx as
+// done and would hand the connection back to the pool mid-transaction.
+type retryTx struct {
+	*sql.Tx
+	conn *sql.Conn
+}
+
+// beginRetryTx starts a retryTx. Commit or Rollback releases its connection.
+func (db *DB) beginRetryTx() (*retryTx, error) {
+	ctx := context.Background()
+	conn, err := db.conn.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &retryTx{Tx: tx, conn: conn}, nil
+}
+
+// Commit commits the transaction, rolling it back if the commit fails
+func (t *retryTx) Commit() error {
+	err := t.Tx.Commit()
+	if err != nil {
+		_, _ = t.conn.ExecContext(context.Background(), `ROLLBACK`)
+	}
+	_ = t.conn.Close()
+	return err
+}
+
+// Rollback rolls the transaction back; after Commit it does nothing
+func (t *retryTx) Rollback() error {
+	err := t.Tx.Rollback()
+	_ = t.conn.Close()
+	return err
+}
@@ -33,4 +33,247 @@ CREATE TABLE IF NOT EXISTS blobs (
 
 CREATE INDEX IF NOT EXISTS idx_blobs_user_id ON blobs(user_id);
 CREATE INDEX IF NOT EXISTS idx_blobs_user_id_blob_name ON blobs(user_id, blob_name);
+
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
 `
+
+// migrations are applied in order on top of the base schema. An entry's
+// version is its 1-based position; never edit or reorder released entries,
+// append a new one instead.
+var migrations = []string{
+	// 1: integrity checksum of the stored encrypted blob
+	`ALTER TABLE blobs ADD COLUMN checksum TEXT`,
+	// 2: optional expiry for ephemeral blobs
+	`ALTER TABLE blobs ADD COLUMN expires_at DATETIME;
+	 CREATE INDEX IF NOT EXISTS idx_blobs_expires_at ON blobs(expires_at) WHERE expires_at IS NOT NULL`,
+	// 3: last username change, for the rename cooldown
+	`ALTER TABLE users ADD COLUMN username_changed_at DATETIME`,
+	// 4: hash algorithm of login_verifier_hash; existing rows were all PBKDF2-SHA256
+	`ALTER TABLE users ADD COLUMN login_verifier_hash_alg TEXT NOT NULL DEFAULT 'pbkdf2_sha256'`,
+	// 5: AEAD algorithm of stored containers; empty for containers stored without one
+	`ALTER TABLE users ADD COLUMN wrapped_account_key_alg TEXT NOT NULL DEFAULT '';
+	 ALTER TABLE blobs ADD COLUMN encrypted_blob_alg TEXT NOT NULL DEFAULT ''`,
+	// 6: per-blob version, bumped on every write; existing rows start at 1
+	`ALTER TABLE blobs ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+	// 7: issued tokens, so users can see and label their devices
+	`CREATE TABLE IF NOT EXISTS sessions (
+	     id TEXT PRIMARY KEY,
+	     user_id INTEGER NOT NULL,
+	     label TEXT NOT NULL DEFAULT '',
+	     scope TEXT NOT NULL,
+	     created_at DATETIME NOT NULL,
+	     expires_at DATETIME NOT NULL,
+	     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	 );
+	 CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)`,
+	// 8: optional collection for scoping listings; '' is the default collection
+	`ALTER TABLE blobs ADD COLUMN collection TEXT NOT NULL DEFAULT '';
+	 CREATE INDEX IF NOT EXISTS idx_blobs_user_id_collection ON blobs(user_id, collection, blob_name)`,
+	// 9: single-use registration invites for -require-invite
+	`CREATE TABLE IF NOT EXISTS invites (
+	     code TEXT PRIMARY KEY,
+	     created_at DATETIME NOT NULL,
+	     used_at DATETIME,
+	     used_by INTEGER REFERENCES users(id) ON DELETE SET NULL
+	 )`,
+	// 10: per-user revision for optimistic concurrency on credential updates
+	`ALTER TABLE users ADD COLUMN rev INTEGER NOT NULL DEFAULT 1`,
+	// 11: oldest-first eviction when -max-sessions is reached
+	`CREATE INDEX IF NOT EXISTS idx_sessions_created_at ON sessions(created_at)`,
+	// 12: content-addressed ciphertext for -dedup-content. A blob with a
+	// content_hash keeps its ciphertext in blob_content; the triggers drop a
+	// reference whenever a blob row is deleted or its content_hash is rewritten.
+	`CREATE TABLE IF NOT EXISTS blob_content (
+	     hash TEXT PRIMARY KEY,
+	     data TEXT NOT NULL,
+	     refcount INTEGER NOT NULL
+	 );
+	 ALTER TABLE blobs ADD COLUMN content_hash TEXT;
+	 CREATE TRIGGER IF NOT EXISTS blobs_content_release_delete AFTER DELETE ON blobs
+	 WHEN OLD.content_hash IS NOT NULL BEGIN
+	     UPDATE blob_content SET refcount = refcount - 1 WHERE hash = OLD.content_hash;
+	     DELETE FROM blob_content WHERE hash = OLD.content_hash AND refcount <= 0;
+	 END;
+	 CREATE TRIGGER IF NOT EXISTS blobs_content_release_update AFTER UPDATE OF content_hash ON blobs
+	 WHEN OLD.content_hash IS NOT NULL BEGIN
+	     UPDATE blob_content SET refcount = refcount - 1 WHERE hash = OLD.content_hash;
+	     DELETE FROM blob_content WHERE hash = OLD.content_hash AND refcount <= 0;
+	 END`,
+	// 13: nonces seen per user and key context, for -reject-nonce-reuse
+	`CREATE TABLE IF NOT EXISTS nonces (
+	     user_id INTEGER NOT NULL,
+	     context TEXT NOT NULL,
+	     nonce_hash TEXT NOT NULL,
+	     checksum TEXT NOT NULL,
+	     PRIMARY KEY (user_id, context, nonce_hash),
+	     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	 ) WITHOUT ROWID`,
+	// 14: auth and blob audit trail. user_id is not a foreign key, so events
+	// outlive the account they describe.
+	`CREATE TABLE IF NOT EXISTS audit_events (
+	     id INTEGER PRIMARY KEY AUTOINCREMENT,
+	     event_type TEXT NOT NULL,
+	     user_id INTEGER,
+	     ip TEXT NOT NULL DEFAULT '',
+	     detail TEXT NOT NULL DEFAULT '',
+	     created_at DATETIME NOT NULL
+	 );
+	 CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
+	 CREATE INDEX IF NOT EXISTS idx_audit_events_user_id ON audit_events(user_id, created_at)`,
+	// 15: advisory blob locks. Keyed by blob id so a lock follows renames and
+	// goes away with the blob; expired rows are ignored until overwritten.
+	`CREATE TABLE IF NOT EXISTS blob_locks (
+	     blob_id INTEGER PRIMARY KEY,
+	     holder TEXT NOT NULL,
+	     expires_at DATETIME NOT NULL,
+	     FOREIGN KEY (blob_id) REFERENCES blobs(id) ON DELETE CASCADE
+	 )`,
+	// 16: server-wide change sequence. Every insert or update of a blob row
+	// takes the next value; existing rows are numbered by id. Writes are
+	// serialized, so seq order is commit order.
+	`CREATE TABLE IF NOT EXISTS blob_seq (
+	     id INTEGER PRIMARY KEY CHECK (id = 1),
+	     value INTEGER NOT NULL
+	 );
+	 ALTER TABLE blobs ADD COLUMN seq INTEGER NOT NULL DEFAULT 0;
+	 UPDATE blobs SET seq = id;
+	 INSERT INTO blob_seq (id, value) SELECT 1, COALESCE(MAX(id), 0) FROM blobs;
+	 CREATE INDEX IF NOT EXISTS idx_blobs_user_id_seq ON blobs(user_id, seq);
+	 CREATE TRIGGER IF NOT EXISTS blobs_seq_insert AFTER INSERT ON blobs BEGIN
+	     UPDATE blob_seq SET value = value + 1 WHERE id = 1;
+	     UPDATE blobs SET seq = (SELECT value FROM blob_seq WHERE id = 1) WHERE id = NEW.id;
+	 END;
+	 CREATE TRIGGER IF NOT EXISTS blobs_seq_update AFTER UPDATE ON blobs
+	 WHEN NEW.seq = OLD.seq BEGIN
+	     UPDATE blob_seq SET value = value + 1 WHERE id = 1;
+	     UPDATE blobs SET seq = (SELECT value FROM blob_seq WHERE id = 1) WHERE id = NEW.id;
+	 END`,
+	// 17: tombstones for blob names that went away, so deletes show up in
+	// change-sequence deltas. A delete, a rename or a transfer away takes the
+	// next seq for the old name; a blob reappearing under the name clears it.
+	// There is no foreign key: rows are dropped with the user by trigger, and
+	// none are written while a user's blobs are deleted along with the user.
+	`CREATE TABLE IF NOT EXISTS blob_tombstones (
+	     user_id INTEGER NOT NULL,
+	     blob_name TEXT NOT NULL,
+	     seq INTEGER NOT NULL,
+	     deleted_at DATETIME NOT NULL,
+	     PRIMARY KEY (user_id, blob_name)
+	 ) WITHOUT ROWID;
+	 CREATE INDEX IF NOT EXISTS idx_blob_tombstones_user_id_seq ON blob_tombstones(user_id, seq);
+	 CREATE TRIGGER IF NOT EXISTS blobs_tombstone_delete AFTER DELETE ON blobs
+	 WHEN EXISTS (SELECT 1 FROM users WHERE id = OLD.user_id) BEGIN
+	     UPDATE blob_seq SET value = value + 1 WHERE id = 1;
+	     INSERT OR REPLACE INTO blob_tombstones (user_id, blob_name, seq, deleted_at)
+	     VALUES (OLD.user_id, OLD.blob_name, (SELECT value FROM blob_seq WHERE id = 1), CURRENT_TIMESTAMP);
+	 END;
+	 CREATE TRIGGER IF NOT EXISTS blobs_tombstone_move AFTER UPDATE OF user_id, blob_name ON blobs
+	 WHEN NEW.user_id != OLD.user_id OR NEW.blob_name != OLD.blob_name BEGIN
+	     UPDATE blob_seq SET value = value + 1 WHERE id = 1;
+	     INSERT OR REPLACE INTO blob_tombstones (user_id, blob_name, seq, deleted_at)
+	     VALUES (OLD.user_id, OLD.blob_name, (SELECT value FROM blob_seq WHERE id = 1), CURRENT_TIMESTAMP);
+	     DELETE FROM blob_tombstones WHERE user_id = NEW.user_id AND blob_name = NEW.blob_name;
+	 END;
+	 CREATE TRIGGER IF NOT EXISTS blobs_tombstone_clear AFTER INSERT ON blobs BEGIN
+	     DELETE FROM blob_tombstones WHERE user_id = NEW.user_id AND blob_name = NEW.blob_name;
+	 END;
+	 CREATE TRIGGER IF NOT EXISTS users_tombstone_cleanup AFTER DELETE ON users BEGIN
+	     DELETE FROM blob_tombstones WHERE user_id = OLD.id;
+	 END`,
+	// 18: opt-in recovery escrow of the account key, wrapped to an
+	// organization key the server never holds
+	`CREATE TABLE IF NOT EXISTS key_escrow (
+	     user_id INTEGER PRIMARY KEY,
+	     nonce TEXT NOT NULL,
+	     ciphertext TEXT NOT NULL,
+	     tag TEXT NOT NULL,
+	     alg TEXT NOT NULL DEFAULT '',
+	     updated_at DATETIME NOT NULL,
+	     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	 )`,
+	// 19: pinned blobs never expire, whatever their expires_at says
+	`ALTER TABLE blobs ADD COLUMN pinned INTEGER NOT NULL DEFAULT 0`,
+	// 20: the username form used for uniqueness and lookup. It equals username
+	// unless Options.CaseInsensitiveUsernames is set, and is re-derived on open
+	// when that option changes.
+	`ALTER TABLE users ADD COLUMN username_canonical TEXT;
+	 UPDATE users SET username_canonical = username;
+	 CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username_canonical ON users(username_canonical)`,
+	// 21: usernames given up by a rename or account deletion, held back from
+	// other accounts for Options.UsernameReleaseHold. released_by is NULL once
+	// the account is gone; otherwise that account may take the name back.
+	`CREATE TABLE IF NOT EXISTS released_usernames (
+	     username_canonical TEXT PRIMARY KEY,
+	     released_by INTEGER,
+	     released_at DATETIME NOT NULL
+	 ) WITHOUT ROWID`,
+	// 22: tokens carry the epoch they were issued under; bumping it revokes
+	// every token of the account at once
+	`ALTER TABLE users ADD COLUMN session_epoch INTEGER NOT NULL DEFAULT 0`,
+	// 23: with encrypted names, blob_name holds the client's HMAC name token
+	// and this the name itself as a JSON container; NULL for plaintext names
+	`ALTER TABLE blobs ADD COLUMN encrypted_name TEXT`,
+	// 24: when a session's token was last used, at SessionActivityResolution;
+	// NULL for sessions not used since this migration
+	`ALTER TABLE sessions ADD COLUMN last_used_at DATETIME`,
+	// 25: ciphertext kept in Options.BlobStore. A blob with a content_ref has
+	// an empty inline column and its stored and decoded sizes recorded here;
+	// the triggers queue a ref for deletion whenever a blob row is deleted or
+	// its content_ref is rewritten, so the file goes only if the write commits.
+	`ALTER TABLE blobs ADD COLUMN content_ref TEXT;
+	 ALTER TABLE blobs ADD COLUMN content_size INTEGER;
+	 ALTER TABLE blobs ADD COLUMN content_decoded_size INTEGER;
+	 CREATE TABLE IF NOT EXISTS blob_content_garbage (
+	     ref TEXT PRIMARY KEY
+	 ) WITHOUT ROWID;
+	 CREATE TRIGGER IF NOT EXISTS blobs_content_ref_release_delete AFTER DELETE ON blobs
+	 WHEN OLD.content_ref IS NOT NULL BEGIN
+	     INSERT OR IGNORE INTO blob_content_garbage (ref) VALUES (OLD.content_ref);
+	 END;
+	 CREATE TRIGGER IF NOT EXISTS blobs_content_ref_release_update AFTER UPDATE OF content_ref ON blobs
+	 WHEN OLD.content_ref IS NOT NULL AND OLD.content_ref IS NOT NEW.content_ref BEGIN
+	     INSERT OR IGNORE INTO blob_content_garbage (ref) VALUES (OLD.content_ref);
+	 END`,
+	// 26: the bytes each blob and each user count against the quota.
+	// stored_size is written with a blob's content; the triggers keep
+	// usage_bytes the sum over the user's blobs, so neither quota checks nor
+	// the storage gauge have to scan blobs. The sequence trigger is set aside
+	// while existing rows are sized, so the backfill is not a change to sync.
+	// SQLite fires the newest trigger first, so the tombstone trigger is
+	// recreated after it to keep a rename's tombstone ahead of its new seq.
+	`ALTER TABLE blobs ADD COLUMN stored_size INTEGER NOT NULL DEFAULT 0;
+	 DROP TRIGGER IF EXISTS blobs_seq_update;
+	 UPDATE blobs SET stored_size =
+	     COALESCE(content_size, length(COALESCE((SELECT data FROM blob_content WHERE hash = blobs.content_hash), encrypted_blob_ciphertext)))
+	     + COALESCE(length(encrypted_name), 0);
+	 CREATE TRIGGER IF NOT EXISTS blobs_seq_update AFTER UPDATE ON blobs
+	 WHEN NEW.seq = OLD.seq BEGIN
+	     UPDATE blob_seq SET value = value + 1 WHERE id = 1;
+	     UPDATE blobs SET seq = (SELECT value FROM blob_seq WHERE id = 1) WHERE id = NEW.id;
+	 END;
+	 DROP TRIGGER IF EXISTS blobs_tombstone_move;
+	 CREATE TRIGGER IF NOT EXISTS blobs_tombstone_move AFTER UPDATE OF user_id, blob_name ON blobs
+	 WHEN NEW.user_id != OLD.user_id OR NEW.blob_name != OLD.blob_name BEGIN
+	     UPDATE blob_seq SET value = value + 1 WHERE id = 1;
+	     INSERT OR REPLACE INTO blob_tombstones (user_id, blob_name, seq, deleted_at)
+	     VALUES (OLD.user_id, OLD.blob_name, (SELECT value FROM blob_seq WHERE id = 1), CURRENT_TIMESTAMP);
+	     DELETE FROM blob_tombstones WHERE user_id = NEW.user_id AND blob_name = NEW.blob_name;
+	 END;
+	 ALTER TABLE users ADD COLUMN usage_bytes INTEGER NOT NULL DEFAULT 0;
+	 UPDATE users SET usage_bytes = (SELECT COALESCE(SUM(stored_size), 0) FROM blobs WHERE user_id = users.id);
+	 CREATE INDEX IF NOT EXISTS idx_users_usage_bytes ON users(usage_bytes);
+	 CREATE TRIGGER IF NOT EXISTS blobs_usage_insert AFTER INSERT ON blobs BEGIN
+	     UPDATE users SET usage_bytes = usage_bytes + NEW.stored_size WHERE id = NEW.user_id;
+	 END;
+	 CREATE TRIGGER IF NOT EXISTS blobs_usage_delete AFTER DELETE ON blobs BEGIN
+	     UPDATE users SET usage_bytes = usage_bytes - OLD.stored_size WHERE id = OLD.user_id;
+	 END;
+	 CREATE TRIGGER IF NOT EXISTS blobs_usage_update AFTER UPDATE OF user_id, stored_size ON blobs
+	 WHEN NEW.user_id != OLD.user_id OR NEW.stored_size != OLD.stored_size BEGIN
+	     UPDATE users SET usage_bytes = usage_bytes - OLD.stored_size WHERE id = OLD.user_id;
+	     UPDATE users SET usage_bytes = usage_bytes + NEW.stored_size WHERE id = NEW.user_id;
+	 END`,
+}
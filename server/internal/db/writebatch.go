@@ -0,0 +1,199 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/models"
+)
+
+// pendingUpsert is one caller's write waiting in a writeBatcher
+type pendingUpsert struct {
+	blob       *models.Blob
+	quotaBytes int64
+	writer     Writer
+	staged     *stagedContent // the blob's content, put before the batch
+	result     error          // set by upsertInSavepoint
+	done       chan error
+}
+
+// writeBatcher coalesces concurrent UpsertBlobWithinQuota calls into shared
+// transactions, so a burst of small writes pays for one commit per batch
+// instead of one per blob. The first caller to find no batch in flight writes
+// its blob at once; callers arriving meanwhile queue up and go out together in
+// the next batch. Only when writes are already queueing does a batch wait up
+// to window for more. Each write runs in its own savepoint, so one caller's
+// error rolls back only that caller's blob.
+type writeBatcher struct {
+	db       *DB
+	window   time.Duration
+	maxBatch int
+
+	mu       sync.Mutex
+	pending  []*pendingUpsert
+	flushing bool
+	full     chan struct{} // signalled when pending reaches maxBatch
+}
+
+// newWriteBatcher returns a batcher, or nil if maxBatch does not allow batching
+func newWriteBatcher(db *DB, window time.Duration, maxBatch int) *writeBatcher {
+	if maxBatch <= 1 {
+		return nil
+	}
+	return &writeBatcher{db: db, window: window, maxBatch: maxBatch, full: make(chan struct{}, 1)}
+}
+
+// upsert queues the write and returns its own result once its batch commits
+func (b *writeBatcher) upsert(blob *models.Blob, quotaBytes int64, writer Writer) error {
+	staged, err := b.db.stageBlobContent(blob.UserID, blob.EncryptedBlob.Ciphertext)
+	if err != nil {
+		return err
+	}
+	req := &pendingUpsert{blob: blob, quotaBytes: quotaBytes, writer: writer, staged: staged, done: make(chan error, 1)}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, req)
+	if len(b.pending) >= b.maxBatch {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+	if b.flushing {
+		b.mu.Unlock()
+		return <-req.done
+	}
+	b.flushing = true
+	b.mu.Unlock()
+
+	b.flush()
+	return <-req.done
+}
+
+// flush writes one batch and hands the rest of the queue to a new flusher, so
+// the caller that started it is not held up by later arrivals. flushing stays
+// set until the batch has committed, so only one batch transaction is ever
+// open and queued writes never contend with it for the write lock.
+func (b *writeBatcher) flush() {
+	b.mu.Lock()
+	if len(b.pending) > 1 && len(b.pending) < b.maxBatch && b.window > 0 {
+		// Writes are queueing up: hold the batch open for more
+		select {
+		case <-b.full:
+		default:
+		}
+		b.mu.Unlock()
+		timer := time.NewTimer(b.window)
+		select {
+		case <-b.full:
+		case <-timer.C:
+		}
+		timer.Stop()
+		b.mu.Lock()
+	}
+	n := min(len(b.pending), b.maxBatch)
+	batch := make([]*pendingUpsert, n)
+	copy(batch, b.pending)
+	b.pending = b.pending[n:]
+	b.mu.Unlock()
+
+	b.write(batch)
+
+	b.mu.Lock()
+	more := len(b.pending) > 0
+	if !more {
+		b.flushing = false
+	}
+	b.mu.Unlock()
+	if more {
+		go b.flush()
+	}
+}
+
+// write applies a batch in one transaction and delivers each caller's result
+func (b *writeBatcher) write(batch []*pendingUpsert) {
+	defer b.db.observe("UpsertBatch", 0, time.Now())
+
+	err := b.db.retryBusy("UpsertBatch", func() error {
+		return b.writeTx(batch)
+	})
+	for _, req := range batch {
+		req.staged.release(err == nil)
+	}
+	if err != nil {
+		for _, req := range batch {
+			req.done <- err
+		}
+		return
+	}
+
+	for _, req := range batch {
+		if req.result == nil {
+			b.db.blobs.invalidate(req.blob.UserID, req.blob.BlobName)
+		}
+	}
+	b.db.collectBlobContent()
+	for _, req := range batch {
+		req.done <- req.result
+	}
+}
+
+// writeTx runs every upsert of a batch in one transaction, recording each
+// outcome in its request. An error means nothing was committed.
+func (b *writeBatcher) writeTx(batch []*pendingUpsert) error {
+	// A retried batch claims its staged content afresh
+	for _, req := range batch {
+		req.staged.reset()
+	}
+
+	tx, err := b.db.beginRetryTx()
+	if err != nil {
+		return fmt.Errorf("failed to begin write batch: %w", err)
+	}
+	for _, req := range batch {
+		if err := upsertInSavepoint(tx, b.db.options, req); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit write batch: %w", err)
+	}
+	return nil
+}
+
+// upsertInSavepoint upserts the request's blob and checks the user's quota
+// inside a savepoint of tx, rolling back to it if either fails, and records
+// the outcome in req.result. An error return means the savepoint itself
+// failed or the database was busy, which leaves the transaction unusable.
+func upsertInSavepoint(tx querier, options Options, req *pendingUpsert) error {
+	if _, err := tx.Exec(`SAVEPOINT batch_upsert`); err != nil {
+		return fmt.Errorf("failed to open savepoint: %w", err)
+	}
+
+	req.result = upsertBlob(tx, options, req.staged, req.blob, nil, req.writer)
+	if req.result == nil && req.quotaBytes > 0 {
+		used, err := usageBytes(tx, req.blob.UserID)
+		if err != nil {
+			req.result = err
+		} else if used > req.quotaBytes {
+			req.result = ErrQuotaExceeded
+		}
+	}
+
+	if isBusy(req.result) {
+		// The lock is held elsewhere, so the whole batch has to go again
+		return req.result
+	}
+	if req.result != nil {
+		if _, err := tx.Exec(`ROLLBACK TO batch_upsert`); err != nil {
+			return fmt.Errorf("failed to roll back savepoint: %w", err)
+		}
+		req.staged.reset()
+	}
+	if _, err := tx.Exec(`RELEASE batch_upsert`); err != nil {
+		return fmt.Errorf("failed to release savepoint: %w", err)
+	}
+	return nil
+}
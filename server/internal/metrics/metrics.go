@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// RequestBodyBytes is the total number of request body bytes read by handlers
+	RequestBodyBytes = expvar.NewInt("http_request_body_bytes_total")
+	// ResponseBodyBytes is the total number of response body bytes written
+	ResponseBodyBytes = expvar.NewInt("http_response_body_bytes_total")
+	// RequestBodySizes counts requests per body size bucket
+	RequestBodySizes = expvar.NewMap("http_request_body_size_bucket")
+	// ResponseBodySizes counts responses per body size bucket
+	ResponseBodySizes = expvar.NewMap("http_response_body_size_bucket")
+
+	// DBQueries counts database operations by name
+	DBQueries = expvar.NewMap("db_queries_total")
+	// DBSlowQueries counts database operations over the slow-query threshold by name
+	DBSlowQueries = expvar.NewMap("db_slow_queries_total")
+	// DBBusyRetries counts database operations retried after SQLITE_BUSY by name
+	DBBusyRetries = expvar.NewMap("db_busy_retries_total")
+	// BlobCacheHits and BlobCacheMisses count GetBlob lookups in the blob cache
+	BlobCacheHits   = expvar.NewInt("blob_cache_hits_total")
+	BlobCacheMisses = expvar.NewInt("blob_cache_misses_total")
+
+	// KDFHashes counts server-side verifier hashes by hash params
+	KDFHashes = expvar.NewMap("kdf_hash_total")
+	// KDFHashNanos is the total time spent in server-side verifier hashes by hash params
+	KDFHashNanos = expvar.NewMap("kdf_hash_duration_nanoseconds_total")
+	// KDFHashDurations counts server-side verifier hashes per "params,bucket" key
+	KDFHashDurations = expvar.NewMap("kdf_hash_duration_bucket")
+
+	// ConcurrencyShed counts requests rejected by a concurrency limit, by limit name
+	ConcurrencyShed = expvar.NewMap("http_concurrency_shed_total")
+	// RateLimited counts requests rejected by a rate limit, by limit name
+	RateLimited = expvar.NewMap("http_rate_limited_total")
+	// ConnLimitWaits counts accepted connections that had to wait for a free
+	// slot under the connection limit
+	ConnLimitWaits = expvar.NewInt("http_conn_limit_waits_total")
+
+	// QuotaRejections counts writes rejected by the storage quota, by UserLabel
+	QuotaRejections = expvar.NewMap("quota_rejections_total")
+)
+
+// storageTopUsers is the latest snapshot for SetStorageTopUsers; the whole map
+// is swapped so a scrape never sees a half-refreshed ranking
+var storageTopUsers struct {
+	sync.RWMutex
+	bytes map[string]int64
+}
+
+func init() {
+	storageTopUsers.bytes = map[string]int64{}
+	expvar.Publish("storage_top_users_bytes", expvar.Func(func() any {
+		storageTopUsers.RLock()
+		defer storageTopUsers.RUnlock()
+		return storageTopUsers.bytes
+	}))
+}
+
+// SetStorageTopUsers replaces the storage_top_users_bytes gauge, keyed by UserLabel
+func SetStorageTopUsers(bytes map[string]int64) {
+	storageTopUsers.Lock()
+	defer storageTopUsers.Unlock()
+	storageTopUsers.bytes = bytes
+}
+
+// userLabelKey keys UserLabel. User ids are small sequential integers, so an
+// unkeyed hash of one would be trivially reversed.
+var userLabelKey struct {
+	sync.RWMutex
+	key []byte
+}
+
+// SetUserLabelKey derives the UserLabel key from a server secret, so labels stay
+// stable across restarts. Until it is called, labels use an empty key.
+func SetUserLabelKey(secret []byte) {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("cryptd metrics user label"))
+
+	userLabelKey.Lock()
+	defer userLabelKey.Unlock()
+	userLabelKey.key = mac.Sum(nil)
+}
+
+// UserLabel pseudonymizes a user id for per-user metrics: operators can follow
+// one user across dashboards without the metrics naming them. It is the first
+// 8 bytes of an HMAC, hex-encoded.
+func UserLabel(userID int64) string {
+	userLabelKey.RLock()
+	mac := hmac.New(sha256.New, userLabelKey.key)
+	userLabelKey.RUnlock()
+
+	mac.Write([]byte(strconv.FormatInt(userID, 10)))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// sizeBuckets are the upper bounds used by SizeBucket
+var sizeBuckets = []struct {
+	limit int64
+	label string
+}{
+	{1 << 10, "le_1KiB"},
+	{64 << 10, "le_64KiB"},
+	{1 << 20, "le_1MiB"},
+	{16 << 20, "le_16MiB"},
+}
+
+// SizeBucket returns the bucket label for a body of n bytes
+func SizeBucket(n int64) string {
+	for _, b := range sizeBuckets {
+		if n <= b.limit {
+			return b.label
+		}
+	}
+	return "gt_16MiB"
+}
+
+// durationBuckets are the upper bounds used by DurationBucket
+var durationBuckets = []struct {
+	limit time.Duration
+	label string
+}{
+	{10 * time.Millisecond, "le_10ms"},
+	{50 * time.Millisecond, "le_50ms"},
+	{100 * time.Millisecond, "le_100ms"},
+	{250 * time.Millisecond, "le_250ms"},
+	{500 * time.Millisecond, "le_500ms"},
+	{time.Second, "le_1s"},
+}
+
+// DurationBucket returns the bucket label for an operation that took d
+func DurationBucket(d time.Duration) string {
+	for _, b := range durationBuckets {
+		if d <= b.limit {
+			return b.label
+		}
+	}
+	return "gt_1s"
+}
+
+// Handler serves all published variables as JSON, like expvar.Handler,
+// but omits "cmdline" since flags may carry secrets.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = fmt.Fprintf(w, "{\n")
+		first := true
+		expvar.Do(func(kv expvar.KeyValue) {
+			if kv.Key == "cmdline" {
+				return
+			}
+			if !first {
+				_, _ = fmt.Fprintf(w, ",\n")
+			}
+			first = false
+			_, _ = fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+		})
+		_, _ = fmt.Fprintf(w, "\n}\n")
+	})
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSizeBucket(t *testing.T) {
+	tests := []struct {
+		n        int64
+		expected string
+	}{
+		{0, "le_1KiB"},
+		{1024, "le_1KiB"},
+		{1025, "le_64KiB"},
+		{1 << 20, "le_1MiB"},
+		{50 << 20, "gt_16MiB"},
+	}
+
+	for _, tt := range tests {
+		if got := SizeBucket(tt.n); got != tt.expected {
+			t.Errorf("SizeBucket(%d) = %s, expected %s", tt.n, got, tt.expected)
+		}
+	}
+}
+
+func TestDurationBucket(t *testing.T) {
+	tests := []struct {
+		d        time.Duration
+		expected string
+	}{
+		{0, "le_10ms"},
+		{10 * time.Millisecond, "le_10ms"},
+		{80 * time.Millisecond, "le_100ms"},
+		{time.Second, "le_1s"},
+		{3 * time.Second, "gt_1s"},
+	}
+
+	for _, tt := range tests {
+		if got := DurationBucket(tt.d); got != tt.expected {
+			t.Errorf("DurationBucket(%s) = %s, expected %s", tt.d, got, tt.expected)
+		}
+	}
+}
+
+func TestUserLabel(t *testing.T) {
+	SetUserLabelKey([]byte("secret"))
+	first := UserLabel(1)
+	if len(first) != 16 || first != UserLabel(1) || first == UserLabel(2) {
+		t.Errorf("expected stable, distinct 16-character labels, got %q", first)
+	}
+
+	SetUserLabelKey([]byte("other secret"))
+	if UserLabel(1) == first {
+		t.Error("expected the label to depend on the key")
+	}
+}
+
+func TestHandlerOmitsCmdline(t *testing.T) {
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("metrics output is not valid JSON: %v", err)
+	}
+
+	if _, ok := vars["cmdline"]; ok {
+		t.Error("cmdline must not be exposed")
+	}
+	if _, ok := vars["http_request_body_bytes_total"]; !ok {
+		t.Error("expected http_request_body_bytes_total to be exposed")
+	}
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+var ErrInvalidAdminToken = errors.New("invalid admin token")
+
+// AdminAuthMiddleware creates a middleware that requires the static admin bearer token
+func AdminAuthMiddleware(adminToken string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString, err := BearerToken(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			// An empty admin token must never authenticate anyone
+			if adminToken == "" || subtle.ConstantTimeCompare([]byte(tokenString), []byte(adminToken)) != 1 {
+				http.Error(w, ErrInvalidAdminToken.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
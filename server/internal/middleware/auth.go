@@ -15,11 +15,39 @@ var (
 	ErrMissingAuthHeader = errors.New("missing authorization header")
 	ErrInvalidAuthHeader = errors.New("invalid authorization header format")
 	ErrInvalidToken      = errors.New("invalid token")
+	ErrInsufficientScope = errors.New("token scope does not permit this operation")
 )
 
 type contextKey string
 
-const UserIDContextKey contextKey = "user_id"
+const (
+	UserIDContextKey contextKey = "user_id"
+	ScopeContextKey  contextKey = "scope"
+	// SessionIDContextKey holds the token's jti; empty for tokens issued without a session
+	SessionIDContextKey contextKey = "session_id"
+	// EpochContextKey holds the session epoch the token was issued under
+	EpochContextKey contextKey = "session_epoch"
+	// forwardedHTTPSContextKey marks a request a trusted proxy received over TLS
+	forwardedHTTPSContextKey contextKey = "forwarded_https"
+)
+
+// Scope limits what a token may do
+type Scope string
+
+const (
+	ScopeRead      Scope = "read"
+	ScopeReadWrite Scope = "readwrite"
+)
+
+// Valid reports whether s is a known scope
+func (s Scope) Valid() bool {
+	return s == ScopeRead || s == ScopeReadWrite
+}
+
+// Allows reports whether a token with scope s may perform an operation requiring required
+func (s Scope) Allows(required Scope) bool {
+	return s == ScopeReadWrite || s == required
+}
 
 // JWTConfig holds the JWT configuration
 type JWTConfig struct {
@@ -31,6 +59,10 @@ type JWTConfig struct {
 // Claims represents JWT claims
 type Claims struct {
 	UserID int64 `json:"user_id"`
+	// Scope is empty in tokens issued before scopes existed; those are treated as readwrite
+	Scope Scope `json:"scope,omitempty"`
+	// Epoch is the account's session epoch at issue; revoking sessions bumps it
+	Epoch int64 `json:"epoch,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -43,12 +75,26 @@ func NewJWTConfig(secret string) *JWTConfig {
 	}
 }
 
-// GenerateToken generates a JWT token for a user
+// GenerateToken generates a readwrite JWT token for a user
 func (c *JWTConfig) GenerateToken(userID int64) (string, error) {
-	now := time.Now()
+	return c.GenerateScopedToken(userID, ScopeReadWrite)
+}
+
+// GenerateScopedToken generates a JWT token for a user limited to scope
+func (c *JWTConfig) GenerateScopedToken(userID int64, scope Scope) (string, error) {
+	return c.GenerateSessionToken(userID, scope, "", 0, time.Now())
+}
+
+// GenerateSessionToken generates a JWT token for a user limited to scope whose
+// jti is sessionID, bound to the account's session epoch and issued at now so
+// the caller can record the same expiry
+func (c *JWTConfig) GenerateSessionToken(userID int64, scope Scope, sessionID string, epoch int64, now time.Time) (string, error) {
 	claims := Claims{
 		UserID: userID,
+		Scope:  scope,
+		Epoch:  epoch,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        sessionID,
 			ExpiresAt: jwt.NewNumericDate(now.Add(c.Expiration)),
 			IssuedAt:  jwt.NewNumericDate(now),
 			NotBefore: jwt.NewNumericDate(now),
@@ -85,21 +131,12 @@ func (c *JWTConfig) ValidateToken(tokenString string) (*Claims, error) {
 func (c *JWTConfig) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Extract token from Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, ErrMissingAuthHeader.Error(), http.StatusUnauthorized)
-			return
-		}
-
-		// Check for Bearer prefix
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, ErrInvalidAuthHeader.Error(), http.StatusUnauthorized)
+		tokenString, err := BearerToken(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		tokenString := parts[1]
-
 		// Validate token
 		claims, err := c.ValidateToken(tokenString)
 		if err != nil {
@@ -107,12 +144,50 @@ func (c *JWTConfig) AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		// Add user ID to context
+		scope := claims.Scope
+		if scope == "" {
+			scope = ScopeReadWrite
+		}
+
+		// Add user ID and scope to context
 		ctx := context.WithValue(r.Context(), UserIDContextKey, claims.UserID)
+		ctx = context.WithValue(ctx, ScopeContextKey, scope)
+		ctx = context.WithValue(ctx, SessionIDContextKey, claims.ID)
+		ctx = context.WithValue(ctx, EpochContextKey, claims.Epoch)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// RequireScope rejects requests whose token scope does not allow required with 403.
+// It must run after AuthMiddleware.
+func RequireScope(required Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !GetScopeFromContext(r.Context()).Allows(required) {
+				http.Error(w, ErrInsufficientScope.Error(), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// BearerToken extracts the token from a "Bearer <token>" Authorization header
+func BearerToken(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", ErrMissingAuthHeader
+	}
+
+	// Check for Bearer prefix
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", ErrInvalidAuthHeader
+	}
+
+	return parts[1], nil
+}
+
 // GetUserIDFromContext extracts the user ID from the request context
 func GetUserIDFromContext(ctx context.Context) (int64, error) {
 	userID, ok := ctx.Value(UserIDContextKey).(int64)
@@ -121,3 +196,25 @@ func GetUserIDFromContext(ctx context.Context) (int64, error) {
 	}
 	return userID, nil
 }
+
+// GetScopeFromContext returns the token scope from the request context, or
+// ScopeRead when none is set so a missing scope never grants write access
+func GetScopeFromContext(ctx context.Context) Scope {
+	scope, ok := ctx.Value(ScopeContextKey).(Scope)
+	if !ok {
+		return ScopeRead
+	}
+	return scope
+}
+
+// GetSessionIDFromContext returns the token's session ID, or "" if it has none
+func GetSessionIDFromContext(ctx context.Context) string {
+	sessionID, _ := ctx.Value(SessionIDContextKey).(string)
+	return sessionID
+}
+
+// GetEpochFromContext returns the session epoch the token was issued under
+func GetEpochFromContext(ctx context.Context) int64 {
+	epoch, _ := ctx.Value(EpochContextKey).(int64)
+	return epoch
+}
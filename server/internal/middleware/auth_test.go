@@ -279,3 +279,51 @@ func TestClaimsIssuer(t *testing.T) {
 		t.Errorf("expected issuer 'cryptd', got '%s'", claims.Issuer)
 	}
 }
+
+func TestRequireScope(t *testing.T) {
+	config := NewJWTConfig("test-secret")
+	handler := config.AuthMiddleware(RequireScope(ScopeReadWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	legacyClaims := Claims{
+		UserID: 123,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	legacy, _ := jwt.NewWithClaims(config.SigningMethod, legacyClaims).SignedString(config.Secret)
+
+	readToken, _ := config.GenerateScopedToken(123, ScopeRead)
+	readWriteToken, _ := config.GenerateScopedToken(123, ScopeReadWrite)
+
+	tests := []struct {
+		name     string
+		token    string
+		expected int
+	}{
+		{"read", readToken, http.StatusForbidden},
+		{"readwrite", readWriteToken, http.StatusOK},
+		{"unscoped legacy token", legacy, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", "/test", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.expected {
+				t.Errorf("expected status %d, got %d", tt.expected, w.Code)
+			}
+		})
+	}
+}
+
+func TestGetScopeFromContextMissing(t *testing.T) {
+	if scope := GetScopeFromContext(context.Background()); scope != ScopeRead {
+		t.Errorf("expected missing scope to default to read, got %q", scope)
+	}
+}
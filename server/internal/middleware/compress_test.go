@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzip(t *testing.T) {
+	large := strings.Repeat(`{"blobName":"vault"},`, 100)
+	handler := func(contentType, body string) http.Handler {
+		return Gzip(1024, "application/json")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = io.WriteString(w, body)
+		}))
+	}
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		body           string
+		expectGzip     bool
+	}{
+		{"large JSON", "gzip, deflate", "application/json", large, true},
+		{"JSON with charset", "br;q=1.0, gzip;q=0.5", "application/json; charset=utf-8", large, true},
+		{"small JSON", "gzip", "application/json", `{"ok":true}`, false},
+		{"ciphertext", "gzip", "application/octet-stream", large, false},
+		{"gzip refused", "gzip;q=0", "application/json", large, false},
+		{"no Accept-Encoding", "", "application/json", large, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			handler(tt.contentType, tt.body).ServeHTTP(w, req)
+
+			if w.Code != http.StatusCreated {
+				t.Errorf("expected status to pass through, got %d", w.Code)
+			}
+			if w.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("expected Vary: Accept-Encoding, got %q", w.Header().Get("Vary"))
+			}
+
+			body := w.Body.String()
+			if gotGzip := w.Header().Get("Content-Encoding") == "gzip"; gotGzip != tt.expectGzip {
+				t.Fatalf("expected gzip=%v, got Content-Encoding %q", tt.expectGzip, w.Header().Get("Content-Encoding"))
+			}
+			if tt.expectGzip {
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("invalid gzip stream: %v", err)
+				}
+				data, _ := io.ReadAll(zr)
+				body = string(data)
+			}
+			if body != tt.body {
+				t.Errorf("body mismatch after decoding: got %d bytes, expected %d", len(body), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestGzipFlush(t *testing.T) {
+	w := httptest.NewRecorder()
+	chunk := `{"blobName":"vault"}`
+	handler := Gzip(1024, "application/json")(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(rw, chunk)
+		if err := http.NewResponseController(rw).Flush(); err != nil {
+			t.Fatalf("expected the writer to support flushing, got %v", err)
+		}
+
+		// What was written so far reaches the client, compressed, before the handler returns
+		if !w.Flushed || w.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("expected a flushed gzip response, got flushed=%v, Content-Encoding %q", w.Flushed, w.Header().Get("Content-Encoding"))
+		}
+		zr, err := gzip.NewReader(strings.NewReader(w.Body.String()))
+		if err != nil {
+			t.Fatalf("invalid gzip stream: %v", err)
+		}
+		got := make([]byte, len(chunk))
+		if _, err := io.ReadFull(zr, got); err != nil || string(got) != chunk {
+			t.Errorf("expected %q readable after the flush, got %q, %v", chunk, got, err)
+		}
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// ErrHTTPSRequired is returned for plaintext requests under RequireHTTPS
+var ErrHTTPSRequired = errors.New("https required")
+
+// RequireHTTPS rejects requests that did not arrive over TLS with 426 Upgrade
+// Required. A request counts as TLS if the server terminated it, or if the
+// immediate peer is in trusted and says so with X-Forwarded-Proto: https; the
+// header is ignored from anyone else. With redirect, GET and HEAD requests are
+// sent to the https:// URL with 308 instead, which is only useful to browsers:
+// API clients that sent a token in the clear have already leaked it.
+// Requests for an exempt path pass in plaintext, for health checks that a
+// load balancer sends straight to the server over plain HTTP.
+// It must run before RealIP, which replaces the peer address.
+func RequireHTTPS(trusted []netip.Prefix, redirect bool, exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isHTTPS(r, trusted) || slices.Contains(exempt, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if redirect && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+				http.Redirect(w, r, "https://"+r.Host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+				return
+			}
+			w.Header().Set("Upgrade", "TLS/1.2, HTTP/1.1")
+			w.Header().Set("Connection", "Upgrade")
+			http.Error(w, ErrHTTPSRequired.Error(), http.StatusUpgradeRequired)
+		})
+	}
+}
+
+// isHTTPS reports whether r arrived over TLS, directly or via a trusted proxy
+func isHTTPS(r *http.Request, trusted []netip.Prefix) bool {
+	if r.TLS != nil {
+		return true
+	}
+	peer, ok := remoteAddr(r.RemoteAddr)
+	if !ok || !isTrusted(trusted, peer) {
+		return false
+	}
+	return forwardedHTTPS(r)
+}
+
+// forwardedHTTPS reports whether r's X-Forwarded-Proto says https. Only ask
+// for a request from a trusted peer.
+func forwardedHTTPS(r *http.Request) bool {
+	// A chain of proxies may append; the last value is the one nearest to us
+	values := strings.Split(strings.Join(r.Header.Values("X-Forwarded-Proto"), ","), ",")
+	return strings.EqualFold(strings.TrimSpace(values[len(values)-1]), "https")
+}
+
+// Scheme returns "https" for a request that arrived over TLS, directly or,
+// behind RealIP, via a trusted proxy's X-Forwarded-Proto, and "http" otherwise
+func Scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if forwarded, _ := r.Context().Value(forwardedHTTPSContextKey).(bool); forwarded {
+		return "https"
+	}
+	return "http"
+}
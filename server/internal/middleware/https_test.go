@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireHTTPS(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("failed to parse trusted proxies: %v", err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		redirect   bool
+		method     string
+		remoteAddr string
+		proto      []string
+		tls        bool
+		expected   int
+	}{
+		{"direct tls", false, "GET", "203.0.113.9:4000", nil, true, http.StatusOK},
+		{"plaintext", false, "GET", "203.0.113.9:4000", nil, false, http.StatusUpgradeRequired},
+		{"trusted proxy https", false, "POST", "10.1.2.3:4000", []string{"https"}, false, http.StatusOK},
+		{"trusted proxy http", false, "POST", "10.1.2.3:4000", []string{"http"}, false, http.StatusUpgradeRequired},
+		{"trusted proxy without header", false, "GET", "10.1.2.3:4000", nil, false, http.StatusUpgradeRequired},
+		{"untrusted peer cannot claim https", false, "GET", "203.0.113.9:4000", []string{"https"}, false, http.StatusUpgradeRequired},
+		{"nearest proxy wins", false, "GET", "10.1.2.3:4000", []string{"https", "http"}, false, http.StatusUpgradeRequired},
+		{"redirect get", true, "GET", "203.0.113.9:4000", nil, false, http.StatusPermanentRedirect},
+		{"redirect skips post", true, "POST", "203.0.113.9:4000", nil, false, http.StatusUpgradeRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://api.example.com/v1/blobs?limit=5", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.proto {
+				req.Header.Add("X-Forwarded-Proto", value)
+			}
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+
+			w := httptest.NewRecorder()
+			RequireHTTPS(trusted, tt.redirect)(next).ServeHTTP(w, req)
+			if w.Code != tt.expected {
+				t.Fatalf("expected status %d, got %d", tt.expected, w.Code)
+			}
+			switch w.Code {
+			case http.StatusUpgradeRequired:
+				if w.Header().Get("Upgrade") == "" {
+					t.Error("expected an Upgrade header on 426")
+				}
+			case http.StatusPermanentRedirect:
+				if location := w.Header().Get("Location"); location != "https://api.example.com/v1/blobs?limit=5" {
+					t.Errorf("unexpected redirect location %q", location)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireHTTPSExempt(t *testing.T) {
+	handler := RequireHTTPS(nil, true, "/health")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for target, expected := range map[string]int{
+		"http://api.example.com/health":     http.StatusOK,
+		"http://api.example.com/health/":    http.StatusPermanentRedirect,
+		"http://api.example.com/v1/version": http.StatusPermanentRedirect,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != expected {
+			t.Errorf("%s: expected status %d, got %d", target, expected, w.Code)
+		}
+	}
+}
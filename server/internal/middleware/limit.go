@@ -0,0 +1,217 @@
+package middleware
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
+)
+
+var (
+	ErrConcurrencyLimit = errors.New("too many concurrent requests, retry shortly")
+	ErrRateLimited      = errors.New("too many requests, slow down")
+)
+
+// concurrencyRetryAfterSeconds is the Retry-After sent with shed requests
+const concurrencyRetryAfterSeconds = 1
+
+// ConcurrencyLimit returns a middleware that lets at most limit requests run
+// at once through every route it wraps; create it once and share it across
+// the routes that should count against the same limit. Requests beyond the
+// limit are shed immediately with 503 and Retry-After rather than queued, and
+// counted under name in metrics. A limit of 0 or less disables it.
+func ConcurrencyLimit(name string, limit int) func(http.Handler) http.Handler {
+	if limit <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+
+	slots := make(chan struct{}, limit)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				next.ServeHTTP(w, r)
+			default:
+				metrics.ConcurrencyShed.Add(name, 1)
+				w.Header().Set("Retry-After", strconv.Itoa(concurrencyRetryAfterSeconds))
+				http.Error(w, ErrConcurrencyLimit.Error(), http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+// RateLimit returns a middleware that lets each key make perMinute requests a
+// minute through every route it wraps, in bursts of up to burst (perMinute
+// when 0 or less); like ConcurrencyLimit, create it once per group of routes
+// that share the budget. Requests over the rate get 429 with Retry-After and
+// are counted under name in metrics. A rate of 0 or less disables it.
+func RateLimit(name string, perMinute, burst int, key func(*http.Request) string) func(http.Handler) http.Handler {
+	if perMinute <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	if burst <= 0 {
+		burst = perMinute
+	}
+
+	limiter := &rateLimiter{burst: float64(burst), buckets: map[string]*rateBucket{}}
+	limiter.perNano = float64(perMinute) / float64(time.Minute)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if wait := limiter.take(key(r), time.Now()); wait > 0 {
+				metrics.RateLimited.Add(name, 1)
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, ErrRateLimited.Error(), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ClientIPKey keys RateLimit by client address; behind RealIP that is the
+// forwarded client when the peer is a trusted proxy
+func ClientIPKey(r *http.Request) string {
+	if addr, ok := remoteAddr(r.RemoteAddr); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+// UserIDKey keys RateLimit by the authenticated user; it must run after the
+// auth middleware, and requests without a user share one bucket
+func UserIDKey(r *http.Request) string {
+	userID, _ := GetUserIDFromContext(r.Context())
+	return strconv.FormatInt(userID, 10)
+}
+
+// rateLimiter is a token bucket per key. Buckets idle long enough to have
+// refilled completely are dropped instead of kept around.
+type rateLimiter struct {
+	mu        sync.Mutex
+	burst     float64
+	perNano   float64
+	buckets   map[string]*rateBucket
+	lastPrune time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token from key's bucket. It returns 0 on success, otherwise
+// how long until a token is available.
+func (l *rateLimiter) take(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) >= time.Minute {
+		for k, b := range l.buckets {
+			if float64(now.Sub(b.last))*l.perNano >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+float64(now.Sub(b.last))*l.perNano)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.perNano)
+	}
+	b.tokens--
+	return 0
+}
+
+// connLimitLogInterval spaces out "limit reached" logs during a sustained flood
+const connLimitLogInterval = time.Minute
+
+// LimitListener returns a listener that keeps at most limit connections open.
+// Once the limit is reached, Accept waits for a connection to close before
+// taking the next one, so excess clients queue in the kernel backlog instead
+// of costing goroutines and file descriptors. Waits are counted in metrics and
+// logged at most once a minute. A limit of 0 or less returns l unchanged.
+func LimitListener(l net.Listener, limit int) net.Listener {
+	if limit <= 0 {
+		return l
+	}
+	return &limitListener{Listener: l, slots: make(chan struct{}, limit), done: make(chan struct{})}
+}
+
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	lastLog   atomic.Int64 // unix nanos of the last "limit reached" log
+}
+
+// acquire takes a connection slot, waiting for one if all are in use. It
+// fails once the listener is closed.
+func (l *limitListener) acquire() bool {
+	select {
+	case <-l.done:
+		return false
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	metrics.ConnLimitWaits.Add(1)
+	now := time.Now().UnixNano()
+	if last := l.lastLog.Load(); now-last >= int64(connLimitLogInterval) && l.lastLog.CompareAndSwap(last, now) {
+		log.Printf("Connection limit of %d reached; new connections wait for one to close", cap(l.slots))
+	}
+
+	select {
+	case <-l.done:
+		return false
+	case l.slots <- struct{}{}:
+		return true
+	}
+}
+
+func (l *limitListener) release() { <-l.slots }
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if !l.acquire() {
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: l.release}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitConn frees its listener slot on the first Close
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
@@ -0,0 +1,264 @@
+package middleware
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	const limit = 2
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	handler := ConcurrencyLimit("test", limit)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Fill every slot with a request that blocks until released
+	var wg sync.WaitGroup
+	codes := make([]int, limit)
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("PUT", "/", nil))
+			codes[i] = w.Code
+		}(i)
+		<-entered
+	}
+
+	// The next one is shed without reaching the handler
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 when saturated, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After on a shed request")
+	}
+	if shed, ok := metrics.ConcurrencyShed.Get("test").(*expvar.Int); !ok || shed.Value() != 1 {
+		t.Errorf("expected 1 shed request counted, got %v", metrics.ConcurrencyShed.Get("test"))
+	}
+
+	close(release)
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d: expected status 200, got %d", i, code)
+		}
+	}
+
+	// Freed slots admit new requests
+	go func() { <-entered }()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 after release, got %d", w.Code)
+	}
+}
+
+func TestConcurrencyLimitDisabled(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := ConcurrencyLimit("test", 0)(next)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 with the limit disabled, got %d", w.Code)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	handler := RateLimit("test", 2, 0, ClientIPKey)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// The burst is spent regardless of port
+	for i, addr := range []string{"192.0.2.1:1000", "192.0.2.1:2000"} {
+		if w := request(addr); w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200, got %d", i, w.Code)
+		}
+	}
+	w := request("192.0.2.1:3000")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429 over the rate, got %d", w.Code)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "30" {
+		t.Errorf("expected Retry-After 30, got %q", retry)
+	}
+	if limited, ok := metrics.RateLimited.Get("test").(*expvar.Int); !ok || limited.Value() != 1 {
+		t.Errorf("expected 1 limited request counted, got %v", metrics.RateLimited.Get("test"))
+	}
+
+	// Other clients have their own bucket
+	if w := request("192.0.2.2:1000"); w.Code != http.StatusOK {
+		t.Errorf("expected another client to pass, got %d", w.Code)
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	limiter := &rateLimiter{burst: 1, buckets: map[string]*rateBucket{}}
+	limiter.perNano = limiter.burst / float64(time.Minute)
+	now := time.Now()
+
+	if wait := limiter.take("a", now); wait != 0 {
+		t.Fatalf("expected the first take to pass, got wait %v", wait)
+	}
+	if wait := limiter.take("a", now.Add(30*time.Second)); wait != 30*time.Second {
+		t.Errorf("expected a 30s wait halfway through the refill, got %v", wait)
+	}
+	if wait := limiter.take("a", now.Add(time.Minute)); wait != 0 {
+		t.Errorf("expected a refilled token after a minute, got wait %v", wait)
+	}
+
+	// Idle buckets are full again, so they are pruned
+	limiter.take("b", now.Add(3*time.Minute))
+	if _, ok := limiter.buckets["a"]; ok || len(limiter.buckets) != 1 {
+		t.Errorf("expected the idle bucket to be pruned, got %v", limiter.buckets)
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	handler := RateLimit("test", 0, 0, ClientIPKey)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200 without a limit, got %d", i, w.Code)
+		}
+	}
+}
+
+func TestLimitListener(t *testing.T) {
+	const limit, clients = 3, 20
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	listener := LimitListener(inner, limit)
+
+	var open, peak atomic.Int32
+	release := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := open.Add(1)
+		defer open.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		<-release
+	})}
+	go func() { _ = server.Serve(listener) }()
+	defer func() { _ = server.Close() }()
+
+	waitsBefore := metrics.ConnLimitWaits.Value()
+
+	// Each client uses its own connection, so at most limit are served at once
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	var wg sync.WaitGroup
+	failures := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get("http://" + inner.Addr().String())
+			if err != nil {
+				failures <- err
+				return
+			}
+			_ = resp.Body.Close()
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for open.Load() < limit && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := open.Load(); got != limit {
+		t.Errorf("expected %d connections served while saturated, got %d", limit, got)
+	}
+
+	close(release)
+	wg.Wait()
+	close(failures)
+	for err := range failures {
+		t.Errorf("request failed: %v", err)
+	}
+	if got := peak.Load(); got > limit {
+		t.Errorf("expected at most %d connections at once, saw %d", limit, got)
+	}
+	if metrics.ConnLimitWaits.Value() == waitsBefore {
+		t.Error("expected waits for a free slot to be counted")
+	}
+}
+
+func TestLimitListenerClose(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	listener := LimitListener(inner, 1)
+
+	// Hold the only slot, then check that Close unblocks a waiting Accept
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	held, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer func() { _ = held.Close() }()
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		accepted <- err
+	}()
+	_ = listener.Close()
+	select {
+	case err := <-accepted:
+		if err == nil {
+			t.Error("expected Accept to fail after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept stayed blocked after Close")
+	}
+}
+
+func TestLimitListenerDisabled(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer func() { _ = inner.Close() }()
+
+	if LimitListener(inner, 0) != inner {
+		t.Error("expected a limit of 0 to return the listener unchanged")
+	}
+}
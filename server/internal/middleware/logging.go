@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+)
+
+// SampledLogger returns a request logger that writes 1 in rate successful
+// requests. Responses with status 400 or above, panics and every request under
+// /v1/auth/ are always logged, so sampling never hides errors or logins. A rate
+// of 1 or less logs every request, exactly like chi's Logger.
+func SampledLogger(rate int) func(http.Handler) http.Handler {
+	if rate <= 1 {
+		return chimw.Logger
+	}
+	return sampledLogger(rate, &chimw.DefaultLogFormatter{
+		Logger:  log.New(os.Stdout, "", log.LstdFlags),
+		NoColor: runtime.GOOS == "windows",
+	})
+}
+
+func sampledLogger(rate int, formatter chimw.LogFormatter) func(http.Handler) http.Handler {
+	return chimw.RequestLogger(&sampledLogFormatter{next: formatter, rate: uint64(rate)})
+}
+
+type sampledLogFormatter struct {
+	next chimw.LogFormatter
+	rate uint64
+	seen atomic.Uint64 // successful requests so far, for picking the sample
+}
+
+func (f *sampledLogFormatter) NewLogEntry(r *http.Request) chimw.LogEntry {
+	return &sampledLogEntry{
+		LogEntry:  f.next.NewLogEntry(r),
+		formatter: f,
+		always:    strings.HasPrefix(r.URL.Path, "/v1/auth/"),
+	}
+}
+
+type sampledLogEntry struct {
+	chimw.LogEntry
+	formatter *sampledLogFormatter
+	always    bool
+}
+
+func (e *sampledLogEntry) Write(status, bytes int, header http.Header, elapsed time.Duration, extra interface{}) {
+	if e.always || status >= 400 || e.formatter.seen.Add(1)%e.formatter.rate == 1 {
+		e.LogEntry.Write(status, bytes, header, elapsed, extra)
+	}
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+)
+
+func TestSampledLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := sampledLogger(10, &chimw.DefaultLogFormatter{Logger: log.New(&buf, "", 0), NoColor: true})
+	handler := logger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	serve := func(method, target string) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, target, nil))
+	}
+
+	for i := 0; i < 100; i++ {
+		serve("GET", "/ok")
+	}
+	for i := 0; i < 5; i++ {
+		serve("GET", "/missing")
+		serve("GET", "/broken")
+		serve("POST", "/v1/auth/verify")
+	}
+
+	count := func(substr string) int { return strings.Count(buf.String(), substr) }
+	if got := count("/ok "); got != 10 {
+		t.Errorf("expected 1 in 10 successful requests logged, got %d of 100", got)
+	}
+	if got := count("/missing "); got != 5 {
+		t.Errorf("expected every 4xx logged, got %d of 5", got)
+	}
+	if got := count("/broken "); got != 5 {
+		t.Errorf("expected every 5xx logged, got %d of 5", got)
+	}
+	if got := count("/v1/auth/verify "); got != 5 {
+		t.Errorf("expected every auth request logged, got %d of 5", got)
+	}
+}
+
+func TestSampledLoggerDisabled(t *testing.T) {
+	// A rate of 1 is chi's Logger itself, so the log format is unchanged
+	handler := SampledLogger(1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+}
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
+)
+
+// countingReader counts bytes read from the wrapped body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// BodySizeMetrics records request and response body sizes
+func BodySizeMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		ww := chimw.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		responseBytes := int64(ww.BytesWritten())
+		metrics.RequestBodyBytes.Add(body.n)
+		metrics.ResponseBodyBytes.Add(responseBytes)
+		metrics.RequestBodySizes.Add(metrics.SizeBucket(body.n), 1)
+		metrics.ResponseBodySizes.Add(metrics.SizeBucket(responseBytes), 1)
+	})
+}
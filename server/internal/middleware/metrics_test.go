@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shalteor/cryptd-poc/server/internal/metrics"
+)
+
+func TestBodySizeMetrics(t *testing.T) {
+	handler := BodySizeMetrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		_, _ = w.Write([]byte("response"))
+	}))
+
+	requestBefore := metrics.RequestBodyBytes.Value()
+	responseBefore := metrics.ResponseBodyBytes.Value()
+
+	req := httptest.NewRequest("PUT", "/test", strings.NewReader("0123456789"))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := metrics.RequestBodyBytes.Value() - requestBefore; got != 10 {
+		t.Errorf("expected 10 request bytes, got %d", got)
+	}
+	if got := metrics.ResponseBodyBytes.Value() - responseBefore; got != int64(len("response")) {
+		t.Errorf("expected %d response bytes, got %d", len("response"), got)
+	}
+}
@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+)
+
+// ProblemContentType is the media type of RFC 9457 problem documents
+const ProblemContentType = "application/problem+json"
+
+// ProblemTypeBase prefixes an error code to form a problem document's type.
+// Errors without a code get "about:blank", whose title is the status text.
+const ProblemTypeBase = "urn:cryptd:problem:"
+
+// ProblemDetails rewrites error responses as RFC 9457 problem documents, for
+// every request when always is set and otherwise only for requests whose
+// Accept header lists application/problem+json. It converts 4xx and 5xx
+// responses carrying the API's {"error", "code"} JSON or a plain-text
+// http.Error body: the message becomes detail, the code becomes type under
+// ProblemTypeBase and the request ID becomes instance. Other fields of the
+// JSON body are kept as extension members. Successful responses and error
+// bodies of any other type pass through unchanged.
+func ProblemDetails(always bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !always {
+				w.Header().Add("Vary", "Accept")
+				if !acceptsProblemJSON(r) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			pw := &problemResponseWriter{ResponseWriter: w, instance: chimw.GetReqID(r.Context())}
+			defer pw.finish()
+			next.ServeHTTP(pw, r)
+		})
+	}
+}
+
+// acceptsProblemJSON reports whether the request lists application/problem+json
+// with a non-zero q-value
+func acceptsProblemJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(mediaType), ProblemContentType) {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+		return true
+	}
+	return false
+}
+
+// problemResponseWriter holds back error bodies it can convert until the
+// handler is done, and passes everything else straight through
+type problemResponseWriter struct {
+	http.ResponseWriter
+	instance string
+
+	wroteHeader bool
+	status      int
+	convert     bool
+	buf         bytes.Buffer
+}
+
+func (p *problemResponseWriter) WriteHeader(status int) {
+	if p.wroteHeader {
+		return
+	}
+	p.wroteHeader = true
+	p.status = status
+
+	contentType, _, _ := mime.ParseMediaType(p.Header().Get("Content-Type"))
+	p.convert = status >= 400 && (contentType == "application/json" || contentType == "text/plain")
+	if !p.convert {
+		p.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (p *problemResponseWriter) Write(b []byte) (int, error) {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+	if p.convert {
+		return p.buf.Write(b)
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been written so far, except an error body held back
+// for conversion, so streamed responses keep streaming
+func (p *problemResponseWriter) Flush() {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+	if p.convert {
+		return
+	}
+	_ = http.NewResponseController(p.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (p *problemResponseWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+// finish writes the problem document for a held-back error body
+func (p *problemResponseWriter) finish() {
+	if !p.convert {
+		return
+	}
+
+	doc := map[string]interface{}{}
+	var body map[string]interface{}
+	if err := json.Unmarshal(p.buf.Bytes(), &body); err == nil {
+		for name, value := range body {
+			doc[name] = value
+		}
+	} else {
+		body = map[string]interface{}{"error": strings.TrimSpace(p.buf.String())}
+	}
+
+	// "detail" in a 500 body is the debug error, which the message displaces
+	if debug, ok := body["detail"]; ok {
+		doc["debug"] = debug
+	}
+	delete(doc, "error")
+	delete(doc, "requestId")
+
+	doc["type"] = "about:blank"
+	if code, ok := body["code"].(string); ok && code != "" {
+		doc["type"] = ProblemTypeBase + code
+	}
+	doc["title"] = http.StatusText(p.status)
+	doc["status"] = p.status
+	if message, ok := body["error"].(string); ok && message != "" {
+		doc["detail"] = message
+	} else {
+		delete(doc, "detail")
+	}
+	if p.instance != "" {
+		doc["instance"] = p.instance
+	}
+
+	h := p.Header()
+	h.Set("Content-Type", ProblemContentType)
+	h.Del("Content-Length")
+	p.ResponseWriter.WriteHeader(p.status)
+	_ = json.NewEncoder(p.ResponseWriter).Encode(doc)
+}
@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	chimw "github.com/go-chi/chi/v5/middleware"
+)
+
+func TestProblemDetails(t *testing.T) {
+	respond := func(status int, contentType, body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+		})
+	}
+
+	tests := []struct {
+		name       string
+		always     bool
+		accept     string
+		handler    http.Handler
+		expectType string
+		expectDoc  map[string]interface{}
+		expectBody string
+		expectVary bool
+	}{
+		{
+			name:       "coded error negotiated",
+			accept:     "application/json, application/problem+json",
+			handler:    respond(http.StatusBadRequest, "application/json", `{"error":"KDF type scrypt is not allowed","code":"kdf_type_not_allowed"}`),
+			expectType: ProblemContentType,
+			expectVary: true,
+			expectDoc: map[string]interface{}{
+				"type":     ProblemTypeBase + "kdf_type_not_allowed",
+				"title":    "Bad Request",
+				"status":   float64(400),
+				"detail":   "KDF type scrypt is not allowed",
+				"instance": "req-1",
+				"code":     "kdf_type_not_allowed",
+			},
+		},
+		{
+			name:       "internal error always",
+			always:     true,
+			handler:    respond(http.StatusInternalServerError, "application/json", `{"error":"failed to list blobs","requestId":"req-1","detail":"sql: database is closed"}`),
+			expectType: ProblemContentType,
+			expectDoc: map[string]interface{}{
+				"type":     "about:blank",
+				"title":    "Internal Server Error",
+				"status":   float64(500),
+				"detail":   "failed to list blobs",
+				"instance": "req-1",
+				"debug":    "sql: database is closed",
+			},
+		},
+		{
+			name:   "plain-text middleware error",
+			always: true,
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			}),
+			expectType: ProblemContentType,
+			expectDoc: map[string]interface{}{
+				"type":     "about:blank",
+				"title":    "Too Many Requests",
+				"status":   float64(429),
+				"detail":   "rate limit exceeded",
+				"instance": "req-1",
+			},
+		},
+		{
+			name:       "not negotiated",
+			accept:     "application/json",
+			handler:    respond(http.StatusNotFound, "application/json", `{"error":"blob not found"}`),
+			expectType: "application/json",
+			expectBody: `{"error":"blob not found"}`,
+			expectVary: true,
+		},
+		{
+			name:       "refused with q=0",
+			accept:     "application/problem+json;q=0",
+			handler:    respond(http.StatusNotFound, "application/json", `{"error":"blob not found"}`),
+			expectType: "application/json",
+			expectBody: `{"error":"blob not found"}`,
+			expectVary: true,
+		},
+		{
+			name:       "success passes through",
+			always:     true,
+			handler:    respond(http.StatusOK, "application/json", `{"ok":true}`),
+			expectType: "application/json",
+			expectBody: `{"ok":true}`,
+		},
+		{
+			name:       "ciphertext error body passes through",
+			always:     true,
+			handler:    respond(http.StatusRequestedRangeNotSatisfiable, "application/octet-stream", "raw"),
+			expectType: "application/octet-stream",
+			expectBody: "raw",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			req = req.WithContext(context.WithValue(req.Context(), chimw.RequestIDKey, "req-1"))
+			ProblemDetails(tt.always)(tt.handler).ServeHTTP(w, req)
+
+			if got := w.Header().Get("Content-Type"); got != tt.expectType {
+				t.Errorf("expected Content-Type %q, got %q", tt.expectType, got)
+			}
+			if got := w.Header().Get("Vary") == "Accept"; got != tt.expectVary {
+				t.Errorf("expected Vary: Accept %v, got %q", tt.expectVary, w.Header().Get("Vary"))
+			}
+			if tt.expectDoc == nil {
+				if w.Body.String() != tt.expectBody {
+					t.Errorf("expected body %q, got %q", tt.expectBody, w.Body.String())
+				}
+				return
+			}
+
+			var doc map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+				t.Fatalf("failed to decode problem document %q: %v", w.Body.String(), err)
+			}
+			if len(doc) != len(tt.expectDoc) {
+				t.Errorf("expected %d members, got %v", len(tt.expectDoc), doc)
+			}
+			for name, want := range tt.expectDoc {
+				if doc[name] != want {
+					t.Errorf("expected %s %v, got %v", name, want, doc[name])
+				}
+			}
+		})
+	}
+}
+
+func TestProblemDetailsFlush(t *testing.T) {
+	w := httptest.NewRecorder()
+	handler := ProblemDetails(true)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/zip")
+		_, _ = rw.Write([]byte("PK"))
+		if err := http.NewResponseController(rw).Flush(); err != nil {
+			t.Fatalf("expected the writer to support flushing, got %v", err)
+		}
+		if !w.Flushed || w.Body.String() != "PK" {
+			t.Errorf("expected a streamed body to be flushed, got flushed=%v, body %q", w.Flushed, w.Body.String())
+		}
+	}))
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	// An error body being converted is not sent early
+	w = httptest.NewRecorder()
+	handler = ProblemDetails(true)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusBadRequest)
+		_, _ = rw.Write([]byte(`{"error":"bad"}`))
+		_ = http.NewResponseController(rw).Flush()
+		if w.Flushed || w.Body.Len() != 0 {
+			t.Errorf("expected the error body to be held back, got flushed=%v, body %q", w.Flushed, w.Body.String())
+		}
+	}))
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("Content-Type") != ProblemContentType {
+		t.Errorf("expected a problem document, got %q", w.Header().Get("Content-Type"))
+	}
+}
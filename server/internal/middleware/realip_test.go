@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatalf("failed to parse trusted proxies: %v", err)
+	}
+
+	var seen string
+	handler := RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.RemoteAddr
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		expected   string
+	}{
+		{"untrusted peer keeps its address", "203.0.113.9:4000", []string{"198.51.100.1"}, "", "203.0.113.9:4000"},
+		{"untrusted peer cannot use X-Real-IP", "203.0.113.9:4000", nil, "198.51.100.1", "203.0.113.9:4000"},
+		{"trusted peer", "10.1.2.3:4000", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"trusted bare ip", "192.168.1.1:4000", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"spoofed prefix is ignored", "10.1.2.3:4000", []string{"1.2.3.4, 198.51.100.1"}, "", "198.51.100.1"},
+		{"trusted hops are skipped", "10.1.2.3:4000", []string{"198.51.100.1", "10.9.9.9"}, "", "198.51.100.1"},
+		{"x-real-ip from trusted peer", "10.1.2.3:4000", nil, "198.51.100.1", "198.51.100.1"},
+		{"malformed hop", "10.1.2.3:4000", []string{"garbage"}, "", "10.1.2.3:4000"},
+		{"no headers", "10.1.2.3:4000", nil, "", "10.1.2.3:4000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if seen != tt.expected {
+				t.Errorf("expected RemoteAddr %q, got %q", tt.expected, seen)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	for _, list := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.0/8,bogus"} {
+		if _, err := ParseTrustedProxies(list); err == nil {
+			t.Errorf("expected %q to be rejected", list)
+		}
+	}
+	if prefixes, err := ParseTrustedProxies(""); err != nil || len(prefixes) != 0 {
+		t.Errorf("expected an empty list, got %v, %v", prefixes, err)
+	}
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareToken(t *testing.T) {
+	config := NewJWTConfig("test-secret")
+	now := time.Now()
+
+	token, err := config.SignShareToken(7, 3, 2, "vault", now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to sign share token: %v", err)
+	}
+
+	claims, err := config.ParseShareToken(token, now)
+	if err != nil {
+		t.Fatalf("failed to parse share token: %v", err)
+	}
+	if claims.UserID != 7 || claims.BlobID != 3 || claims.Version != 2 || claims.BlobName != "vault" {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+
+	if _, err := config.ParseShareToken(token, now.Add(time.Hour)); err != ErrShareTokenExpired {
+		t.Errorf("expected ErrShareTokenExpired, got %v", err)
+	}
+
+	// Swap in a payload for another blob, keeping the original signature
+	forged, _ := config.SignShareToken(7, 4, 1, "other", now.Add(time.Hour))
+	payload, _, _ := strings.Cut(forged, ".")
+	_, signature, _ := strings.Cut(token, ".")
+	for name, tampered := range map[string]string{
+		"swapped payload": payload + "." + signature,
+		"no separator":    strings.ReplaceAll(token, ".", ""),
+		"bad encoding":    token + "!",
+	} {
+		if _, err := config.ParseShareToken(tampered, now); err != ErrShareTokenInvalid {
+			t.Errorf("%s: expected ErrShareTokenInvalid, got %v", name, err)
+		}
+	}
+
+	if _, err := NewJWTConfig("other-secret").ParseShareToken(token, now); err != ErrShareTokenInvalid {
+		t.Errorf("expected ErrShareTokenInvalid under another secret, got %v", err)
+	}
+
+	// A share token is not a bearer token
+	if _, err := config.ValidateToken(token); err == nil {
+		t.Error("expected share token to be rejected as a JWT")
+	}
+}
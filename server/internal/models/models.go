@@ -1,12 +1,102 @@
 package models
 
-import "time"
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimestampLayout is the wire format for all timestamps: RFC3339 with millisecond precision
+const TimestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Timestamp is a time.Time that always serializes as UTC in TimestampLayout
+type Timestamp struct {
+	time.Time
+}
+
+// NewTimestamp wraps t as a UTC Timestamp
+func NewTimestamp(t time.Time) Timestamp {
+	return Timestamp{Time: t.UTC()}
+}
+
+// String formats the timestamp in TimestampLayout
+func (t Timestamp) String() string {
+	return t.UTC().Format(TimestampLayout)
+}
+
+// MarshalJSON implements json.Marshaler
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + t.String() + `"`), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, accepting any RFC3339 timestamp
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		t.Time = time.Time{}
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q: %w", s, err)
+	}
+	t.Time = parsed.UTC()
+	return nil
+}
+
+// Value implements driver.Valuer so timestamps are always stored as UTC
+func (t Timestamp) Value() (driver.Value, error) {
+	return t.UTC(), nil
+}
+
+// Scan implements sql.Scanner, normalizing stored values to UTC
+func (t *Timestamp) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case time.Time:
+		t.Time = v.UTC()
+		return nil
+	case string:
+		return t.parseStored(v)
+	case []byte:
+		return t.parseStored(string(v))
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Timestamp", src)
+	}
+}
+
+// storedLayouts are the text formats SQLite may hand back for DATETIME columns.
+// The first is how the driver writes time.Time values; it is seen as is where
+// an expression such as MAX() hides the column type from the driver.
+var storedLayouts = []string{
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	time.RFC3339Nano,
+}
+
+func (t *Timestamp) parseStored(s string) error {
+	for _, layout := range storedLayouts {
+		if parsed, err := time.Parse(layout, s); err == nil {
+			t.Time = parsed.UTC()
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse stored timestamp %q", s)
+}
 
 // Container represents an AEAD encrypted container (AES-256-GCM)
 type Container struct {
-	Nonce      string `json:"nonce"`      // base64(12 bytes)
-	Ciphertext string `json:"ciphertext"` // base64(bytes)
-	Tag        string `json:"tag"`        // base64(16 bytes)
+	Nonce      string `json:"nonce"`         // base64(12 bytes for A256GCM)
+	Ciphertext string `json:"ciphertext"`    // base64(bytes)
+	Tag        string `json:"tag"`           // base64(16 bytes)
+	Alg        string `json:"alg,omitempty"` // AEAD algorithm, e.g. A256GCM; empty for legacy containers
 }
 
 // KDFType represents the supported KDF algorithms
@@ -17,6 +107,14 @@ const (
 	KDFTypeArgon2id     KDFType = "argon2id"
 )
 
+// VerifierHashAlg identifies the server-side hash applied to login verifiers
+type VerifierHashAlg string
+
+const (
+	VerifierHashPBKDF2SHA256 VerifierHashAlg = "pbkdf2_sha256"
+	VerifierHashPBKDF2SHA512 VerifierHashAlg = "pbkdf2_sha512"
+)
+
 // KDFParams represents KDF configuration parameters
 type KDFParams struct {
 	Type        KDFType `json:"kdfType"`
@@ -27,31 +125,125 @@ type KDFParams struct {
 
 // User represents a user in the database
 type User struct {
-	ID                int64     `json:"id"`
-	Username          string    `json:"username"`
-	KDFType           KDFType   `json:"-"`
-	KDFIterations     int       `json:"-"`
-	KDFMemoryKiB      *int      `json:"-"`
-	KDFParallelism    *int      `json:"-"`
-	LoginVerifierHash []byte    `json:"-"`
-	WrappedAccountKey Container `json:"-"`
-	CreatedAt         time.Time `json:"createdAt"`
-	UpdatedAt         time.Time `json:"updatedAt"`
+	ID                int64           `json:"id"`
+	Username          string          `json:"username"`
+	KDFType           KDFType         `json:"-"`
+	KDFIterations     int             `json:"-"`
+	KDFMemoryKiB      *int            `json:"-"`
+	KDFParallelism    *int            `json:"-"`
+	LoginVerifierHash []byte          `json:"-"`
+	VerifierHashAlg   VerifierHashAlg `json:"-"` // algorithm LoginVerifierHash was computed with
+	WrappedAccountKey Container       `json:"-"`
+	UsernameChangedAt *Timestamp      `json:"-"`   // nil until the first rename
+	Rev               int64           `json:"rev"` // starts at 1, incremented on every credential change
+	SessionEpoch      int64           `json:"-"`   // tokens carrying another epoch are revoked
+	CreatedAt         Timestamp       `json:"createdAt"`
+	UpdatedAt         Timestamp       `json:"updatedAt"`
 }
 
 // Blob represents an encrypted blob in the database
 type Blob struct {
-	ID            int64     `json:"id"`
-	UserID        int64     `json:"-"`
-	BlobName      string    `json:"blobName"`
-	EncryptedBlob Container `json:"encryptedBlob"`
-	CreatedAt     time.Time `json:"createdAt"`
-	UpdatedAt     time.Time `json:"updatedAt"`
+	ID            int64      `json:"id"`
+	UserID        int64      `json:"-"`
+	BlobName      string     `json:"blobName"`
+	EncryptedBlob Container  `json:"encryptedBlob"`
+	EncryptedName *Container `json:"encryptedName,omitempty"` // set when BlobName is a name token
+	Collection    string     `json:"collection,omitempty"`    // opaque, exact-match only; "" is the default
+	Checksum      string     `json:"-"`                       // hex SHA-256 of EncryptedBlob, empty for legacy rows
+	Version       int64      `json:"version"`                 // starts at 1, incremented on every write
+	ExpiresAt     *Timestamp `json:"expiresAt,omitempty"`
+	Pinned        bool       `json:"pinned,omitempty"` // never expires or gets swept while set
+	CreatedAt     Timestamp  `json:"createdAt"`
+	UpdatedAt     Timestamp  `json:"updatedAt"`
 }
 
 // BlobListItem represents a blob item in list responses
 type BlobListItem struct {
-	BlobName      string    `json:"blobName"`
-	UpdatedAt     time.Time `json:"updatedAt"`
-	EncryptedSize int       `json:"encryptedSize"` // size of ciphertext in bytes
+	BlobName      string     `json:"blobName"`
+	EncryptedName *Container `json:"encryptedName,omitempty"`
+	Collection    string     `json:"collection,omitempty"`
+	UpdatedAt     Timestamp  `json:"updatedAt"`
+	EncryptedSize int        `json:"encryptedSize"` // size of ciphertext in bytes
+	Version       int64      `json:"version"`
+	Seq           int64      `json:"seq"` // server-wide change sequence of the last write
+	ExpiresAt     *Timestamp `json:"expiresAt,omitempty"`
+	Pinned        bool       `json:"pinned,omitempty"`
+}
+
+// Ops of a BlobChange
+const (
+	BlobChangeUpsert = "upsert"
+	BlobChangeDelete = "delete"
+)
+
+// BlobChange is one entry of a change-sequence delta: a blob written, or a
+// name that went away through a delete, rename, transfer or expiry sweep
+type BlobChange struct {
+	BlobName string `json:"blobName"`
+	Seq      int64  `json:"seq"`
+	Op       string `json:"op"`                // BlobChangeUpsert or BlobChangeDelete
+	Version  int64  `json:"version,omitempty"` // the written version; omitted for deletes
+}
+
+// Session is an issued token, identified by the token's jti
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int64     `json:"-"`
+	Label      string    `json:"label"`
+	Scope      string    `json:"scope"`
+	CreatedAt  Timestamp `json:"createdAt"`
+	LastUsedAt Timestamp `json:"lastUsedAt"` // to within a minute or so; see db.RecordSessionUse
+	ExpiresAt  Timestamp `json:"expiresAt"`
+}
+
+// SessionSummary counts a user's unexpired sessions
+type SessionSummary struct {
+	Active       int        `json:"active"`
+	LastActiveAt *Timestamp `json:"lastActiveAt"` // latest LastUsedAt; nil without sessions
+}
+
+// BlobLock is an advisory single-writer lock on a blob, held by a session
+type BlobLock struct {
+	BlobName  string    `json:"blobName"`
+	Holder    string    `json:"holder"` // session ID of the token that acquired it
+	ExpiresAt Timestamp `json:"expiresAt"`
+}
+
+// KeyEscrow is a user's account key wrapped to an organization recovery key,
+// kept apart from the password-wrapped account key
+type KeyEscrow struct {
+	UserID             int64     `json:"userId"`
+	EscrowedAccountKey Container `json:"escrowedAccountKey"`
+	UpdatedAt          Timestamp `json:"updatedAt"`
+}
+
+// Invite is a single-use registration code
+type Invite struct {
+	Code      string     `json:"code"`
+	CreatedAt Timestamp  `json:"createdAt"`
+	UsedAt    *Timestamp `json:"usedAt,omitempty"`
+}
+
+// AuditEvent is one recorded auth or blob action. Its JSON form is the stable
+// export schema; add fields rather than renaming them.
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	UserID    *int64    `json:"userId"` // nil when no account was identified, e.g. unknown username
+	IP        string    `json:"ip"`
+	Detail    string    `json:"detail"` // blob name, scope or similar; never secrets
+	CreatedAt Timestamp `json:"createdAt"`
+}
+
+// BlobRef identifies a blob across users
+type BlobRef struct {
+	UserID   int64  `json:"userId"`
+	BlobName string `json:"blobName"`
+}
+
+// ScrubReport summarizes an integrity check over all stored blobs
+type ScrubReport struct {
+	Scanned       int       `json:"scanned"`
+	Unchecksummed int       `json:"unchecksummed"` // legacy rows stored before checksums existed
+	Corrupted     []BlobRef `json:"corrupted"`
 }
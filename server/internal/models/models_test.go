@@ -0,0 +1,78 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTimestampMarshalJSON(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	ts := NewTimestamp(time.Date(2024, 3, 5, 14, 7, 9, 123456789, loc))
+
+	data, err := json.Marshal(ts)
+	if err != nil {
+		t.Fatalf("failed to marshal timestamp: %v", err)
+	}
+
+	expected := `"2024-03-05T12:07:09.123Z"`
+	if string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+}
+
+func TestTimestampMarshalJSONWholeSecond(t *testing.T) {
+	ts := NewTimestamp(time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC))
+
+	data, err := json.Marshal(ts)
+	if err != nil {
+		t.Fatalf("failed to marshal timestamp: %v", err)
+	}
+
+	// Milliseconds are always present, even when zero
+	expected := `"2024-03-05T12:00:00.000Z"`
+	if string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+}
+
+func TestTimestampUnmarshalJSON(t *testing.T) {
+	var ts Timestamp
+	if err := json.Unmarshal([]byte(`"2024-03-05T14:07:09.123+02:00"`), &ts); err != nil {
+		t.Fatalf("failed to unmarshal timestamp: %v", err)
+	}
+
+	expected := time.Date(2024, 3, 5, 12, 7, 9, 123000000, time.UTC)
+	if !ts.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, ts.Time)
+	}
+
+	if ts.Location() != time.UTC {
+		t.Errorf("expected UTC location, got %v", ts.Location())
+	}
+}
+
+func TestTimestampScan(t *testing.T) {
+	tests := []struct {
+		name string
+		src  interface{}
+	}{
+		{"time", time.Date(2024, 3, 5, 14, 7, 9, 0, time.FixedZone("UTC+2", 2*60*60))},
+		{"sqlite text", "2024-03-05 12:07:09"},
+		{"sqlite text with offset", "2024-03-05 12:07:09+00:00"},
+		{"bytes", []byte("2024-03-05T12:07:09Z")},
+	}
+
+	expected := time.Date(2024, 3, 5, 12, 7, 9, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ts Timestamp
+			if err := ts.Scan(tt.src); err != nil {
+				t.Fatalf("failed to scan: %v", err)
+			}
+			if !ts.Equal(expected) || ts.Location() != time.UTC {
+				t.Errorf("expected %v, got %v", expected, ts.Time)
+			}
+		})
+	}
+}